@@ -108,7 +108,7 @@ func Test_login(t *testing.T) {
 			return r
 		},
 		wantResponse: Response{
-			Status:              Success,
+			Status:              LoginSuccess,
 			Username:            "jude",
 			AuthenticationToken: "<expected>",
 		},
@@ -121,7 +121,7 @@ func Test_login(t *testing.T) {
 			return r
 		},
 		wantResponse: Response{
-			Status:              Success,
+			Status:              LoginSuccess,
 			Username:            "callum",
 			AuthenticationToken: "<expected>",
 		},
@@ -149,7 +149,7 @@ func Test_login(t *testing.T) {
 			return r
 		},
 		wantResponse: Response{
-			Status:              Success,
+			Status:              LoginSuccess,
 			Username:            "christopher@email.com",
 			AuthenticationToken: "<expected>",
 			Redirect:            "/admin/createcategory/?type=posts",
@@ -163,7 +163,7 @@ func Test_login(t *testing.T) {
 			return r
 		},
 		wantResponse: Response{
-			Status:              Success,
+			Status:              LoginSuccess,
 			Username:            "jacob",
 			AuthenticationToken: "<expected>",
 			Redirect:            "/admin/notes/foo.md",
@@ -175,18 +175,18 @@ func Test_login(t *testing.T) {
 		t.Run(tt.description, func(t *testing.T) {
 			t.Parallel()
 			g, ctx := errgroup.WithContext(context.Background())
-			for dialect, db := range databases {
+			for _, testDB := range testDatabases {
 				nbrew := &Notebrew{
-					Dialect:   dialect,
-					DB:        db,
+					Dialect:   testDB.Dialect,
+					DB:        testDB.DB,
 					FS:        testutil.NewFS(nil),
-					ErrorCode: errorCodeFuncs[dialect],
+					ErrorCode: testDB.ErrorCode,
 				}
 				g.Go(func() error {
 					w := httptest.NewRecorder()
 					r := tt.request(t, nbrew)
 					r.Header.Set("Accept", "application/json")
-					nbrew.login(w, r.WithContext(ctx), getIP(r))
+					nbrew.login(w, r.WithContext(ctx), nbrew.getIP(r))
 					if ctx.Err() != nil {
 						return nil
 					}
@@ -246,12 +246,12 @@ func Test_login(t *testing.T) {
 
 func Test_logout(t *testing.T) {
 	g, ctx := errgroup.WithContext(context.Background())
-	for dialect, db := range databases {
+	for _, testDB := range testDatabases {
 		nbrew := &Notebrew{
-			Dialect:   dialect,
-			DB:        db,
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
 			FS:        testutil.NewFS(nil),
-			ErrorCode: errorCodeFuncs[dialect],
+			ErrorCode: testDB.ErrorCode,
 		}
 		g.Go(func() error {
 			createUser(t, nbrew, "kate", "kate@email.com", "password123")
@@ -260,7 +260,7 @@ func Test_logout(t *testing.T) {
 			r, _ := http.NewRequest("POST", "/admin/login/", strings.NewReader(`{"username":"kate","password":"password123"}`))
 			r.Header.Set("Content-Type", "application/json")
 			r.Header.Set("Accept", "application/json")
-			nbrew.login(w, r.WithContext(ctx), getIP(r))
+			nbrew.login(w, r.WithContext(ctx), nbrew.getIP(r))
 			if ctx.Err() != nil {
 				return nil
 			}
@@ -300,19 +300,270 @@ func Test_logout(t *testing.T) {
 	}
 }
 
-func Test_resetpassword_invalidTokenBadRequest(t *testing.T) {
+func Test_admin_sessionExpiry(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:            testDB.Dialect,
+			DB:                 testDB.DB,
+			FS:                 testutil.NewFS(nil),
+			ErrorCode:          testDB.ErrorCode,
+			SessionIdleTimeout: time.Hour,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "ada", "ada@email.com", "password123")
+			authenticationToken := generateAuthenticationToken(t, nbrew, "ada")
+			_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "UPDATE authentication SET last_seen_at = {lastSeenAt} WHERE user_id = (SELECT user_id FROM users WHERE username = 'ada')",
+				Values: []any{
+					sq.Int64Param("lastSeenAt", time.Now().Add(-2*time.Hour).Unix()),
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/admin/@ada/notes/", nil)
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			if w.Code != http.StatusUnauthorized {
+				return fmt.Errorf("[%s] %s got status %d, want %d", nbrew.Dialect, testutil.Callers(), w.Code, http.StatusUnauthorized)
+			}
+			exists, err := sq.FetchExistsContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "SELECT 1" +
+					" FROM users" +
+					" JOIN authentication ON authentication.user_id = users.user_id" +
+					" WHERE users.username = 'ada'",
+			})
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if exists {
+				return fmt.Errorf("[%s] %s expired session was not deleted", nbrew.Dialect, testutil.Callers())
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_login_twoFactor(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "grace", "grace@email.com", "password123")
+			secret, err := newTOTPSecret()
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "UPDATE users SET totp_secret = {secret} WHERE username = 'grace'",
+				Values: []any{
+					sq.StringParam("secret", secret),
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			type Response struct {
+				Status              Error  `json:"status"`
+				AuthenticationToken string `json:"authenticationToken"`
+				TwoFactorToken      string `json:"twoFactorToken"`
+			}
+			login := func(body string) (response Response, err error) {
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("POST", "/admin/login/", strings.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Accept", "application/json")
+				nbrew.login(w, r.WithContext(ctx), "127.0.0.1")
+				err = json.Unmarshal(w.Body.Bytes(), &response)
+				return response, err
+			}
+			response, err := login(`{"username":"grace","password":"password123"}`)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Status != ErrTwoFactorRequired || response.TwoFactorToken == "" || response.AuthenticationToken != "" {
+				return fmt.Errorf("[%s] %s unexpected response %#v", nbrew.Dialect, testutil.Callers(), response)
+			}
+			twoFactorToken := response.TwoFactorToken
+			response, err = login(`{"twoFactorToken":"` + twoFactorToken + `","twoFactorCode":"000000x"}`)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Status != ErrIncorrectTwoFactorCode {
+				return fmt.Errorf("[%s] %s got status %q, want %q", nbrew.Dialect, testutil.Callers(), response.Status, ErrIncorrectTwoFactorCode)
+			}
+			key, _ := totpEncoding.DecodeString(secret)
+			code := totpCode(key, uint64(time.Now().Unix())/totpPeriod)
+			response, err = login(`{"twoFactorToken":"` + twoFactorToken + `","twoFactorCode":"` + code + `"}`)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Status != LoginSuccess || response.AuthenticationToken == "" {
+				return fmt.Errorf("[%s] %s unexpected response %#v", nbrew.Dialect, testutil.Callers(), response)
+			}
+			// A two-factor token can only be used once.
+			response, err = login(`{"twoFactorToken":"` + twoFactorToken + `","twoFactorCode":"` + code + `"}`)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Status != ErrTokenExpired {
+				return fmt.Errorf("[%s] %s got status %q, want %q", nbrew.Dialect, testutil.Callers(), response.Status, ErrTokenExpired)
+			}
+			// Neither can a TOTP code, even with a new two-factor token.
+			response, err = login(`{"username":"grace","password":"password123"}`)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			twoFactorToken = response.TwoFactorToken
+			response, err = login(`{"twoFactorToken":"` + twoFactorToken + `","twoFactorCode":"` + code + `"}`)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Status != ErrIncorrectTwoFactorCode {
+				return fmt.Errorf("[%s] %s got status %q, want %q", nbrew.Dialect, testutil.Callers(), response.Status, ErrIncorrectTwoFactorCode)
+			}
+			// Concurrent attempts can't make more than maxTwoFactorAttempts
+			// between them (one has been made already).
+			statuses := make([]Error, 2*maxTwoFactorAttempts)
+			var attempts errgroup.Group
+			for i := range statuses {
+				i := i
+				attempts.Go(func() error {
+					response, err := login(`{"twoFactorToken":"` + twoFactorToken + `","twoFactorCode":"000000"}`)
+					statuses[i] = response.Status
+					return err
+				})
+			}
+			err = attempts.Wait()
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			incorrect := 0
+			for _, status := range statuses {
+				switch status {
+				case ErrIncorrectTwoFactorCode:
+					incorrect++
+				case ErrTokenExpired:
+				default:
+					return fmt.Errorf("[%s] %s unexpected status %q", nbrew.Dialect, testutil.Callers(), status)
+				}
+			}
+			if incorrect != maxTwoFactorAttempts-1 {
+				return fmt.Errorf("[%s] %s got %d incorrect attempts, want %d", nbrew.Dialect, testutil.Callers(), incorrect, maxTwoFactorAttempts-1)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_twofactor_enable(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "backus", "backus@email.com", "password123")
+			type Response struct {
+				Status  Error  `json:"status"`
+				Enabled bool   `json:"enabled"`
+				Secret  string `json:"secret"`
+			}
+			enable := func(secret string, cookies []*http.Cookie) (response Response, err error) {
+				key, _ := totpEncoding.DecodeString(secret)
+				code := totpCode(key, uint64(time.Now().Unix())/totpPeriod)
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("POST", "/admin/twofactor/", strings.NewReader(`{"action":"enable","secret":"`+secret+`","code":"`+code+`"}`))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Accept", "application/json")
+				for _, cookie := range cookies {
+					r.AddCookie(cookie)
+				}
+				nbrew.twofactor(w, r.WithContext(ctx), "backus")
+				err = json.Unmarshal(w.Body.Bytes(), &response)
+				return response, err
+			}
+			// A secret supplied by the client is ignored.
+			secret, err := newTOTPSecret()
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			response, err := enable(secret, nil)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Status != ErrTokenExpired || response.Enabled {
+				return fmt.Errorf("[%s] %s unexpected response %#v", nbrew.Dialect, testutil.Callers(), response)
+			}
+			// The secret generated by the server is accepted.
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/admin/twofactor/", nil)
+			r.Header.Set("Accept", "application/json")
+			nbrew.twofactor(w, r.WithContext(ctx), "backus")
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Secret == "" {
+				return fmt.Errorf("[%s] %s unexpected response %#v", nbrew.Dialect, testutil.Callers(), response)
+			}
+			response, err = enable(response.Secret, w.Result().Cookies())
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if response.Status != EnableTwoFactorSuccess || !response.Enabled {
+				return fmt.Errorf("[%s] %s unexpected response %#v", nbrew.Dialect, testutil.Callers(), response)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (w deadlineRecorder) SetWriteDeadline(deadline time.Time) error { return nil }
+
+func Test_resetpassword_invalidToken(t *testing.T) {
+	type Response struct {
+		Status Error `json:"status"`
+	}
 	type TestTable struct {
 		description string
 		request     func(t *testing.T, nbrew *Notebrew) *http.Request
 	}
 
 	tests := []TestTable{{
-		description: "GET without token",
-		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
-			r, _ := http.NewRequest("GET", "/admin/resetpassword/", nil)
-			return r
-		},
-	}, {
 		description: "GET with non-hexadecimal token",
 		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
 			r, _ := http.NewRequest("GET", "/admin/resetpassword/?token=abcdefghijklmnop", nil)
@@ -324,24 +575,17 @@ func Test_resetpassword_invalidTokenBadRequest(t *testing.T) {
 			r, _ := http.NewRequest("GET", "/admin/resetpassword/?token=64fd5f583e9ac639a2140905857e3440c2b16c59", nil)
 			return r
 		},
-	}, {
-		description: "POST without token",
-		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
-			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader("password=newpassword&confirmPassword=newpassword"))
-			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			return r
-		},
 	}, {
 		description: "POST with non-hexadecimal token",
 		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
-			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader("password=newpassword&confirmPassword=newpassword&token=abcdefghijklmnop"))
+			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader("password=newpassword&confirmPassword=newpassword&resetToken=abcdefghijklmnop"))
 			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			return r
 		},
 	}, {
 		description: "POST with nonexistent token",
 		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
-			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader("password=newpassword&confirmPassword=newpassword&token=64fd5f583e9ac639a2140905857e3440c2b16c59"))
+			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader("password=newpassword&confirmPassword=newpassword&resetToken=64fd5f583e9ac639a2140905857e3440c2b16c59"))
 			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			return r
 		},
@@ -352,12 +596,12 @@ func Test_resetpassword_invalidTokenBadRequest(t *testing.T) {
 		t.Run(tt.description, func(t *testing.T) {
 			t.Parallel()
 			g, ctx := errgroup.WithContext(context.Background())
-			for dialect, db := range databases {
+			for _, testDB := range testDatabases {
 				nbrew := &Notebrew{
-					Dialect:   dialect,
-					DB:        db,
+					Dialect:   testDB.Dialect,
+					DB:        testDB.DB,
 					FS:        testutil.NewFS(nil),
-					ErrorCode: errorCodeFuncs[dialect],
+					ErrorCode: testDB.ErrorCode,
 				}
 				g.Go(func() error {
 					w := httptest.NewRecorder()
@@ -367,7 +611,15 @@ func Test_resetpassword_invalidTokenBadRequest(t *testing.T) {
 					if ctx.Err() != nil {
 						return nil
 					}
-					if diff := testutil.Diff(w.Code, http.StatusBadRequest); diff != "" {
+					if diff := testutil.Diff(w.Code, http.StatusOK); diff != "" {
+						return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), diff)
+					}
+					var gotResponse Response
+					err := json.Unmarshal(w.Body.Bytes(), &gotResponse)
+					if err != nil {
+						return fmt.Errorf("[%s] %s %v\nResponse Body: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+					}
+					if diff := testutil.Diff(gotResponse.Status, ErrInvalidToken); diff != "" {
 						return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), diff)
 					}
 					return nil
@@ -383,7 +635,7 @@ func Test_resetpassword_invalidTokenBadRequest(t *testing.T) {
 
 func Test_resetpassword(t *testing.T) {
 	type Response struct {
-		Errors url.Values `json:"errors,omitempty"`
+		Errors map[string][]Error `json:"errors,omitempty"`
 	}
 	type TestTable struct {
 		description  string
@@ -392,20 +644,35 @@ func Test_resetpassword(t *testing.T) {
 	}
 
 	tests := []TestTable{{
+		description: "email required",
+		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
+			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader(url.Values{
+				"password":        []string{"newpassword"},
+				"confirmPassword": []string{"newpassword"},
+			}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return r
+		},
+		wantResponse: Response{
+			Errors: map[string][]Error{
+				"email": {ErrRequired},
+			},
+		},
+	}, {
 		description: "password too short",
 		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
 			createUser(t, nbrew, "trevor", "trevor@email.com", "password123")
 			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader(url.Values{
-				"token":           []string{generateResetToken(t, nbrew, "trevor")},
-				"password":        []string{"123456"},
-				"confirmPassword": []string{"123456"},
+				"resetToken":      []string{generateResetToken(t, nbrew, "trevor")},
+				"password":        []string{"Hx7#qP"},
+				"confirmPassword": []string{"Hx7#qP"},
 			}.Encode()))
 			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			return r
 		},
 		wantResponse: Response{
-			Errors: url.Values{
-				"": []string{"Password must be at least 8 characters"},
+			Errors: map[string][]Error{
+				"password": {Error(fmt.Sprintf("%s - minimum 8 characters", ErrTooShort))},
 			},
 		},
 	}, {
@@ -413,7 +680,7 @@ func Test_resetpassword(t *testing.T) {
 		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
 			createUser(t, nbrew, "august", "auguest@email.com", "password123")
 			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader(url.Values{
-				"token":           []string{generateResetToken(t, nbrew, "august")},
+				"resetToken":      []string{generateResetToken(t, nbrew, "august")},
 				"password":        []string{"12345678"},
 				"confirmPassword": []string{"12345678"},
 			}.Encode()))
@@ -421,8 +688,8 @@ func Test_resetpassword(t *testing.T) {
 			return r
 		},
 		wantResponse: Response{
-			Errors: url.Values{
-				"": []string{"Password is too common."},
+			Errors: map[string][]Error{
+				"password": {ErrPasswordTooCommon},
 			},
 		},
 	}, {
@@ -430,7 +697,7 @@ func Test_resetpassword(t *testing.T) {
 		request: func(t *testing.T, nbrew *Notebrew) *http.Request {
 			createUser(t, nbrew, "finn", "finn@email.com", "password123")
 			r, _ := http.NewRequest("POST", "/admin/resetpassword/", strings.NewReader(url.Values{
-				"token":           []string{generateResetToken(t, nbrew, "finn")},
+				"resetToken":      []string{generateResetToken(t, nbrew, "finn")},
 				"password":        []string{"Hunter2!"},
 				"confirmPassword": []string{"Hunter3!"},
 			}.Encode()))
@@ -438,8 +705,8 @@ func Test_resetpassword(t *testing.T) {
 			return r
 		},
 		wantResponse: Response{
-			Errors: url.Values{
-				"": []string{"Passwords do not match"},
+			Errors: map[string][]Error{
+				"confirmPassword": {ErrPasswordNotMatch},
 			},
 		},
 	}}
@@ -449,12 +716,12 @@ func Test_resetpassword(t *testing.T) {
 		t.Run(tt.description, func(t *testing.T) {
 			t.Parallel()
 			g, ctx := errgroup.WithContext(context.Background())
-			for dialect, db := range databases {
+			for _, testDB := range testDatabases {
 				nbrew := &Notebrew{
-					Dialect:   dialect,
-					DB:        db,
+					Dialect:   testDB.Dialect,
+					DB:        testDB.DB,
 					FS:        testutil.NewFS(nil),
-					ErrorCode: errorCodeFuncs[dialect],
+					ErrorCode: testDB.ErrorCode,
 				}
 				g.Go(func() error {
 					w := httptest.NewRecorder()
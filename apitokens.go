@@ -0,0 +1,263 @@
+package nb7
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// APITokenPrefix is prepended to every API token so that it can be told apart
+// from a login session's authentication token.
+const APITokenPrefix = "nbt_"
+
+// API token scopes take one of the following forms:
+//
+//   - "read" grants read-only access to every site the user belongs to.
+//   - "write:<site>" grants read and write access to a site, where <site> is
+//     the site prefix as it appears in the admin URL (e.g. "@alice" or
+//     "example.com") or "/" for the main site.
+//   - "write:<site>/<folder>" grants read access to the site and write access
+//     to a folder inside it only (e.g. "write:@alice/posts" or "write:/notes").
+type apiTokenScope struct {
+	write      bool
+	sitePrefix string
+	folder     string
+}
+
+// ValidateAPITokenScope checks that scope is a valid API token scope.
+func ValidateAPITokenScope(scope string) error {
+	_, err := parseAPITokenScope(scope)
+	return err
+}
+
+func parseAPITokenScope(scope string) (apiTokenScope, error) {
+	if scope == "read" {
+		return apiTokenScope{}, nil
+	}
+	target, ok := strings.CutPrefix(scope, "write:")
+	if !ok || target == "" {
+		return apiTokenScope{}, fmt.Errorf("%s: %w", scope, ErrInvalidScope)
+	}
+	target = strings.Trim(target, "/")
+	if path.Clean("/" + target)[1:] != target {
+		return apiTokenScope{}, fmt.Errorf("%s: %w", scope, ErrInvalidScope)
+	}
+	parsed := apiTokenScope{write: true}
+	head, tail, _ := strings.Cut(target, "/")
+	if strings.HasPrefix(head, "@") || strings.Contains(head, ".") {
+		parsed.sitePrefix = head
+		parsed.folder = tail
+	} else {
+		parsed.folder = target
+	}
+	if parsed.folder != "" {
+		head, _, _ := strings.Cut(parsed.folder, "/")
+		switch head {
+		case "notes", "pages", "posts", "output":
+			break
+		default:
+			return apiTokenScope{}, fmt.Errorf("%s: %w", scope, ErrInvalidScope)
+		}
+	}
+	return parsed, nil
+}
+
+// canWrite reports whether any of the scopes grant write access to the
+// filePath inside the site.
+func canWrite(scopes []apiTokenScope, sitePrefix, filePath string) bool {
+	for _, scope := range scopes {
+		if !scope.write || scope.sitePrefix != sitePrefix {
+			continue
+		}
+		if scope.folder == "" || filePath == scope.folder || strings.HasPrefix(filePath, scope.folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenAllows reports whether the scopes allow a request to the admin
+// route identified by head and urlPath.
+func apiTokenAllows(scopes []apiTokenScope, method, sitePrefix, head, urlPath string) bool {
+	switch head {
+	case "createsite", "deletesite", "sessions", "twofactor", "tokens", "collaborators", "invite":
+		// Account management always requires a login session.
+		return false
+	}
+	if method == "GET" || method == "HEAD" {
+		for _, scope := range scopes {
+			if !scope.write || scope.sitePrefix == sitePrefix {
+				return true
+			}
+		}
+		return false
+	}
+	switch head {
+	case "", "notes", "pages", "posts", "output":
+		return canWrite(scopes, sitePrefix, urlPath)
+	case "createnote":
+		return canWrite(scopes, sitePrefix, "notes")
+	case "createpost", "createcategory":
+		return canWrite(scopes, sitePrefix, "posts")
+	case "createpage":
+		return canWrite(scopes, sitePrefix, "pages")
+	case "createfile", "createfolder", "delete", "trash", "revisions":
+		// The folder being written to is only known once the request body
+		// has been parsed, so the handler checks it with canWriteTo.
+		for _, scope := range scopes {
+			if scope.write && scope.sitePrefix == sitePrefix {
+				return true
+			}
+		}
+		return false
+	default:
+		return canWrite(scopes, sitePrefix, "")
+	}
+}
+
+var apiTokenScopesKey = &contextKey{}
+
+// NewAPIToken generates a new API token together with the hash that is
+// stored in the database.
+func NewAPIToken() (token string, tokenHash []byte, err error) {
+	var b [8 + 16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().Unix()))
+	_, err = rand.Read(b[8:])
+	if err != nil {
+		return "", nil, fmt.Errorf("reading rand: %w", err)
+	}
+	return APITokenPrefix + hex.EncodeToString(b[:]), hashToken(b[:]), nil
+}
+
+// getAPITokenHash returns the hash of the API token in the request's
+// Authorization header, or nil if the request wasn't made with an API token.
+func getAPITokenHash(r *http.Request) []byte {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Notebrew "+APITokenPrefix)
+	if !ok {
+		return nil
+	}
+	b, err := hex.DecodeString(token)
+	if err != nil || len(b) != 8+16 {
+		return nil
+	}
+	return hashToken(b)
+}
+
+// authenticateAPIToken authenticates a request made with an API token and
+// checks the token's scopes against the admin route. If ok is false a response
+// has already been written.
+func (nbrew *Notebrew) authenticateAPIToken(w http.ResponseWriter, r *http.Request, ip, sitePrefix, head, urlPath string) (username string, _ *http.Request, ok bool) {
+	apiTokenHash := getAPITokenHash(r)
+	if apiTokenHash == nil {
+		notAuthenticated(w, r)
+		return "", r, false
+	}
+	result, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM api_token" +
+			" JOIN users ON users.user_id = api_token.user_id" +
+			" LEFT JOIN (" +
+			"SELECT site_user.user_id, site_user.role" +
+			" FROM site_user" +
+			" JOIN site ON site.site_id = site_user.site_id" +
+			" WHERE site.site_name = {siteName}" +
+			") AS authorized_users ON authorized_users.user_id = users.user_id" +
+			" WHERE api_token.api_token_hash = {apiTokenHash}",
+		Values: []any{
+			sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+			sq.BytesParam("apiTokenHash", apiTokenHash),
+		},
+	}, func(row *sq.Row) (result struct {
+		Username     string
+		IsAuthorized bool
+		Role         string
+		Scopes       []byte
+		ExpiresAt    sql.NullInt64
+		LastUsedAt   sql.NullInt64
+	}) {
+		result.Username = row.String("users.username")
+		result.IsAuthorized = row.Bool("CASE WHEN authorized_users.user_id IS NOT NULL THEN 1 ELSE 0 END")
+		result.Role = row.String("COALESCE(authorized_users.role, 'owner')")
+		result.Scopes = row.Bytes("api_token.scopes")
+		result.ExpiresAt = row.NullInt64("api_token.expires_at")
+		result.LastUsedAt = row.NullInt64("api_token.last_used_at")
+		return result
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			notAuthenticated(w, r)
+			return "", r, false
+		}
+		getLogger(r.Context()).Error(err.Error())
+		internalServerError(w, r, err)
+		return "", r, false
+	}
+	now := time.Now()
+	if result.ExpiresAt.Valid && now.Unix() >= result.ExpiresAt.Int64 {
+		notAuthenticated(w, r)
+		return "", r, false
+	}
+	if !result.LastUsedAt.Valid || now.Unix()-result.LastUsedAt.Int64 > 60 {
+		_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE api_token SET last_used_at = {lastUsedAt} WHERE api_token_hash = {apiTokenHash}",
+			Values: []any{
+				sq.Int64Param("lastUsedAt", now.Unix()),
+				sq.BytesParam("apiTokenHash", apiTokenHash),
+			},
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+	}
+	var rawScopes []string
+	if len(result.Scopes) > 0 {
+		err = json.Unmarshal(result.Scopes, &rawScopes)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return "", r, false
+		}
+	}
+	scopes := make([]apiTokenScope, 0, len(rawScopes))
+	for _, rawScope := range rawScopes {
+		scope, err := parseAPITokenScope(rawScope)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	logger := getLogger(r.Context()).With(slog.String("username", result.Username))
+	r = r.WithContext(context.WithValue(r.Context(), loggerKey, logger))
+	if !result.IsAuthorized && (sitePrefix != "" || head != "") {
+		notAuthorized(w, r)
+		return "", r, false
+	}
+	if !apiTokenAllows(scopes, r.Method, sitePrefix, head, urlPath) {
+		notAuthorized(w, r)
+		return "", r, false
+	}
+	if result.IsAuthorized {
+		if !roleAllows(result.Role, r.Method, head, urlPath) {
+			notAuthorized(w, r)
+			return "", r, false
+		}
+		r = withRole(r, result.Role)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), apiTokenScopesKey, scopes))
+	return result.Username, r, true
+}
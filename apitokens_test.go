@@ -0,0 +1,81 @@
+package nb7
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"github.com/bokwoon95/sq"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_admin_apiTokenScopes(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "hopper", "hopper@email.com", "password123")
+			token, tokenHash, err := NewAPIToken()
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "INSERT INTO api_token (api_token_hash, user_id, token_name, scopes, created_at)" +
+					" VALUES ({apiTokenHash}, (SELECT user_id FROM users WHERE username = 'hopper'), 'ci', {scopes}, {createdAt})",
+				Values: []any{
+					sq.BytesParam("apiTokenHash", tokenHash),
+					sq.StringParam("scopes", `["write:@hopper/posts"]`),
+					sq.Int64Param("createdAt", time.Now().Unix()),
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			tests := []struct {
+				method string
+				url    string
+				denied bool
+			}{
+				{"GET", "/admin/@hopper/notes/", false},
+				{"POST", "/admin/@hopper/createpost/", false},
+				{"POST", "/admin/@hopper/createnote/", true},
+				{"POST", "/admin/@hopper/notes/note.md", true},
+				{"GET", "/admin/sessions/", true},
+				{"GET", "/admin/@someoneelse/notes/", true},
+			}
+			for _, tt := range tests {
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest(tt.method, tt.url, strings.NewReader("{}"))
+				r.Header.Set("Authorization", "Notebrew "+token)
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Accept", "application/json")
+				nbrew.admin(w, r.WithContext(ctx), "")
+				if ctx.Err() != nil {
+					return nil
+				}
+				if w.Code == http.StatusUnauthorized {
+					return fmt.Errorf("[%s] %s %s %s: API token was not accepted", nbrew.Dialect, testutil.Callers(), tt.method, tt.url)
+				}
+				if denied := w.Code == http.StatusForbidden; denied != tt.denied {
+					return fmt.Errorf("[%s] %s %s %s: got status %d, want denied=%v", nbrew.Dialect, testutil.Callers(), tt.method, tt.url, w.Code, tt.denied)
+				}
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,219 @@
+package nb7
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// Sources of an audit log entry.
+const (
+	AuditSourceAdmin = "admin" // admin interface, authenticated by session
+	AuditSourceAPI   = "api"   // admin interface, authenticated by API token
+	AuditSourceCLI   = "cli"   // notebrew command line
+)
+
+// AuditEntry is an entry in the audit log.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor,omitempty"` // username, empty for CLI commands
+	Source   string    `json:"source"`
+	SiteName string    `json:"siteName"` // empty for the main site
+	// IsAccount is true for actions on the actor's account (API tokens,
+	// sessions, two-factor authentication) rather than on a site.
+	IsAccount bool           `json:"isAccount,omitempty"`
+	Action    string         `json:"action"`
+	FilePath  string         `json:"filePath,omitempty"`
+	Target    string         `json:"target,omitempty"` // user or API token acted on, for actions that aren't on a file
+	IP        string         `json:"ip,omitempty"`
+	Before    *AuditSnapshot `json:"before,omitempty"`
+	After     *AuditSnapshot `json:"after,omitempty"`
+}
+
+// AuditSnapshot describes the state of a file before or after an action.
+type AuditSnapshot struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"` // hex-encoded SHA-256 of the contents, empty for folders
+}
+
+// AuditFilter restricts which entries are returned by QueryAuditLog. Zero
+// values do not filter anything.
+type AuditFilter struct {
+	SiteName sql.NullString // the main site is the empty string
+	Actor    string
+	Action   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// WriteAuditLog appends an entry to the audit log. It does nothing if the
+// notebrew instance has no database.
+func (nbrew *Notebrew) WriteAuditLog(ctx context.Context, entry AuditEntry) error {
+	if nbrew.DB == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	siteName := sql.NullString{String: entry.SiteName, Valid: !entry.IsAccount}
+	var beforeSize, afterSize sql.NullInt64
+	var beforeHash, afterHash sql.NullString
+	if entry.Before != nil {
+		beforeSize = sql.NullInt64{Int64: entry.Before.Size, Valid: true}
+		beforeHash = sql.NullString{String: entry.Before.Hash, Valid: entry.Before.Hash != ""}
+	}
+	if entry.After != nil {
+		afterSize = sql.NullInt64{Int64: entry.After.Size, Valid: true}
+		afterHash = sql.NullString{String: entry.After.Hash, Valid: entry.After.Hash != ""}
+	}
+	_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO audit_log (audit_log_id, logged_at, actor, source, site_name, action, file_path, target, ip, before_size, before_hash, after_size, after_hash)" +
+			" VALUES ({auditLogID}, {loggedAt}, {actor}, {source}, {siteName}, {action}, {filePath}, {target}, {ip}, {beforeSize}, {beforeHash}, {afterSize}, {afterHash})",
+		Values: []any{
+			sq.UUIDParam("auditLogID", NewID()),
+			sq.Int64Param("loggedAt", entry.Time.Unix()),
+			sq.StringParam("actor", entry.Actor),
+			sq.StringParam("source", entry.Source),
+			sq.Param("siteName", siteName),
+			sq.StringParam("action", entry.Action),
+			sq.StringParam("filePath", entry.FilePath),
+			sq.StringParam("target", entry.Target),
+			sq.StringParam("ip", entry.IP),
+			sq.Param("beforeSize", beforeSize),
+			sq.Param("beforeHash", beforeHash),
+			sq.Param("afterSize", afterSize),
+			sq.Param("afterHash", afterHash),
+		},
+	})
+	return err
+}
+
+// QueryAuditLog calls fn for every audit log entry matching the filter,
+// most recent first.
+func (nbrew *Notebrew) QueryAuditLog(ctx context.Context, filter AuditFilter, fn func(AuditEntry) error) error {
+	var conditions []sq.Predicate
+	if filter.SiteName.Valid {
+		conditions = append(conditions, sq.Expr("site_name = {}", filter.SiteName.String))
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, sq.Expr("actor = {}", filter.Actor))
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, sq.Expr("action = {}", filter.Action))
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, sq.Expr("logged_at >= {}", filter.Since.Unix()))
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, sq.Expr("logged_at < {}", filter.Until.Unix()))
+	}
+	if len(conditions) == 0 {
+		conditions = []sq.Predicate{sq.Expr("1 = 1")}
+	}
+	format := "SELECT {*} FROM audit_log WHERE {conditions} ORDER BY logged_at DESC, audit_log_id DESC"
+	values := []any{
+		sq.Param("conditions", sq.And(conditions...)),
+	}
+	if filter.Limit > 0 {
+		if nbrew.Dialect == "sqlserver" {
+			format += " OFFSET 0 ROWS FETCH NEXT {limit} ROWS ONLY"
+		} else {
+			format += " LIMIT {limit}"
+		}
+		values = append(values, sq.IntParam("limit", filter.Limit))
+	}
+	cursor, err := sq.FetchCursorContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  format,
+		Values:  values,
+	}, func(row *sq.Row) AuditEntry {
+		entry := AuditEntry{
+			Time:     time.Unix(row.Int64("logged_at"), 0).UTC(),
+			Actor:    row.String("actor"),
+			Source:   row.String("source"),
+			Action:   row.String("action"),
+			FilePath: row.String("file_path"),
+			Target:   row.String("target"),
+			IP:       row.String("ip"),
+		}
+		siteName := row.NullString("site_name")
+		entry.SiteName, entry.IsAccount = siteName.String, !siteName.Valid
+		beforeSize := row.NullInt64("before_size")
+		beforeHash := row.String("before_hash")
+		afterSize := row.NullInt64("after_size")
+		afterHash := row.String("after_hash")
+		if beforeSize.Valid {
+			entry.Before = &AuditSnapshot{Size: beforeSize.Int64, Hash: beforeHash}
+		}
+		if afterSize.Valid {
+			entry.After = &AuditSnapshot{Size: afterSize.Int64, Hash: afterHash}
+		}
+		return entry
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		entry, err := cursor.Result()
+		if err != nil {
+			return err
+		}
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Close()
+}
+
+// auditLog records an action performed through the admin interface, filling
+// in the source and IP address from the request. Failing to write the audit
+// log does not fail the request, the error is only logged.
+func (nbrew *Notebrew) auditLog(r *http.Request, entry AuditEntry) {
+	entry.Source = AuditSourceAdmin
+	if _, ok := r.Context().Value(apiTokenScopesKey).([]apiTokenScope); ok {
+		entry.Source = AuditSourceAPI
+	}
+	entry.IP = nbrew.getIP(r)
+	err := nbrew.WriteAuditLog(r.Context(), entry)
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+	}
+}
+
+// NewAuditSnapshot returns the snapshot of a file or folder in fsys, or nil
+// if it does not exist. Folders are described by their total size only.
+func NewAuditSnapshot(fsys fs.FS, name string) *AuditSnapshot {
+	fileInfo, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil
+	}
+	if fileInfo.IsDir() {
+		size, err := getFileSize(fsys, name)
+		if err != nil {
+			return nil
+		}
+		return &AuditSnapshot{Size: size}
+	}
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil
+	}
+	return &AuditSnapshot{Size: size, Hash: hex.EncodeToString(hash.Sum(nil))}
+}
@@ -0,0 +1,86 @@
+package nb7
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_admin_auditLog(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "hamilton", "hamilton@email.com", "password123")
+			authenticationToken := generateAuthenticationToken(t, nbrew, "hamilton")
+			for _, dir := range []string{"@hamilton", "@hamilton/notes"} {
+				err := nbrew.FS.Mkdir(dir, 0755)
+				if err != nil && !errors.Is(err, fs.ErrExist) {
+					return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("POST", "/admin/@hamilton/createnote/", strings.NewReader(`{"content":"# hello"}`))
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			// X-Real-IP is only trusted from proxies, which default to
+			// loopback addresses.
+			r.RemoteAddr = "127.0.0.1:1234"
+			r.Header.Set("X-Real-IP", "203.0.113.7")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			if w.Code != http.StatusOK {
+				return fmt.Errorf("[%s] %s createnote: got status %d: %s", nbrew.Dialect, testutil.Callers(), w.Code, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("GET", "/admin/@hamilton/auditlog/?action=createnote", nil)
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			var response struct {
+				Entries []AuditEntry `json:"entries"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if len(response.Entries) != 1 {
+				return fmt.Errorf("[%s] %s got %d entries, want 1", nbrew.Dialect, testutil.Callers(), len(response.Entries))
+			}
+			entry := response.Entries[0]
+			if entry.Actor != "hamilton" || entry.SiteName != "hamilton" || entry.IP != "203.0.113.7" || !strings.HasPrefix(entry.FilePath, "notes/") {
+				return fmt.Errorf("[%s] %s unexpected entry %+v", nbrew.Dialect, testutil.Callers(), entry)
+			}
+			if entry.After == nil || entry.After.Size != int64(len("# hello")) || entry.After.Hash == "" {
+				return fmt.Errorf("[%s] %s unexpected snapshot %+v", nbrew.Dialect, testutil.Callers(), entry.After)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,116 @@
+package nb7
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (nbrew *Notebrew) auditlog(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Response struct {
+		Status     Error        `json:"status"`
+		SitePrefix string       `json:"sitePrefix,omitempty"`
+		Actor      string       `json:"actor,omitempty"`
+		Action     string       `json:"action,omitempty"`
+		Since      string       `json:"since,omitempty"`
+		Limit      int          `json:"limit,omitempty"`
+		Entries    []AuditEntry `json:"entries"`
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		methodNotAllowed(w, r)
+		return
+	}
+	// The audit log reveals the activity of every collaborator, so only
+	// those who can manage the whole site may view it.
+	if role, ok := r.Context().Value(roleKey).(string); ok && role != RoleOwner && role != RoleEditor {
+		notAuthorized(w, r)
+		return
+	}
+
+	writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			encoder := json.NewEncoder(w)
+			encoder.SetEscapeHTML(false)
+			err := encoder.Encode(&response)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+			}
+			return
+		}
+		funcMap := map[string]any{
+			"join":        path.Join,
+			"stylesCSS":   func() template.CSS { return template.CSS(stylesCSS) },
+			"baselineJS":  func() template.JS { return template.JS(baselineJS) },
+			"hasDatabase": func() bool { return nbrew.DB != nil },
+			"referer":     func() string { return r.Referer() },
+			"username":    func() string { return username },
+			"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+		}
+		tmpl, err := template.New("auditlog.html").Funcs(funcMap).ParseFS(rootFS, "embed/auditlog.html")
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		contentSecurityPolicy(w, "", nil)
+		executeTemplate(w, r, time.Time{}, tmpl, &response)
+	}
+
+	query := r.URL.Query()
+	response := Response{
+		Status:     Success,
+		SitePrefix: sitePrefix,
+		Actor:      strings.TrimPrefix(strings.TrimSpace(query.Get("actor")), "@"),
+		Action:     strings.TrimSpace(query.Get("action")),
+		Since:      strings.TrimSpace(query.Get("since")),
+		Limit:      100,
+		Entries:    []AuditEntry{},
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			response.Status = ErrInvalidValue
+			writeResponse(w, r, response)
+			return
+		}
+		response.Limit = min(limit, 1000)
+	}
+	filter := AuditFilter{
+		SiteName: sql.NullString{String: strings.TrimPrefix(sitePrefix, "@"), Valid: true},
+		Actor:    response.Actor,
+		Action:   response.Action,
+		Limit:    response.Limit,
+	}
+	if response.Since != "" {
+		since, err := time.ParseInLocation("2006-01-02", response.Since, time.UTC)
+		if err != nil {
+			response.Status = ErrInvalidValue
+			writeResponse(w, r, response)
+			return
+		}
+		filter.Since = since
+	}
+	err := nbrew.QueryAuditLog(r.Context(), filter, func(entry AuditEntry) error {
+		response.Entries = append(response.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	writeResponse(w, r, response)
+}
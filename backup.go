@@ -0,0 +1,493 @@
+package nb7
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// BackupVersion is the version of the backup format written by BackupSite.
+// RestoreSite refuses backups with a newer version.
+const BackupVersion = 1
+
+// backupRoots are the folders in a site that are backed up. The rest of
+// output is generated by RegenerateSite and the trash is left out.
+var backupRoots = []string{"notes", "pages", "posts", "output/themes", "output/images", "system"}
+
+// BackupManifest is the first entry of a backup archive and describes its
+// contents.
+type BackupManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	SiteName  string    `json:"siteName"` // empty for the main site
+	// Site holds the site's database row. It is nil if the backup was made
+	// without a database.
+	Site    *BackupSiteRow `json:"site,omitempty"`
+	Members []BackupMember `json:"members,omitempty"`
+	Files   []BackupFile   `json:"files"`
+}
+
+// BackupSiteRow holds the settings stored in a site's database row.
+type BackupSiteRow struct {
+	StorageLimit *int64 `json:"storageLimit,omitempty"`
+}
+
+// BackupMember is a user with access to the site. Users are referred to by
+// username since IDs differ between instances.
+type BackupMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// BackupFile describes a file in a backup archive, stored under
+// files/<Path>.
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// RestoreOptions configures RestoreSite.
+type RestoreOptions struct {
+	// SiteName is the site to restore into. If not valid, the site name in
+	// the manifest is used.
+	SiteName sql.NullString
+
+	// Overwrite allows restoring into a site that already exists. Files in
+	// the backup replace existing files, other files are left alone.
+	Overwrite bool
+}
+
+// RestoreResult reports what RestoreSite did.
+type RestoreResult struct {
+	Manifest BackupManifest
+	SiteName string
+	// SkippedMembers are members whose user accounts do not exist in this
+	// instance, so their memberships could not be restored.
+	SkippedMembers []string
+}
+
+// BackupSite writes a backup of a site to w as a gzipped tar archive. The
+// archive contains a manifest.json with the site's database rows and the
+// checksums of every file, followed by the files themselves.
+func (nbrew *Notebrew) BackupSite(ctx context.Context, w io.Writer, sitePrefix string) error {
+	siteName := strings.TrimPrefix(sitePrefix, "@")
+	manifest := BackupManifest{
+		Version:   BackupVersion,
+		CreatedAt: time.Now().UTC(),
+		SiteName:  siteName,
+		Files:     []BackupFile{},
+	}
+	if nbrew.DB != nil {
+		storageLimit, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM site WHERE site_name = {siteName}",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+			},
+		}, func(row *sq.Row) sql.NullInt64 {
+			return row.NullInt64("storage_limit")
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("site %q does not exist", siteName)
+			}
+			return err
+		}
+		manifest.Site = &BackupSiteRow{}
+		if storageLimit.Valid {
+			manifest.Site.StorageLimit = &storageLimit.Int64
+		}
+		manifest.Members, err = sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM site_user" +
+				" JOIN site ON site.site_id = site_user.site_id" +
+				" JOIN users ON users.user_id = site_user.user_id" +
+				" WHERE site.site_name = {siteName}" +
+				" ORDER BY users.username",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+			},
+		}, func(row *sq.Row) BackupMember {
+			return BackupMember{
+				Username: row.String("users.username"),
+				Role:     row.String("COALESCE(site_user.role, 'owner')"),
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Checksum every file first, since the manifest has to be written
+	// before the files.
+	for _, root := range backupRoots {
+		err := fs.WalkDir(nbrew.FS, path.Join(sitePrefix, root), func(filePath string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return fs.SkipDir
+				}
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			name := strings.TrimPrefix(strings.TrimPrefix(filePath, sitePrefix), "/")
+			if dirEntry.IsDir() {
+				if name == trashDir {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			file, err := nbrew.FS.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			hash := sha256.New()
+			size, err := io.Copy(hash, file)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, BackupFile{
+				Path:   name,
+				Size:   size,
+				SHA256: hex.EncodeToString(hash.Sum(nil)),
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	b, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "manifest.json",
+		Size:     int64(len(b)),
+		Mode:     0644,
+		ModTime:  manifest.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tarWriter.Write(b)
+	if err != nil {
+		return err
+	}
+	for _, backupFile := range manifest.Files {
+		b, err := fs.ReadFile(nbrew.FS, path.Join(sitePrefix, backupFile.Path))
+		if err != nil {
+			return err
+		}
+		if int64(len(b)) != backupFile.Size {
+			return fmt.Errorf("%s: file changed during backup", backupFile.Path)
+		}
+		err = tarWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "files/" + backupFile.Path,
+			Size:     int64(len(b)),
+			Mode:     0644,
+			ModTime:  manifest.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tarWriter.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// RestoreSite restores a backup written by BackupSite, possibly made by an
+// instance using a different database dialect. Every file is checked against
+// the checksum in the manifest before it is written.
+func (nbrew *Notebrew) RestoreSite(ctx context.Context, r io.Reader, opts RestoreOptions) (RestoreResult, error) {
+	var result RestoreResult
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return result, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	header, err := tarReader.Next()
+	if err != nil {
+		return result, fmt.Errorf("not a backup archive: %w", err)
+	}
+	if header.Name != "manifest.json" {
+		return result, fmt.Errorf("not a backup archive: first entry is %q, expected manifest.json", header.Name)
+	}
+	err = json.NewDecoder(tarReader).Decode(&result.Manifest)
+	if err != nil {
+		return result, fmt.Errorf("manifest.json: %w", err)
+	}
+	if result.Manifest.Version < 1 || result.Manifest.Version > BackupVersion {
+		return result, fmt.Errorf("unsupported backup version %d", result.Manifest.Version)
+	}
+	result.SiteName = result.Manifest.SiteName
+	if opts.SiteName.Valid {
+		result.SiteName = strings.TrimPrefix(opts.SiteName.String, "@")
+	}
+	var sitePrefix string
+	if strings.Contains(result.SiteName, ".") {
+		sitePrefix = result.SiteName
+	} else if result.SiteName != "" {
+		sitePrefix = "@" + result.SiteName
+	}
+	if sitePrefix != "" && (strings.Contains(sitePrefix, "/") || !fs.ValidPath(sitePrefix)) {
+		return result, fmt.Errorf("invalid site name %q", result.SiteName)
+	}
+	if !opts.Overwrite {
+		exists := false
+		if sitePrefix != "" {
+			_, err := fs.Stat(nbrew.FS, sitePrefix)
+			if err == nil {
+				exists = true
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+		} else {
+			for _, root := range backupRoots[:3] {
+				dirEntries, err := nbrew.FS.ReadDir(root)
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return result, err
+				}
+				if len(dirEntries) > 0 {
+					exists = true
+					break
+				}
+			}
+		}
+		if exists {
+			return result, fmt.Errorf("site %q already exists", result.SiteName)
+		}
+	}
+
+	for _, member := range result.Manifest.Members {
+		if !IsValidRole(member.Role) {
+			return result, fmt.Errorf("manifest.json: member %q has invalid role %q", member.Username, member.Role)
+		}
+	}
+	// backupFiles maps each path in the manifest to its index, which names
+	// the file that it is staged in.
+	backupFiles := make(map[string]int, len(result.Manifest.Files))
+	for i, backupFile := range result.Manifest.Files {
+		if !fs.ValidPath(backupFile.Path) || !isBackupPath(backupFile.Path) {
+			return result, fmt.Errorf("manifest.json: invalid path %q", backupFile.Path)
+		}
+		if _, ok := backupFiles[backupFile.Path]; ok {
+			return result, fmt.Errorf("manifest.json: duplicate path %q", backupFile.Path)
+		}
+		backupFiles[backupFile.Path] = i
+	}
+	// Verify every file before writing anything, so that a corrupt archive
+	// does not leave behind a half-restored site. The files are staged in a
+	// temporary directory in the meantime rather than held in memory.
+	stagingDir, err := os.MkdirTemp("", "notebrew-restore-*")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(stagingDir)
+	staged := make(map[string]bool, len(backupFiles))
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		header, err := tarReader.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return result, err
+		}
+		name, ok := strings.CutPrefix(header.Name, "files/")
+		if !ok || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		i, ok := backupFiles[name]
+		if !ok {
+			return result, fmt.Errorf("%s: not in manifest.json", header.Name)
+		}
+		backupFile := result.Manifest.Files[i]
+		file, err := os.Create(filepath.Join(stagingDir, strconv.Itoa(i)))
+		if err != nil {
+			return result, err
+		}
+		hash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(tarReader, backupFile.Size+1))
+		if err != nil {
+			file.Close()
+			return result, err
+		}
+		err = file.Close()
+		if err != nil {
+			return result, err
+		}
+		if n != backupFile.Size || hex.EncodeToString(hash.Sum(nil)) != backupFile.SHA256 {
+			return result, fmt.Errorf("%s: checksum mismatch", header.Name)
+		}
+		staged[name] = true
+	}
+	for name := range backupFiles {
+		if !staged[name] {
+			return result, fmt.Errorf("files/%s: missing from archive", name)
+		}
+	}
+	for i, backupFile := range result.Manifest.Files {
+		filePath := path.Join(sitePrefix, backupFile.Path)
+		err = MkdirAll(nbrew.FS, path.Dir(filePath), 0755)
+		if err != nil {
+			return result, err
+		}
+		file, err := os.Open(filepath.Join(stagingDir, strconv.Itoa(i)))
+		if err != nil {
+			return result, err
+		}
+		readerFrom, err := nbrew.FS.OpenReaderFrom(filePath, 0644)
+		if err != nil {
+			file.Close()
+			return result, err
+		}
+		_, err = readerFrom.ReadFrom(file)
+		file.Close()
+		if err != nil {
+			return result, err
+		}
+	}
+	for _, dir := range []string{"notes", "pages", "posts", "output", "output/themes", "output/images"} {
+		err = MkdirAll(nbrew.FS, path.Join(sitePrefix, dir), 0755)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if nbrew.DB != nil {
+		var storageLimit sql.NullInt64
+		if result.Manifest.Site != nil && result.Manifest.Site.StorageLimit != nil {
+			storageLimit = sql.NullInt64{Int64: *result.Manifest.Site.StorageLimit, Valid: true}
+		}
+		storageUsed, err := getFileSize(nbrew.FS, sitePrefix)
+		if err != nil {
+			return result, err
+		}
+		// The site and its members are restored together or not at all.
+		tx, err := nbrew.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return result, err
+		}
+		defer tx.Rollback()
+		exists, err := sq.FetchExistsContext(ctx, tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT 1 FROM site WHERE site_name = {siteName}",
+			Values: []any{
+				sq.StringParam("siteName", result.SiteName),
+			},
+		})
+		if err != nil {
+			return result, err
+		}
+		if exists {
+			_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "UPDATE site SET storage_limit = {storageLimit}, storage_used = {storageUsed} WHERE site_name = {siteName}",
+				Values: []any{
+					sq.Param("storageLimit", storageLimit),
+					sq.Int64Param("storageUsed", storageUsed),
+					sq.StringParam("siteName", result.SiteName),
+				},
+			})
+		} else {
+			_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "INSERT INTO site (site_id, site_name, storage_limit, storage_used) VALUES ({siteID}, {siteName}, {storageLimit}, {storageUsed})",
+				Values: []any{
+					sq.UUIDParam("siteID", NewID()),
+					sq.StringParam("siteName", result.SiteName),
+					sq.Param("storageLimit", storageLimit),
+					sq.Int64Param("storageUsed", storageUsed),
+				},
+			})
+		}
+		if err != nil {
+			return result, err
+		}
+		for _, member := range result.Manifest.Members {
+			userExists, err := sq.FetchExistsContext(ctx, tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT 1 FROM users WHERE username = {username}",
+				Values: []any{
+					sq.StringParam("username", member.Username),
+				},
+			})
+			if err != nil {
+				return result, err
+			}
+			if !userExists {
+				result.SkippedMembers = append(result.SkippedMembers, member.Username)
+				continue
+			}
+			_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "INSERT INTO site_user (site_id, user_id, role)" +
+					" SELECT site.site_id, users.user_id, {role} FROM site, users" +
+					" WHERE site.site_name = {siteName} AND users.username = {username}" +
+					" AND NOT EXISTS (SELECT 1 FROM site_user WHERE site_user.site_id = site.site_id AND site_user.user_id = users.user_id)",
+				Values: []any{
+					sq.StringParam("role", member.Role),
+					sq.StringParam("siteName", result.SiteName),
+					sq.StringParam("username", member.Username),
+				},
+			})
+			if err != nil {
+				return result, err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return result, err
+		}
+	}
+	err = nbrew.RegenerateSite(ctx, sitePrefix)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func isBackupPath(name string) bool {
+	for _, root := range backupRoots {
+		if strings.HasPrefix(name, root+"/") {
+			return !strings.HasPrefix(name, trashDir+"/")
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package nb7
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"github.com/bokwoon95/sq"
+)
+
+func Test_BackupSite(t *testing.T) {
+	src := newTestSite("@alice", fstest.MapFS{
+		"@alice/output/posts/old.html":   &fstest.MapFile{Data: []byte("generated")},
+		"@alice/pages/index.html":        &fstest.MapFile{Data: []byte("<p>welcome</p>")},
+		"@alice/posts/hello-world.md":    &fstest.MapFile{Data: []byte("# Hello World\n")},
+		"@alice/notes/todo.txt":          &fstest.MapFile{Data: []byte("buy milk")},
+		"@alice/output/images/cat.jpg":   &fstest.MapFile{Data: []byte("meow")},
+		"@alice/system/trash/1/todo.txt": &fstest.MapFile{Data: []byte("deleted")},
+	})
+	var buf bytes.Buffer
+	err := src.BackupSite(context.Background(), &buf, "@alice")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	archive := buf.Bytes()
+	dest := newTestSite("", nil)
+	result, err := dest.RestoreSite(context.Background(), bytes.NewReader(archive), RestoreOptions{
+		SiteName: sql.NullString{String: "bob", Valid: true},
+	})
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if result.Manifest.SiteName != "alice" || result.SiteName != "bob" {
+		t.Errorf("%s got site names %q and %q, want alice and bob", testutil.Callers(), result.Manifest.SiteName, result.SiteName)
+	}
+	for name, want := range map[string]string{
+		"@bob/pages/index.html":      "<p>welcome</p>",
+		"@bob/notes/todo.txt":        "buy milk",
+		"@bob/output/images/cat.jpg": "meow",
+	} {
+		b, err := fs.ReadFile(dest.FS, name)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if string(b) != want {
+			t.Errorf("%s %s: got %q, want %q", testutil.Callers(), name, string(b), want)
+		}
+	}
+	for _, name := range []string{"@bob/system/trash/1/todo.txt", "@bob/output/posts/old.html"} {
+		_, err := fs.Stat(dest.FS, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s %s: expected it to not be restored, got %v", testutil.Callers(), name, err)
+		}
+	}
+	_, err = fs.Stat(dest.FS, "@bob/output/posts/hello-world/index.html")
+	if err != nil {
+		t.Errorf("%s site was not regenerated: %v", testutil.Callers(), err)
+	}
+	_, err = dest.RestoreSite(context.Background(), bytes.NewReader(archive), RestoreOptions{
+		SiteName: sql.NullString{String: "bob", Valid: true},
+	})
+	if err == nil {
+		t.Errorf("%s expected an error restoring into an existing site", testutil.Callers())
+	}
+
+	// Corrupt the contents of a file without touching the manifest.
+	var tampered bytes.Buffer
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	gzipWriter := gzip.NewWriter(&tampered)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		b, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if header.Name == "files/notes/todo.txt" {
+			b = []byte("buy eggs")
+		}
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		_, err = tarWriter.Write(b)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	_, err = dest.RestoreSite(context.Background(), &tampered, RestoreOptions{
+		SiteName: sql.NullString{String: "carol", Valid: true},
+	})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("%s got %v, want a checksum mismatch", testutil.Callers(), err)
+	}
+	_, err = fs.Stat(dest.FS, "@carol")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s corrupt backup was partially restored: %v", testutil.Callers(), err)
+	}
+}
+
+func Test_RestoreSite_database(t *testing.T) {
+	for _, testDB := range testDatabases {
+		t.Run(testDB.Name, func(t *testing.T) {
+			nbrew := &Notebrew{
+				Dialect:       testDB.Dialect,
+				DB:            testDB.DB,
+				FS:            testutil.NewFS(nil),
+				ErrorCode:     testDB.ErrorCode,
+				Scheme:        "https://",
+				ContentDomain: "example.com",
+			}
+			createUser(t, nbrew, "ritchie", "ritchie@email.com", "password123")
+			createUser(t, nbrew, "thompson", "thompson@email.com", "password123")
+			storageLimit := int64(1 << 20)
+			files := map[string]string{
+				"pages/index.html": "<p>unix</p>",
+				"notes/todo.txt":   "write a kernel",
+			}
+
+			// A member with an invalid role fails the restore before anything
+			// is written.
+			_, err := nbrew.RestoreSite(context.Background(), backupArchive(t, BackupManifest{
+				SiteName: "multics",
+				Members:  []BackupMember{{Username: "ritchie", Role: "superuser"}},
+			}, files), RestoreOptions{})
+			if err == nil {
+				t.Fatalf("%s: got nil error, want an invalid role error", testutil.Callers())
+			}
+			if _, err := fs.Stat(nbrew.FS, "@multics"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: site with an invalid member was partially restored (err=%v)", testutil.Callers(), err)
+			}
+
+			result, err := nbrew.RestoreSite(context.Background(), backupArchive(t, BackupManifest{
+				SiteName: "unix",
+				Site:     &BackupSiteRow{StorageLimit: &storageLimit},
+				Members: []BackupMember{
+					{Username: "kernighan", Role: RoleEditor},
+					{Username: "ritchie", Role: RoleOwner},
+					{Username: "thompson", Role: RoleAuthor},
+				},
+			}, files), RestoreOptions{})
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			if !slices.Equal(result.SkippedMembers, []string{"kernighan"}) {
+				t.Errorf("%s: got skipped members %v, want [kernighan]", testutil.Callers(), result.SkippedMembers)
+			}
+			for name, want := range files {
+				b, err := fs.ReadFile(nbrew.FS, "@unix/"+name)
+				if err != nil {
+					t.Fatal(testutil.Callers(), err)
+				}
+				if string(b) != want {
+					t.Errorf("%s %s: got %q, want %q", testutil.Callers(), name, string(b), want)
+				}
+			}
+			gotLimit, err := sq.FetchOne(nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM site WHERE site_name = 'unix'",
+			}, func(row *sq.Row) sql.NullInt64 {
+				return row.NullInt64("storage_limit")
+			})
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			if gotLimit.Int64 != storageLimit {
+				t.Errorf("%s: got storage limit %v, want %d", testutil.Callers(), gotLimit, storageLimit)
+			}
+			members, err := sq.FetchAll(nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "SELECT {*}" +
+					" FROM site_user" +
+					" JOIN site ON site.site_id = site_user.site_id" +
+					" JOIN users ON users.user_id = site_user.user_id" +
+					" WHERE site.site_name = 'unix'" +
+					" ORDER BY users.username",
+			}, func(row *sq.Row) BackupMember {
+				return BackupMember{
+					Username: row.String("users.username"),
+					Role:     row.String("COALESCE(site_user.role, 'owner')"),
+				}
+			})
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			wantMembers := []BackupMember{{Username: "ritchie", Role: RoleOwner}, {Username: "thompson", Role: RoleAuthor}}
+			if !slices.Equal(members, wantMembers) {
+				t.Errorf("%s: got members %+v, want %+v", testutil.Callers(), members, wantMembers)
+			}
+		})
+	}
+}
+
+// backupArchive writes a backup archive of files the way that BackupSite
+// does, filling in the version and file checksums of the manifest.
+func backupArchive(t *testing.T, manifest BackupManifest, files map[string]string) *bytes.Buffer {
+	manifest.Version = BackupVersion
+	manifest.CreatedAt = time.Now().UTC()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		checksum := sha256.Sum256([]byte(files[name]))
+		manifest.Files = append(manifest.Files, BackupFile{
+			Path:   name,
+			Size:   int64(len(files[name])),
+			SHA256: hex.EncodeToString(checksum[:]),
+		})
+	}
+	b, err := json.Marshal(&manifest)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	buf := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	writeEntry := func(name string, b []byte) {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     int64(len(b)),
+			Mode:     0644,
+		})
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		_, err = tarWriter.Write(b)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+	}
+	writeEntry("manifest.json", b)
+	for _, name := range names {
+		writeEntry("files/"+name, []byte(files[name]))
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	return buf
+}
@@ -0,0 +1,315 @@
+package nb7
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaptchaProvider verifies that a login or signup was made by a human.
+type CaptchaProvider interface {
+	// Name is the name of the provider as used by the captcha.provider
+	// config key. The login and signup pages render the captcha widget
+	// according to it.
+	Name() string
+
+	// SiteKey is the public key that the captcha widget is rendered with,
+	// if any.
+	SiteKey() string
+
+	// Challenge returns a new challenge for the captcha widget to solve, if
+	// the provider issues its own challenges.
+	Challenge() (string, error)
+
+	// ResponseField is the name of the form field that the captcha widget
+	// puts its response in.
+	ResponseField() string
+
+	// Origins are the origins that the captcha widget loads scripts, styles
+	// and frames from and connects to, which the Content-Security-Policy of
+	// the login and signup pages must allow.
+	Origins() []string
+
+	// Verify reports whether the captcha response is valid. An error is
+	// returned only if the response could not be verified at all.
+	Verify(ctx context.Context, response, ip string) (ok bool, err error)
+}
+
+// captchaProvider returns the captcha provider configured by the captcha
+// config key, or nil if captchas are not configured.
+func (nbrew *Notebrew) captchaProvider() CaptchaProvider {
+	config := nbrew.Config().Captcha
+	switch config.provider() {
+	case "hcaptcha":
+		return &hCaptcha{siteKey: config.SiteKey, secretKey: config.SecretKey}
+	case "turnstile":
+		return &turnstile{siteKey: config.SiteKey, secretKey: config.SecretKey}
+	case "pow":
+		difficulty := config.Difficulty
+		if difficulty == 0 {
+			difficulty = defaultProofOfWorkDifficulty
+		}
+		// The provider holds the challenges that have been used, so it is
+		// kept around for as long as its settings don't change.
+		nbrew.proofOfWork.mu.Lock()
+		defer nbrew.proofOfWork.mu.Unlock()
+		if nbrew.proofOfWork.captcha == nil || nbrew.proofOfWork.secretKey != config.SecretKey || nbrew.proofOfWork.captcha.difficulty != difficulty {
+			key := []byte(config.SecretKey)
+			if len(key) == 0 {
+				// Without a secret key, challenges are signed with a key
+				// that only lasts as long as the process does.
+				key = make([]byte, 32)
+				_, err := rand.Read(key)
+				if err != nil {
+					panic(err)
+				}
+			}
+			nbrew.proofOfWork.captcha = &proofOfWorkCaptcha{
+				key:        key,
+				difficulty: difficulty,
+			}
+			nbrew.proofOfWork.secretKey = config.SecretKey
+		}
+		return nbrew.proofOfWork.captcha
+	default:
+		return nil
+	}
+}
+
+// hCaptcha is the hCaptcha captcha provider.
+//
+// https://docs.hcaptcha.com/
+type hCaptcha struct {
+	siteKey   string
+	secretKey string
+}
+
+func (captcha *hCaptcha) Name() string { return "hcaptcha" }
+
+func (captcha *hCaptcha) SiteKey() string { return captcha.siteKey }
+
+func (captcha *hCaptcha) Challenge() (string, error) { return "", nil }
+
+func (captcha *hCaptcha) ResponseField() string { return "h-captcha-response" }
+
+func (captcha *hCaptcha) Origins() []string {
+	return []string{"https://hcaptcha.com", "https://*.hcaptcha.com"}
+}
+
+func (captcha *hCaptcha) Verify(ctx context.Context, response, ip string) (ok bool, err error) {
+	return siteverify(ctx, "https://api.hcaptcha.com/siteverify", url.Values{
+		"secret":   []string{captcha.secretKey},
+		"response": []string{response},
+		"remoteip": []string{ip},
+		"sitekey":  []string{captcha.siteKey},
+	})
+}
+
+// turnstile is the Cloudflare Turnstile captcha provider.
+//
+// https://developers.cloudflare.com/turnstile/
+type turnstile struct {
+	siteKey   string
+	secretKey string
+}
+
+func (captcha *turnstile) Name() string { return "turnstile" }
+
+func (captcha *turnstile) SiteKey() string { return captcha.siteKey }
+
+func (captcha *turnstile) Challenge() (string, error) { return "", nil }
+
+func (captcha *turnstile) ResponseField() string { return "cf-turnstile-response" }
+
+func (captcha *turnstile) Origins() []string {
+	return []string{"https://challenges.cloudflare.com"}
+}
+
+func (captcha *turnstile) Verify(ctx context.Context, response, ip string) (ok bool, err error) {
+	return siteverify(ctx, "https://challenges.cloudflare.com/turnstile/v0/siteverify", url.Values{
+		"secret":   []string{captcha.secretKey},
+		"response": []string{response},
+		"remoteip": []string{ip},
+	})
+}
+
+// siteverify posts a captcha response to the siteverify endpoint of a third
+// party captcha provider. hCaptcha and Turnstile share the same API.
+func siteverify(ctx context.Context, endpoint string, values url.Values) (ok bool, err error) {
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	result := make(map[string]any)
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	success, _ := result["success"].(bool)
+	if !success {
+		b, err := json.Marshal(result)
+		if err != nil {
+			getLogger(ctx).Warn(err.Error())
+		} else {
+			getLogger(ctx).Warn(string(b))
+		}
+	}
+	return success, nil
+}
+
+const (
+	// defaultProofOfWorkDifficulty takes a browser around a second to solve.
+	defaultProofOfWorkDifficulty = 16
+
+	// proofOfWorkMaxAge is how long a proof-of-work challenge may be solved
+	// for after it is issued.
+	proofOfWorkMaxAge = 10 * time.Minute
+)
+
+// proofOfWorkCaptcha is the self-hosted captcha provider that needs no third
+// party: instead of proving that they are human, clients prove that they
+// spent some CPU time, which makes automated logins and signups expensive.
+//
+// A challenge is a difficulty, an expiry time and a random salt, signed with
+// key so that the server does not need to remember the challenges it
+// issued:
+//
+//	<difficulty>.<expiresAt>.<salt>.<signature>
+//
+// Solving a challenge means finding a nonce (a decimal number) such that the
+// SHA-256 hash of "<challenge>:<nonce>" starts with at least difficulty zero
+// bits. The response is "<challenge>:<nonce>". static/captcha.js is the
+// solver that the login and signup pages use.
+//
+// Each challenge can be used once. Used challenges are remembered in memory
+// until they expire, so notebrew instances that share a secret key each
+// accept a challenge once.
+type proofOfWorkCaptcha struct {
+	// key signs the challenges.
+	key []byte
+
+	// difficulty is the number of leading zero bits that the hash of a
+	// solution must have. Every additional bit doubles the average time
+	// taken to solve a challenge.
+	difficulty int
+
+	mu       sync.Mutex
+	used     map[string]time.Time
+	prunedAt time.Time
+}
+
+// proofOfWork holds the proof-of-work captcha provider of a Notebrew.
+type proofOfWork struct {
+	mu        sync.Mutex
+	captcha   *proofOfWorkCaptcha
+	secretKey string
+}
+
+func (captcha *proofOfWorkCaptcha) Name() string { return "pow" }
+
+func (captcha *proofOfWorkCaptcha) SiteKey() string { return "" }
+
+func (captcha *proofOfWorkCaptcha) Challenge() (string, error) {
+	var salt [16]byte
+	_, err := rand.Read(salt[:])
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.Itoa(captcha.difficulty) + "." + strconv.FormatInt(time.Now().Add(proofOfWorkMaxAge).Unix(), 10) + "." + hex.EncodeToString(salt[:])
+	return payload + "." + captcha.sign(payload), nil
+}
+
+func (captcha *proofOfWorkCaptcha) ResponseField() string { return "captcha-response" }
+
+func (captcha *proofOfWorkCaptcha) Origins() []string { return nil }
+
+func (captcha *proofOfWorkCaptcha) Verify(ctx context.Context, response, ip string) (ok bool, err error) {
+	challenge, nonce, ok := strings.Cut(response, ":")
+	if !ok || nonce == "" || len(nonce) > 20 {
+		return false, nil
+	}
+	for _, char := range nonce {
+		if char < '0' || char > '9' {
+			return false, nil
+		}
+	}
+	fields := strings.Split(challenge, ".")
+	if len(fields) != 4 {
+		return false, nil
+	}
+	if !hmac.Equal([]byte(fields[3]), []byte(captcha.sign(strings.Join(fields[:3], ".")))) {
+		return false, nil
+	}
+	// The difficulty is signed, so it is whatever the challenge was issued
+	// with even if the difficulty has changed since.
+	difficulty, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false, nil
+	}
+	expiresAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	now := time.Now()
+	if now.Unix() > expiresAt {
+		return false, nil
+	}
+	if proofOfWorkZeroBits(sha256.Sum256([]byte(response))) < difficulty {
+		return false, nil
+	}
+	captcha.mu.Lock()
+	defer captcha.mu.Unlock()
+	if captcha.used == nil {
+		captcha.used = make(map[string]time.Time)
+	}
+	if now.Sub(captcha.prunedAt) > time.Minute {
+		for usedChallenge, usedExpiresAt := range captcha.used {
+			if now.After(usedExpiresAt) {
+				delete(captcha.used, usedChallenge)
+			}
+		}
+		captcha.prunedAt = now
+	}
+	if _, ok := captcha.used[challenge]; ok {
+		return false, nil
+	}
+	captcha.used[challenge] = time.Unix(expiresAt, 0)
+	return true, nil
+}
+
+func (captcha *proofOfWorkCaptcha) sign(payload string) string {
+	mac := hmac.New(sha256.New, captcha.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// proofOfWorkZeroBits returns the number of leading zero bits in a hash.
+func proofOfWorkZeroBits(hash [sha256.Size]byte) int {
+	var n int
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,182 @@
+package nb7
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+// solveProofOfWork solves a proof-of-work challenge the same way that
+// static/captcha.js does.
+func solveProofOfWork(challenge string) (response string, err error) {
+	difficulty, _, ok := strings.Cut(challenge, ".")
+	if !ok {
+		return "", fmt.Errorf("malformed challenge %q", challenge)
+	}
+	zeroBits, err := strconv.Atoi(difficulty)
+	if err != nil {
+		return "", fmt.Errorf("malformed challenge %q: %w", challenge, err)
+	}
+	for nonce := 0; ; nonce++ {
+		response = challenge + ":" + strconv.Itoa(nonce)
+		if proofOfWorkZeroBits(sha256.Sum256([]byte(response))) >= zeroBits {
+			return response, nil
+		}
+	}
+}
+
+func Test_proofOfWorkCaptcha(t *testing.T) {
+	ctx := context.Background()
+	captcha := &proofOfWorkCaptcha{key: []byte("secret"), difficulty: 8}
+	challenge, err := captcha.Challenge()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	response, err := solveProofOfWork(challenge)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	// A hash that falls short of the difficulty.
+	var unsolved string
+	for nonce := 0; unsolved == ""; nonce++ {
+		candidate := challenge + ":" + strconv.Itoa(nonce)
+		if proofOfWorkZeroBits(sha256.Sum256([]byte(candidate))) < 8 {
+			unsolved = candidate
+		}
+	}
+	// A challenge that is signed correctly but has expired.
+	expiredPayload := "8." + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ".00"
+	expired, err := solveProofOfWork(expiredPayload + "." + captcha.sign(expiredPayload))
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	// A challenge whose difficulty was lowered by the client.
+	lowered, err := solveProofOfWork("0" + strings.TrimPrefix(challenge, "8"))
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	otherCaptcha := &proofOfWorkCaptcha{key: []byte("other secret"), difficulty: 8}
+	for _, tt := range []struct {
+		description string
+		captcha     *proofOfWorkCaptcha
+		response    string
+		want        bool
+	}{
+		{"unsolved", captcha, unsolved, false},
+		{"expired", captcha, expired, false},
+		{"difficulty lowered", captcha, lowered, false},
+		{"signed with another key", otherCaptcha, response, false},
+		{"malformed", captcha, challenge, false},
+		{"non-numeric nonce", captcha, challenge + ":x", false},
+		{"solved", captcha, response, true},
+		{"replayed", captcha, response, false},
+	} {
+		ok, err := tt.captcha.Verify(ctx, tt.response, "192.0.2.1")
+		if err != nil {
+			t.Fatal(testutil.Callers(), tt.description, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s %s: got %v, want %v", testutil.Callers(), tt.description, ok, tt.want)
+		}
+	}
+}
+
+func Test_signup_captcha(t *testing.T) {
+	type Response struct {
+		Status           Error  `json:"status"`
+		RequireCaptcha   bool   `json:"requireCaptcha"`
+		CaptchaProvider  string `json:"captchaProvider"`
+		CaptchaChallenge string `json:"captchaChallenge"`
+	}
+	for _, testDB := range testDatabases {
+		t.Run(testDB.Name, func(t *testing.T) {
+			nbrew := &Notebrew{
+				Dialect:       testDB.Dialect,
+				DB:            testDB.DB,
+				FS:            testutil.NewFS(nil),
+				ErrorCode:     testDB.ErrorCode,
+				Scheme:        "http://",
+				AdminDomain:   "localhost:6444",
+				ContentDomain: "localhost:6444",
+			}
+			nbrew.config.Store(&Config{
+				Signups: true,
+				Captcha: CaptchaConfig{Provider: "pow", Difficulty: 8},
+			})
+			serve := func(method string, values url.Values) Response {
+				var r *http.Request
+				if method == "GET" {
+					r, _ = http.NewRequest("GET", "http://localhost:6444/admin/signup/", nil)
+				} else {
+					r, _ = http.NewRequest("POST", "http://localhost:6444/admin/signup/", strings.NewReader(values.Encode()))
+					r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+				r.Header.Set("Accept", "application/json")
+				r.RemoteAddr = "192.0.2.1:1234"
+				w := httptest.NewRecorder()
+				nbrew.ServeHTTP(w, r)
+				var response Response
+				err := json.Unmarshal(w.Body.Bytes(), &response)
+				if err != nil {
+					t.Fatal(testutil.Callers(), err, w.Body.String())
+				}
+				return response
+			}
+			response := serve("GET", nil)
+			if !response.RequireCaptcha || response.CaptchaProvider != "pow" || response.CaptchaChallenge == "" {
+				t.Fatalf("%s: got %+v, want a pow challenge", testutil.Callers(), response)
+			}
+			response = serve("POST", url.Values{"username": {"turing"}})
+			if response.Status != ErrRetryWithCaptcha {
+				t.Fatalf("%s: got status %q, want %q", testutil.Callers(), response.Status, ErrRetryWithCaptcha)
+			}
+			captchaResponse, err := solveProofOfWork(response.CaptchaChallenge)
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			// The username is invalid, so the signup fails validation only
+			// after the captcha is accepted.
+			response = serve("POST", url.Values{"username": {"Turing!"}, "captcha-response": {captchaResponse}})
+			if response.Status == ErrRetryWithCaptcha || response.Status == ErrCaptchaChallengeFailed {
+				t.Fatalf("%s: got status %q, want the captcha to be accepted", testutil.Callers(), response.Status)
+			}
+			response = serve("POST", url.Values{"username": {"Turing!"}, "captcha-response": {captchaResponse}})
+			if response.Status != ErrCaptchaChallengeFailed {
+				t.Fatalf("%s: got status %q, want %q", testutil.Callers(), response.Status, ErrCaptchaChallengeFailed)
+			}
+		})
+	}
+}
+
+func Test_contentSecurityPolicy_captcha(t *testing.T) {
+	for _, tt := range []struct {
+		captcha CaptchaProvider
+		want    string
+	}{
+		{&hCaptcha{}, "frame-src https://hcaptcha.com https://*.hcaptcha.com;"},
+		{&turnstile{}, "frame-src https://challenges.cloudflare.com;"},
+	} {
+		w := httptest.NewRecorder()
+		contentSecurityPolicy(w, "", tt.captcha)
+		if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, tt.want) {
+			t.Errorf("%s %s: got %q, want it to contain %q", testutil.Callers(), tt.captcha.Name(), csp, tt.want)
+		}
+	}
+	// The proof-of-work captcha is served from 'self' and needs no
+	// allowances.
+	w := httptest.NewRecorder()
+	contentSecurityPolicy(w, "", &proofOfWorkCaptcha{})
+	if csp := w.Header().Get("Content-Security-Policy"); strings.Contains(csp, "frame-src") {
+		t.Errorf("%s: got %q, want no frame-src", testutil.Callers(), csp)
+	}
+}
@@ -0,0 +1,428 @@
+package nb7
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/crypto/blake2b"
+)
+
+// siteInviteMaxAge is how long a site invitation link stays valid.
+const siteInviteMaxAge = 7 * 24 * time.Hour
+
+func (nbrew *Notebrew) collaborators(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Collaborator struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	type Invite struct {
+		InviteID  string    `json:"inviteID"`
+		Username  string    `json:"username"`
+		Role      string    `json:"role"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	type Request struct {
+		Action   string `json:"action,omitempty"` // "invite" | "remove" | "cancelinvite"
+		User     string `json:"user,omitempty"`   // username or email
+		Role     string `json:"role,omitempty"`
+		InviteID string `json:"inviteID,omitempty"`
+	}
+	type Response struct {
+		Status           Error              `json:"status"`
+		Errors           map[string][]Error `json:"errors,omitempty"`
+		SitePrefix       string             `json:"sitePrefix,omitempty"`
+		Role             string             `json:"role,omitempty"` // the current user's role
+		Collaborators    []Collaborator     `json:"collaborators,omitempty"`
+		Invites          []Invite           `json:"invites,omitempty"`
+		User             string             `json:"user,omitempty"`
+		InviteLink       string             `json:"inviteLink,omitempty"`
+		MailSendingError string             `json:"mailSendingError,omitempty"`
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+	siteName := strings.TrimPrefix(sitePrefix, "@")
+	role, _ := r.Context().Value(roleKey).(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"join":        path.Join,
+				"stylesCSS":   func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":  func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase": func() bool { return nbrew.DB != nil },
+				"referer":     func() string { return r.Referer() },
+				"username":    func() string { return username },
+				"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+			}
+			tmpl, err := template.New("collaborators.html").Funcs(funcMap).ParseFS(rootFS, "embed/collaborators.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status == "" {
+			response.Status = Success
+		}
+		response.SitePrefix = sitePrefix
+		response.Role = role
+		response.Collaborators, err = sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM site_user" +
+				" JOIN site ON site.site_id = site_user.site_id" +
+				" JOIN users ON users.user_id = site_user.user_id" +
+				" WHERE site.site_name = {siteName}" +
+				" ORDER BY users.username",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+			},
+		}, func(row *sq.Row) Collaborator {
+			return Collaborator{
+				Username: row.String("users.username"),
+				Role:     row.String("COALESCE(site_user.role, 'owner')"),
+			}
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		response.Invites, err = sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM site_invite" +
+				" JOIN site ON site.site_id = site_invite.site_id" +
+				" JOIN users ON users.user_id = site_invite.user_id" +
+				" WHERE site.site_name = {siteName}" +
+				" ORDER BY users.username",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+			},
+		}, func(row *sq.Row) Invite {
+			siteInviteTokenHash := row.Bytes("site_invite.site_invite_token_hash")
+			invite := Invite{
+				InviteID: hex.EncodeToString(siteInviteTokenHash),
+				Username: row.String("users.username"),
+				Role:     row.String("COALESCE(site_invite.role, 'editor')"),
+			}
+			if len(siteInviteTokenHash) >= 8 {
+				invite.ExpiresAt = time.Unix(int64(binary.BigEndian.Uint64(siteInviteTokenHash[:8])), 0).Add(siteInviteMaxAge).UTC()
+			}
+			return invite
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", &response)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "collaborators")+"/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.Action = r.Form.Get("action")
+			request.User = r.Form.Get("user")
+			request.Role = r.Form.Get("role")
+			request.InviteID = r.Form.Get("inviteID")
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		response := Response{
+			SitePrefix: sitePrefix,
+			Role:       role,
+			User:       strings.TrimPrefix(strings.TrimSpace(request.User), "@"),
+			Errors:     make(map[string][]Error),
+		}
+		switch request.Action {
+		case "invite":
+			if request.Role == "" {
+				request.Role = RoleEditor
+			}
+			switch request.Role {
+			case RoleEditor, RoleAuthor, RoleViewer:
+				break
+			default:
+				// Ownership can only be transferred with notebrew
+				// permissions -setowner.
+				response.Errors["role"] = append(response.Errors["role"], ErrInvalidValue)
+			}
+			if response.User == "" {
+				response.Errors["user"] = append(response.Errors["user"], ErrRequired)
+			}
+			if len(response.Errors) > 0 {
+				response.Status = ErrValidationFailed
+				writeResponse(w, r, response)
+				return
+			}
+			field := "username"
+			if strings.Contains(response.User, "@") {
+				field = "email"
+			}
+			invitee, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM users WHERE " + field + " = {user}",
+				Values: []any{
+					sq.StringParam("user", response.User),
+				},
+			}, func(row *sq.Row) (invitee struct {
+				Username       string
+				Email          string
+				IsCollaborator bool
+			}) {
+				invitee.Username = row.String("users.username")
+				invitee.Email = row.String("users.email")
+				invitee.IsCollaborator = row.Bool("CASE WHEN EXISTS (SELECT 1 FROM site_user JOIN site ON site.site_id = site_user.site_id WHERE site_user.user_id = users.user_id AND site.site_name = {siteName}) THEN 1 ELSE 0 END", sq.StringParam("siteName", siteName))
+				return invitee
+			})
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					response.Errors["user"] = append(response.Errors["user"], ErrUserNotFound)
+					response.Status = ErrValidationFailed
+					writeResponse(w, r, response)
+					return
+				}
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if invitee.IsCollaborator {
+				response.Errors["user"] = append(response.Errors["user"], ErrAlreadyCollaborator)
+				response.Status = ErrValidationFailed
+				writeResponse(w, r, response)
+				return
+			}
+			var siteInviteToken [8 + 16]byte
+			binary.BigEndian.PutUint64(siteInviteToken[:8], uint64(time.Now().Unix()))
+			_, err = rand.Read(siteInviteToken[8:])
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			var siteInviteTokenHash [8 + blake2b.Size256]byte
+			checksum := blake2b.Sum256(siteInviteToken[8:])
+			copy(siteInviteTokenHash[:8], siteInviteToken[:8])
+			copy(siteInviteTokenHash[8:], checksum[:])
+			_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "INSERT INTO site_invite (site_invite_token_hash, site_id, user_id, role)" +
+					" VALUES ({siteInviteTokenHash}, (SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username}), {role})",
+				Values: []any{
+					sq.BytesParam("siteInviteTokenHash", siteInviteTokenHash[:]),
+					sq.StringParam("siteName", siteName),
+					sq.StringParam("username", invitee.Username),
+					sq.StringParam("role", request.Role),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: siteName,
+				Action:   "invitecollaborator",
+				Target:   invitee.Username,
+			})
+			response.User = invitee.Username
+			response.InviteLink = nbrew.Scheme + nbrew.AdminDomain + "/admin/invite/?token=" + strings.TrimLeft(hex.EncodeToString(siteInviteToken[:]), "0")
+			response.Status = InviteCollaboratorSuccess
+			// If there is no mailer the invite link is returned so that it
+			// can be passed on to the user some other way.
+			smtpSettings, isDisabled, isMisconfigured, err := nbrew.getSmtpSettings()
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if isDisabled || isMisconfigured || invitee.Email == "" {
+				writeResponse(w, r, response)
+				return
+			}
+			siteLabel := sitePrefix
+			if siteLabel == "" {
+				siteLabel = nbrew.ContentDomain
+			}
+			auth := smtp.PlainAuth("", smtpSettings.Username, smtpSettings.Password, smtpSettings.Host)
+			from := "Notebrew mailer"
+			to := strings.ReplaceAll(strings.ReplaceAll(invitee.Email, "\r", ""), "\n", "")
+			subject := "You have been invited to " + strings.ReplaceAll(strings.ReplaceAll(siteLabel, "\r", ""), "\n", "")
+			msg := "MIME-version: 1.0\r\n" +
+				"Content-Type: text/html; charset=\"UTF-8\"\r\n" +
+				"From: " + from + "\r\n" +
+				"To: " + to + "\r\n" +
+				"Subject: " + subject + "\r\n" +
+				"\r\n" +
+				html.EscapeString(username) + ` has invited you to collaborate on ` + html.EscapeString(siteLabel) + ` as ` + html.EscapeString(request.Role) + `.<br><br>` +
+				`Accept the invitation at <a href="` + html.EscapeString(response.InviteLink) + `">` + html.EscapeString(response.InviteLink) + `</a>. It will expire in 7 days.<br><br>`
+			err = smtp.SendMail(smtpSettings.Host+":"+smtpSettings.Port, auth, from, []string{to}, []byte(msg))
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				response.MailSendingError = err.Error()
+				response.Status = ErrMailSendingFailed
+			}
+			writeResponse(w, r, response)
+		case "remove":
+			if response.User == "" {
+				response.Errors["user"] = append(response.Errors["user"], ErrRequired)
+				response.Status = ErrValidationFailed
+				writeResponse(w, r, response)
+				return
+			}
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "DELETE FROM site_user" +
+					" WHERE site_id = (SELECT site_id FROM site WHERE site_name = {siteName})" +
+					" AND user_id = (SELECT user_id FROM users WHERE username = {username})" +
+					" AND role IS NOT NULL AND role <> 'owner'",
+				Values: []any{
+					sq.StringParam("siteName", siteName),
+					sq.StringParam("username", response.User),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				// Either the user isn't a collaborator or they are the
+				// site's owner, who cannot be removed.
+				response.Errors["user"] = append(response.Errors["user"], ErrUserNotFound)
+				response.Status = ErrValidationFailed
+				writeResponse(w, r, response)
+				return
+			}
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: siteName,
+				Action:   "removecollaborator",
+				Target:   response.User,
+			})
+			response.Status = RemoveCollaboratorSuccess
+			writeResponse(w, r, response)
+		case "cancelinvite":
+			siteInviteTokenHash, err := hex.DecodeString(request.InviteID)
+			if err != nil || len(siteInviteTokenHash) == 0 {
+				response.Status = ErrInviteNotFound
+				writeResponse(w, r, response)
+				return
+			}
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "DELETE FROM site_invite" +
+					" WHERE site_invite_token_hash = {siteInviteTokenHash}" +
+					" AND site_id = (SELECT site_id FROM site WHERE site_name = {siteName})",
+				Values: []any{
+					sq.BytesParam("siteInviteTokenHash", siteInviteTokenHash),
+					sq.StringParam("siteName", siteName),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Status = ErrInviteNotFound
+				writeResponse(w, r, response)
+				return
+			}
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: siteName,
+				Action:   "cancelinvite",
+			})
+			response.Status = CancelInviteSuccess
+			writeResponse(w, r, response)
+		default:
+			response.Status = ErrInvalidValue
+			writeResponse(w, r, response)
+		}
+	default:
+		methodNotAllowed(w, r)
+	}
+}
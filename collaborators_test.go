@@ -0,0 +1,126 @@
+package nb7
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"github.com/bokwoon95/sq"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_admin_collaborators(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "liskov", "liskov@email.com", "password123")
+			createUser(t, nbrew, "dijkstra", "dijkstra@email.com", "password123")
+			liskovToken := generateAuthenticationToken(t, nbrew, "liskov")
+			dijkstraToken := generateAuthenticationToken(t, nbrew, "dijkstra")
+
+			// liskov invites dijkstra to their site as an author.
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("POST", "/admin/@liskov/collaborators/", strings.NewReader(`{"action":"invite","user":"dijkstra@email.com","role":"author"}`))
+			r.Header.Set("Authorization", "Notebrew "+liskovToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			var response struct {
+				Status     Error  `json:"status"`
+				InviteLink string `json:"inviteLink"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if response.Status != InviteCollaboratorSuccess {
+				return fmt.Errorf("[%s] %s invite: got status %q, want %q", nbrew.Dialect, testutil.Callers(), response.Status, InviteCollaboratorSuccess)
+			}
+			_, token, _ := strings.Cut(response.InviteLink, "?token=")
+
+			// Only the invitee may accept the invitation.
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("POST", "/admin/invite/", strings.NewReader(`{"token":"`+token+`"}`))
+			r.Header.Set("Authorization", "Notebrew "+liskovToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			if w.Code != http.StatusForbidden {
+				return fmt.Errorf("[%s] %s accept as inviter: got status %d, want %d", nbrew.Dialect, testutil.Callers(), w.Code, http.StatusForbidden)
+			}
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("POST", "/admin/invite/", strings.NewReader(`{"token":"`+token+`"}`))
+			r.Header.Set("Authorization", "Notebrew "+dijkstraToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if response.Status != AcceptInviteSuccess {
+				return fmt.Errorf("[%s] %s accept: got status %q, want %q", nbrew.Dialect, testutil.Callers(), response.Status, AcceptInviteSuccess)
+			}
+			role, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "SELECT {*}" +
+					" FROM site_user" +
+					" JOIN site ON site.site_id = site_user.site_id" +
+					" JOIN users ON users.user_id = site_user.user_id" +
+					" WHERE site.site_name = 'liskov' AND users.username = 'dijkstra'",
+			}, func(row *sq.Row) string {
+				return row.String("site_user.role")
+			})
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if role != RoleAuthor {
+				return fmt.Errorf("[%s] %s got role %q, want %q", nbrew.Dialect, testutil.Callers(), role, RoleAuthor)
+			}
+
+			// The invitation can only be used once.
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("POST", "/admin/invite/", strings.NewReader(`{"token":"`+token+`"}`))
+			r.Header.Set("Authorization", "Notebrew "+dijkstraToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if response.Status != ErrInviteNotFound {
+				return fmt.Errorf("[%s] %s reuse: got status %q, want %q", nbrew.Dialect, testutil.Callers(), response.Status, ErrInviteNotFound)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,1161 @@
+package nb7
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of a notebrew instance. It is read from
+// config/notebrew.json, falling back to the legacy config/*.txt and
+// config/*.json files for any key that config/notebrew.json does not set.
+//
+//	{
+//	  "adminDomain": "example.com",
+//	  "contentDomain": "example.com",
+//	  "multisite": "subdirectory",
+//	  "database": "sqlite",
+//	  "migrations": "auto",
+//	  "databasePool": {"maxOpenConns": 25, "maxIdleConns": 25, "connMaxLifetime": "1h"},
+//	  "sqlite": {"journalMode": "WAL", "synchronous": "NORMAL", "busyTimeout": "10s"},
+//	  "mailer": "smtp://user@mail.com:password@smtp.server.com:587",
+//	  "signups": true,
+//	  "captcha": {"provider": "turnstile", "siteKey": "...", "secretKey": "..."},
+//	  "dns01": {"provider": "cloudflare", "apiToken": "..."},
+//	  "sessions": {"idleTimeout": "720h", "maxAge": "8760h"},
+//	  "trash": {"retention": "720h"},
+//	  "revisions": {"maxRevisions": 50}
+//	}
+//
+// Secrets may also be supplied through environment variables (see
+// ConfigEnv), which take precedence over the config files.
+type Config struct {
+	// AdminDomain is the domain of the admin interface e.g. example.com or
+	// localhost:6444. If empty, it defaults to localhost:6444.
+	AdminDomain string `json:"adminDomain,omitempty"`
+
+	// ContentDomain is the domain that sites are served on. If empty, it
+	// defaults to AdminDomain.
+	ContentDomain string `json:"contentDomain,omitempty"`
+
+	// Multisite is how sites other than the main site are served:
+	// "subdomain", "subdirectory" or "" to disable.
+	Multisite string `json:"multisite,omitempty"`
+
+	// Database is the data source name of the database, "sqlite" for an
+	// SQLite database in the notebrew directory or file:<path> to read the
+	// data source name from a file.
+	Database string `json:"database,omitempty"`
+
+	// Migrations is how the database schema is kept up to date on startup:
+	// "auto" (the default) to automigrate it to match schema.go or
+	// "versioned" to require the numbered migrations in the migrations
+	// directory to be applied with the migrate command.
+	Migrations string `json:"migrations,omitempty"`
+
+	DatabasePool DatabasePoolConfig `json:"databasePool"`
+
+	SQLite SQLiteConfig `json:"sqlite"`
+
+	// Mailer is the SMTP URL used to send mail, or file:<path> to read the
+	// URL from a file.
+	Mailer string `json:"mailer,omitempty"`
+
+	// Signups reports whether anyone may sign up for an account.
+	Signups bool `json:"signups,omitempty"`
+
+	// ShowLatency logs how long each request took.
+	ShowLatency bool `json:"showLatency,omitempty"`
+
+	// ShowQueries logs every database query.
+	ShowQueries bool `json:"showQueries,omitempty"`
+
+	Captcha CaptchaConfig `json:"captcha"`
+
+	DNS01 DNS01Config `json:"dns01"`
+
+	Sessions SessionsConfig `json:"sessions"`
+
+	Trash TrashConfig `json:"trash"`
+
+	Revisions RevisionsConfig `json:"revisions"`
+
+	Jobs JobsConfig `json:"jobs"`
+
+	RateLimits RateLimitsConfig `json:"rateLimits"`
+
+	Proxy ProxyConfig `json:"proxy"`
+
+	// sources maps each key that was set to the file or environment
+	// variable it was read from.
+	sources map[string]string
+
+	// notebrewJSON is the path of config/notebrew.json.
+	notebrewJSON string
+}
+
+// DatabasePoolConfig tunes the database connection pool. Fields that are
+// not set keep the database/sql defaults.
+type DatabasePoolConfig struct {
+	MaxOpenConns    int    `json:"maxOpenConns,omitempty"`
+	MaxIdleConns    int    `json:"maxIdleConns,omitempty"`
+	ConnMaxLifetime string `json:"connMaxLifetime,omitempty"`
+	ConnMaxIdleTime string `json:"connMaxIdleTime,omitempty"`
+
+	// ReadyTimeout is how long to keep retrying a postgres, mysql or
+	// sqlserver database that is not accepting connections on startup
+	// (default 30s).
+	ReadyTimeout string `json:"readyTimeout,omitempty"`
+}
+
+// SQLiteConfig holds the pragmas that are set on every SQLite connection.
+// Foreign keys are always enabled.
+type SQLiteConfig struct {
+	// JournalMode defaults to "WAL".
+	JournalMode string `json:"journalMode,omitempty"`
+
+	// Synchronous defaults to "NORMAL".
+	Synchronous string `json:"synchronous,omitempty"`
+
+	// BusyTimeout is how long a connection waits for a lock held by another
+	// connection, as a duration (default 10s).
+	BusyTimeout string `json:"busyTimeout,omitempty"`
+}
+
+// CaptchaConfig configures the captcha of the login and signup pages.
+// Captchas are required only if a provider is configured.
+type CaptchaConfig struct {
+	// Provider is one of "hcaptcha", "turnstile" or "pow" (a self-hosted
+	// proof-of-work challenge). If empty, it defaults to "hcaptcha" if both
+	// keys are set.
+	Provider string `json:"provider,omitempty"`
+
+	// SiteKey and SecretKey are the credentials of hCaptcha or Turnstile.
+	// For pow, the optional SecretKey signs challenges so that they survive
+	// restarts and can be solved against any instance that shares it.
+	SiteKey   string `json:"siteKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// Difficulty is the number of leading zero bits that pow solutions must
+	// have, between 1 and 32 (0 uses the default of 16). Every additional
+	// bit doubles the work.
+	Difficulty int `json:"difficulty,omitempty"`
+}
+
+// provider returns the effective captcha provider, or an empty string if
+// captchas are not configured.
+func (config CaptchaConfig) provider() string {
+	if config.Provider != "" {
+		return config.Provider
+	}
+	if config.SiteKey != "" && config.SecretKey != "" {
+		return "hcaptcha"
+	}
+	return ""
+}
+
+// DNS01Config holds the credentials of the DNS provider used to solve ACME
+// DNS-01 challenges, which are needed for wildcard certificates.
+type DNS01Config struct {
+	// Provider is one of "namecheap", "cloudflare", "porkbun" or "godaddy".
+	Provider  string `json:"provider,omitempty"`
+	Username  string `json:"username,omitempty"`
+	APIKey    string `json:"apiKey,omitempty"`
+	APIToken  string `json:"apiToken,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+}
+
+// SessionsConfig holds the lifetimes of authentication sessions, as
+// durations e.g. "720h".
+type SessionsConfig struct {
+	IdleTimeout string `json:"idleTimeout,omitempty"`
+	MaxAge      string `json:"maxAge,omitempty"`
+}
+
+// TrashConfig holds how long deleted items are kept, as a duration e.g.
+// "720h".
+type TrashConfig struct {
+	Retention string `json:"retention,omitempty"`
+}
+
+// RevisionsConfig holds how many prior revisions are kept for each file.
+type RevisionsConfig struct {
+	MaxRevisions int `json:"maxRevisions,omitempty"`
+}
+
+// JobsConfig configures the background jobs that the server runs (see
+// StartJobs).
+type JobsConfig struct {
+	// PurgeSessions deletes expired sessions (default every 1h).
+	PurgeSessions JobConfig `json:"purgeSessions"`
+
+	// PurgeTokens deletes expired signup, invitation, password reset and
+	// API tokens and stale rate limits (default every 1h).
+	PurgeTokens JobConfig `json:"purgeTokens"`
+
+	// DecayLoginFailures halves the failed login counters (default every
+	// 1h).
+	DecayLoginFailures JobConfig `json:"decayLoginFailures"`
+
+	// PurgeTrash deletes items that have been in the trash for longer than
+	// trash.retention (default every 1h).
+	PurgeTrash JobConfig `json:"purgeTrash"`
+
+	// Optimize runs PRAGMA optimize on SQLite databases (default every
+	// 24h).
+	Optimize JobConfig `json:"optimize"`
+}
+
+// JobConfig configures a background job.
+type JobConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Interval is how often the job runs, as a duration of at least 1m.
+	Interval string `json:"interval,omitempty"`
+}
+
+// RateLimitsConfig configures the rate limits on the admin interface.
+// Requests over the limit are rejected with 429 Too Many Requests.
+type RateLimitsConfig struct {
+	// Store is where the rate limiter keeps track of requests: "memory"
+	// (the default) or "database" to share the limits between notebrew
+	// instances that use the same database.
+	Store string `json:"store,omitempty"`
+
+	// Login limits login attempts per IP address, and failed login attempts
+	// per account (default 10 per 1m each). Requests that are turned away
+	// before the password is checked, and logins that succeed, don't count
+	// against the account.
+	Login RateLimitConfig `json:"login"`
+
+	// Signup limits signups per IP address (default 5 per 1h).
+	Signup RateLimitConfig `json:"signup"`
+
+	// ResetPassword limits password reset requests per IP address, and reset
+	// emails sent per email address (default 5 per 1h each). Every email
+	// sent has a reset link that replaces the last, so the owner always has
+	// a working link even when the limit for their address is used up.
+	ResetPassword RateLimitConfig `json:"resetPassword"`
+
+	// Write limits requests that change data per user, or per IP address
+	// for requests that are not logged in (default 120 per 1m).
+	Write RateLimitConfig `json:"write"`
+}
+
+// RateLimitConfig configures a rate limit. Up to requests requests may be
+// made at once, after which they are allowed at an average rate of requests
+// per period.
+type RateLimitConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	Requests int `json:"requests,omitempty"`
+
+	// Period is a duration of at least 1s e.g. "1m".
+	Period string `json:"period,omitempty"`
+}
+
+// ProxyConfig describes the reverse proxies or load balancers in front of
+// notebrew, which are trusted to report the IP address of the client.
+type ProxyConfig struct {
+	// TrustedProxies is a comma-separated list of the IP addresses and CIDRs
+	// of trusted proxies e.g. "10.0.0.0/8, 192.168.1.10". If empty, only
+	// loopback addresses are trusted. The Forwarded, X-Forwarded-For and
+	// X-Real-IP headers are ignored on requests from any other address.
+	TrustedProxies string `json:"trustedProxies,omitempty"`
+
+	// ProxyProtocol accepts PROXY protocol (v1 and v2) headers on
+	// connections from trusted proxies.
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+}
+
+// trustedProxies returns the prefixes of the trusted proxies.
+func (config *Config) trustedProxies() []netip.Prefix {
+	if strings.TrimSpace(config.Proxy.TrustedProxies) == "" {
+		return []netip.Prefix{
+			netip.MustParsePrefix("127.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"),
+		}
+	}
+	var prefixes []netip.Prefix
+	for _, value := range strings.Split(config.Proxy.TrustedProxies, ",") {
+		prefix, err := parseTrustedProxy(value)
+		if err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// parseTrustedProxy parses an IP address or CIDR.
+func parseTrustedProxy(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ConfigEnv maps environment variables to the config keys they override.
+var ConfigEnv = []struct {
+	Name string
+	Key  string
+}{
+	{"NOTEBREW_DATABASE", "database"},
+	{"NOTEBREW_MAILER", "mailer"},
+	{"NOTEBREW_CAPTCHA_SITE_KEY", "captcha.siteKey"},
+	{"NOTEBREW_CAPTCHA_SECRET_KEY", "captcha.secretKey"},
+	{"NOTEBREW_DNS01_USERNAME", "dns01.username"},
+	{"NOTEBREW_DNS01_API_KEY", "dns01.apiKey"},
+	{"NOTEBREW_DNS01_API_TOKEN", "dns01.apiToken"},
+	{"NOTEBREW_DNS01_SECRET_KEY", "dns01.secretKey"},
+}
+
+// ConfigError is an invalid config value.
+type ConfigError struct {
+	// Source is the file or environment variable the value was read from.
+	Source string
+
+	// Key is the config key of the value e.g. dns01.apiKey. It is empty if
+	// the error is not about any one key.
+	Key string
+
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return e.Source + ": " + e.Err.Error()
+	}
+	return e.Source + ": " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ReadConfig reads the config of the notebrew instance in fsys. It does not
+// validate the config, call Validate for that.
+func ReadConfig(fsys FS) (*Config, error) {
+	return readConfig(fsys, nil)
+}
+
+// readConfig reads the config of the notebrew instance in fsys. If
+// notebrewJSON is not nil, it is used in place of the contents of
+// config/notebrew.json.
+func readConfig(fsys FS, notebrewJSON []byte) (*Config, error) {
+	config := &Config{
+		sources: make(map[string]string),
+	}
+	localDir, err := filepath.Abs(fmt.Sprint(fsys))
+	if err == nil {
+		fileInfo, err := os.Stat(localDir)
+		if err != nil || !fileInfo.IsDir() {
+			localDir = ""
+		}
+	}
+	readFile := func(name string) ([]byte, string, error) {
+		source := filepath.Join(localDir, name)
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, source, nil
+			}
+			return nil, source, &ConfigError{Source: source, Err: err}
+		}
+		return b, source, nil
+	}
+	firstLine := func(b []byte) string {
+		line, _, _ := bytes.Cut(b, []byte("\n"))
+		return string(bytes.TrimSpace(line))
+	}
+
+	// Read the legacy config files.
+	b, source, err := readFile("config/address.txt")
+	if err != nil {
+		return nil, err
+	}
+	if address := strings.TrimSpace(string(b)); address != "" {
+		lines := strings.Split(address, "\n")
+		if len(lines) > 2 {
+			return nil, &ConfigError{Source: source, Err: fmt.Errorf("contains too many lines, maximum 2 lines." +
+				" The first line is the admin domain, the second line is the content domain." +
+				" Alternatively, if only one line is provided it will be used as as both the admin domain and content domain.",
+			)}
+		}
+		config.AdminDomain = strings.TrimSpace(lines[0])
+		config.sources["adminDomain"] = source
+		if len(lines) == 2 {
+			config.ContentDomain = strings.TrimSpace(lines[1])
+			config.sources["contentDomain"] = source
+		}
+	}
+	for _, file := range []struct {
+		name  string
+		key   string
+		value *string
+	}{
+		{"config/multisite.txt", "multisite", &config.Multisite},
+		{"config/database.txt", "database", &config.Database},
+		{"config/mailer.txt", "mailer", &config.Mailer},
+	} {
+		b, source, err := readFile(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if value := strings.TrimSpace(string(b)); value != "" {
+			*file.value = value
+			config.sources[file.key] = source
+		}
+	}
+	config.Multisite = strings.ToLower(config.Multisite)
+	for _, file := range []struct {
+		name  string
+		key   string
+		value *bool
+	}{
+		{"config/signups.txt", "signups", &config.Signups},
+		{"config/show-latency.txt", "showLatency", &config.ShowLatency},
+		{"config/show-queries.txt", "showQueries", &config.ShowQueries},
+	} {
+		b, source, err := readFile(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > 0 {
+			*file.value, _ = strconv.ParseBool(firstLine(b))
+			config.sources[file.key] = source
+		}
+	}
+	for _, file := range []struct {
+		name  string
+		key   string
+		value any
+	}{
+		{"config/captcha.json", "captcha", &config.Captcha},
+		{"config/dns01.json", "dns01", &config.DNS01},
+		{"config/sessions.json", "sessions", &config.Sessions},
+		{"config/trash.json", "trash", &config.Trash},
+		{"config/revisions.json", "revisions", &config.Revisions},
+	} {
+		b, source, err := readFile(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(b)) == 0 {
+			continue
+		}
+		err = decodeConfigJSON(source, file.key, b, file.value, false)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]any
+		json.Unmarshal(b, &m)
+		for key := range m {
+			config.sources[file.key+"."+key] = source
+		}
+	}
+
+	// Read config/notebrew.json, which takes precedence over the legacy
+	// config files.
+	source = filepath.Join(localDir, "config/notebrew.json")
+	config.notebrewJSON = source
+	if notebrewJSON == nil {
+		notebrewJSON, source, err = readFile("config/notebrew.json")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(bytes.TrimSpace(notebrewJSON)) > 0 {
+		err = decodeConfigJSON(source, "", notebrewJSON, config, true)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]any
+		json.Unmarshal(notebrewJSON, &m)
+		var setSources func(prefix string, m map[string]any)
+		setSources = func(prefix string, m map[string]any) {
+			for key, value := range m {
+				if section, ok := value.(map[string]any); ok {
+					setSources(prefix+key+".", section)
+					continue
+				}
+				config.sources[prefix+key] = source
+			}
+		}
+		setSources("", m)
+	}
+
+	// Environment variables take precedence over everything else.
+	for _, env := range ConfigEnv {
+		value, ok := os.LookupEnv(env.Name)
+		if !ok {
+			continue
+		}
+		field, _ := configField(config, env.Key)
+		field.SetString(value)
+		config.sources[env.Key] = "$" + env.Name
+	}
+	return config, nil
+}
+
+// decodeConfigJSON decodes the JSON object b into v, converting decoding
+// errors into a *ConfigError that points at the offending key. prefix is
+// the key that v is found under.
+func decodeConfigJSON(source, prefix string, b []byte, v any, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		if key == "" {
+			return prefix
+		}
+		return prefix + "." + key
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line := 1 + bytes.Count(b[:syntaxErr.Offset], []byte("\n"))
+		column := int(syntaxErr.Offset) - bytes.LastIndexByte(b[:syntaxErr.Offset], '\n') - 1
+		return &ConfigError{Source: fmt.Sprintf("%s:%d:%d", source, line, column), Err: err}
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ConfigError{Source: source, Key: join(typeErr.Field), Err: fmt.Errorf("expected %s, got %s", configTypeName(typeErr.Type), typeErr.Value)}
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		key, _ := strconv.Unquote(name)
+		// The error only names the field, so look for it in the document to
+		// report its full key.
+		var m map[string]any
+		json.Unmarshal(b, &m)
+		var find func(prefix string, m map[string]any) string
+		find = func(prefix string, m map[string]any) string {
+			for name, value := range m {
+				if _, ok := configField(&Config{}, join(prefix+name)); !ok {
+					if name == key {
+						return prefix + name
+					}
+					continue
+				}
+				if section, ok := value.(map[string]any); ok {
+					if path := find(prefix+name+".", section); path != "" {
+						return path
+					}
+				}
+			}
+			return ""
+		}
+		if path := find("", m); path != "" {
+			key = path
+		}
+		return &ConfigError{Source: source, Key: join(key), Err: fmt.Errorf("unknown key")}
+	}
+	return &ConfigError{Source: source, Key: prefix, Err: err}
+}
+
+func configTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int:
+		return "a number"
+	case reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
+
+// configField returns the field of config that corresponds to key.
+func configField(config *Config, key string) (reflect.Value, bool) {
+	value := reflect.ValueOf(config).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if value.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		found := false
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if field.IsExported() && tag == name {
+				value = value.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, false
+		}
+	}
+	return value, true
+}
+
+// ConfigKeys returns every config key, in the order they are declared.
+func ConfigKeys() []string {
+	var keys []string
+	var walk func(prefix string, typ reflect.Type)
+	walk = func(prefix string, typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if field.Type.Kind() == reflect.Struct {
+				walk(prefix+tag+".", field.Type)
+				continue
+			}
+			keys = append(keys, prefix+tag)
+		}
+	}
+	walk("", reflect.TypeOf(Config{}))
+	return keys
+}
+
+// Get returns the value of a config key. If the key is a section such as
+// dns01, the whole section is returned.
+func (config *Config) Get(key string) (any, error) {
+	field, ok := configField(config, key)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", key)
+	}
+	return field.Interface(), nil
+}
+
+// Source returns the file or environment variable that a config key was
+// read from, or an empty string if the key was not set.
+func (config *Config) Source(key string) string {
+	return config.sources[key]
+}
+
+// source is like Source, but falls back to config/notebrew.json for keys
+// that were not set so that validation errors always have a file to point
+// at.
+func (config *Config) source(key string) string {
+	if source := config.sources[key]; source != "" {
+		return source
+	}
+	if source := config.sources[strings.Split(key, ".")[0]]; source != "" {
+		return source
+	}
+	return config.notebrewJSON
+}
+
+// Validate reports every invalid value in the config as a *ConfigError,
+// joined with errors.Join.
+func (config *Config) Validate() error {
+	var errs []error
+	fail := func(key string, format string, a ...any) {
+		errs = append(errs, &ConfigError{Source: config.source(key), Key: key, Err: fmt.Errorf(format, a...)})
+	}
+
+	// adminDomain and contentDomain.
+	adminDomain, contentDomain := config.adminDomain(), config.contentDomain()
+	domains := []struct {
+		key   string
+		value string
+	}{
+		{"adminDomain", adminDomain},
+	}
+	if config.ContentDomain != "" {
+		domains = append(domains, struct {
+			key   string
+			value string
+		}{"contentDomain", contentDomain})
+	}
+	for _, domain := range domains {
+		if strings.Contains(domain.value, "127.0.0.1") {
+			fail(domain.key, "%q: don't use 127.0.0.1, use localhost instead", domain.value)
+			continue
+		}
+		if domain.value == "localhost" || strings.HasPrefix(domain.value, "localhost:") {
+			if port, ok := strings.CutPrefix(domain.value, "localhost:"); ok {
+				_, err := strconv.Atoi(port)
+				if err != nil {
+					fail(domain.key, "%q: localhost port invalid, must be a number e.g. localhost:6444", domain.value)
+				}
+			}
+			continue
+		}
+		if !strings.Contains(domain.value, ".") {
+			fail(domain.key, "%q is not a valid domain (e.g. example.com): missing a top level domain (.com, .org, .net, etc)", domain.value)
+			continue
+		}
+		for _, char := range domain.value {
+			if (char >= '0' && char <= '9') || (char >= 'a' && char <= 'z') || char == '.' || char == '-' {
+				continue
+			}
+			fail(domain.key, "%q is not a valid domain: only lowercase letters, numbers, dot and hyphen are allowed e.g. example.com", domain.value)
+			break
+		}
+	}
+	localhostAdmin := adminDomain == "localhost" || strings.HasPrefix(adminDomain, "localhost:")
+	localhostContent := contentDomain == "localhost" || strings.HasPrefix(contentDomain, "localhost:")
+	if localhostAdmin && localhostContent && adminDomain != contentDomain {
+		fail("contentDomain", "%q, %q: if localhost, addresses must be the same", adminDomain, contentDomain)
+	} else if localhostAdmin != localhostContent {
+		fail("contentDomain", "%q, %q: localhost and non-localhost addresses cannot be mixed", adminDomain, contentDomain)
+	}
+
+	// multisite.
+	if config.Multisite != "" && config.Multisite != "subdomain" && config.Multisite != "subdirectory" {
+		fail("multisite", `%q is not a valid multisite value (accepted values: "", "subdomain", "subdirectory")`, config.Multisite)
+	}
+
+	// database.
+	if config.Database != "" && !strings.HasPrefix(config.Database, "file:") && databaseDialect(config.Database) == "" {
+		fail("database", "unknown or unsupported dataSourceName %q", config.Database)
+	}
+
+	// migrations.
+	if config.Migrations != "" && config.Migrations != "auto" && config.Migrations != "versioned" {
+		fail("migrations", `%q is not a valid migrations value (accepted values: "auto", "versioned")`, config.Migrations)
+	}
+
+	// mailer.
+	if config.Mailer != "" && !strings.HasPrefix(config.Mailer, "file:") {
+		const expectedFormat = "smtp://user@mail.com:password@smtp.server.com:587"
+		uri, err := url.Parse(config.Mailer)
+		if err != nil {
+			fail("mailer", "not a valid URL (expected format: %s)", expectedFormat)
+		} else if uri.Scheme != "smtp" {
+			fail("mailer", "not an SMTP URL (expected format: %s)", expectedFormat)
+		} else if uri.User == nil {
+			fail("mailer", "missing the username (expected format: %s)", expectedFormat)
+		} else if _, ok := uri.User.Password(); !ok {
+			fail("mailer", "missing the password (expected format: %s)", expectedFormat)
+		} else if uri.Port() == "" {
+			fail("mailer", "missing the port number (expected format: %s)", expectedFormat)
+		}
+	}
+
+	// captcha.
+	switch config.Captcha.Provider {
+	case "", "hcaptcha", "turnstile":
+		if config.Captcha.Provider != "" && config.Captcha.SiteKey == "" && config.Captcha.SecretKey == "" {
+			fail("captcha.siteKey", "missing (required by %s)", config.Captcha.Provider)
+			fail("captcha.secretKey", "missing (required by %s)", config.Captcha.Provider)
+		}
+		if config.Captcha.SiteKey != "" && config.Captcha.SecretKey == "" {
+			fail("captcha.secretKey", "missing (required when captcha.siteKey is set)")
+		}
+		if config.Captcha.SecretKey != "" && config.Captcha.SiteKey == "" {
+			fail("captcha.siteKey", "missing (required when captcha.secretKey is set)")
+		}
+		if config.Captcha.Difficulty != 0 {
+			fail("captcha.difficulty", "only applies to pow")
+		}
+	case "pow":
+		// 0 is the unset value and uses the default difficulty.
+		if config.Captcha.Difficulty < 0 || config.Captcha.Difficulty > 32 {
+			fail("captcha.difficulty", "%d is not between 1 and 32 (or 0 for the default of 16)", config.Captcha.Difficulty)
+		}
+	default:
+		fail("captcha.provider", `%q is not a valid captcha provider (accepted values: "hcaptcha", "turnstile", "pow")`, config.Captcha.Provider)
+	}
+
+	// dns01.
+	if config.DNS01 != (DNS01Config{}) {
+		var required []string
+		switch config.DNS01.Provider {
+		case "":
+			fail("dns01.provider", "no provider specified")
+		case "namecheap":
+			required = []string{"username", "apiKey"}
+		case "cloudflare":
+			required = []string{"apiToken"}
+		case "porkbun":
+			required = []string{"apiKey", "secretKey"}
+		case "godaddy":
+			required = []string{"apiToken"}
+		default:
+			fail("dns01.provider", "unsupported provider %q (supported providers: namecheap, cloudflare, porkbun, godaddy)", config.DNS01.Provider)
+		}
+		for _, key := range required {
+			field, _ := configField(config, "dns01."+key)
+			if field.String() == "" {
+				fail("dns01."+key, "missing (required by %s)", config.DNS01.Provider)
+			}
+		}
+	}
+
+	// databasePool.
+	if config.DatabasePool.MaxOpenConns < 0 {
+		fail("databasePool.maxOpenConns", "%d cannot be negative", config.DatabasePool.MaxOpenConns)
+	}
+	if config.DatabasePool.MaxIdleConns < 0 {
+		fail("databasePool.maxIdleConns", "%d cannot be negative", config.DatabasePool.MaxIdleConns)
+	}
+
+	// sqlite.
+	switch strings.ToUpper(config.SQLite.JournalMode) {
+	case "", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+		break
+	default:
+		fail("sqlite.journalMode", "%q is not a valid journal mode (accepted values: DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF)", config.SQLite.JournalMode)
+	}
+	switch strings.ToUpper(config.SQLite.Synchronous) {
+	case "", "OFF", "NORMAL", "FULL", "EXTRA":
+		break
+	default:
+		fail("sqlite.synchronous", "%q is not a valid synchronous value (accepted values: OFF, NORMAL, FULL, EXTRA)", config.SQLite.Synchronous)
+	}
+
+	// sessions, trash, databasePool, sqlite.
+	for _, key := range []string{
+		"sessions.idleTimeout", "sessions.maxAge", "trash.retention",
+		"databasePool.connMaxLifetime", "databasePool.connMaxIdleTime", "databasePool.readyTimeout",
+		"sqlite.busyTimeout",
+	} {
+		field, _ := configField(config, key)
+		if field.String() == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(field.String())
+		if err != nil {
+			fail(key, "%q is not a valid duration (e.g. 720h)", field.String())
+		} else if duration < 0 {
+			fail(key, "%q cannot be negative", field.String())
+		}
+	}
+
+	// proxy.
+	if strings.TrimSpace(config.Proxy.TrustedProxies) != "" {
+		for _, value := range strings.Split(config.Proxy.TrustedProxies, ",") {
+			_, err := parseTrustedProxy(value)
+			if err != nil {
+				fail("proxy.trustedProxies", "%q is not a valid IP address or CIDR (e.g. 10.0.0.0/8)", strings.TrimSpace(value))
+			}
+		}
+	}
+
+	// rateLimits.
+	if config.RateLimits.Store != "" && config.RateLimits.Store != "memory" && config.RateLimits.Store != "database" {
+		fail("rateLimits.store", `%q is not a valid store (accepted values: "memory", "database")`, config.RateLimits.Store)
+	}
+	for _, key := range ConfigKeys() {
+		if !strings.HasPrefix(key, "rateLimits.") {
+			continue
+		}
+		field, _ := configField(config, key)
+		switch {
+		case strings.HasSuffix(key, ".requests"):
+			if field.Int() < 0 {
+				fail(key, "%d cannot be negative", field.Int())
+			}
+		case strings.HasSuffix(key, ".period"):
+			if field.String() == "" {
+				continue
+			}
+			duration, err := time.ParseDuration(field.String())
+			if err != nil {
+				fail(key, "%q is not a valid duration (e.g. 1m)", field.String())
+			} else if duration < time.Second {
+				fail(key, "%q is too short, the minimum is 1s", field.String())
+			}
+		}
+	}
+
+	// jobs.
+	for _, key := range ConfigKeys() {
+		if !strings.HasPrefix(key, "jobs.") || !strings.HasSuffix(key, ".interval") {
+			continue
+		}
+		field, _ := configField(config, key)
+		if field.String() == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(field.String())
+		if err != nil {
+			fail(key, "%q is not a valid duration (e.g. 1h)", field.String())
+		} else if duration < time.Minute {
+			fail(key, "%q is too short, the minimum is 1m", field.String())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (config *Config) adminDomain() string {
+	if config.AdminDomain == "" {
+		return "localhost:6444"
+	}
+	return config.AdminDomain
+}
+
+func (config *Config) contentDomain() string {
+	if config.ContentDomain == "" {
+		return config.adminDomain()
+	}
+	return config.ContentDomain
+}
+
+// databaseDialect returns the database dialect of a data source name, or an
+// empty string if it cannot be determined.
+func databaseDialect(dsn string) string {
+	if dsn == "sqlite" || strings.HasPrefix(dsn, "sqlite:") || strings.HasPrefix(dsn, "sqlite3:") {
+		return "sqlite"
+	}
+	if strings.HasPrefix(dsn, "postgres://") {
+		return "postgres"
+	}
+	if strings.HasPrefix(dsn, "mysql://") || strings.Contains(dsn, "@tcp(") || strings.Contains(dsn, "@unix(") {
+		return "mysql"
+	}
+	if strings.HasPrefix(dsn, "sqlserver://") {
+		return "sqlserver"
+	}
+	switch filepath.Ext(dsn) {
+	case ".sqlite", ".sqlite3", ".db", ".db3":
+		return "sqlite"
+	}
+	return ""
+}
+
+// SetConfig sets config keys in config/notebrew.json, creating it if
+// necessary. Values are converted to the type of their key. The file is
+// only written if the resulting config is valid.
+func SetConfig(fsys FS, values map[string]string) error {
+	localDir, err := filepath.Abs(fmt.Sprint(fsys))
+	if err == nil {
+		fileInfo, err := os.Stat(localDir)
+		if err != nil || !fileInfo.IsDir() {
+			localDir = ""
+		}
+	}
+	source := filepath.Join(localDir, "config/notebrew.json")
+	b, err := fs.ReadFile(fsys, "config/notebrew.json")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	m := make(map[string]any)
+	if len(bytes.TrimSpace(b)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		err = decoder.Decode(&m)
+		if err != nil {
+			return decodeConfigJSON(source, "", b, &Config{}, true)
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field, ok := configField(&Config{}, key)
+		if !ok {
+			return &ConfigError{Source: source, Key: key, Err: fmt.Errorf("unknown key")}
+		}
+		var value any
+		switch field.Kind() {
+		case reflect.String:
+			value = values[key]
+		case reflect.Bool:
+			value, err = strconv.ParseBool(values[key])
+			if err != nil {
+				return &ConfigError{Source: source, Key: key, Err: fmt.Errorf("%q is not true or false", values[key])}
+			}
+		case reflect.Int:
+			value, err = strconv.Atoi(values[key])
+			if err != nil {
+				return &ConfigError{Source: source, Key: key, Err: fmt.Errorf("%q is not a number", values[key])}
+			}
+		default:
+			var sectionKeys []string
+			for _, sectionKey := range ConfigKeys() {
+				if strings.HasPrefix(sectionKey, key+".") {
+					sectionKeys = append(sectionKeys, sectionKey)
+				}
+			}
+			return &ConfigError{Source: source, Key: key, Err: fmt.Errorf("is a section, set one of its keys instead (%s)", strings.Join(sectionKeys, ", "))}
+		}
+		section := m
+		names := strings.Split(key, ".")
+		for _, name := range names[:len(names)-1] {
+			next, ok := section[name].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				section[name] = next
+			}
+			section = next
+		}
+		section[names[len(names)-1]] = value
+	}
+	b, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	config, err := readConfig(fsys, b)
+	if err != nil {
+		return err
+	}
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+	writer, err := fsys.OpenReaderFrom("config/notebrew.json", 0644)
+	if err != nil {
+		return err
+	}
+	_, err = writer.ReadFrom(bytes.NewReader(b))
+	return err
+}
+
+// Config returns the current config snapshot. It is never nil, and must not
+// be modified.
+func (nbrew *Notebrew) Config() *Config {
+	if config := nbrew.config.Load(); config != nil {
+		return config
+	}
+	return &Config{}
+}
+
+// ReloadConfig rereads the config and swaps it in for the current snapshot.
+// If the new config is invalid, the current snapshot is kept and the error
+// is returned.
+//
+// Keys that the server is set up with on startup (adminDomain,
+// contentDomain, database, migrations, databasePool, sqlite, dns01,
+// rateLimits.store, proxy.proxyProtocol and switching multisite to
+// subdomain over HTTPS, which needs a wildcard certificate) keep their
+// current value and are returned as restartKeys so that the caller can
+// report that a restart is needed for them to take effect. The domains are
+// among them because on localhost the admin domain is the address that the
+// server listens on, and otherwise the certificates for them are obtained
+// on startup.
+func (nbrew *Notebrew) ReloadConfig() (restartKeys []string, err error) {
+	config, err := ReadConfig(nbrew.FS)
+	if err != nil {
+		return nil, err
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	current := nbrew.Config()
+	keep := func(key string) {
+		restartKeys = append(restartKeys, key)
+		currentField, _ := configField(current, key)
+		field, _ := configField(config, key)
+		field.Set(currentField)
+		for k := range config.sources {
+			if k == key || strings.HasPrefix(k, key+".") {
+				delete(config.sources, k)
+			}
+		}
+		for k, source := range current.sources {
+			if k == key || strings.HasPrefix(k, key+".") {
+				config.sources[k] = source
+			}
+		}
+	}
+	if config.adminDomain() != current.adminDomain() {
+		keep("adminDomain")
+	}
+	if config.contentDomain() != current.contentDomain() {
+		keep("contentDomain")
+	}
+	if config.Database != current.Database {
+		keep("database")
+	}
+	if config.Migrations != current.Migrations {
+		keep("migrations")
+	}
+	if config.DatabasePool != current.DatabasePool {
+		keep("databasePool")
+	}
+	if config.SQLite != current.SQLite {
+		keep("sqlite")
+	}
+	if config.DNS01 != current.DNS01 {
+		keep("dns01")
+	}
+	if config.RateLimits.Store != current.RateLimits.Store {
+		keep("rateLimits.store")
+	}
+	if config.Proxy.ProxyProtocol != current.Proxy.ProxyProtocol {
+		keep("proxy.proxyProtocol")
+	}
+	if nbrew.Scheme == "https://" && config.Multisite == "subdomain" && current.Multisite != "subdomain" {
+		keep("multisite")
+	}
+	nbrew.config.Store(config)
+	return restartKeys, nil
+}
+
+// WatchConfig polls the config directory every interval and reloads the
+// config whenever a file in it changes, until ctx is canceled.
+func (nbrew *Notebrew) WatchConfig(ctx context.Context, interval time.Duration) {
+	// fingerprint identifies the state of the config directory by the name,
+	// size and modification time of its files.
+	fingerprint := func() string {
+		dirEntries, err := nbrew.FS.ReadDir("config")
+		if err != nil {
+			return ""
+		}
+		var b strings.Builder
+		for _, dirEntry := range dirEntries {
+			fileInfo, err := dirEntry.Info()
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(&b, "%s %d %d\n", dirEntry.Name(), fileInfo.Size(), fileInfo.ModTime().UnixNano())
+		}
+		return b.String()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	previous := fingerprint()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := fingerprint()
+		if current == previous {
+			continue
+		}
+		previous = current
+		restartKeys, err := nbrew.ReloadConfig()
+		if err != nil {
+			getLogger(ctx).Error("config not reloaded", slog.String("error", err.Error()))
+			continue
+		}
+		getLogger(ctx).Info("config reloaded")
+		if len(restartKeys) > 0 {
+			getLogger(ctx).Warn("restart notebrew for changes to take effect", slog.String("keys", strings.Join(restartKeys, ", ")))
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package nb7
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_ReadConfig(t *testing.T) {
+	fsys := testutil.NewFS(fstest.MapFS{
+		"config/address.txt":   &fstest.MapFile{Data: []byte("admin.example.com\nexample.com\n")},
+		"config/multisite.txt": &fstest.MapFile{Data: []byte("Subdirectory\n")},
+		"config/signups.txt":   &fstest.MapFile{Data: []byte("true\n")},
+		"config/dns01.json":    &fstest.MapFile{Data: []byte(`{"provider":"cloudflare","apiToken":"legacy"}`)},
+		"config/notebrew.json": &fstest.MapFile{Data: []byte(`{"adminDomain":"notes.example.com","sessions":{"maxAge":"24h"}}`)},
+	})
+	t.Setenv("NOTEBREW_DNS01_API_TOKEN", "secret")
+	config, err := ReadConfig(fsys)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	err = config.Validate()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	for _, tt := range []struct {
+		key    string
+		value  any
+		source string
+	}{
+		{"adminDomain", "notes.example.com", "config/notebrew.json"},
+		{"contentDomain", "example.com", "config/address.txt"},
+		{"multisite", "subdirectory", "config/multisite.txt"},
+		{"signups", true, "config/signups.txt"},
+		{"dns01.provider", "cloudflare", "config/dns01.json"},
+		{"dns01.apiToken", "secret", "$NOTEBREW_DNS01_API_TOKEN"},
+		{"sessions.maxAge", "24h", "config/notebrew.json"},
+	} {
+		value, err := config.Get(tt.key)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if value != tt.value {
+			t.Errorf("%s %s: got %v, want %v", testutil.Callers(), tt.key, value, tt.value)
+		}
+		if source := config.Source(tt.key); source != tt.source {
+			t.Errorf("%s %s: got source %q, want %q", testutil.Callers(), tt.key, source, tt.source)
+		}
+	}
+
+	// Errors point at the offending key.
+	for _, tt := range []struct {
+		notebrewJSON string
+		key          string
+	}{
+		{`{"dns01":{"provider":"cloudflare","apiSecret":"x"}}`, "dns01.apiSecret"},
+		{`{"signups":"yes"}`, "signups"},
+		{`{"trash":{"retention":"forever"}}`, "trash.retention"},
+		{`{"contentDomain":"localhost:6444"}`, "contentDomain"},
+		{`{"captcha":{"siteKey":"x"}}`, "captcha.secretKey"},
+		{`{"captcha":{"provider":"recaptcha"}}`, "captcha.provider"},
+		{`{"captcha":{"provider":"pow","difficulty":64}}`, "captcha.difficulty"},
+		{`{"captcha":{"provider":"pow","difficulty":33}}`, "captcha.difficulty"},
+		{`{"captcha":{"provider":"pow","difficulty":-1}}`, "captcha.difficulty"},
+	} {
+		config, err := readConfig(fsys, []byte(tt.notebrewJSON))
+		if err == nil {
+			err = config.Validate()
+		}
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Errorf("%s %s: got %v, want a *ConfigError", testutil.Callers(), tt.notebrewJSON, err)
+			continue
+		}
+		if configErr.Key != tt.key {
+			t.Errorf("%s %s: got key %q, want %q (%v)", testutil.Callers(), tt.notebrewJSON, configErr.Key, tt.key, err)
+		}
+	}
+
+	// A pow difficulty of 0 is the same as leaving it unset.
+	for _, notebrewJSON := range []string{
+		`{"captcha":{"provider":"pow","difficulty":0}}`,
+		`{"captcha":{"provider":"pow","difficulty":1}}`,
+		`{"captcha":{"provider":"pow","difficulty":32}}`,
+	} {
+		config, err := readConfig(fsys, []byte(notebrewJSON))
+		if err == nil {
+			err = config.Validate()
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", testutil.Callers(), notebrewJSON, err)
+		}
+	}
+
+	// SetConfig converts values to the type of their key and refuses to write
+	// an invalid config.
+	err = SetConfig(fsys, map[string]string{"revisions.maxRevisions": "10", "signups": "false"})
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	err = SetConfig(fsys, map[string]string{"multisite": "subfolder"})
+	if err == nil {
+		t.Fatalf("%s got nil error for an invalid multisite value", testutil.Callers())
+	}
+	b, err := fs.ReadFile(fsys, "config/notebrew.json")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	want := "{\n  \"adminDomain\": \"notes.example.com\",\n  \"revisions\": {\n    \"maxRevisions\": 10\n  },\n  \"sessions\": {\n    \"maxAge\": \"24h\"\n  },\n  \"signups\": false\n}\n"
+	if string(b) != want {
+		t.Errorf("%s got %s, want %s", testutil.Callers(), b, want)
+	}
+}
+
+func Test_ReloadConfig(t *testing.T) {
+	nbrew := &Notebrew{
+		FS: testutil.NewFS(fstest.MapFS{
+			"config/address.txt": &fstest.MapFile{Data: []byte("localhost:6444")},
+		}),
+		Scheme:        "http://",
+		AdminDomain:   "localhost:6444",
+		ContentDomain: "localhost:6444",
+	}
+	writeFile := func(name, content string) {
+		readerFrom, err := nbrew.FS.OpenReaderFrom(name, 0644)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		_, err = readerFrom.ReadFrom(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+	}
+	_, err := nbrew.ReloadConfig()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if nbrew.Config().Signups {
+		t.Fatalf("%s signups open before config/signups.txt was written", testutil.Callers())
+	}
+
+	writeFile("config/signups.txt", "true")
+	writeFile("config/notebrew.json", `{"adminDomain":"localhost:8080","sessions":{"idleTimeout":"1h"}}`)
+	restartKeys, err := nbrew.ReloadConfig()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if !nbrew.Config().Signups {
+		t.Errorf("%s signups not open after reload", testutil.Callers())
+	}
+	if got := nbrew.sessionIdleTimeout(); got != time.Hour {
+		t.Errorf("%s session idle timeout: got %s, want 1h", testutil.Callers(), got)
+	}
+	if strings.Join(restartKeys, ",") != "adminDomain" {
+		t.Errorf("%s restart keys: got %q, want [adminDomain]", testutil.Callers(), restartKeys)
+	}
+	if got := nbrew.Config().AdminDomain; got != "localhost:6444" {
+		t.Errorf("%s adminDomain: got %q, want the value the server was started with", testutil.Callers(), got)
+	}
+
+	// An invalid config keeps the current snapshot.
+	writeFile("config/notebrew.json", `{"signups":"no"}`)
+	_, err = nbrew.ReloadConfig()
+	if err == nil {
+		t.Fatalf("%s got nil error for an invalid config", testutil.Callers())
+	}
+	if !nbrew.Config().Signups || nbrew.sessionIdleTimeout() != time.Hour {
+		t.Errorf("%s snapshot changed by an invalid config", testutil.Callers())
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"path"
 	"slices"
+	"strings"
 	"time"
 )
 
@@ -65,7 +66,7 @@ func (nbrew *Notebrew) createcategory(w http.ResponseWriter, r *http.Request, us
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -224,6 +225,12 @@ func (nbrew *Notebrew) createcategory(w http.ResponseWriter, r *http.Request, us
 			internalServerError(w, r, err)
 			return
 		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:    username,
+			SiteName: strings.TrimPrefix(sitePrefix, "@"),
+			Action:   "createcategory",
+			FilePath: path.Join(resource, response.Category),
+		})
 		response.Status = CreateCategorySuccess
 		writeResponse(w, r, response)
 	default:
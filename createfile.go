@@ -83,7 +83,7 @@ func (nbrew *Notebrew) createfile(w http.ResponseWriter, r *http.Request, userna
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -227,6 +227,10 @@ func (nbrew *Notebrew) createfile(w http.ResponseWriter, r *http.Request, userna
 			writeResponse(w, r, response)
 			return
 		}
+		if !canWriteTo(r, sitePrefix, response.ParentFolder) {
+			notAuthorized(w, r)
+			return
+		}
 
 		fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, response.ParentFolder, response.Name+"."+response.Ext))
 		if err != nil && !errors.Is(err, fs.ErrNotExist) {
@@ -253,6 +257,16 @@ func (nbrew *Notebrew) createfile(w http.ResponseWriter, r *http.Request, userna
 			internalServerError(w, r, err)
 			return
 		}
+		if nbrew.DB != nil {
+			filePath := path.Join(response.ParentFolder, response.Name+"."+response.Ext)
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   "createfile",
+				FilePath: filePath,
+				After:    NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, filePath)),
+			})
+		}
 		response.Status = CreateFileSuccess
 		writeResponse(w, r, response)
 	default:
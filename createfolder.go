@@ -92,7 +92,7 @@ func (nbrew *Notebrew) createfolder(w http.ResponseWriter, r *http.Request, user
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -227,6 +227,10 @@ func (nbrew *Notebrew) createfolder(w http.ResponseWriter, r *http.Request, user
 			writeResponse(w, r, response)
 			return
 		}
+		if !canWriteTo(r, sitePrefix, response.ParentFolder) {
+			notAuthorized(w, r)
+			return
+		}
 
 		head, tail, _ := strings.Cut(response.ParentFolder, "/")
 		if head == "pages" {
@@ -263,6 +267,12 @@ func (nbrew *Notebrew) createfolder(w http.ResponseWriter, r *http.Request, user
 			internalServerError(w, r, err)
 			return
 		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:    username,
+			SiteName: strings.TrimPrefix(sitePrefix, "@"),
+			Action:   "createfolder",
+			FilePath: path.Join(response.ParentFolder, response.Name),
+		})
 		response.Status = CreateFolderSuccess
 		writeResponse(w, r, response)
 	default:
@@ -83,7 +83,7 @@ func (nbrew *Notebrew) createnote(w http.ResponseWriter, r *http.Request, userna
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -242,6 +242,16 @@ func (nbrew *Notebrew) createnote(w http.ResponseWriter, r *http.Request, userna
 			internalServerError(w, r, err)
 			return
 		}
+		if nbrew.DB != nil {
+			filePath := path.Join("notes", response.Category, response.Name+".md")
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   "createnote",
+				FilePath: filePath,
+				After:    NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, filePath)),
+			})
+		}
 		response.Status = CreateNoteSuccess
 		writeResponse(w, r, response)
 	default:
@@ -81,7 +81,7 @@ func (nbrew *Notebrew) createpage(w http.ResponseWriter, r *http.Request, userna
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -246,6 +246,16 @@ func (nbrew *Notebrew) createpage(w http.ResponseWriter, r *http.Request, userna
 			internalServerError(w, r, err)
 			return
 		}
+		if nbrew.DB != nil {
+			filePath := path.Join(response.ParentFolder, response.Name+".html")
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   "createpage",
+				FilePath: filePath,
+				After:    NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, filePath)),
+			})
+		}
 
 		err = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(3 * time.Minute))
 		if err != nil {
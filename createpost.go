@@ -83,7 +83,7 @@ func (nbrew *Notebrew) createpost(w http.ResponseWriter, r *http.Request, userna
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -240,6 +240,16 @@ func (nbrew *Notebrew) createpost(w http.ResponseWriter, r *http.Request, userna
 			internalServerError(w, r, err)
 			return
 		}
+		if nbrew.DB != nil {
+			filePath := path.Join("posts", response.Category, response.Name+".md")
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   "createpost",
+				FilePath: filePath,
+				After:    NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, filePath)),
+			})
+		}
 
 		err = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(3 * time.Minute))
 		if err != nil {
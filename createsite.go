@@ -35,6 +35,7 @@ func (nbrew *Notebrew) createsite(w http.ResponseWriter, r *http.Request, userna
 				" JOIN site_user ON site_user.site_id = site.site_id" +
 				" JOIN users ON users.user_id = site_user.user_id" +
 				" WHERE users.username = {username}" +
+				" AND COALESCE(site_user.role, 'owner') = 'owner'" +
 				" AND site.site_name <> ''" +
 				" AND NOT EXISTS (" +
 				"SELECT 1 FROM users WHERE username = site.site_name" +
@@ -86,7 +87,7 @@ func (nbrew *Notebrew) createsite(w http.ResponseWriter, r *http.Request, userna
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -320,8 +321,8 @@ func (nbrew *Notebrew) createsite(w http.ResponseWriter, r *http.Request, userna
 			}
 			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
 				Dialect: nbrew.Dialect,
-				Format: "INSERT INTO site_user (site_id, user_id)" +
-					" VALUES ((SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username}))",
+				Format: "INSERT INTO site_user (site_id, user_id, role)" +
+					" VALUES ((SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username}), 'owner')",
 				Values: []any{
 					sq.StringParam("siteName", request.SiteName),
 					sq.StringParam("username", username),
@@ -339,6 +340,11 @@ func (nbrew *Notebrew) createsite(w http.ResponseWriter, r *http.Request, userna
 				return
 			}
 		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:    username,
+			SiteName: request.SiteName,
+			Action:   "createsite",
+		})
 		response.Status = CreateSiteSuccess
 		writeResponse(w, r, response)
 	default:
@@ -0,0 +1,139 @@
+package nb7
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqliteDB reopens an SQLite database so that busy_timeout, foreign_keys,
+// journal_mode and synchronous are set on every new connection. Pragmas are
+// per-connection state, so setting them once on a pooled *sql.DB only
+// affects whichever connection happened to run them.
+func sqliteDB(db *sql.DB, dsn string, config SQLiteConfig) (*sql.DB, error) {
+	var connector driver.Connector
+	if driverCtx, ok := db.Driver().(driver.DriverContext); ok {
+		var err error
+		connector, err = driverCtx.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		connector = dsnConnector{dsn: dsn, driver: db.Driver()}
+	}
+	busyTimeout := 10 * time.Second
+	if config.BusyTimeout != "" {
+		// The duration has already been validated by Config.Validate.
+		busyTimeout, _ = time.ParseDuration(config.BusyTimeout)
+	}
+	journalMode := "WAL"
+	if config.JournalMode != "" {
+		journalMode = strings.ToUpper(config.JournalMode)
+	}
+	synchronous := "NORMAL"
+	if config.Synchronous != "" {
+		synchronous = strings.ToUpper(config.Synchronous)
+	}
+	db.Close()
+	return sql.OpenDB(&sqliteConnector{
+		Connector: connector,
+		// busy_timeout goes first so that the other pragmas wait for locks.
+		pragmas: []string{
+			"PRAGMA busy_timeout = " + strconv.FormatInt(busyTimeout.Milliseconds(), 10),
+			"PRAGMA foreign_keys = ON",
+			"PRAGMA journal_mode = " + journalMode,
+			"PRAGMA synchronous = " + synchronous,
+		},
+	}), nil
+}
+
+// sqliteConnector runs pragmas on every connection it opens.
+type sqliteConnector struct {
+	driver.Connector
+	pragmas []string
+}
+
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%T does not implement driver.ExecerContext", conn)
+	}
+	for _, pragma := range c.pragmas {
+		_, err = execer.ExecContext(ctx, pragma, nil)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	return conn, nil
+}
+
+// dsnConnector is a driver.Connector for drivers that do not implement
+// driver.DriverContext.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// setPoolConfig applies the connection pool settings that are set in
+// config.
+func setPoolConfig(db *sql.DB, config DatabasePoolConfig) {
+	// The durations have already been validated by Config.Validate.
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime != "" {
+		connMaxLifetime, _ := time.ParseDuration(config.ConnMaxLifetime)
+		db.SetConnMaxLifetime(connMaxLifetime)
+	}
+	if config.ConnMaxIdleTime != "" {
+		connMaxIdleTime, _ := time.ParseDuration(config.ConnMaxIdleTime)
+		db.SetConnMaxIdleTime(connMaxIdleTime)
+	}
+}
+
+// waitForDB pings the database until it accepts connections, backing off
+// between attempts, and gives up once timeout has elapsed. Database servers
+// that are started alongside notebrew (e.g. in docker compose) often take a
+// few seconds before they are ready.
+func waitForDB(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := 500 * time.Millisecond
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("database not ready after %s: %w", timeout, err)
+		}
+		log.Printf("database not ready, retrying in %s: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 5*time.Second)
+	}
+}
@@ -0,0 +1,49 @@
+package nb7
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_sqliteDB(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "notebrew.db")
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	db, err = sqliteDB(db, dsn, SQLiteConfig{Synchronous: "full", BusyTimeout: "3s"})
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	defer db.Close()
+	// Hold on to one connection so that the next query has to open another.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	defer conn.Close()
+	for _, db := range []interface {
+		QueryRowContext(context.Context, string, ...any) *sql.Row
+	}{conn, db} {
+		for pragma, want := range map[string]string{
+			"busy_timeout": "3000",
+			"foreign_keys": "1",
+			"journal_mode": "wal",
+			"synchronous":  "2",
+		} {
+			var got string
+			err = db.QueryRowContext(ctx, "PRAGMA "+pragma).Scan(&got)
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			if got != want {
+				t.Errorf("%s %s: got %s, want %s", testutil.Callers(), pragma, got, want)
+			}
+		}
+	}
+}
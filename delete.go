@@ -111,7 +111,7 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -253,6 +253,10 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 			writeResponse(w, r, response)
 			return
 		}
+		if !canWriteTo(r, sitePrefix, response.ParentFolder) {
+			notAuthorized(w, r)
+			return
+		}
 		seen := make(map[string]bool)
 		for _, name := range request.Names {
 			name = filepath.ToSlash(name)
@@ -280,11 +284,26 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 					getLogger(r.Context()).Error(err.Error())
 				}
 			}
-			err := RemoveAll(nbrew.FS, path.Join(sitePrefix, response.ParentFolder, name))
+			var before *AuditSnapshot
+			if nbrew.DB != nil {
+				before = NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, response.ParentFolder, name))
+			}
+			// Items are moved to the site's trash rather than removed
+			// outright so that accidental deletions can be undone.
+			_, err := nbrew.MoveToTrash(sitePrefix, path.Join(response.ParentFolder, name), username)
 			if err != nil {
 				response.Errors = append(response.Errors, Error(fmt.Sprintf("%s: %v", name, err)))
 			} else {
 				response.Items = append(response.Items, Item{Name: name})
+				if nbrew.DB != nil && before != nil {
+					nbrew.auditLog(r, AuditEntry{
+						Actor:    username,
+						SiteName: strings.TrimPrefix(sitePrefix, "@"),
+						Action:   "delete",
+						FilePath: path.Join(response.ParentFolder, name),
+						Before:   before,
+					})
+				}
 			}
 		}
 		var b strings.Builder
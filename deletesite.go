@@ -64,7 +64,7 @@ func (nbrew *Notebrew) deletesite(w http.ResponseWriter, r *http.Request, userna
 				sq.StringParam("username", username),
 			},
 		}, func(row *sq.Row) bool {
-			return row.Bool("users.user_id IS NOT NULL")
+			return row.Bool("CASE WHEN users.user_id IS NOT NULL AND COALESCE(site_user.role, 'owner') = 'owner' THEN 1 ELSE 0 END")
 		})
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
@@ -113,7 +113,7 @@ func (nbrew *Notebrew) deletesite(w http.ResponseWriter, r *http.Request, userna
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -288,7 +288,9 @@ func (nbrew *Notebrew) deletesite(w http.ResponseWriter, r *http.Request, userna
 		} else if response.SiteName != "" {
 			sitePrefix = "@" + response.SiteName
 		}
-		err = RemoveAll(nbrew.FS, sitePrefix)
+		// The site folder is moved into the main site's trash so that its
+		// owners can still restore it until the trash is purged.
+		_, err = nbrew.MoveSiteToTrash(r.Context(), sitePrefix, username)
 		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			getLogger(r.Context()).Error(err.Error())
 			internalServerError(w, r, err)
@@ -319,6 +321,18 @@ func (nbrew *Notebrew) deletesite(w http.ResponseWriter, r *http.Request, userna
 				internalServerError(w, r, err)
 				return
 			}
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM site_invite WHERE site_id = (SELECT site_id FROM site WHERE site_name = {siteName})",
+				Values: []any{
+					sq.StringParam("siteName", request.SiteName),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
 			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
 				Dialect: nbrew.Dialect,
 				Format:  "DELETE FROM site WHERE site_name = {siteName}",
@@ -338,6 +352,11 @@ func (nbrew *Notebrew) deletesite(w http.ResponseWriter, r *http.Request, userna
 				return
 			}
 		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:    username,
+			SiteName: request.SiteName,
+			Action:   "deletesite",
+		})
 		response.Status = DeleteSiteSuccess
 		writeResponse(w, r, response)
 	default:
@@ -11,7 +11,9 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Error string
@@ -34,6 +36,20 @@ const (
 	CreateFolderSuccess         = Error("NB-00130 created folder successfully")
 	CreatePageSuccess           = Error("NB-00140 created page successfully")
 	CreateFileSuccess           = Error("NB-00150 created file successfully")
+	RevokeSessionSuccess        = Error("NB-00160 revoked session successfully")
+	RevokeAllSessionsSuccess    = Error("NB-00170 revoked all other sessions successfully")
+	EnableTwoFactorSuccess      = Error("NB-00180 enabled two-factor authentication successfully")
+	DisableTwoFactorSuccess     = Error("NB-00190 disabled two-factor authentication successfully")
+	CreateAPITokenSuccess       = Error("NB-00200 created API token successfully")
+	RevokeAPITokenSuccess       = Error("NB-00210 revoked API token successfully")
+	InviteCollaboratorSuccess   = Error("NB-00220 invited collaborator successfully")
+	RemoveCollaboratorSuccess   = Error("NB-00230 removed collaborator successfully")
+	CancelInviteSuccess         = Error("NB-00240 cancelled invitation successfully")
+	AcceptInviteSuccess         = Error("NB-00250 accepted invitation successfully")
+	RestoreSuccess              = Error("NB-00260 restore success")
+	PurgeSuccess                = Error("NB-00270 purge success")
+	RestoreRevisionSuccess      = Error("NB-00280 restored revision successfully")
+	ModerateWebmentionsSuccess  = Error("NB-00290 moderated webmentions successfully")
 
 	// Class 03 - General
 	ErrAlreadyAuthenticated      = Error("NB-03000 already authenticated")
@@ -56,6 +72,13 @@ const (
 	ErrInvalidType               = Error("NB-03180 invalid type")
 	ErrItemAlreadyExists         = Error("NB-03190 item already exists")
 	ErrTemplateError             = Error("NB-03200 template error")
+	ErrTwoFactorRequired         = Error("NB-03210 two-factor authentication required")
+	ErrIncorrectTwoFactorCode    = Error("NB-03220 incorrect two-factor code")
+	ErrTwoFactorAlreadyEnabled   = Error("NB-03230 two-factor authentication already enabled")
+	ErrTwoFactorNotEnabled       = Error("NB-03240 two-factor authentication not enabled")
+	ErrRestoreFailed             = Error("NB-03250 restore failed")
+	ErrPurgeFailed               = Error("NB-03260 purge failed")
+	ErrConflict                  = Error("NB-03270 file was modified by someone else since it was loaded")
 
 	// Class 04 - Validation
 	ErrValidationFailed    = Error("NB-04000 validation failed")
@@ -74,6 +97,14 @@ const (
 	ErrInvalidSiteName     = Error("NB-04120 invalid site name")
 	ErrSiteIsUser          = Error("NB-04130 site is a user")
 	ErrSiteNotFound        = Error("NB-04140 site not found")
+	ErrSessionNotFound     = Error("NB-04150 session not found")
+	ErrAPITokenNotFound    = Error("NB-04160 API token not found")
+	ErrInvalidScope        = Error("NB-04170 invalid scope")
+	ErrAlreadyCollaborator = Error("NB-04180 user is already a collaborator")
+	ErrInviteNotFound      = Error("NB-04190 invitation not found")
+	ErrTrashItemNotFound   = Error("NB-04200 trash item not found")
+	ErrRevisionNotFound    = Error("NB-04210 revision not found")
+	ErrWebmentionNotFound  = Error("NB-04220 webmention not found")
 
 	// Class 05 - idgaf about categorization anymore
 	ErrFieldRequired        = Error("NB-05000 field required")
@@ -88,6 +119,7 @@ const (
 	ErrNotFound             = Error("NB-99404 not found")
 	ErrMethodNotAllowed     = Error("NB-99405 method not allowed")
 	ErrUnsupportedMediaType = Error("NB-99415 unsupported media type")
+	ErrTooManyRequests      = Error("NB-99429 too many requests")
 	ErrServerError          = Error("NB-99500 server error")
 )
 
@@ -193,7 +225,7 @@ func badRequest(w http.ResponseWriter, r *http.Request, serverErr error) {
 		http.Error(w, string(ErrBadRequest)+": "+msg, http.StatusBadRequest)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	w.WriteHeader(http.StatusBadRequest)
 	buf.WriteTo(w)
 }
@@ -234,7 +266,7 @@ func notAuthenticated(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, string(ErrNotAuthenticated), http.StatusUnauthorized)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	w.WriteHeader(http.StatusUnauthorized)
 	buf.WriteTo(w)
 }
@@ -268,7 +300,7 @@ func notAuthorized(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, string(ErrNotAuthorized), http.StatusForbidden)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	w.WriteHeader(http.StatusForbidden)
 	buf.WriteTo(w)
 }
@@ -302,7 +334,7 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, string(ErrNotFound), http.StatusNotFound)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	w.WriteHeader(http.StatusNotFound)
 	buf.WriteTo(w)
 }
@@ -335,7 +367,7 @@ func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, string(ErrNotFound), http.StatusMethodNotAllowed)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	w.WriteHeader(http.StatusMethodNotAllowed)
 	buf.WriteTo(w)
 }
@@ -375,11 +407,53 @@ func unsupportedContentType(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ErrUnsupportedMediaType.Code()+" "+msg, http.StatusUnsupportedMediaType)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	w.WriteHeader(http.StatusUnsupportedMediaType)
 	buf.WriteTo(w)
 }
 
+// tooManyRequests responds with 429 Too Many Requests, telling the client
+// to retry after retryAfter (rounded up to the nearest second).
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	if accept == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(map[string]any{
+			"status":     ErrTooManyRequests,
+			"retryAfter": seconds,
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		return
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err := errorTemplate.Execute(buf, map[string]any{
+		"Referer":  r.Referer(),
+		"Title":    "429 too many requests",
+		"Headline": "429 too many requests",
+		"Byline":   fmt.Sprintf("You are making too many requests, please try again in %s.", time.Duration(seconds)*time.Second),
+	})
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+		http.Error(w, string(ErrTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	contentSecurityPolicy(w, "", nil)
+	w.WriteHeader(http.StatusTooManyRequests)
+	buf.WriteTo(w)
+}
+
 func internalServerError(w http.ResponseWriter, r *http.Request, serverErr error) {
 	accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
 	if accept == "application/json" {
@@ -420,7 +494,7 @@ func internalServerError(w http.ResponseWriter, r *http.Request, serverErr error
 		http.Error(w, string(ErrServerError), http.StatusInternalServerError)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	w.WriteHeader(http.StatusInternalServerError)
 	buf.WriteTo(w)
 }
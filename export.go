@@ -0,0 +1,156 @@
+package nb7
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ExportOptions configures ExportSite.
+type ExportOptions struct {
+	// Format is the archive format, either "tar.gz" or "zip".
+	Format string
+
+	// BaseURL replaces the site URL in the exported files, so that the
+	// archive can be deployed to a different host. If empty, links to the
+	// site become root-relative (e.g. /posts/hello-world/).
+	BaseURL string
+}
+
+// exportRewriteExts are the extensions of files whose contents may contain
+// the site URL and are rewritten on export.
+var exportRewriteExts = map[string]bool{
+	".html": true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".xml":  true,
+	".txt":  true,
+}
+
+// ExportSite regenerates a site and writes its output folder to w as an
+// archive, rewriting absolute links to the site to use opts.BaseURL instead.
+func (nbrew *Notebrew) ExportSite(ctx context.Context, w io.Writer, sitePrefix string, opts ExportOptions) error {
+	var addFile func(name string, fileInfo fs.FileInfo, b []byte) error
+	var closeArchive func() error
+	switch opts.Format {
+	case "tar.gz":
+		gzipWriter := gzip.NewWriter(w)
+		tarWriter := tar.NewWriter(gzipWriter)
+		addFile = func(name string, fileInfo fs.FileInfo, b []byte) error {
+			err := tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Size:     int64(len(b)),
+				Mode:     0644,
+				ModTime:  fileInfo.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = tarWriter.Write(b)
+			return err
+		}
+		closeArchive = func() error {
+			err := tarWriter.Close()
+			if err != nil {
+				return err
+			}
+			return gzipWriter.Close()
+		}
+	case "zip":
+		zipWriter := zip.NewWriter(w)
+		addFile = func(name string, fileInfo fs.FileInfo, b []byte) error {
+			writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     name,
+				Method:   zip.Deflate,
+				Modified: fileInfo.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = writer.Write(b)
+			return err
+		}
+		closeArchive = zipWriter.Close
+	default:
+		return fmt.Errorf("unsupported format %q (must be tar.gz or zip)", opts.Format)
+	}
+
+	err := nbrew.RegenerateSite(ctx, sitePrefix)
+	if err != nil {
+		return err
+	}
+	siteURL := strings.TrimSuffix(contentSiteURL(nbrew, sitePrefix), "/")
+	baseURL := strings.TrimSuffix(opts.BaseURL, "/")
+	outputDir := path.Join(sitePrefix, "output")
+	err = fs.WalkDir(nbrew.FS, outputDir, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if dirEntry.IsDir() {
+			return nil
+		}
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		b, err := fs.ReadFile(nbrew.FS, filePath)
+		if err != nil {
+			return err
+		}
+		if siteURL != "" && siteURL != baseURL && exportRewriteExts[path.Ext(filePath)] {
+			b = []byte(rewriteSiteURL(string(b), siteURL, baseURL))
+		}
+		return addFile(strings.TrimPrefix(filePath, outputDir+"/"), fileInfo, b)
+	})
+	if err != nil {
+		return err
+	}
+	return closeArchive()
+}
+
+// rewriteSiteURL replaces the links to siteURL in s with links to baseURL.
+// siteURL is only replaced where the link ends after it (it is followed by a
+// slash, a quote, '?', '#', '<', whitespace or the end of s), so that the
+// https://example.com in https://example.com.au is left alone.
+func rewriteSiteURL(s, siteURL, baseURL string) string {
+	// A bare site URL (without a trailing slash) is the site's root, which
+	// must not become an empty link if the base URL is empty.
+	root := baseURL
+	if root == "" {
+		root = "/"
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for {
+		i := strings.Index(s, siteURL)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		s = s[i+len(siteURL):]
+		if s == "" {
+			b.WriteString(root)
+			continue
+		}
+		switch s[0] {
+		case '/':
+			b.WriteString(baseURL)
+		case '"', '\'', '?', '#', '<', ' ', '\t', '\n', '\r':
+			b.WriteString(root)
+		default:
+			b.WriteString(siteURL)
+		}
+	}
+}
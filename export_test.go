@@ -0,0 +1,89 @@
+package nb7
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_ExportSite(t *testing.T) {
+	nbrew := newTestSite("", fstest.MapFS{
+		"system/search.txt":    &fstest.MapFile{Data: []byte("true")},
+		"posts/hello-world.md": &fstest.MapFile{Data: []byte("# Hello World\n\nThis is my first post.\n")},
+		"pages/index.html":     &fstest.MapFile{Data: []byte(`<a href="{{ siteURL }}">home</a><a href="{{ siteURL }}/posts/">posts</a>`)},
+	})
+	var buf bytes.Buffer
+	err := nbrew.ExportSite(context.Background(), &buf, "", ExportOptions{Format: "zip", BaseURL: "https://blog.example.org/"})
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	b, err := fs.ReadFile(zipReader, "index.html")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	want := `<a href="https://blog.example.org">home</a><a href="https://blog.example.org/posts/">posts</a>`
+	if string(b) != want {
+		t.Errorf("%s index.html: got %q, want %q", testutil.Callers(), string(b), want)
+	}
+	b, err = fs.ReadFile(zipReader, "search-index.json")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if !bytes.Contains(b, []byte(`"https://blog.example.org/posts/hello-world/"`)) || bytes.Contains(b, []byte("https://example.com")) {
+		t.Errorf("%s search-index.json was not rewritten: %s", testutil.Callers(), string(b))
+	}
+}
+
+func Test_rewriteSiteURL(t *testing.T) {
+	type TestTable struct {
+		description string
+		baseURL     string
+		input       string
+		want        string
+	}
+	tests := []TestTable{{
+		description: "paths",
+		baseURL:     "https://blog.example.org",
+		input:       `<a href="https://example.com/posts/">posts</a>`,
+		want:        `<a href="https://blog.example.org/posts/">posts</a>`,
+	}, {
+		description: "root",
+		baseURL:     "https://blog.example.org",
+		input:       `<a href="https://example.com">home</a><a href='https://example.com?q=go'>search</a><a href="https://example.com#top">top</a>`,
+		want:        `<a href="https://blog.example.org">home</a><a href='https://blog.example.org?q=go'>search</a><a href="https://blog.example.org#top">top</a>`,
+	}, {
+		description: "root relative",
+		baseURL:     "",
+		input:       `<link>https://example.com</link><a href="https://example.com/about/">about</a>`,
+		want:        `<link>/</link><a href="/about/">about</a>`,
+	}, {
+		description: "end of text",
+		baseURL:     "https://blog.example.org",
+		input:       "Visit https://example.com today or https://example.com",
+		want:        "Visit https://blog.example.org today or https://blog.example.org",
+	}, {
+		description: "longer host",
+		baseURL:     "https://blog.example.org",
+		input:       `<a href="https://example.com.au/">aussie</a><a href="https://example.community">community</a>`,
+		want:        `<a href="https://example.com.au/">aussie</a><a href="https://example.community">community</a>`,
+	}}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			t.Parallel()
+			got := rewriteSiteURL(tt.input, "https://example.com", tt.baseURL)
+			if diff := testutil.Diff(got, tt.want); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"mime"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -46,6 +47,10 @@ var extensionTypes = map[string]string{
 func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, sitePrefix, filePath string, fileInfo fs.FileInfo) {
 	type Request struct {
 		Content string `json:"content"`
+		// ModTime is the modification time of the file when it was
+		// loaded. It may be omitted if an If-Match header is sent
+		// instead.
+		ModTime string `json:"modTime,omitempty"`
 	}
 	type Response struct {
 		Status         Error              `json:"status"`
@@ -55,6 +60,7 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 		ModTime        *time.Time         `json:"modTime,omitempty"`
 		Type           string             `json:"type,omitempty"`
 		Content        string             `json:"content,omitempty"`
+		CurrentContent string             `json:"currentContent,omitempty"`
 		Location       string             `json:"location,omitempty"`
 		Errors         map[string][]Error `json:"errors,omitempty"`
 		StorageUsed    int64              `json:"storageUsed,omitempty"`
@@ -72,6 +78,9 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
 			if accept == "application/json" {
 				w.Header().Set("Content-Type", "application/json")
+				if response.ModTime != nil {
+					w.Header().Set("ETag", fileETag(*response.ModTime))
+				}
 				encoder := json.NewEncoder(w)
 				encoder.SetEscapeHTML(false)
 				err := encoder.Encode(&response)
@@ -108,6 +117,7 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 				"sitePrefix":       func() string { return sitePrefix },
 				"title":            func() string { return title },
 				"safeHTML":         func(s string) template.HTML { return template.HTML(s) },
+				"diffLines":        diffLines,
 				"head": func(s string) string {
 					head, _, _ := strings.Cut(s, "/")
 					return head
@@ -139,7 +149,7 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, fileInfo.ModTime(), tmpl, &response)
 		}
 		err := r.ParseForm()
@@ -172,6 +182,15 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 			response.ModTime = &modTime
 		}
 		if response.Status != "" {
+			if response.Status == ErrConflict {
+				b, err := fs.ReadFile(nbrew.FS, path.Join(sitePrefix, filePath))
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				response.CurrentContent = string(b)
+			}
 			writeResponse(w, r, response)
 			return
 		}
@@ -205,6 +224,12 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
 			if accept == "application/json" {
 				w.Header().Set("Content-Type", "application/json")
+				if response.ModTime != nil {
+					w.Header().Set("ETag", fileETag(*response.ModTime))
+				}
+				if response.Status == ErrConflict {
+					w.WriteHeader(http.StatusConflict)
+				}
 				encoder := json.NewEncoder(w)
 				encoder.SetEscapeHTML(false)
 				err := encoder.Encode(&response)
@@ -226,7 +251,9 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
 		switch contentType {
 		case "application/json":
-			if typ != "text" {
+			// typ is a MIME type from extensionTypes such as "text/markdown",
+			// so only the text types can be saved.
+			if !strings.HasPrefix(typ, "text") {
 				unsupportedContentType(w, r)
 				return
 			}
@@ -243,7 +270,7 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 					return
 				}
 			} else {
-				if typ != "text" {
+				if !strings.HasPrefix(typ, "text") {
 					unsupportedContentType(w, r)
 					return
 				}
@@ -254,6 +281,7 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 				}
 			}
 			request.Content = r.Form.Get("content")
+			request.ModTime = r.Form.Get("modTime")
 		default:
 			unsupportedContentType(w, r)
 			return
@@ -271,6 +299,49 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 			response.ModTime = &modTime
 		}
 
+		// Reject the save if the file was modified after the client loaded
+		// it, otherwise the later of two concurrent edits would silently
+		// overwrite the earlier one. The current contents are returned so
+		// that the client can merge the changes.
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			if !etagMatches(ifMatch, fileETag(modTime)) {
+				response.Status = ErrConflict
+			}
+		} else if request.ModTime != "" {
+			loadedModTime, err := time.Parse(time.RFC3339Nano, request.ModTime)
+			if err != nil {
+				response.Errors["modTime"] = append(response.Errors["modTime"], ErrInvalidValue)
+				response.Status = ErrValidationFailed
+				writeResponse(w, r, response)
+				return
+			}
+			if !loadedModTime.Equal(modTime) {
+				response.Status = ErrConflict
+			}
+		} else {
+			response.Errors["modTime"] = append(response.Errors["modTime"], ErrRequired)
+			response.Status = ErrValidationFailed
+			writeResponse(w, r, response)
+			return
+		}
+		if response.Status == ErrConflict {
+			// The HTML page reloads the current contents when it renders the
+			// conflict rather than have them stored in the session alongside
+			// the rejected contents.
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				b, err := fs.ReadFile(nbrew.FS, path.Join(sitePrefix, filePath))
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				response.CurrentContent = string(b)
+			}
+			writeResponse(w, r, response)
+			return
+		}
+
 		if nbrew.DB != nil {
 			result, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
 				Dialect: nbrew.Dialect,
@@ -291,6 +362,8 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 				internalServerError(w, r, err)
 				return
 			}
+			// The previous contents are kept as a revision, so saving
+			// takes up as much space as the new contents.
 			if result.StorageLimit.Valid && result.StorageUsed+int64(len(request.Content)) > result.StorageLimit.Int64 {
 				response.StorageUsed = result.StorageUsed
 				response.StorageLimit = result.StorageLimit.Int64
@@ -320,6 +393,16 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 			}()
 		}
 
+		var before *AuditSnapshot
+		if nbrew.DB != nil {
+			before = NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, filePath))
+		}
+		err := nbrew.saveRevision(sitePrefix, filePath, username, request.Content)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
 		readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, filePath), 0644)
 		if err != nil {
 			getLogger(r.Context()).Error(err.Error())
@@ -332,6 +415,20 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 			internalServerError(w, r, err)
 			return
 		}
+		if fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, filePath)); err == nil {
+			modTime := fileInfo.ModTime()
+			response.ModTime = &modTime
+		}
+		if nbrew.DB != nil {
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   "updatefile",
+				FilePath: filePath,
+				Before:   before,
+				After:    NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, filePath)),
+			})
+		}
 
 		segments := strings.Split(filePath, "/")
 		if segments[0] == "posts" || segments[0] == "pages" || (len(segments) > 2 && segments[0] == "output" && segments[1] == "themes") {
@@ -361,3 +458,21 @@ func (nbrew *Notebrew) file(w http.ResponseWriter, r *http.Request, username, si
 		methodNotAllowed(w, r)
 	}
 }
+
+// fileETag returns the entity tag of a file with the given modification time,
+// for use with the If-Match header.
+func fileETag(modTime time.Time) string {
+	return `"` + strconv.FormatInt(modTime.UnixNano(), 16) + `"`
+}
+
+// etagMatches reports whether an If-Match header value matches etag, using
+// the strong comparison that If-Match requires.
+func etagMatches(ifMatch, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package nb7
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_admin_fileConflict(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "lamport", "lamport@email.com", "password123")
+			authenticationToken := generateAuthenticationToken(t, nbrew, "lamport")
+			for _, dir := range []string{"@lamport", "@lamport/notes"} {
+				err := nbrew.FS.Mkdir(dir, 0755)
+				if err != nil && !errors.Is(err, fs.ErrExist) {
+					return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+				}
+			}
+			readerFrom, err := nbrew.FS.OpenReaderFrom("@lamport/notes/clocks.md", 0644)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			_, err = readerFrom.ReadFrom(strings.NewReader("original"))
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/admin/@lamport/notes/clocks.md", nil)
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			etag := w.Header().Get("ETag")
+			if etag == "" {
+				return fmt.Errorf("[%s] %s GET did not return an ETag", nbrew.Dialect, testutil.Callers())
+			}
+
+			type Response struct {
+				Status         Error  `json:"status"`
+				CurrentContent string `json:"currentContent"`
+			}
+			// The first editor saves successfully, the second editor who
+			// loaded the same version gets a conflict.
+			for i, content := range []string{"first editor", "second editor"} {
+				// A slight delay so that the first save changes the
+				// modification time.
+				time.Sleep(time.Millisecond)
+				w = httptest.NewRecorder()
+				r, _ = http.NewRequest("POST", "/admin/@lamport/notes/clocks.md", strings.NewReader(`{"content":"`+content+`"}`))
+				r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Accept", "application/json")
+				r.Header.Set("If-Match", etag)
+				nbrew.admin(w, r.WithContext(ctx), "")
+				if ctx.Err() != nil {
+					return nil
+				}
+				var response Response
+				err = json.Unmarshal(w.Body.Bytes(), &response)
+				if err != nil {
+					return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+				}
+				if i == 0 {
+					if w.Code != http.StatusOK || response.Status != UpdateSuccess {
+						return fmt.Errorf("[%s] %s first save: got %d %q", nbrew.Dialect, testutil.Callers(), w.Code, response.Status)
+					}
+					continue
+				}
+				if w.Code != http.StatusConflict || response.Status != ErrConflict {
+					return fmt.Errorf("[%s] %s second save: got %d %q, want 409 %q", nbrew.Dialect, testutil.Callers(), w.Code, response.Status, ErrConflict)
+				}
+				if response.CurrentContent != "first editor" {
+					return fmt.Errorf("[%s] %s got current content %q, want %q", nbrew.Dialect, testutil.Callers(), response.CurrentContent, "first editor")
+				}
+			}
+
+			// An HTML form save that conflicts redirects back to the file with
+			// only the rejected contents in the flash session, and the current
+			// contents are loaded when the conflict is rendered.
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("POST", "/admin/@lamport/notes/clocks.md", strings.NewReader(url.Values{
+				"content": {"form editor"},
+				"modTime": {"2000-01-01T00:00:00Z"},
+			}.Encode()))
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			if w.Code != http.StatusFound {
+				return fmt.Errorf("[%s] %s form save: got %d, want %d", nbrew.Dialect, testutil.Callers(), w.Code, http.StatusFound)
+			}
+			r, _ = http.NewRequest("GET", "/admin/@lamport/notes/clocks.md", nil)
+			for _, cookie := range w.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+			var flash map[string]any
+			_, err = nbrew.getSession(r, "flash", &flash)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if _, ok := flash["currentContent"]; ok {
+				return fmt.Errorf("[%s] %s flash session has the current contents: %v", nbrew.Dialect, testutil.Callers(), flash)
+			}
+			w = httptest.NewRecorder()
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			var flashResponse struct {
+				Status         Error  `json:"status"`
+				Content        string `json:"content"`
+				CurrentContent string `json:"currentContent"`
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &flashResponse)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if flashResponse.Status != ErrConflict || flashResponse.Content != "form editor" || flashResponse.CurrentContent != "first editor" {
+				return fmt.Errorf("[%s] %s got %+v, want status %q with content %q and current content %q", nbrew.Dialect, testutil.Callers(), flashResponse, ErrConflict, "form editor", "first editor")
+			}
+
+			b, err := fs.ReadFile(nbrew.FS, "@lamport/notes/clocks.md")
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if string(b) != "first editor" {
+				return fmt.Errorf("[%s] %s file has contents %q, want %q", nbrew.Dialect, testutil.Callers(), string(b), "first editor")
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
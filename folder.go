@@ -167,6 +167,11 @@ func (nbrew *Notebrew) folder(w http.ResponseWriter, r *http.Request, username,
 		}
 		if sitePrefix == "" {
 			if nbrew.DB != nil {
+				// || is logical OR in MySQL and unsupported in SQL Server.
+				atSiteName := "'@' || site.site_name"
+				if nbrew.Dialect == "mysql" || nbrew.Dialect == "sqlserver" {
+					atSiteName = "CONCAT('@', site.site_name)"
+				}
 				results, err := sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
 					Dialect: nbrew.Dialect,
 					Format: "SELECT {*}" +
@@ -184,11 +189,11 @@ func (nbrew *Notebrew) folder(w http.ResponseWriter, r *http.Request, username,
 				}) {
 					result.SitePrefix = row.String("CASE" +
 						" WHEN site.site_name LIKE '%.%' THEN site.site_name" +
-						" WHEN site.site_name <> '' THEN '@' || site.site_name" +
+						" WHEN site.site_name <> '' THEN " + atSiteName +
 						" ELSE ''" +
 						" END AS site_prefix",
 					)
-					result.IsUser = row.Bool("EXISTS (SELECT 1 FROM users WHERE users.username = site.site_name)")
+					result.IsUser = row.Bool("CASE WHEN EXISTS (SELECT 1 FROM users WHERE users.username = site.site_name) THEN 1 ELSE 0 END")
 					return result
 				})
 				if err != nil {
@@ -528,6 +533,6 @@ func (nbrew *Notebrew) folder(w http.ResponseWriter, r *http.Request, username,
 		internalServerError(w, r, err)
 		return
 	}
-	contentSecurityPolicy(w, "", false)
+	contentSecurityPolicy(w, "", nil)
 	executeTemplate(w, r, fileInfo.ModTime(), tmpl, &response)
 }
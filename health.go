@@ -0,0 +1,125 @@
+package nb7
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// health reports whether the database and the file system are reachable,
+// for load balancers and uptime monitors. It responds with 503 Service
+// Unavailable if either is not. Errors are logged rather than returned
+// because the endpoint is public.
+func (nbrew *Notebrew) health(w http.ResponseWriter, r *http.Request) {
+	type Check struct {
+		Status  string `json:"status"`
+		Latency string `json:"latency,omitempty"`
+	}
+	type DatabaseCheck struct {
+		Check
+		Dialect         string `json:"dialect,omitempty"`
+		OpenConnections int    `json:"openConnections"`
+		InUse           int    `json:"inUse"`
+		Idle            int    `json:"idle"`
+		WaitCount       int64  `json:"waitCount"`
+	}
+	type JobCheck struct {
+		Name         string `json:"name"`
+		Status       string `json:"status"` // ok | error | running | pending | disabled
+		Runs         int    `json:"runs"`
+		LastRunAt    string `json:"lastRunAt,omitempty"`
+		LastDuration string `json:"lastDuration,omitempty"`
+		NextRunAt    string `json:"nextRunAt,omitempty"`
+	}
+	type Response struct {
+		Status   string        `json:"status"`
+		Database DatabaseCheck `json:"database"`
+		FS       Check         `json:"fs"`
+		Jobs     []JobCheck    `json:"jobs"`
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	response := Response{Status: "ok"}
+
+	if nbrew.DB == nil {
+		response.Database.Status = "disabled"
+	} else {
+		response.Database.Dialect = nbrew.Dialect
+		startedAt := time.Now()
+		err := nbrew.DB.PingContext(ctx)
+		response.Database.Latency = time.Since(startedAt).String()
+		if err != nil {
+			getLogger(r.Context()).Error("health: database: " + err.Error())
+			response.Status = "error"
+			response.Database.Status = "error"
+		} else {
+			response.Database.Status = "ok"
+		}
+		stats := nbrew.DB.Stats()
+		response.Database.OpenConnections = stats.OpenConnections
+		response.Database.InUse = stats.InUse
+		response.Database.Idle = stats.Idle
+		response.Database.WaitCount = stats.WaitCount
+	}
+
+	startedAt := time.Now()
+	_, err := nbrew.FS.ReadDir(".")
+	response.FS.Latency = time.Since(startedAt).String()
+	if err != nil {
+		getLogger(r.Context()).Error("health: fs: " + err.Error())
+		response.Status = "error"
+		response.FS.Status = "error"
+	} else {
+		response.FS.Status = "ok"
+	}
+
+	// A failed job does not make the instance unhealthy, it is only
+	// reported. The error itself has already been logged.
+	for _, jobStatus := range nbrew.JobStatuses() {
+		jobCheck := JobCheck{
+			Name: jobStatus.Name,
+			Runs: jobStatus.Runs,
+		}
+		switch {
+		case jobStatus.Running:
+			jobCheck.Status = "running"
+		case jobStatus.Disabled:
+			jobCheck.Status = "disabled"
+		case jobStatus.Runs == 0:
+			jobCheck.Status = "pending"
+		case jobStatus.LastError != nil:
+			jobCheck.Status = "error"
+		default:
+			jobCheck.Status = "ok"
+		}
+		if jobStatus.Runs > 0 {
+			jobCheck.LastRunAt = jobStatus.LastRunAt.UTC().Format(time.RFC3339)
+			jobCheck.LastDuration = jobStatus.LastDuration.String()
+		}
+		if !jobStatus.NextRunAt.IsZero() {
+			jobCheck.NextRunAt = jobStatus.NextRunAt.UTC().Format(time.RFC3339)
+		}
+		response.Jobs = append(response.Jobs, jobCheck)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(&response)
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+	}
+}
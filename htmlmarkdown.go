@@ -0,0 +1,208 @@
+package nb7
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var excessNewlinesRegexp = regexp.MustCompile(`\n{3,}`)
+
+// htmlToMarkdown converts the HTML content of an imported post into
+// Markdown, since notebrew doesn't render raw HTML in posts. Elements that
+// have no Markdown equivalent (scripts, iframes, forms...) are dropped and
+// reported as a problem.
+func (imp *siteImporter) htmlToMarkdown(srcPath, src string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(src), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return "", err
+	}
+	converter := &markdownConverter{dropped: make(map[string]bool)}
+	var b strings.Builder
+	for _, node := range nodes {
+		converter.render(&b, node)
+	}
+	if len(converter.dropped) > 0 {
+		tags := make([]string, 0, len(converter.dropped))
+		for tag := range converter.dropped {
+			tags = append(tags, "<"+tag+">")
+		}
+		sort.Strings(tags)
+		imp.problem(srcPath, "dropped unsupported HTML %s", strings.Join(tags, ", "))
+	}
+	return strings.TrimSpace(excessNewlinesRegexp.ReplaceAllString(b.String(), "\n\n")), nil
+}
+
+type markdownConverter struct {
+	dropped map[string]bool
+	inPre   bool
+}
+
+func (c *markdownConverter) renderChildren(b *strings.Builder, node *html.Node) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		c.render(b, child)
+	}
+}
+
+// renderInline renders the children of node on a single line.
+func (c *markdownConverter) renderInline(node *html.Node) string {
+	var b strings.Builder
+	c.renderChildren(&b, node)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func (c *markdownConverter) render(b *strings.Builder, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		if c.inPre {
+			b.WriteString(node.Data)
+			return
+		}
+		// WordPress separates paragraphs with blank lines, so newlines are
+		// kept. Indentation is not, since it would turn into code blocks.
+		lines := strings.Split(strings.ReplaceAll(node.Data, "\r\n", "\n"), "\n")
+		for i := range lines {
+			if i > 0 {
+				lines[i] = strings.TrimLeft(lines[i], " \t")
+			}
+		}
+		b.WriteString(strings.Join(lines, "\n"))
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	switch node.DataAtom {
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Figure, atom.Figcaption, atom.Header, atom.Footer:
+		b.WriteString("\n\n")
+		c.renderChildren(b, node)
+		b.WriteString("\n\n")
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level, _ := strconv.Atoi(node.Data[1:])
+		b.WriteString("\n\n" + strings.Repeat("#", level) + " " + c.renderInline(node) + "\n\n")
+	case atom.Br:
+		b.WriteString("\\\n")
+	case atom.Hr:
+		b.WriteString("\n\n---\n\n")
+	case atom.Strong, atom.B:
+		if text := c.renderInline(node); text != "" {
+			b.WriteString("**" + text + "**")
+		}
+	case atom.Em, atom.I:
+		if text := c.renderInline(node); text != "" {
+			b.WriteString("*" + text + "*")
+		}
+	case atom.Code:
+		if c.inPre {
+			c.renderChildren(b, node)
+			return
+		}
+		b.WriteString("`" + c.renderInline(node) + "`")
+	case atom.Pre:
+		c.inPre = true
+		var code strings.Builder
+		c.renderChildren(&code, node)
+		c.inPre = false
+		b.WriteString("\n\n```\n" + strings.Trim(code.String(), "\n") + "\n```\n\n")
+	case atom.A:
+		href := getAttr(node, "href")
+		text := c.renderInline(node)
+		if href == "" {
+			b.WriteString(text)
+			return
+		}
+		b.WriteString("[" + text + "](" + href + ")")
+	case atom.Img:
+		b.WriteString("![" + getAttr(node, "alt") + "](" + getAttr(node, "src") + ")")
+	case atom.Ul, atom.Ol:
+		b.WriteString("\n\n")
+		n := 0
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode || child.DataAtom != atom.Li {
+				continue
+			}
+			n++
+			marker := "- "
+			if node.DataAtom == atom.Ol {
+				marker = strconv.Itoa(n) + ". "
+			}
+			var item strings.Builder
+			c.renderChildren(&item, child)
+			text := strings.TrimSpace(excessNewlinesRegexp.ReplaceAllString(item.String(), "\n\n"))
+			b.WriteString(marker + strings.ReplaceAll(text, "\n", "\n"+strings.Repeat(" ", len(marker))) + "\n")
+		}
+		b.WriteString("\n")
+	case atom.Blockquote:
+		var quote strings.Builder
+		c.renderChildren(&quote, node)
+		text := strings.TrimSpace(excessNewlinesRegexp.ReplaceAllString(quote.String(), "\n\n"))
+		b.WriteString("\n\n> " + strings.ReplaceAll(text, "\n", "\n> ") + "\n\n")
+	case atom.Table:
+		c.renderTable(b, node)
+	case atom.Script, atom.Style, atom.Iframe, atom.Object, atom.Embed, atom.Form, atom.Video, atom.Audio, atom.Canvas, atom.Svg:
+		c.dropped[node.Data] = true
+	default:
+		c.renderChildren(b, node)
+	}
+}
+
+// renderTable renders a table as a Markdown table, using the first row as the
+// header.
+func (c *markdownConverter) renderTable(b *strings.Builder, table *html.Node) {
+	var rows [][]string
+	var walk func(*html.Node)
+	walk = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			if child.DataAtom != atom.Tr {
+				walk(child)
+				continue
+			}
+			var row []string
+			for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					row = append(row, strings.ReplaceAll(c.renderInline(cell), "|", `\|`))
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	walk(table)
+	if len(rows) == 0 {
+		return
+	}
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	b.WriteString("\n\n")
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		b.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString("|" + strings.Repeat(" --- |", columns) + "\n")
+		}
+	}
+	b.WriteString("\n")
+}
+
+func getAttr(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
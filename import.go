@@ -0,0 +1,849 @@
+package nb7
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Import formats supported by ImportSite.
+const (
+	ImportMarkdown = "markdown" // a folder of Markdown files, subfolders become categories
+	ImportJekyll   = "jekyll"   // a Jekyll site folder
+	ImportHugo     = "hugo"     // a Hugo site folder
+	ImportWXR      = "wxr"      // a WordPress eXtended RSS export file
+)
+
+// ImportResult reports what ImportSite did.
+type ImportResult struct {
+	Posts    int
+	Pages    int
+	Images   int
+	Problems []ImportProblem
+}
+
+// ImportProblem is something ImportSite couldn't convert, or converted with
+// caveats.
+type ImportProblem struct {
+	Path   string // path of the source file (or WXR item) with the problem
+	Reason string
+}
+
+// importDoc is a post or page read from a source site, before it is written
+// into notebrew.
+type importDoc struct {
+	srcPath  string // path in the source fs, used for reporting and resolving relative images
+	title    string
+	slug     string // may contain slashes for nested pages
+	category string
+	date     time.Time
+	body     string // Markdown
+	draft    bool
+}
+
+type siteImporter struct {
+	nbrew      *Notebrew
+	ctx        context.Context
+	sitePrefix string
+	src        fs.FS
+	format     string
+	// imageRoots are the folders in src that absolute image paths (e.g.
+	// /images/cat.jpg) are resolved against, in order.
+	imageRoots []string
+	siteURL    string
+	images     map[string]string // source path -> URL of the copied image
+	result     ImportResult
+}
+
+var (
+	markdownImageRegexp = regexp.MustCompile(`!\[[^\]]*\]\(\s*<?([^)\s>]+)`)
+	htmlImageRegexp     = regexp.MustCompile(`<img\s[^>]*?src\s*=\s*["']([^"']+)["']`)
+	jekyllPostRegexp    = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)$`)
+)
+
+// importImageExts are the image extensions that are copied into
+// output/images.
+var importImageExts = map[string]bool{
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+	".gif":  true,
+	".svg":  true,
+	".ico":  true,
+}
+
+// ImportSite converts the posts and pages of a blog made with another tool
+// into a site. For the markdown, jekyll and hugo formats, name is the site's
+// folder in fsys; for wxr it is the export file. Dates become the timestamp
+// prefix of post names, categories become post categories and images
+// referenced by posts and pages are copied into output/images. Anything that
+// couldn't be converted is reported in the result instead of failing the
+// import.
+func (nbrew *Notebrew) ImportSite(ctx context.Context, sitePrefix string, fsys fs.FS, name, format string) (ImportResult, error) {
+	src, err := fs.Sub(fsys, name)
+	if format == ImportWXR {
+		src, err = fs.Sub(fsys, path.Dir(name))
+	}
+	if err != nil {
+		return ImportResult{}, err
+	}
+	siteURL := contentSiteURL(nbrew, sitePrefix)
+	if siteURL == "" {
+		siteURL = "/"
+	}
+	imp := &siteImporter{
+		nbrew:      nbrew,
+		ctx:        ctx,
+		sitePrefix: sitePrefix,
+		src:        src,
+		format:     format,
+		siteURL:    siteURL,
+		images:     make(map[string]string),
+	}
+	switch format {
+	case ImportMarkdown:
+		imp.imageRoots = []string{"."}
+		err = imp.importMarkdown()
+	case ImportJekyll:
+		imp.imageRoots = []string{"."}
+		err = imp.importJekyll()
+	case ImportHugo:
+		imp.imageRoots = []string{"static", "assets", "."}
+		err = imp.importHugo()
+	case ImportWXR:
+		imp.imageRoots = []string{"."}
+		err = imp.importWXR(path.Base(name))
+	default:
+		return ImportResult{}, fmt.Errorf("unsupported format %q (must be markdown, jekyll, hugo or wxr)", format)
+	}
+	if err != nil {
+		return imp.result, err
+	}
+	err = nbrew.RegenerateSite(ctx, sitePrefix)
+	if err != nil {
+		return imp.result, err
+	}
+	return imp.result, nil
+}
+
+func (imp *siteImporter) problem(srcPath, format string, a ...any) {
+	imp.result.Problems = append(imp.result.Problems, ImportProblem{
+		Path:   srcPath,
+		Reason: fmt.Sprintf(format, a...),
+	})
+}
+
+func (imp *siteImporter) importMarkdown() error {
+	return fs.WalkDir(imp.src, ".", func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := imp.ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(dirEntry.Name(), ".") && filePath != "." {
+			if dirEntry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if dirEntry.IsDir() {
+			return nil
+		}
+		ext := path.Ext(filePath)
+		if ext != ".md" && ext != ".markdown" {
+			return nil
+		}
+		doc, err := imp.readDoc(filePath)
+		if err != nil {
+			return err
+		}
+		if segments := strings.Split(filePath, "/"); len(segments) > 1 {
+			if doc.category == "" {
+				doc.category = segments[0]
+			}
+			if len(segments) > 2 {
+				imp.problem(filePath, "nested folders are not supported, imported into category %q", doc.category)
+			}
+		}
+		return imp.writePost(doc)
+	})
+}
+
+func (imp *siteImporter) importJekyll() error {
+	return fs.WalkDir(imp.src, ".", func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := imp.ctx.Err(); err != nil {
+			return err
+		}
+		name := dirEntry.Name()
+		if dirEntry.IsDir() {
+			if filePath == "." {
+				return nil
+			}
+			switch name {
+			case "_posts":
+				return nil
+			case "_drafts":
+				imp.problem(filePath, "drafts are not imported")
+				return fs.SkipDir
+			case "node_modules", "vendor":
+				return fs.SkipDir
+			}
+			if strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		ext := path.Ext(name)
+		if ext != ".md" && ext != ".markdown" && ext != ".html" {
+			return nil
+		}
+		isPost := strings.Contains("/"+filePath, "/_posts/")
+		if !isPost {
+			// Jekyll only processes pages with front matter, everything
+			// else is a static file.
+			b, err := fs.ReadFile(imp.src, filePath)
+			if err != nil {
+				return err
+			}
+			if !bytes.HasPrefix(b, []byte("---")) {
+				return nil
+			}
+		}
+		doc, err := imp.readDoc(filePath)
+		if err != nil {
+			return err
+		}
+		if !isPost {
+			return imp.writePage(doc, ext == ".html")
+		}
+		if match := jekyllPostRegexp.FindStringSubmatch(strings.TrimSuffix(name, ext)); match != nil {
+			if doc.date.IsZero() {
+				doc.date, _ = time.Parse("2006-01-02", match[1])
+			}
+			if doc.slug == strings.TrimSuffix(name, ext) {
+				doc.slug = match[2]
+			}
+		}
+		if ext == ".html" {
+			doc.body, err = imp.htmlToMarkdown(filePath, doc.body)
+			if err != nil {
+				return err
+			}
+		}
+		return imp.writePost(doc)
+	})
+}
+
+func (imp *siteImporter) importHugo() error {
+	_, err := fs.Stat(imp.src, "content")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("content folder not found, is this a Hugo site?")
+		}
+		return err
+	}
+	return fs.WalkDir(imp.src, "content", func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := imp.ctx.Err(); err != nil {
+			return err
+		}
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || (path.Ext(name) != ".md" && path.Ext(name) != ".markdown") {
+			return nil
+		}
+		if strings.TrimSuffix(name, path.Ext(name)) == "_index" {
+			imp.problem(filePath, "section list pages are not imported")
+			return nil
+		}
+		doc, err := imp.readDoc(filePath)
+		if err != nil {
+			return err
+		}
+		relativePath := strings.TrimPrefix(filePath, "content/")
+		if strings.TrimSuffix(name, path.Ext(name)) == "index" && path.Dir(relativePath) != "." {
+			// Page bundle: the folder is the page.
+			if doc.slug == "index" {
+				doc.slug = urlSafe(path.Base(path.Dir(relativePath)))
+			}
+			relativePath = path.Dir(relativePath) + path.Ext(name)
+		}
+		section, _, ok := strings.Cut(relativePath, "/")
+		if !ok || (section != "post" && section != "posts" && section != "blog") {
+			doc.slug = strings.TrimSuffix(relativePath, path.Ext(relativePath))
+			if strings.Contains(doc.slug, "/") {
+				doc.slug = path.Join(path.Dir(doc.slug), urlSafe(path.Base(doc.slug)))
+			}
+			return imp.writePage(doc, false)
+		}
+		return imp.writePost(doc)
+	})
+}
+
+// readDoc reads a Markdown or HTML file with optional front matter.
+func (imp *siteImporter) readDoc(filePath string) (importDoc, error) {
+	b, err := fs.ReadFile(imp.src, filePath)
+	if err != nil {
+		return importDoc{}, err
+	}
+	name := path.Base(filePath)
+	doc := importDoc{
+		srcPath: filePath,
+		slug:    strings.TrimSuffix(name, path.Ext(name)),
+	}
+	frontMatter, body, err := splitFrontMatter(string(b))
+	if err != nil {
+		imp.problem(filePath, "invalid front matter: %v", err)
+	}
+	doc.body = body
+	if title, ok := frontMatter["title"].(string); ok {
+		doc.title = strings.TrimSpace(title)
+	}
+	if slug, ok := frontMatter["slug"].(string); ok && slug != "" {
+		doc.slug = slug
+	}
+	for _, key := range []string{"date", "publishDate"} {
+		if value, ok := frontMatter[key]; ok {
+			doc.date, err = parseImportDate(value)
+			if err != nil {
+				imp.problem(filePath, "invalid %s %v", key, value)
+			}
+			break
+		}
+	}
+	if doc.date.IsZero() {
+		if fileInfo, err := fs.Stat(imp.src, filePath); err == nil && imp.format == ImportMarkdown {
+			doc.date = fileInfo.ModTime()
+		}
+	}
+	switch categories := frontMatter["categories"].(type) {
+	case string:
+		doc.category, _, _ = strings.Cut(strings.TrimSpace(categories), " ")
+	case []any:
+		if len(categories) > 0 {
+			doc.category = fmt.Sprint(categories[0])
+		}
+		if len(categories) > 1 {
+			imp.problem(filePath, "posts can only have one category, imported into %q", doc.category)
+		}
+	}
+	if category, ok := frontMatter["category"].(string); ok && doc.category == "" {
+		doc.category = category
+	}
+	if draft, ok := frontMatter["draft"].(bool); ok {
+		doc.draft = draft
+	}
+	if published, ok := frontMatter["published"].(bool); ok && !published {
+		doc.draft = true
+	}
+	return doc, nil
+}
+
+// splitFrontMatter splits YAML (---), TOML (+++) or JSON ({) front matter
+// from the body of a document.
+func splitFrontMatter(s string) (frontMatter map[string]any, body string, err error) {
+	s = strings.TrimPrefix(strings.ReplaceAll(s, "\r\n", "\n"), "\ufeff")
+	frontMatter = make(map[string]any)
+	for _, delimiter := range []string{"---", "+++"} {
+		if !strings.HasPrefix(s, delimiter+"\n") {
+			continue
+		}
+		head, body, ok := strings.Cut(s[len(delimiter)+1:], "\n"+delimiter)
+		if !ok {
+			if strings.HasPrefix(s[len(delimiter)+1:], delimiter) {
+				head, body = "", s[2*len(delimiter)+1:]
+			} else {
+				return frontMatter, s, fmt.Errorf("missing closing %s", delimiter)
+			}
+		}
+		_, body, _ = strings.Cut(body, "\n")
+		if delimiter == "---" {
+			err = yaml.Unmarshal([]byte(head), &frontMatter)
+		} else {
+			frontMatter, err = parseTOMLFrontMatter(head)
+		}
+		return frontMatter, body, err
+	}
+	if strings.HasPrefix(s, "{") {
+		decoder := json.NewDecoder(strings.NewReader(s))
+		err = decoder.Decode(&frontMatter)
+		if err != nil {
+			return frontMatter, s, err
+		}
+		return frontMatter, s[decoder.InputOffset():], nil
+	}
+	return frontMatter, s, nil
+}
+
+// parseTOMLFrontMatter parses the top-level keys of TOML front matter, which
+// is all that is needed for importing. Tables are skipped.
+func parseTOMLFrontMatter(s string) (map[string]any, error) {
+	frontMatter := make(map[string]any)
+	inTable := false
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inTable = true
+			continue
+		}
+		if inTable {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return frontMatter, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		parsed, err := parseTOMLValue(strings.TrimSpace(value))
+		if err != nil {
+			return frontMatter, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		frontMatter[key] = parsed
+	}
+	return frontMatter, nil
+}
+
+func parseTOMLValue(value string) (any, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		return strings.Trim(value, "'"), nil
+	case strings.HasPrefix(value, "["):
+		var values []any
+		for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			parsed, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, parsed)
+		}
+		return values, nil
+	case value == "true" || value == "false":
+		return value == "true", nil
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+	// Bare dates and datetimes.
+	return value, nil
+}
+
+func parseImportDate(value any) (time.Time, error) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, nil
+	case string:
+		for _, layout := range []string{
+			time.RFC3339,
+			"2006-01-02 15:04:05 -0700",
+			"2006-01-02 15:04:05 MST",
+			"2006-01-02T15:04:05",
+			"2006-01-02 15:04:05",
+			"2006-01-02 15:04",
+			"2006-01-02",
+			time.RFC1123Z,
+			time.RFC1123,
+		} {
+			t, err := time.Parse(layout, strings.TrimSpace(value))
+			if err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %v", value)
+}
+
+// writePost writes a post into posts/<category>/, named with the timestamp
+// prefix of its date.
+func (imp *siteImporter) writePost(doc importDoc) error {
+	if doc.draft {
+		imp.problem(doc.srcPath, "drafts are not imported")
+		return nil
+	}
+	body := strings.TrimSpace(doc.body)
+	imp.warnTemplateTags(doc.srcPath, body)
+	body = imp.copyImages(doc.srcPath, body)
+	if doc.title == "" {
+		doc.title = firstLine(body)
+		if doc.title == "" {
+			doc.title = strings.ReplaceAll(doc.slug, "-", " ")
+		}
+	}
+	if !strings.HasPrefix(body, "#") {
+		body = "# " + doc.title + "\n\n" + body
+	}
+	category := urlSafe(doc.category)
+	if category != "" {
+		err := MkdirAll(imp.nbrew.FS, path.Join(imp.sitePrefix, "posts", category), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if doc.date.IsZero() {
+		imp.problem(doc.srcPath, "no date found, using the current time")
+		doc.date = time.Now()
+	}
+	unix := doc.date.Unix()
+	if unix < 1 {
+		unix = 1
+	}
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(unix))
+	prefix := strings.TrimLeft(base32Encoding.EncodeToString(timestamp[len(timestamp)-5:]), "0")
+	name := prefix
+	if slug := urlSafe(doc.slug); slug != "" {
+		name = prefix + "-" + slug
+	}
+	filePath := path.Join(imp.sitePrefix, "posts", category, name+".md")
+	written, err := imp.writeFile(doc.srcPath, filePath, body+"\n")
+	if err != nil {
+		return err
+	}
+	if written {
+		imp.result.Posts++
+	}
+	return nil
+}
+
+// writePage writes a page into pages/. Markdown is converted to HTML since
+// pages are HTML templates.
+func (imp *siteImporter) writePage(doc importDoc, isHTML bool) error {
+	if doc.draft {
+		imp.problem(doc.srcPath, "drafts are not imported")
+		return nil
+	}
+	if isHTML && (strings.Contains(doc.body, "{%") || strings.Contains(doc.body, "{{")) {
+		imp.problem(doc.srcPath, "HTML pages with Liquid tags cannot be converted")
+		return nil
+	}
+	body := imp.copyImages(doc.srcPath, strings.TrimSpace(doc.body))
+	var content string
+	if isHTML {
+		content = body
+	} else {
+		imp.warnTemplateTags(doc.srcPath, body)
+		var b strings.Builder
+		err := goldmarkMarkdown.Convert([]byte(body), &b)
+		if err != nil {
+			return err
+		}
+		content = b.String()
+		if doc.title == "" {
+			doc.title = firstLine(body)
+		}
+	}
+	// Pages are templates, so anything that looks like an action has to be
+	// escaped.
+	content = strings.ReplaceAll(content, "{{", `{{ "{{" }}`)
+	if doc.title != "" {
+		content = "<title>" + html.EscapeString(doc.title) + "</title>\n" + content
+	}
+	// The slug comes from the front matter or the WXR export and may be
+	// nested, so each segment is made URL safe the way post slugs are and
+	// slugs that climb out of pages/ are refused.
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimSuffix(doc.slug, "/index"), "/") {
+		if segment == ".." {
+			imp.problem(doc.srcPath, "invalid slug %q", doc.slug)
+			return nil
+		}
+		segment = urlSafe(segment)
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	slug := strings.Join(segments, "/")
+	if slug == "" {
+		slug = "index"
+	}
+	filePath := path.Join(imp.sitePrefix, "pages", slug+".html")
+	written, err := imp.writeFile(doc.srcPath, filePath, content)
+	if err != nil {
+		return err
+	}
+	if written {
+		imp.result.Pages++
+	}
+	return nil
+}
+
+// writeFile writes a converted post or page, refusing to overwrite existing
+// files.
+func (imp *siteImporter) writeFile(srcPath, filePath, content string) (written bool, err error) {
+	_, err = fs.Stat(imp.nbrew.FS, filePath)
+	if err == nil {
+		imp.problem(srcPath, "%s already exists", strings.TrimPrefix(strings.TrimPrefix(filePath, imp.sitePrefix), "/"))
+		return false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	err = MkdirAll(imp.nbrew.FS, path.Dir(filePath), 0755)
+	if err != nil {
+		return false, err
+	}
+	readerFrom, err := imp.nbrew.FS.OpenReaderFrom(filePath, 0644)
+	if err != nil {
+		return false, err
+	}
+	_, err = readerFrom.ReadFrom(strings.NewReader(content))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (imp *siteImporter) warnTemplateTags(srcPath, body string) {
+	switch {
+	case strings.Contains(body, "{%"):
+		imp.problem(srcPath, "contains Liquid tags, left as is")
+	case strings.Contains(body, "{{<") || strings.Contains(body, "{{%"):
+		imp.problem(srcPath, "contains Hugo shortcodes, left as is")
+	}
+}
+
+// copyImages copies the images referenced by body into output/images and
+// returns body with the references pointing to the copies.
+func (imp *siteImporter) copyImages(srcPath, body string) string {
+	replace := func(regex *regexp.Regexp, s string) string {
+		var b strings.Builder
+		last := 0
+		for _, match := range regex.FindAllStringSubmatchIndex(s, -1) {
+			start, end := match[2], match[3]
+			b.WriteString(s[last:start])
+			b.WriteString(imp.copyImage(srcPath, s[start:end]))
+			last = end
+		}
+		b.WriteString(s[last:])
+		return b.String()
+	}
+	return replace(htmlImageRegexp, replace(markdownImageRegexp, body))
+}
+
+// copyImage copies a single image and returns its new URL, or the original
+// URL if it couldn't be copied.
+func (imp *siteImporter) copyImage(srcPath, imageURL string) string {
+	uri, err := url.Parse(html.UnescapeString(imageURL))
+	if err != nil || !importImageExts[strings.ToLower(path.Ext(uri.Path))] {
+		return imageURL
+	}
+	var candidates []string
+	if uri.Host != "" {
+		// Remote images can only be copied if they were exported alongside
+		// the site, like a WordPress uploads folder.
+		_, uploadPath, ok := strings.Cut(uri.Path, "/wp-content/")
+		if !ok {
+			imp.problem(srcPath, "remote image %s not copied", imageURL)
+			return imageURL
+		}
+		candidates = []string{"wp-content/" + uploadPath, uploadPath}
+	} else if strings.HasPrefix(uri.Path, "/") {
+		for _, root := range imp.imageRoots {
+			candidates = append(candidates, path.Join(root, uri.Path))
+		}
+	} else {
+		candidates = []string{path.Join(path.Dir(srcPath), uri.Path)}
+	}
+	for _, candidate := range candidates {
+		if !fs.ValidPath(candidate) {
+			continue
+		}
+		if newURL, ok := imp.images[candidate]; ok {
+			return newURL
+		}
+		b, err := fs.ReadFile(imp.src, candidate)
+		if err != nil {
+			continue
+		}
+		name, err := imp.writeImage(path.Base(candidate), b)
+		if err != nil {
+			imp.problem(srcPath, "copying image %s: %v", imageURL, err)
+			return imageURL
+		}
+		imp.result.Images++
+		newURL := imp.siteURL + "images/" + name
+		imp.images[candidate] = newURL
+		return newURL
+	}
+	imp.problem(srcPath, "image %s not found", imageURL)
+	return imageURL
+}
+
+// writeImage writes an image into output/images, renaming it if a different
+// image with the same name already exists.
+func (imp *siteImporter) writeImage(name string, b []byte) (string, error) {
+	ext := path.Ext(name)
+	base := urlSafe(strings.TrimSuffix(name, ext))
+	if base == "" {
+		base = "image"
+	}
+	err := MkdirAll(imp.nbrew.FS, path.Join(imp.sitePrefix, "output/images"), 0755)
+	if err != nil {
+		return "", err
+	}
+	for i := 1; ; i++ {
+		name = base + strings.ToLower(ext)
+		if i > 1 {
+			name = base + "-" + strconv.Itoa(i) + strings.ToLower(ext)
+		}
+		filePath := path.Join(imp.sitePrefix, "output/images", name)
+		existing, err := fs.ReadFile(imp.nbrew.FS, filePath)
+		if err == nil {
+			if bytes.Equal(existing, b) {
+				return name, nil
+			}
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		readerFrom, err := imp.nbrew.FS.OpenReaderFrom(filePath, 0644)
+		if err != nil {
+			return "", err
+		}
+		_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+		if err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+}
+
+func firstLine(s string) string {
+	for s != "" {
+		var line string
+		line, s, _ = strings.Cut(s, "\n")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			return stripMarkdownStyles([]byte(line))
+		}
+	}
+	return ""
+}
+
+// wxrItem is an item in a WordPress export, which may be a post, a page or
+// one of many other things WordPress stores as posts.
+type wxrItem struct {
+	Title      string `xml:"title"`
+	Link       string `xml:"link"`
+	PubDate    string `xml:"pubDate"`
+	Content    string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostName   string `xml:"post_name"`
+	PostDate   string `xml:"post_date_gmt"`
+	PostType   string `xml:"post_type"`
+	Status     string `xml:"status"`
+	Categories []struct {
+		Domain   string `xml:"domain,attr"`
+		Nicename string `xml:"nicename,attr"`
+		Name     string `xml:",chardata"`
+	} `xml:"category"`
+}
+
+func (imp *siteImporter) importWXR(name string) error {
+	file, err := imp.src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var rss struct {
+		Items []wxrItem `xml:"channel>item"`
+	}
+	decoder := xml.NewDecoder(file)
+	decoder.Strict = false
+	err = decoder.Decode(&rss)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	// WordPress exports items in no particular order, sort them so that
+	// problems are reported in a predictable order.
+	sort.SliceStable(rss.Items, func(i, j int) bool {
+		return rss.Items[i].PostDate < rss.Items[j].PostDate
+	})
+	for _, item := range rss.Items {
+		if err := imp.ctx.Err(); err != nil {
+			return err
+		}
+		srcPath := item.Link
+		if srcPath == "" {
+			srcPath = item.Title
+		}
+		switch item.PostType {
+		case "post", "page":
+		case "attachment", "nav_menu_item", "wp_global_styles", "wp_navigation", "custom_css":
+			continue
+		default:
+			imp.problem(srcPath, "unsupported post type %q", item.PostType)
+			continue
+		}
+		doc := importDoc{
+			srcPath: srcPath,
+			title:   html.UnescapeString(strings.TrimSpace(item.Title)),
+			slug:    item.PostName,
+			draft:   item.Status != "" && item.Status != "publish",
+		}
+		if doc.slug == "" {
+			doc.slug = urlSafe(doc.title)
+		}
+		if item.PostDate != "" && !strings.HasPrefix(item.PostDate, "0000") {
+			doc.date, _ = time.Parse("2006-01-02 15:04:05", item.PostDate)
+		}
+		if doc.date.IsZero() {
+			doc.date, _ = time.Parse(time.RFC1123Z, item.PubDate)
+		}
+		for _, category := range item.Categories {
+			if category.Domain != "category" || category.Nicename == "uncategorized" {
+				continue
+			}
+			if doc.category != "" {
+				imp.problem(srcPath, "posts can only have one category, imported into %q", doc.category)
+				break
+			}
+			doc.category = category.Nicename
+		}
+		doc.body, err = imp.htmlToMarkdown(srcPath, item.Content)
+		if err != nil {
+			return err
+		}
+		if doc.draft {
+			imp.problem(srcPath, "%s items are not imported", item.Status)
+			continue
+		}
+		if item.PostType == "page" {
+			err = imp.writePage(doc, false)
+		} else {
+			err = imp.writePost(doc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package nb7
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_ImportSite(t *testing.T) {
+	t.Run("jekyll", func(t *testing.T) {
+		t.Parallel()
+		nbrew := newTestSite("", nil)
+		src := fstest.MapFS{
+			"blog/_config.yml":                      &fstest.MapFile{Data: []byte("title: My Blog\n")},
+			"blog/_posts/2020-01-02-hello-world.md": &fstest.MapFile{Data: []byte("---\nlayout: post\ntitle: Hello World\ncategories: [travel]\n---\nLook at my cat.\n\n![cat](/assets/cat.jpg)\n")},
+			"blog/_posts/2020-01-03-secret.md":      &fstest.MapFile{Data: []byte("---\ntitle: Secret\npublished: false\n---\nshh\n")},
+			"blog/_drafts/wip.md":                   &fstest.MapFile{Data: []byte("---\ntitle: WIP\n---\n")},
+			"blog/assets/cat.jpg":                   &fstest.MapFile{Data: []byte("meow")},
+			"blog/about.md":                         &fstest.MapFile{Data: []byte("---\ntitle: About\n---\nI like {{ cats }}.\n")},
+			"blog/index.html":                       &fstest.MapFile{Data: []byte("---\nlayout: home\n---\n{% for post in site.posts %}{% endfor %}\n")},
+		}
+		result, err := nbrew.ImportSite(context.Background(), "", src, "blog", ImportJekyll)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if result.Posts != 1 || result.Pages != 1 || result.Images != 1 {
+			t.Errorf("%s got %d posts, %d pages, %d images, want 1 each (problems: %v)", testutil.Callers(), result.Posts, result.Pages, result.Images, result.Problems)
+		}
+		if len(result.Problems) != 3 {
+			t.Errorf("%s got problems %v, want 3 (draft, unpublished post, liquid page)", testutil.Callers(), result.Problems)
+		}
+		// 2020-01-02 00:00:00 UTC is 1577923200.
+		b, err := fs.ReadFile(nbrew.FS, "posts/travel/1f0tcm0-hello-world.md")
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		want := "# Hello World\n\nLook at my cat.\n\n![cat](https://example.com/images/cat.jpg)\n"
+		if string(b) != want {
+			t.Errorf("%s got %q, want %q", testutil.Callers(), string(b), want)
+		}
+		b, err = fs.ReadFile(nbrew.FS, "output/about/index.html")
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if !strings.Contains(string(b), "I like {{ cats }}.") {
+			t.Errorf("%s about page not rendered correctly: %q", testutil.Callers(), string(b))
+		}
+	})
+	t.Run("wxr", func(t *testing.T) {
+		t.Parallel()
+		nbrew := newTestSite("", nil)
+		src := fstest.MapFS{
+			"export/site.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+<item>
+	<title>My &amp; First Post</title>
+	<link>https://old.example.org/my-first-post/</link>
+	<content:encoded><![CDATA[<!-- wp:paragraph -->
+<p>Hello <strong>there</strong>, see <a href="https://go.dev">Go</a>.</p>
+<!-- /wp:paragraph -->
+<ul><li>one</li><li>two</li></ul>
+<img src="https://old.example.org/wp-content/uploads/2021/05/dog.png" alt="dog">
+<iframe src="https://youtube.com/embed/x"></iframe>]]></content:encoded>
+	<wp:post_name>my-first-post</wp:post_name>
+	<wp:post_date_gmt>2021-05-06 07:08:09</wp:post_date_gmt>
+	<wp:status>publish</wp:status>
+	<wp:post_type>post</wp:post_type>
+	<category domain="category" nicename="pets"><![CDATA[Pets]]></category>
+</item>
+<item>
+	<title>Unfinished</title>
+	<wp:post_name>unfinished</wp:post_name>
+	<wp:status>draft</wp:status>
+	<wp:post_type>post</wp:post_type>
+</item>
+</channel>
+</rss>`)},
+			"export/wp-content/uploads/2021/05/dog.png": &fstest.MapFile{Data: []byte("woof")},
+		}
+		result, err := nbrew.ImportSite(context.Background(), "", src, "export/site.xml", ImportWXR)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if result.Posts != 1 || result.Images != 1 || len(result.Problems) != 2 {
+			t.Errorf("%s got %d posts, %d images, problems %v", testutil.Callers(), result.Posts, result.Images, result.Problems)
+		}
+		// 2021-05-06 07:08:09 UTC is 1620284889.
+		b, err := fs.ReadFile(nbrew.FS, "posts/pets/1g975es-my-first-post.md")
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		want := "# My & First Post\n\nHello **there**, see [Go](https://go.dev).\n\n- one\n- two\n\n![dog](https://example.com/images/dog.png)\n"
+		if string(b) != want {
+			t.Errorf("%s got %q, want %q", testutil.Callers(), string(b), want)
+		}
+	})
+}
+
+func Test_ImportSite_pageSlug(t *testing.T) {
+	nbrew := newTestSite("@alice", fstest.MapFS{
+		"@victim/pages/index.html": &fstest.MapFile{Data: []byte("<p>victim</p>")},
+	})
+	src := fstest.MapFS{
+		"blog/_config.yml": &fstest.MapFile{Data: []byte("title: My Blog\n")},
+		"blog/evil.md":     &fstest.MapFile{Data: []byte("---\ntitle: Evil\nslug: ../../@victim/pages/index\n---\npwned\n")},
+		"blog/nested.md":   &fstest.MapFile{Data: []byte("---\ntitle: Nested\nslug: /Docs/Getting Started\n---\nhello\n")},
+		"site.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+<item>
+	<title>Evil</title>
+	<content:encoded><![CDATA[<p>pwned</p>]]></content:encoded>
+	<wp:post_name>docs/../../../@victim/pages/evil</wp:post_name>
+	<wp:status>publish</wp:status>
+	<wp:post_type>page</wp:post_type>
+</item>
+</channel>
+</rss>
+`)},
+	}
+	var problems []ImportProblem
+	result, err := nbrew.ImportSite(context.Background(), "@alice", src, "blog", ImportJekyll)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	problems = append(problems, result.Problems...)
+	result, err = nbrew.ImportSite(context.Background(), "@alice", src, "site.xml", ImportWXR)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	problems = append(problems, result.Problems...)
+
+	b, err := fs.ReadFile(nbrew.FS, "@victim/pages/index.html")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if string(b) != "<p>victim</p>" {
+		t.Errorf("%s: another site's page was overwritten: %q", testutil.Callers(), string(b))
+	}
+	_, err = fs.Stat(nbrew.FS, "@victim/pages/evil.html")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: a page was written into another site (err=%v)", testutil.Callers(), err)
+	}
+	var invalidSlugs int
+	for _, problem := range problems {
+		if strings.HasPrefix(problem.Reason, "invalid slug") {
+			invalidSlugs++
+		}
+	}
+	if invalidSlugs != 2 {
+		t.Errorf("%s: got problems %v, want 2 invalid slugs", testutil.Callers(), problems)
+	}
+	// Nested slugs are kept, made URL safe segment by segment.
+	_, err = fs.Stat(nbrew.FS, "@alice/pages/docs/getting-started.html")
+	if err != nil {
+		t.Error(testutil.Callers(), err)
+	}
+}
@@ -119,13 +119,15 @@ func (testFS *TestFS) Rename(oldname, newname string) error {
 	testFS.mu.Lock()
 	defer testFS.mu.Unlock()
 	testFS.mapFS[newname] = testFS.mapFS[oldname]
+	delete(testFS.mapFS, oldname)
 	if !oldFileInfo.IsDir() {
 		return nil
 	}
 	dirPrefix := oldname + "/"
 	for name, file := range testFS.mapFS {
 		if strings.HasPrefix(name, dirPrefix) {
-			testFS.mapFS[path.Join(newname, strings.Trim(name, dirPrefix))] = file
+			testFS.mapFS[path.Join(newname, strings.TrimPrefix(name, dirPrefix))] = file
+			delete(testFS.mapFS, name)
 		}
 	}
 	return nil
@@ -0,0 +1,297 @@
+package nb7
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/crypto/blake2b"
+)
+
+func (nbrew *Notebrew) invite(w http.ResponseWriter, r *http.Request, username string) {
+	type Request struct {
+		Token string `json:"token,omitempty"`
+	}
+	type Response struct {
+		Status     Error  `json:"status"`
+		Token      string `json:"token,omitempty"`
+		SitePrefix string `json:"sitePrefix,omitempty"`
+		Role       string `json:"role,omitempty"`
+		Invitee    string `json:"invitee,omitempty"`
+	}
+	type Invite struct {
+		SiteInviteTokenHash []byte
+		SiteID              [16]byte
+		SiteName            string
+		Role                string
+		Invitee             string
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+
+	// getInvite returns the invite for the token. A nil invite is returned if
+	// the token is invalid.
+	getInvite := func(token string) (invite *Invite, expired bool, err error) {
+		if len(token) > 48 {
+			return nil, false, nil
+		}
+		b, err := hex.DecodeString(fmt.Sprintf("%048s", token))
+		if err != nil {
+			return nil, false, nil
+		}
+		var siteInviteTokenHash [8 + blake2b.Size256]byte
+		checksum := blake2b.Sum256(b[8:])
+		copy(siteInviteTokenHash[:8], b[:8])
+		copy(siteInviteTokenHash[8:], checksum[:])
+		result, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM site_invite" +
+				" JOIN site ON site.site_id = site_invite.site_id" +
+				" JOIN users ON users.user_id = site_invite.user_id" +
+				" WHERE site_invite.site_invite_token_hash = {siteInviteTokenHash}",
+			Values: []any{
+				sq.BytesParam("siteInviteTokenHash", siteInviteTokenHash[:]),
+			},
+		}, func(row *sq.Row) (invite Invite) {
+			row.UUID(&invite.SiteID, "site.site_id")
+			invite.SiteName = row.String("site.site_name")
+			invite.Role = row.String("COALESCE(site_invite.role, 'editor')")
+			invite.Invitee = row.String("users.username")
+			return invite
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		result.SiteInviteTokenHash = siteInviteTokenHash[:]
+		issuedAt := time.Unix(int64(binary.BigEndian.Uint64(siteInviteTokenHash[:8])), 0)
+		return &result, time.Since(issuedAt) > siteInviteMaxAge, nil
+	}
+
+	toSitePrefix := func(siteName string) string {
+		if strings.Contains(siteName, ".") {
+			return siteName
+		}
+		if siteName != "" {
+			return "@" + siteName
+		}
+		return ""
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"join":        path.Join,
+				"stylesCSS":   func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":  func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase": func() bool { return nbrew.DB != nil },
+				"referer":     func() string { return r.Referer() },
+				"username":    func() string { return username },
+				"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+			}
+			tmpl, err := template.New("invite.html").Funcs(funcMap).ParseFS(rootFS, "embed/invite.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status != "" {
+			writeResponse(w, r, response)
+			return
+		}
+		response.Token = r.URL.Query().Get("token")
+		invite, expired, err := getInvite(response.Token)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if invite == nil {
+			response.Status = ErrInviteNotFound
+			writeResponse(w, r, response)
+			return
+		}
+		response.SitePrefix = toSitePrefix(invite.SiteName)
+		response.Role = invite.Role
+		response.Invitee = invite.Invitee
+		if expired {
+			response.Status = ErrTokenExpired
+			writeResponse(w, r, response)
+			return
+		}
+		if invite.Invitee != username {
+			response.Status = ErrNotAuthorized
+			writeResponse(w, r, response)
+			return
+		}
+		response.Status = Success
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			if response.Status.Success() {
+				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", response.SitePrefix)+"/", http.StatusFound)
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", &response)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/invite/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.Token = r.Form.Get("token")
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		var response Response
+		invite, expired, err := getInvite(request.Token)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if invite == nil {
+			response.Status = ErrInviteNotFound
+			writeResponse(w, r, response)
+			return
+		}
+		response.SitePrefix = toSitePrefix(invite.SiteName)
+		response.Role = invite.Role
+		response.Invitee = invite.Invitee
+		if expired {
+			response.Status = ErrTokenExpired
+			writeResponse(w, r, response)
+			return
+		}
+		if invite.Invitee != username {
+			notAuthorized(w, r)
+			return
+		}
+		tx, err := nbrew.DB.Begin()
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+		_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "DELETE FROM site_invite WHERE site_invite_token_hash = {siteInviteTokenHash}",
+			Values: []any{
+				sq.BytesParam("siteInviteTokenHash", invite.SiteInviteTokenHash),
+			},
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "INSERT INTO site_user (site_id, user_id, role)" +
+				" VALUES ({siteID}, (SELECT user_id FROM users WHERE username = {username}), {role})",
+			Values: []any{
+				sq.UUIDParam("siteID", invite.SiteID),
+				sq.StringParam("username", username),
+				sq.StringParam("role", invite.Role),
+			},
+		})
+		if err != nil && !nbrew.IsKeyViolation(err) {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:    username,
+			SiteName: invite.SiteName,
+			Action:   "acceptinvite",
+		})
+		response.Status = AcceptInviteSuccess
+		writeResponse(w, r, response)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
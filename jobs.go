@@ -0,0 +1,397 @@
+package nb7
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// JobStatus is the state of a background job.
+type JobStatus struct {
+	// Name is the key of the job under the jobs config section e.g.
+	// purgeSessions.
+	Name string
+
+	Disabled bool
+
+	Interval time.Duration
+
+	Running bool
+
+	// Runs is how many times the job has run since the server started.
+	Runs int
+
+	// LastRunAt is when the job last started running. It is zero if the job
+	// has not run yet.
+	LastRunAt time.Time
+
+	LastDuration time.Duration
+
+	// LastError is the error returned by the last run, if any.
+	LastError error
+
+	// NextRunAt is when the job is due to run next. It is zero if the job is
+	// disabled.
+	NextRunAt time.Time
+}
+
+// job is a periodic maintenance task.
+type job struct {
+	name            string
+	defaultInterval time.Duration
+	config          func(*Config) JobConfig
+	run             func(ctx context.Context) error
+}
+
+// jobScheduler runs the background jobs of a notebrew instance. The zero
+// value is ready to use.
+type jobScheduler struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	statuses map[string]*JobStatus
+}
+
+// jobs returns the background jobs that apply to the notebrew instance.
+func (nbrew *Notebrew) jobs() []job {
+	jobs := []job{{
+		name:            "purgeTrash",
+		defaultInterval: time.Hour,
+		config:          func(config *Config) JobConfig { return config.Jobs.PurgeTrash },
+		run: func(ctx context.Context) error {
+			_, err := nbrew.PurgeTrash(ctx)
+			return err
+		},
+	}}
+	if nbrew.DB == nil {
+		return jobs
+	}
+	jobs = append(jobs, job{
+		name:            "purgeSessions",
+		defaultInterval: time.Hour,
+		config:          func(config *Config) JobConfig { return config.Jobs.PurgeSessions },
+		run:             nbrew.purgeSessions,
+	}, job{
+		name:            "purgeTokens",
+		defaultInterval: time.Hour,
+		config:          func(config *Config) JobConfig { return config.Jobs.PurgeTokens },
+		run:             nbrew.purgeTokens,
+	}, job{
+		name:            "decayLoginFailures",
+		defaultInterval: time.Hour,
+		config:          func(config *Config) JobConfig { return config.Jobs.DecayLoginFailures },
+		run:             nbrew.decayLoginFailures,
+	})
+	if nbrew.Dialect == "sqlite" {
+		jobs = append(jobs, job{
+			name:            "optimize",
+			defaultInterval: 24 * time.Hour,
+			config:          func(config *Config) JobConfig { return config.Jobs.Optimize },
+			run: func(ctx context.Context) error {
+				_, err := nbrew.DB.ExecContext(ctx, "PRAGMA analysis_limit(400); PRAGMA optimize;")
+				return err
+			},
+		})
+	}
+	return jobs
+}
+
+// jobInterval returns how often a job runs and whether it is disabled,
+// according to the current config.
+func (nbrew *Notebrew) jobInterval(job job) (interval time.Duration, disabled bool) {
+	config := job.config(nbrew.Config())
+	interval = job.defaultInterval
+	if config.Interval != "" {
+		// The interval has already been validated by Config.Validate.
+		interval, _ = time.ParseDuration(config.Interval)
+	}
+	return interval, config.Disabled
+}
+
+// StartJobs starts running the background jobs (purging expired sessions,
+// tokens and trash, decaying login failure counters and optimizing SQLite
+// databases) until Close is called. Every job runs once on startup and then
+// on its configured interval. Changes to the jobs config take effect
+// without a restart. Calling StartJobs more than once has no effect.
+func (nbrew *Notebrew) StartJobs() {
+	nbrew.jobScheduler.mu.Lock()
+	defer nbrew.jobScheduler.mu.Unlock()
+	if nbrew.jobScheduler.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	nbrew.jobScheduler.cancel = cancel
+	nbrew.jobScheduler.wg.Add(1)
+	go func() {
+		defer nbrew.jobScheduler.wg.Done()
+		// Intervals are validated to be at least a minute, so checking every
+		// minute for jobs that are due is frequent enough.
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			now := time.Now()
+			for _, job := range nbrew.jobs() {
+				interval, disabled := nbrew.jobInterval(job)
+				if disabled {
+					continue
+				}
+				status := nbrew.jobStatus(job.name)
+				nbrew.jobScheduler.mu.Lock()
+				due := !status.Running && (status.LastRunAt.IsZero() || !now.Before(status.LastRunAt.Add(interval)))
+				if due {
+					status.Running = true
+				}
+				nbrew.jobScheduler.mu.Unlock()
+				if !due {
+					continue
+				}
+				job := job
+				nbrew.jobScheduler.wg.Add(1)
+				go func() {
+					defer nbrew.jobScheduler.wg.Done()
+					err := nbrew.runJob(ctx, job)
+					if err != nil && ctx.Err() == nil {
+						nbrew.jobLogger().Error("job failed", slog.String("job", job.name), slog.String("error", err.Error()))
+					}
+				}()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopJobs stops the background jobs and waits for any running jobs to
+// return.
+func (nbrew *Notebrew) stopJobs() {
+	nbrew.jobScheduler.mu.Lock()
+	cancel := nbrew.jobScheduler.cancel
+	nbrew.jobScheduler.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	nbrew.jobScheduler.wg.Wait()
+}
+
+// RunJob runs a background job immediately, regardless of whether it is
+// disabled.
+func (nbrew *Notebrew) RunJob(ctx context.Context, name string) error {
+	for _, job := range nbrew.jobs() {
+		if job.name != name {
+			continue
+		}
+		status := nbrew.jobStatus(name)
+		nbrew.jobScheduler.mu.Lock()
+		if status.Running {
+			nbrew.jobScheduler.mu.Unlock()
+			return fmt.Errorf("job %s is already running", name)
+		}
+		status.Running = true
+		nbrew.jobScheduler.mu.Unlock()
+		return nbrew.runJob(ctx, job)
+	}
+	return fmt.Errorf("unknown job %q", name)
+}
+
+// runJob runs a job that has already been marked as running and records the
+// outcome in its status.
+func (nbrew *Notebrew) runJob(ctx context.Context, job job) error {
+	startedAt := time.Now()
+	err := job.run(ctx)
+	nbrew.jobScheduler.mu.Lock()
+	defer nbrew.jobScheduler.mu.Unlock()
+	status := nbrew.jobScheduler.statuses[job.name]
+	status.Running = false
+	status.Runs++
+	status.LastRunAt = startedAt
+	status.LastDuration = time.Since(startedAt)
+	status.LastError = err
+	return err
+}
+
+// jobStatus returns the status of a job, creating it if necessary.
+func (nbrew *Notebrew) jobStatus(name string) *JobStatus {
+	nbrew.jobScheduler.mu.Lock()
+	defer nbrew.jobScheduler.mu.Unlock()
+	if nbrew.jobScheduler.statuses == nil {
+		nbrew.jobScheduler.statuses = make(map[string]*JobStatus)
+	}
+	status := nbrew.jobScheduler.statuses[name]
+	if status == nil {
+		status = &JobStatus{Name: name}
+		nbrew.jobScheduler.statuses[name] = status
+	}
+	return status
+}
+
+// JobStatuses returns the status of every background job.
+func (nbrew *Notebrew) JobStatuses() []JobStatus {
+	jobs := nbrew.jobs()
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		interval, disabled := nbrew.jobInterval(job)
+		status := nbrew.jobStatus(job.name)
+		nbrew.jobScheduler.mu.Lock()
+		jobStatus := *status
+		nbrew.jobScheduler.mu.Unlock()
+		jobStatus.Disabled = disabled
+		jobStatus.Interval = interval
+		if !disabled && !jobStatus.Running {
+			jobStatus.NextRunAt = jobStatus.LastRunAt.Add(interval)
+			if jobStatus.LastRunAt.IsZero() {
+				jobStatus.NextRunAt = time.Now()
+			}
+		}
+		statuses = append(statuses, jobStatus)
+	}
+	return statuses
+}
+
+func (nbrew *Notebrew) jobLogger() *slog.Logger {
+	if nbrew.Logger != nil {
+		return nbrew.Logger
+	}
+	return slog.Default()
+}
+
+// tokenHashCutoff returns the prefix of the hashes of tokens issued at t.
+// Token hashes start with the big-endian unix timestamp of when the token
+// was issued, so comparing a hash against the prefix compares issue times.
+func tokenHashCutoff(t time.Time) []byte {
+	var cutoff [8]byte
+	binary.BigEndian.PutUint64(cutoff[:], uint64(t.Unix()))
+	return cutoff[:]
+}
+
+// purgeSessions deletes expired flash sessions and authentication sessions
+// that have gone past their max age or idle timeout.
+func (nbrew *Notebrew) purgeSessions(ctx context.Context) error {
+	now := time.Now()
+	_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM session WHERE session_token_hash < {cutoff}",
+		Values: []any{
+			sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-5*time.Minute))),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// Sessions created before created_at was tracked fall back to the
+	// timestamp embedded in the token, and sessions without a last_seen_at
+	// are never considered idle (see ServeHTTP).
+	createdBefore := now.Add(-nbrew.sessionMaxAge())
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "DELETE FROM authentication" +
+			" WHERE created_at < {createdBefore}" +
+			" OR (created_at IS NULL AND authentication_token_hash < {cutoff})" +
+			" OR last_seen_at < {lastSeenBefore}",
+		Values: []any{
+			sq.Int64Param("createdBefore", createdBefore.Unix()),
+			sq.BytesParam("cutoff", tokenHashCutoff(createdBefore)),
+			sq.Int64Param("lastSeenBefore", now.Add(-nbrew.sessionIdleTimeout()).Unix()),
+		},
+	})
+	return err
+}
+
+// purgeTokens deletes expired signup tokens, site invitations, password
+// reset tokens and API tokens as well as rate limit buckets that have
+// filled up again.
+func (nbrew *Notebrew) purgeTokens(ctx context.Context) error {
+	now := time.Now()
+	_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM signup WHERE signup_token_hash < {cutoff}",
+		Values: []any{
+			sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-signupTokenMaxAge))),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM site_invite WHERE site_invite_token_hash < {cutoff}",
+		Values: []any{
+			sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-siteInviteMaxAge))),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE users SET reset_token_hash = NULL WHERE reset_token_hash < {cutoff}",
+		Values: []any{
+			sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-resetTokenMaxAge))),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM api_token WHERE expires_at < {now}",
+		Values: []any{
+			sq.Int64Param("now", now.Unix()),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM rate_limit WHERE full_at < {now}",
+		Values: []any{
+			sq.Int64Param("now", now.UnixMilli()),
+		},
+	})
+	return err
+}
+
+// decayLoginFailures halves the failed login counters of every IP address
+// and user, so that a captcha is no longer demanded once the failures have
+// stopped for a while. Counters that reach zero are cleared.
+func (nbrew *Notebrew) decayLoginFailures(ctx context.Context) error {
+	half := "failed_logins / 2"
+	if nbrew.Dialect == "mysql" {
+		half = "failed_logins DIV 2"
+	}
+	_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM ip_login WHERE failed_logins IS NULL OR failed_logins <= 1",
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE ip_login SET failed_logins = " + half,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE users SET failed_logins = NULL WHERE failed_logins <= 1",
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE users SET failed_logins = " + half + " WHERE failed_logins > 1",
+	})
+	return err
+}
@@ -0,0 +1,78 @@
+package nb7
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"github.com/bokwoon95/sq"
+)
+
+func Test_jobs(t *testing.T) {
+	for _, testDB := range testDatabases {
+		t.Run(testDB.Name, func(t *testing.T) {
+			ctx := context.Background()
+			nbrew := &Notebrew{
+				Dialect:   testDB.Dialect,
+				DB:        testDB.DB,
+				FS:        testutil.NewFS(nil),
+				ErrorCode: testDB.ErrorCode,
+			}
+			tokenHash := func(issuedAt time.Time) []byte {
+				hash := make([]byte, 40)
+				binary.BigEndian.PutUint64(hash[:8], uint64(issuedAt.Unix()))
+				rand.Read(hash[8:])
+				return hash
+			}
+			now := time.Now()
+			expiredSession, session := tokenHash(now.Add(-time.Hour)), tokenHash(now)
+			expiredSignup, signup := tokenHash(now.Add(-8*24*time.Hour)), tokenHash(now)
+			for _, query := range []sq.CustomQuery{
+				{Format: "INSERT INTO session (session_token_hash, data) VALUES ({}, {}), ({}, {})", Values: []any{expiredSession, "{}", session, "{}"}},
+				{Format: "INSERT INTO signup (signup_token_hash) VALUES ({}), ({})", Values: []any{expiredSignup, signup}},
+				{Format: "INSERT INTO ip_login (ip, failed_logins) VALUES ('192.0.2.1', 1), ('192.0.2.2', 5)"},
+			} {
+				query.Dialect = nbrew.Dialect
+				_, err := sq.ExecContext(ctx, nbrew.DB, query)
+				if err != nil {
+					t.Fatal(testutil.Callers(), err)
+				}
+			}
+			for _, name := range []string{"purgeSessions", "purgeTokens", "decayLoginFailures"} {
+				err := nbrew.RunJob(ctx, name)
+				if err != nil {
+					t.Fatal(testutil.Callers(), name, err)
+				}
+			}
+			for _, tt := range []struct {
+				description string
+				query       sq.CustomQuery
+				want        bool
+			}{
+				{"expired session purged", sq.CustomQuery{Format: "SELECT 1 FROM session WHERE session_token_hash = {}", Values: []any{expiredSession}}, false},
+				{"session kept", sq.CustomQuery{Format: "SELECT 1 FROM session WHERE session_token_hash = {}", Values: []any{session}}, true},
+				{"expired signup purged", sq.CustomQuery{Format: "SELECT 1 FROM signup WHERE signup_token_hash = {}", Values: []any{expiredSignup}}, false},
+				{"signup kept", sq.CustomQuery{Format: "SELECT 1 FROM signup WHERE signup_token_hash = {}", Values: []any{signup}}, true},
+				{"ip_login cleared", sq.CustomQuery{Format: "SELECT 1 FROM ip_login WHERE ip = '192.0.2.1'"}, false},
+				{"ip_login halved", sq.CustomQuery{Format: "SELECT 1 FROM ip_login WHERE ip = '192.0.2.2' AND failed_logins = 2"}, true},
+			} {
+				tt.query.Dialect = nbrew.Dialect
+				exists, err := sq.FetchExistsContext(ctx, nbrew.DB, tt.query)
+				if err != nil {
+					t.Fatal(testutil.Callers(), tt.description, err)
+				}
+				if exists != tt.want {
+					t.Errorf("%s %s: got %v, want %v", testutil.Callers(), tt.description, exists, tt.want)
+				}
+			}
+			for _, jobStatus := range nbrew.JobStatuses() {
+				if jobStatus.Name == "purgeSessions" && (jobStatus.Runs != 1 || jobStatus.LastError != nil) {
+					t.Errorf("%s %s: got %d runs and error %v, want 1 run and no error", testutil.Callers(), jobStatus.Name, jobStatus.Runs, jobStatus.LastError)
+				}
+			}
+		})
+	}
+}
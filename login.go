@@ -1,8 +1,6 @@
 package nb7
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/rand"
 	"database/sql"
 	"encoding/binary"
@@ -10,13 +8,10 @@ import (
 	"encoding/json"
 	"errors"
 	"html/template"
-	"io"
-	"io/fs"
 	"mime"
 	"net/http"
 	"net/url"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 
@@ -30,16 +25,21 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 		Username        string `json:"username,omitempty"`
 		Password        string `json:"password,omitempty"`
 		CaptchaResponse string `json:"captchaResponse,omitempty"`
+		TwoFactorToken  string `json:"twoFactorToken,omitempty"`
+		TwoFactorCode   string `json:"twoFactorCode,omitempty"`
 	}
 	type Response struct {
 		Status              Error              `json:"status"`
 		Username            string             `json:"username,omitempty"` // could be username -or- email, check sitePrefix for username instead
 		RequireCaptcha      bool               `json:"requireCaptcha,omitempty"`
+		CaptchaProvider     string             `json:"captchaProvider,omitempty"`
 		CaptchaSiteKey      string             `json:"captchaSiteKey,omitempty"`
+		CaptchaChallenge    string             `json:"captchaChallenge,omitempty"`
 		Errors              map[string][]Error `json:"errors,omitempty"`
 		AuthenticationToken string             `json:"authenticationToken,omitempty"`
 		Redirect            string             `json:"redirect,omitempty"`
 		SitePrefix          string             `json:"sitePrefix,omitempty"`
+		TwoFactorToken      string             `json:"twoFactorToken,omitempty"`
 	}
 
 	if nbrew.DB == nil {
@@ -81,34 +81,8 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 		return failedLogins, nil
 	}
 
-	type CaptchaCredentials struct {
-		SecretKey string `json:"secretKey,omitempty"`
-		SiteKey   string `json:"siteKey,omitempty"`
-	}
-	getCaptchaCredentials := func() (CaptchaCredentials, error) {
-		var captchaCredentials CaptchaCredentials
-		b, err := fs.ReadFile(nbrew.FS, "config/captcha.json")
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return captchaCredentials, err
-		}
-		err = json.Unmarshal(b, &captchaCredentials)
-		return captchaCredentials, err
-	}
-
 	signupsAreOpen := func() bool {
-		file, err := nbrew.FS.Open("config/signups.txt")
-		if err != nil {
-			return false
-		}
-		defer file.Close()
-		reader := bufio.NewReader(file)
-		line, err := reader.ReadString('\n')
-		if err != nil && err != io.EOF {
-			getLogger(r.Context()).Error(err.Error())
-			return false
-		}
-		isOpen, _ := strconv.ParseBool(line)
-		return isOpen
+		return nbrew.Config().Signups
 	}
 
 	sanitizeRedirect := func(redirect string) string {
@@ -135,18 +109,44 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 		return uri.String()
 	}
 
+	createAuthenticationToken := func(username string) (string, error) {
+		now := time.Now()
+		var authenticationToken [8 + 16]byte
+		binary.BigEndian.PutUint64(authenticationToken[:8], uint64(now.Unix()))
+		_, err := rand.Read(authenticationToken[8:])
+		if err != nil {
+			return "", err
+		}
+		var authenticationTokenHash [8 + blake2b.Size256]byte
+		checksum := blake2b.Sum256(authenticationToken[8:])
+		copy(authenticationTokenHash[:8], authenticationToken[:8])
+		copy(authenticationTokenHash[8:], checksum[:])
+		_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "INSERT INTO authentication (authentication_token_hash, user_id, created_at, last_seen_at, user_agent, ip)" +
+				" VALUES ({authenticationTokenHash}, (SELECT user_id FROM users WHERE username = {username}), {now}, {now}, {userAgent}, {ip})",
+			Values: []any{
+				sq.BytesParam("authenticationTokenHash", authenticationTokenHash[:]),
+				sq.Int64Param("now", now.Unix()),
+				sq.StringParam("userAgent", truncateUserAgent(r.UserAgent())),
+				sq.StringParam("ip", ip),
+				sq.StringParam("username", username),
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimLeft(hex.EncodeToString(authenticationToken[:]), "0"), nil
+	}
+
 	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
 	switch r.Method {
 	case "GET":
 		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
-			captchaCredentials, err := getCaptchaCredentials()
-			if err != nil {
-				getLogger(r.Context()).Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			response.CaptchaSiteKey = captchaCredentials.SiteKey
-			if captchaCredentials.SecretKey != "" && captchaCredentials.SiteKey != "" {
+			captcha := nbrew.captchaProvider()
+			if captcha != nil {
+				response.CaptchaProvider = captcha.Name()
+				response.CaptchaSiteKey = captcha.SiteKey()
 				failedLogins, err := getFailedLoginsForIP(ip)
 				if err != nil {
 					getLogger(r.Context()).Error(err.Error())
@@ -156,6 +156,14 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 				if failedLogins >= 3 {
 					response.RequireCaptcha = true
 				}
+				if response.RequireCaptcha {
+					response.CaptchaChallenge, err = captcha.Challenge()
+					if err != nil {
+						getLogger(r.Context()).Error(err.Error())
+						internalServerError(w, r, err)
+						return
+					}
+				}
 			}
 			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
 			if accept == "application/json" {
@@ -179,7 +187,7 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", true)
+			contentSecurityPolicy(w, "", captcha)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -215,37 +223,36 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 		writeResponse(w, r, response)
 	case "POST":
 		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
-			if response.Status == ErrIncorrectLoginCredentials || response.Status == ErrUserNotFound {
-				if nbrew.Dialect == sq.DialectMySQL {
-					_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
-						Dialect: nbrew.Dialect,
-						Format: "INSERT INTO ip_login (ip, failed_logins) VALUES ({ip}, 1)" +
-							" ON DUPLICATE KEY UPDATE failed_logins = COALESCE(failed_logins, 0) + 1",
-						Values: []any{
-							sq.StringParam("ip", ip),
-						},
-					})
-					if err != nil {
-						getLogger(r.Context()).Error(err.Error())
-						internalServerError(w, r, err)
-						return
-					}
-				} else {
-					_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
-						Dialect: nbrew.Dialect,
-						Format: "INSERT INTO ip_login (ip, failed_logins) VALUES ({ip}, 1)" +
-							" ON CONFLICT (ip) DO UPDATE SET failed_logins = COALESCE(failed_logins, 0) + 1",
-						Values: []any{
-							sq.StringParam("ip", ip),
-						},
-					})
-					if err != nil {
-						getLogger(r.Context()).Error(err.Error())
-						internalServerError(w, r, err)
-						return
-					}
+			if response.Status == ErrIncorrectLoginCredentials || response.Status == ErrUserNotFound || response.Status == ErrIncorrectTwoFactorCode {
+				var format string
+				switch nbrew.Dialect {
+				case "mysql":
+					format = "INSERT INTO ip_login (ip, failed_logins) VALUES ({ip}, 1)" +
+						" ON DUPLICATE KEY UPDATE failed_logins = COALESCE(failed_logins, 0) + 1"
+				case "sqlserver":
+					// HOLDLOCK keeps concurrent MERGEs from both inserting the
+					// same ip.
+					format = "MERGE INTO ip_login WITH (HOLDLOCK)" +
+						" USING (SELECT {ip} AS ip) AS src ON ip_login.ip = src.ip" +
+						" WHEN MATCHED THEN UPDATE SET failed_logins = COALESCE(ip_login.failed_logins, 0) + 1" +
+						" WHEN NOT MATCHED THEN INSERT (ip, failed_logins) VALUES (src.ip, 1);"
+				default:
+					format = "INSERT INTO ip_login (ip, failed_logins) VALUES ({ip}, 1)" +
+						" ON CONFLICT (ip) DO UPDATE SET failed_logins = COALESCE(failed_logins, 0) + 1"
 				}
 				_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+					Dialect: nbrew.Dialect,
+					Format:  format,
+					Values: []any{
+						sq.StringParam("ip", ip),
+					},
+				})
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
 					Dialect: nbrew.Dialect,
 					Format:  "UPDATE users SET failed_logins = COALESCE(failed_logins, 0) + 1 WHERE username = {username}",
 					Values: []any{
@@ -315,7 +322,7 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 				Secure:   nbrew.Scheme == "https://",
 				HttpOnly: true,
 				SameSite: http.SameSiteLaxMode,
-				MaxAge:   int((time.Hour * 24 * 365).Seconds()),
+				MaxAge:   int(nbrew.sessionMaxAge().Seconds()),
 			})
 			if response.Redirect != "" {
 				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+response.Redirect, http.StatusFound)
@@ -324,6 +331,7 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", response.SitePrefix)+"/", http.StatusFound)
 		}
 
+		captcha := nbrew.captchaProvider()
 		var request Request
 		var redirect string
 		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
@@ -350,7 +358,11 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 			}
 			request.Username = r.Form.Get("username")
 			request.Password = r.Form.Get("password")
-			request.CaptchaResponse = r.Form.Get("h-captcha-response")
+			if captcha != nil {
+				request.CaptchaResponse = r.Form.Get(captcha.ResponseField())
+			}
+			request.TwoFactorToken = r.Form.Get("twoFactorToken")
+			request.TwoFactorCode = r.Form.Get("twoFactorCode")
 			redirect = r.Form.Get("redirect")
 		default:
 			unsupportedContentType(w, r)
@@ -367,6 +379,94 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 			writeResponse(w, r, response)
 			return
 		}
+		// Besides the per-IP limit applied by the router, failed password
+		// attempts are limited per account so that guessing one account's
+		// password from many addresses is just as slow. Only attempts with a
+		// wrong password (or no such account) are counted, so requests
+		// turned away before the password is checked don't use up the
+		// account's limit. The check happens before the account is looked up
+		// so that it responds the same whether or not the account exists.
+		accountKey := "account:" + strings.ToLower(response.Username)
+		if request.TwoFactorToken == "" && response.Username != "" {
+			if !nbrew.checkRateLimit(w, r, "login", accountKey) {
+				return
+			}
+		}
+
+		if request.TwoFactorToken != "" {
+			// The attempt is counted before the code is checked, so that each
+			// two-factor login only gets a handful of attempts before the
+			// user has to enter their password again.
+			login, sessionTokenHash, ok, err := nbrew.takeTwoFactorAttempt(r.Context(), request.TwoFactorToken)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if !ok {
+				response.Status = ErrTokenExpired
+				writeResponse(w, r, response)
+				return
+			}
+			response.Username = login.Username
+			response.SitePrefix = "@" + login.Username
+			response.Redirect = login.Redirect
+			ok, err = nbrew.verifyTwoFactorCode(r.Context(), login.Username, request.TwoFactorCode)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if !ok {
+				if login.Attempts >= maxTwoFactorAttempts {
+					_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+						Dialect: nbrew.Dialect,
+						Format:  "DELETE FROM session WHERE session_token_hash = {sessionTokenHash}",
+						Values: []any{
+							sq.BytesParam("sessionTokenHash", sessionTokenHash),
+						},
+					})
+					if err != nil {
+						getLogger(r.Context()).Error(err.Error())
+						internalServerError(w, r, err)
+						return
+					}
+				} else {
+					response.TwoFactorToken = request.TwoFactorToken
+				}
+				response.Status = ErrIncorrectTwoFactorCode
+				writeResponse(w, r, response)
+				return
+			}
+			// Whichever request deletes the two-factor login gets to log in,
+			// so that it can only be used once.
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM session WHERE session_token_hash = {sessionTokenHash}",
+				Values: []any{
+					sq.BytesParam("sessionTokenHash", sessionTokenHash),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Status = ErrTokenExpired
+				writeResponse(w, r, response)
+				return
+			}
+			response.AuthenticationToken, err = createAuthenticationToken(login.Username)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			response.Status = LoginSuccess
+			writeResponse(w, r, response)
+			return
+		}
 
 		if response.Username == "" {
 			response.Errors["username"] = append(response.Errors["username"], ErrRequired)
@@ -448,14 +548,9 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 			failedLogins = result.FailedLogins
 		}
 
-		captchaCredentials, err := getCaptchaCredentials()
-		if err != nil {
-			getLogger(r.Context()).Error(err.Error())
-			internalServerError(w, r, err)
-			return
-		}
-		response.CaptchaSiteKey = captchaCredentials.SiteKey
-		if captchaCredentials.SecretKey != "" && captchaCredentials.SiteKey != "" {
+		if captcha != nil {
+			response.CaptchaProvider = captcha.Name()
+			response.CaptchaSiteKey = captcha.SiteKey()
 			if failedLogins >= 3 {
 				response.RequireCaptcha = true
 			} else {
@@ -472,6 +567,14 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 		}
 
 		if response.RequireCaptcha {
+			// Every attempt needs a new challenge, whether or not this one
+			// succeeds.
+			response.CaptchaChallenge, err = captcha.Challenge()
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
 			if request.CaptchaResponse == "" {
 				response.Status = ErrRetryWithCaptcha
 				writeResponse(w, r, response)
@@ -485,42 +588,13 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 					return
 				}
 			}
-			client := &http.Client{
-				Timeout: 60 * time.Second,
-			}
-			values := url.Values{
-				"secret":   []string{captchaCredentials.SecretKey},
-				"response": []string{request.CaptchaResponse},
-				"remoteip": []string{ip},
-				"sitekey":  []string{captchaCredentials.SiteKey},
-			}
-			resp, err := client.Post("https://api.hcaptcha.com/siteverify", "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
-			if err != nil {
-				getLogger(r.Context()).Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			defer resp.Body.Close()
-			result := make(map[string]any)
-			err = json.NewDecoder(resp.Body).Decode(&result)
+			ok, err := captcha.Verify(r.Context(), request.CaptchaResponse, ip)
 			if err != nil {
 				getLogger(r.Context()).Error(err.Error())
 				internalServerError(w, r, err)
 				return
 			}
-			success, _ := result["success"].(bool)
-			if !success {
-				buf := bufPool.Get().(*bytes.Buffer)
-				buf.Reset()
-				defer bufPool.Put(buf)
-				encoder := json.NewEncoder(buf)
-				encoder.SetEscapeHTML(false)
-				err := encoder.Encode(result)
-				if err != nil {
-					getLogger(r.Context()).Warn(err.Error())
-				} else {
-					getLogger(r.Context()).Warn(strings.TrimSpace(buf.String()))
-				}
+			if !ok {
 				response.Status = ErrCaptchaChallengeFailed
 				writeResponse(w, r, response)
 				return
@@ -528,6 +602,7 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 		}
 
 		if userNotFound {
+			nbrew.spendRateLimit(r, "login", accountKey)
 			response.Status = ErrUserNotFound
 			writeResponse(w, r, response)
 			return
@@ -535,55 +610,45 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request, ip string)
 
 		err = bcrypt.CompareHashAndPassword(passwordHash, []byte(request.Password))
 		if err != nil {
+			nbrew.spendRateLimit(r, "login", accountKey)
 			response.Status = ErrIncorrectLoginCredentials
 			writeResponse(w, r, response)
 			return
 		}
 
-		var authenticationToken [8 + 16]byte
-		binary.BigEndian.PutUint64(authenticationToken[:8], uint64(time.Now().Unix()))
-		_, err = rand.Read(authenticationToken[8:])
+		twoFactorEnabled, err := sq.FetchExistsContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT 1 FROM users WHERE username = {username} AND totp_secret IS NOT NULL",
+			Values: []any{
+				sq.StringParam("username", strings.TrimPrefix(response.SitePrefix, "@")),
+			},
+		})
 		if err != nil {
 			getLogger(r.Context()).Error(err.Error())
 			internalServerError(w, r, err)
 			return
 		}
-		var authenticationTokenHash [8 + blake2b.Size256]byte
-		checksum := blake2b.Sum256(authenticationToken[8:])
-		copy(authenticationTokenHash[:8], authenticationToken[:8])
-		copy(authenticationTokenHash[8:], checksum[:])
-		if email != "" {
-			_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
-				Dialect: nbrew.Dialect,
-				Format: "INSERT INTO authentication (authentication_token_hash, user_id)" +
-					" VALUES ({authenticationTokenHash}, (SELECT user_id FROM users WHERE email = {email}))",
-				Values: []any{
-					sq.BytesParam("authenticationTokenHash", authenticationTokenHash[:]),
-					sq.StringParam("email", email),
-				},
-			})
-			if err != nil {
-				getLogger(r.Context()).Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-		} else {
-			_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
-				Dialect: nbrew.Dialect,
-				Format: "INSERT INTO authentication (authentication_token_hash, user_id)" +
-					" VALUES ({authenticationTokenHash}, (SELECT user_id FROM users WHERE username = {username}))",
-				Values: []any{
-					sq.BytesParam("authenticationTokenHash", authenticationTokenHash[:]),
-					sq.StringParam("username", response.Username),
-				},
+		if twoFactorEnabled {
+			response.TwoFactorToken, err = nbrew.createTwoFactorLogin(r.Context(), twoFactorLogin{
+				Username: strings.TrimPrefix(response.SitePrefix, "@"),
+				Redirect: response.Redirect,
 			})
 			if err != nil {
 				getLogger(r.Context()).Error(err.Error())
 				internalServerError(w, r, err)
 				return
 			}
+			response.Status = ErrTwoFactorRequired
+			writeResponse(w, r, response)
+			return
+		}
+
+		response.AuthenticationToken, err = createAuthenticationToken(strings.TrimPrefix(response.SitePrefix, "@"))
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
 		}
-		response.AuthenticationToken = strings.TrimLeft(hex.EncodeToString(authenticationToken[:]), "0")
 		response.Status = LoginSuccess
 		writeResponse(w, r, response)
 	default:
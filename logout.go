@@ -31,7 +31,7 @@ func (nbrew *Notebrew) logout(w http.ResponseWriter, r *http.Request, ip string)
 			internalServerError(w, r, err)
 			return
 		}
-		contentSecurityPolicy(w, "", false)
+		contentSecurityPolicy(w, "", nil)
 		executeTemplate(w, r, time.Time{}, tmpl, nil)
 	case "POST":
 		http.SetCookie(w, &http.Cookie{
@@ -0,0 +1,63 @@
+package nb7
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// SmtpSettings are the settings used to send mail, parsed from the mailer
+// config key.
+type SmtpSettings struct {
+	Username string
+	Password string
+	Host     string
+	Port     string
+}
+
+// getSmtpSettings parses the SMTP settings from the mailer config key.
+// isDisabled is true if there is no mailer configured and isMisconfigured is
+// true if the configuration is invalid.
+func (nbrew *Notebrew) getSmtpSettings() (smtpSettings *SmtpSettings, isDisabled, isMisconfigured bool, err error) {
+	smtpURL := nbrew.Config().Mailer
+	if smtpURL == "" {
+		return nil, true, false, nil
+	}
+	if strings.HasPrefix(smtpURL, "file:") {
+		filename := strings.TrimPrefix(strings.TrimPrefix(smtpURL, "file:"), "//")
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, false, true, nil
+			}
+			return nil, false, true, err
+		}
+		smtpURL = string(bytes.TrimSpace(b))
+	}
+	smtpSettings = &SmtpSettings{}
+	uri, err := url.Parse(smtpURL)
+	if err != nil {
+		return nil, false, true, nil
+	}
+	if uri.Scheme != "smtp" {
+		return nil, false, true, nil
+	}
+	if uri.User == nil {
+		return nil, false, true, nil
+	}
+	var ok bool
+	smtpSettings.Username = uri.User.Username()
+	smtpSettings.Password, ok = uri.User.Password()
+	if !ok {
+		return nil, false, true, nil
+	}
+	smtpSettings.Port = uri.Port()
+	if smtpSettings.Port == "" {
+		return nil, false, true, nil
+	}
+	smtpSettings.Host = strings.TrimSuffix(uri.Host, ":"+smtpSettings.Port)
+	return smtpSettings, false, false, nil
+}
@@ -0,0 +1,401 @@
+package nb7
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// migrationsFS holds the versioned migrations for each dialect, named
+// migrations/<dialect>/<version>_<name>.up.sql and
+// migrations/<dialect>/<version>_<name>.down.sql. Whenever schema.go changes,
+// a new migration that brings the previous schema in line with it must be
+// added for every dialect.
+//
+//go:embed migrations
+var migrationsFS embed.FS
+
+// Migration is a versioned migration.
+type Migration struct {
+	// Version is the number the migration's filename starts with.
+	Version int64
+
+	// Name is the rest of the migration's filename e.g. "initial".
+	Name string
+
+	// Up is the SQL that applies the migration.
+	Up string
+
+	// Down is the SQL that reverts the migration.
+	Down string
+}
+
+// MigrationStatus is a versioned migration and when it was applied.
+type MigrationStatus struct {
+	Migration
+
+	// AppliedAt is when the migration was applied. It is the zero time if
+	// the migration is pending.
+	AppliedAt time.Time
+}
+
+// Migrations returns the versioned migrations for a dialect, ordered by
+// version.
+func Migrations(dialect string) ([]Migration, error) {
+	dirEntries, err := fs.ReadDir(migrationsFS, "migrations/"+dialect)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %q", dialect)
+	}
+	migrations := make(map[int64]*Migration)
+	for _, dirEntry := range dirEntries {
+		filename := dirEntry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		prefix, name, _ := strings.Cut(strings.TrimSuffix(filename, "."+direction+".sql"), "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrations/%s/%s: filename does not start with a version number", dialect, filename)
+		}
+		b, err := fs.ReadFile(migrationsFS, "migrations/"+dialect+"/"+filename)
+		if err != nil {
+			return nil, err
+		}
+		migration := migrations[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: name}
+			migrations[version] = migration
+		} else if migration.Name != name {
+			return nil, fmt.Errorf("migrations/%s: version %d has two names: %q and %q", dialect, version, migration.Name, name)
+		}
+		if direction == "up" {
+			migration.Up = string(b)
+		} else {
+			migration.Down = string(b)
+		}
+	}
+	list := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migrations/%s: version %d has no up migration", dialect, migration.Version)
+		}
+		list = append(list, *migration)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// MigrationStatuses returns every versioned migration for the database's
+// dialect and when it was applied.
+func (nbrew *Notebrew) MigrationStatuses(ctx context.Context) ([]MigrationStatus, error) {
+	if nbrew.DB == nil {
+		return nil, fmt.Errorf("database is not configured")
+	}
+	migrations, err := Migrations(nbrew.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i].Migration = migration
+	}
+	exists, err := nbrew.schemaMigrationsExists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return statuses, nil
+	}
+	type appliedMigration struct {
+		version   int64
+		appliedAt int64
+	}
+	appliedMigrations, err := sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM schema_migrations",
+	}, func(row *sq.Row) appliedMigration {
+		return appliedMigration{
+			version:   row.Int64("version"),
+			appliedAt: row.Int64("applied_at"),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, appliedMigration := range appliedMigrations {
+		for i := range statuses {
+			if statuses[i].Version == appliedMigration.version {
+				statuses[i].AppliedAt = time.Unix(appliedMigration.appliedAt, 0).UTC()
+				break
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// MigrateUp applies the pending versioned migrations in order, writing the
+// version and name of each migration to w as it is applied. If dryRun is
+// true, the SQL of the pending migrations is written to w instead. It returns
+// the number of pending migrations.
+func (nbrew *Notebrew) MigrateUp(ctx context.Context, w io.Writer, dryRun bool) (int, error) {
+	statuses, err := nbrew.MigrationStatuses(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var pending []Migration
+	for _, status := range statuses {
+		if status.AppliedAt.IsZero() {
+			pending = append(pending, status.Migration)
+		}
+	}
+	if dryRun {
+		for _, migration := range pending {
+			fmt.Fprintf(w, "-- %04d_%s.up.sql\n%s\n", migration.Version, migration.Name, strings.TrimSpace(migration.Up))
+		}
+		return len(pending), nil
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	err = nbrew.createSchemaMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, migration := range pending {
+		err = nbrew.runMigration(ctx, migration.Up, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "INSERT INTO schema_migrations (version, name, applied_at) VALUES ({version}, {name}, {appliedAt})",
+			Values: []any{
+				sq.Int64Param("version", migration.Version),
+				sq.StringParam("name", migration.Name),
+				sq.Int64Param("appliedAt", time.Now().Unix()),
+			},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("%04d_%s.up.sql: %w", migration.Version, migration.Name, err)
+		}
+		fmt.Fprintf(w, "applied %04d_%s\n", migration.Version, migration.Name)
+	}
+	return len(pending), nil
+}
+
+// MigrateDown reverts the last steps applied versioned migrations in reverse
+// order, writing the version and name of each migration to w as it is
+// reverted. If dryRun is true, the SQL of the migrations is written to w
+// instead. It returns the number of migrations reverted.
+func (nbrew *Notebrew) MigrateDown(ctx context.Context, w io.Writer, steps int, dryRun bool) (int, error) {
+	statuses, err := nbrew.MigrationStatuses(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var applied []Migration
+	for i := len(statuses) - 1; i >= 0 && len(applied) < steps; i-- {
+		if !statuses[i].AppliedAt.IsZero() {
+			applied = append(applied, statuses[i].Migration)
+		}
+	}
+	for _, migration := range applied {
+		if migration.Down == "" {
+			return 0, fmt.Errorf("%04d_%s has no down migration", migration.Version, migration.Name)
+		}
+	}
+	if dryRun {
+		for _, migration := range applied {
+			fmt.Fprintf(w, "-- %04d_%s.down.sql\n%s\n", migration.Version, migration.Name, strings.TrimSpace(migration.Down))
+		}
+		return len(applied), nil
+	}
+	for _, migration := range applied {
+		err = nbrew.runMigration(ctx, migration.Down, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "DELETE FROM schema_migrations WHERE version = {version}",
+			Values: []any{
+				sq.Int64Param("version", migration.Version),
+			},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("%04d_%s.down.sql: %w", migration.Version, migration.Name, err)
+		}
+		fmt.Fprintf(w, "reverted %04d_%s\n", migration.Version, migration.Name)
+	}
+	return len(applied), nil
+}
+
+// Automigrate brings the database in line with schema.go (see automigrate)
+// and records every versioned migration as applied, so that switching to
+// versioned migrations later only applies the migrations added after that.
+func (nbrew *Notebrew) Automigrate(ctx context.Context, confirmDestructive bool) error {
+	if nbrew.DB == nil {
+		return fmt.Errorf("database is not configured")
+	}
+	err := automigrate(nbrew.Dialect, nbrew.DB, confirmDestructive)
+	if err != nil {
+		return err
+	}
+	statuses, err := nbrew.MigrationStatuses(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if !status.AppliedAt.IsZero() {
+			continue
+		}
+		_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "INSERT INTO schema_migrations (version, name, applied_at) VALUES ({version}, {name}, {appliedAt})",
+			Values: []any{
+				sq.Int64Param("version", status.Version),
+				sq.StringParam("name", status.Name),
+				sq.Int64Param("appliedAt", time.Now().Unix()),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AutomigrateDryRun returns the SQL that Automigrate would run, including
+// any destructive statements, and the warnings about it.
+func (nbrew *Notebrew) AutomigrateDryRun() (statements string, warnings []string, err error) {
+	if nbrew.DB == nil {
+		return "", nil, fmt.Errorf("database is not configured")
+	}
+	return automigrateDryRun(nbrew.Dialect, nbrew.DB, true)
+}
+
+// migrate is called on startup to bring the database schema up to date
+// according to the migrations config key.
+func (nbrew *Notebrew) migrate(ctx context.Context) error {
+	if nbrew.Config().Migrations != "versioned" {
+		return nbrew.Automigrate(ctx, false)
+	}
+	n, err := nbrew.MigrateUp(ctx, io.Discard, true)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%d pending migration(s): run \"notebrew migrate up\" to apply them", n)
+	}
+	return nil
+}
+
+// runMigration runs the statements in contents followed by the query that
+// records the migration in the schema_migrations table, in a single
+// transaction where the dialect supports it.
+func (nbrew *Notebrew) runMigration(ctx context.Context, contents string, record sq.CustomQuery) error {
+	tx, err := nbrew.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range splitStatements(contents) {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	_, err = sq.ExecContext(ctx, tx, record)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitStatements splits the contents of a migration into statements. A
+// statement ends on a line that ends with a semicolon.
+func splitStatements(contents string) []string {
+	var statements []string
+	var b strings.Builder
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if b.Len() == 0 && (line == "" || strings.HasPrefix(line, "--")) {
+			continue
+		}
+		b.WriteString(line + "\n")
+		if strings.HasSuffix(line, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(b.String()), ";"))
+			b.Reset()
+		}
+	}
+	if statement := strings.TrimSpace(b.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+func (nbrew *Notebrew) schemaMigrationsExists(ctx context.Context) (bool, error) {
+	var format string
+	switch nbrew.Dialect {
+	case "sqlite":
+		format = "SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	case "postgres":
+		format = "SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	case "mysql":
+		format = "SELECT 1 FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'schema_migrations'"
+	default:
+		format = "SELECT 1 FROM information_schema.tables WHERE table_schema = SCHEMA_NAME() AND table_name = 'schema_migrations'"
+	}
+	return sq.FetchExistsContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  format,
+	})
+}
+
+// createSchemaMigrations creates the schema_migrations table if it does not
+// exist. The table definitions match the SCHEMA_MIGRATIONS table in
+// schema.go.
+func (nbrew *Notebrew) createSchemaMigrations(ctx context.Context) error {
+	var query string
+	switch nbrew.Dialect {
+	case "sqlite":
+		query = "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+			"\n    version BIGINT PRIMARY KEY NOT NULL" +
+			"\n    ,name TEXT NOT NULL" +
+			"\n    ,applied_at BIGINT NOT NULL" +
+			"\n)"
+	case "postgres":
+		query = "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+			"\n    version BIGINT NOT NULL" +
+			"\n    ,name VARCHAR(500) NOT NULL" +
+			"\n    ,applied_at BIGINT NOT NULL" +
+			"\n" +
+			"\n    ,CONSTRAINT schema_migrations_version_pkey PRIMARY KEY (version)" +
+			"\n)"
+	case "mysql":
+		query = "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+			"\n    version BIGINT NOT NULL" +
+			"\n    ,name VARCHAR(500) NOT NULL" +
+			"\n    ,applied_at BIGINT NOT NULL" +
+			"\n" +
+			"\n    ,PRIMARY KEY (version)" +
+			"\n)"
+	case "sqlserver":
+		query = "IF OBJECT_ID('schema_migrations', 'U') IS NULL CREATE TABLE schema_migrations (" +
+			"\n    version BIGINT NOT NULL" +
+			"\n    ,name NVARCHAR(500) NOT NULL" +
+			"\n    ,applied_at BIGINT NOT NULL" +
+			"\n" +
+			"\n    ,CONSTRAINT schema_migrations_version_pkey PRIMARY KEY (version)" +
+			"\n)"
+	default:
+		return fmt.Errorf("unsupported dialect %q", nbrew.Dialect)
+	}
+	_, err := nbrew.DB.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,104 @@
+package nb7
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_Migrate(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notebrew.db")+"?_pragma=foreign_keys(ON)")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	defer db.Close()
+	nbrew := &Notebrew{
+		DB:      db,
+		Dialect: "sqlite",
+	}
+	ctx := context.Background()
+
+	// The versioned migrations produce the same schema as automigrate.
+	_, err = nbrew.MigrateUp(ctx, io.Discard, false)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	statements, warnings, err := nbrew.AutomigrateDryRun()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if statements != "" || len(warnings) > 0 {
+		t.Fatalf("%s versioned migrations differ from schema.go:\n%s\n%v", testutil.Callers(), statements, warnings)
+	}
+
+	// Down followed by up round-trips.
+	n, err := nbrew.MigrateDown(ctx, io.Discard, 1, false)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if n != 1 {
+		t.Fatalf("%s reverted %d migrations, want 1", testutil.Callers(), n)
+	}
+	n, err = nbrew.MigrateUp(ctx, io.Discard, false)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if n != 1 {
+		t.Fatalf("%s applied %d migrations, want 1", testutil.Callers(), n)
+	}
+
+	// Automigrate refuses to drop a table unless confirmed.
+	_, err = db.Exec("CREATE TABLE extra (id INT)")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	err = nbrew.Automigrate(ctx, false)
+	var destructiveErr *DestructiveMigrationError
+	if !errors.As(err, &destructiveErr) {
+		t.Fatalf("%s got %v, want a *DestructiveMigrationError", testutil.Callers(), err)
+	}
+	err = nbrew.Automigrate(ctx, true)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	statements, _, err = nbrew.AutomigrateDryRun()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if statements != "" {
+		t.Fatalf("%s schema not up to date after a confirmed automigrate:\n%s", testutil.Callers(), statements)
+	}
+}
+
+func Test_Migrations(t *testing.T) {
+	for _, dialect := range []string{"sqlite", "postgres", "mysql", "sqlserver"} {
+		migrations, err := Migrations(dialect)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		for _, migration := range migrations {
+			if migration.Down == "" {
+				t.Errorf("%s %s: %04d_%s has no down migration", testutil.Callers(), dialect, migration.Version, migration.Name)
+			}
+		}
+	}
+	// Reset tokens stay unique on SQL Server, where a unique constraint
+	// would only allow one user without a reset token.
+	migrations, err := Migrations("sqlserver")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	var up string
+	for _, migration := range migrations {
+		up += migration.Up
+	}
+	if !strings.Contains(up, "CREATE UNIQUE INDEX users_reset_token_hash_idx ON users (reset_token_hash) WHERE reset_token_hash IS NOT NULL;") {
+		t.Errorf("%s: SQL Server migrations do not make reset_token_hash unique", testutil.Callers())
+	}
+}
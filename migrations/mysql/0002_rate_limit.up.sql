@@ -0,0 +1,6 @@
+CREATE TABLE rate_limit (
+    rate_limit_key VARCHAR(500) NOT NULL
+    ,full_at BIGINT NOT NULL
+
+    ,PRIMARY KEY (rate_limit_key)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE rate_limit (
+    rate_limit_key VARCHAR(500) NOT NULL
+    ,full_at BIGINT NOT NULL
+
+    ,CONSTRAINT rate_limit_rate_limit_key_pkey PRIMARY KEY (rate_limit_key)
+);
@@ -0,0 +1,119 @@
+CREATE TABLE site (
+    site_id UUID PRIMARY KEY NOT NULL
+    ,site_name TEXT NOT NULL
+    ,storage_limit INT
+    ,storage_used INT
+
+    ,CONSTRAINT site_site_name_key UNIQUE (site_name)
+);
+
+CREATE TABLE users (
+    user_id UUID PRIMARY KEY NOT NULL
+    ,username TEXT NOT NULL
+    ,email TEXT NOT NULL
+    ,password_hash TEXT
+    ,reset_token_hash BLOB
+    ,failed_logins INT
+    ,totp_secret TEXT
+    ,totp_last_used BIGINT
+
+    ,CONSTRAINT users_username_key UNIQUE (username)
+    ,CONSTRAINT users_username_fkey FOREIGN KEY (username) REFERENCES site (site_name) ON UPDATE CASCADE
+    ,CONSTRAINT users_email_key UNIQUE (email)
+    ,CONSTRAINT users_reset_token_hash_key UNIQUE (reset_token_hash)
+);
+
+CREATE TABLE ip_login (
+    ip TEXT PRIMARY KEY NOT NULL
+    ,failed_logins INT
+);
+
+CREATE TABLE site_user (
+    site_id UUID NOT NULL
+    ,user_id UUID NOT NULL
+    ,role TEXT
+
+    ,CONSTRAINT site_user_site_id_user_id_pkey PRIMARY KEY (site_id, user_id)
+    ,CONSTRAINT site_user_site_id_fkey FOREIGN KEY (site_id) REFERENCES site (site_id) ON UPDATE CASCADE
+    ,CONSTRAINT site_user_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id) ON UPDATE CASCADE
+);
+
+CREATE INDEX site_user_user_id_idx ON site_user (user_id);
+
+CREATE TABLE session (
+    session_token_hash BLOB PRIMARY KEY NOT NULL
+    ,data JSON
+);
+
+CREATE TABLE signup (
+    signup_token_hash BLOB PRIMARY KEY NOT NULL
+);
+
+CREATE TABLE site_invite (
+    site_invite_token_hash BLOB PRIMARY KEY NOT NULL
+    ,site_id UUID NOT NULL
+    ,user_id UUID NOT NULL
+    ,role TEXT
+
+    ,CONSTRAINT site_invite_site_id_fkey FOREIGN KEY (site_id) REFERENCES site (site_id) ON UPDATE CASCADE
+    ,CONSTRAINT site_invite_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id) ON UPDATE CASCADE
+);
+
+CREATE INDEX site_invite_site_id_idx ON site_invite (site_id);
+
+CREATE INDEX site_invite_user_id_idx ON site_invite (user_id);
+
+CREATE TABLE authentication (
+    authentication_token_hash BLOB PRIMARY KEY NOT NULL
+    ,user_id UUID NOT NULL
+    ,created_at BIGINT
+    ,last_seen_at BIGINT
+    ,user_agent TEXT
+    ,ip TEXT
+
+    ,CONSTRAINT authentication_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id) ON UPDATE CASCADE
+);
+
+CREATE INDEX authentication_user_id_idx ON authentication (user_id);
+
+CREATE TABLE recovery_code (
+    recovery_code_hash BLOB PRIMARY KEY NOT NULL
+    ,user_id UUID NOT NULL
+
+    ,CONSTRAINT recovery_code_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id) ON UPDATE CASCADE
+);
+
+CREATE INDEX recovery_code_user_id_idx ON recovery_code (user_id);
+
+CREATE TABLE api_token (
+    api_token_hash BLOB PRIMARY KEY NOT NULL
+    ,user_id UUID NOT NULL
+    ,token_name TEXT NOT NULL
+    ,scopes JSON
+    ,created_at BIGINT
+    ,expires_at BIGINT
+    ,last_used_at BIGINT
+
+    ,CONSTRAINT api_token_user_id_token_name_key UNIQUE (user_id, token_name)
+    ,CONSTRAINT api_token_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id) ON UPDATE CASCADE
+);
+
+CREATE TABLE audit_log (
+    audit_log_id UUID PRIMARY KEY NOT NULL
+    ,logged_at BIGINT NOT NULL
+    ,actor TEXT
+    ,source TEXT
+    ,site_name TEXT
+    ,"action" TEXT NOT NULL
+    ,file_path TEXT
+    ,target TEXT
+    ,ip TEXT
+    ,before_size BIGINT
+    ,before_hash TEXT
+    ,after_size BIGINT
+    ,after_hash TEXT
+);
+
+CREATE INDEX audit_log_logged_at_idx ON audit_log (logged_at);
+
+CREATE INDEX audit_log_site_name_idx ON audit_log (site_name);
@@ -0,0 +1,4 @@
+CREATE TABLE rate_limit (
+    rate_limit_key TEXT PRIMARY KEY NOT NULL
+    ,full_at BIGINT NOT NULL
+);
@@ -0,0 +1,11 @@
+DROP TABLE audit_log;
+DROP TABLE api_token;
+DROP TABLE recovery_code;
+DROP TABLE authentication;
+DROP TABLE site_invite;
+DROP TABLE signup;
+DROP TABLE session;
+DROP TABLE site_user;
+DROP TABLE ip_login;
+DROP TABLE users;
+DROP TABLE site;
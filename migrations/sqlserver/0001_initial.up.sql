@@ -0,0 +1,142 @@
+CREATE TABLE site (
+    site_id BINARY(16) NOT NULL
+    ,site_name NVARCHAR(500) NOT NULL
+    ,storage_limit INT
+    ,storage_used INT
+
+    ,CONSTRAINT site_site_id_pkey PRIMARY KEY (site_id)
+    ,CONSTRAINT site_site_name_key UNIQUE (site_name)
+);
+
+CREATE TABLE users (
+    user_id BINARY(16) NOT NULL
+    ,username NVARCHAR(500) NOT NULL
+    ,email NVARCHAR(500) NOT NULL
+    ,password_hash NVARCHAR(500)
+    ,reset_token_hash BINARY(40)
+    ,failed_logins INT
+    ,totp_secret NVARCHAR(500)
+    ,totp_last_used BIGINT
+
+    ,CONSTRAINT users_user_id_pkey PRIMARY KEY (user_id)
+    ,CONSTRAINT users_username_key UNIQUE (username)
+    ,CONSTRAINT users_email_key UNIQUE (email)
+);
+
+CREATE INDEX users_reset_token_hash_idx ON users (reset_token_hash);
+
+CREATE TABLE ip_login (
+    ip NVARCHAR(500) NOT NULL
+    ,failed_logins INT
+
+    ,CONSTRAINT ip_login_ip_pkey PRIMARY KEY (ip)
+);
+
+CREATE TABLE site_user (
+    site_id BINARY(16) NOT NULL
+    ,user_id BINARY(16) NOT NULL
+    ,role NVARCHAR(500)
+
+    ,CONSTRAINT site_user_site_id_user_id_pkey PRIMARY KEY (site_id, user_id)
+);
+
+CREATE INDEX site_user_user_id_idx ON site_user (user_id);
+
+CREATE TABLE session (
+    session_token_hash BINARY(40) NOT NULL
+    ,data NVARCHAR(MAX)
+
+    ,CONSTRAINT session_session_token_hash_pkey PRIMARY KEY (session_token_hash)
+);
+
+CREATE TABLE signup (
+    signup_token_hash BINARY(40) NOT NULL
+
+    ,CONSTRAINT signup_signup_token_hash_pkey PRIMARY KEY (signup_token_hash)
+);
+
+CREATE TABLE site_invite (
+    site_invite_token_hash BINARY(40) NOT NULL
+    ,site_id BINARY(16) NOT NULL
+    ,user_id BINARY(16) NOT NULL
+    ,role NVARCHAR(500)
+
+    ,CONSTRAINT site_invite_site_invite_token_hash_pkey PRIMARY KEY (site_invite_token_hash)
+);
+
+CREATE INDEX site_invite_site_id_idx ON site_invite (site_id);
+
+CREATE INDEX site_invite_user_id_idx ON site_invite (user_id);
+
+CREATE TABLE authentication (
+    authentication_token_hash BINARY(40) NOT NULL
+    ,user_id BINARY(16) NOT NULL
+    ,created_at BIGINT
+    ,last_seen_at BIGINT
+    ,user_agent NVARCHAR(500)
+    ,ip NVARCHAR(500)
+
+    ,CONSTRAINT authentication_authentication_token_hash_pkey PRIMARY KEY (authentication_token_hash)
+);
+
+CREATE INDEX authentication_user_id_idx ON authentication (user_id);
+
+CREATE TABLE recovery_code (
+    recovery_code_hash BINARY(32) NOT NULL
+    ,user_id BINARY(16) NOT NULL
+
+    ,CONSTRAINT recovery_code_recovery_code_hash_pkey PRIMARY KEY (recovery_code_hash)
+);
+
+CREATE INDEX recovery_code_user_id_idx ON recovery_code (user_id);
+
+CREATE TABLE api_token (
+    api_token_hash BINARY(40) NOT NULL
+    ,user_id BINARY(16) NOT NULL
+    ,token_name NVARCHAR(500) NOT NULL
+    ,scopes NVARCHAR(MAX)
+    ,created_at BIGINT
+    ,expires_at BIGINT
+    ,last_used_at BIGINT
+
+    ,CONSTRAINT api_token_user_id_token_name_key UNIQUE (user_id, token_name)
+    ,CONSTRAINT api_token_api_token_hash_pkey PRIMARY KEY (api_token_hash)
+);
+
+CREATE TABLE audit_log (
+    audit_log_id BINARY(16) NOT NULL
+    ,logged_at BIGINT NOT NULL
+    ,actor NVARCHAR(500)
+    ,source NVARCHAR(500)
+    ,site_name NVARCHAR(500)
+    ,action NVARCHAR(500) NOT NULL
+    ,file_path NVARCHAR(500)
+    ,target NVARCHAR(500)
+    ,ip NVARCHAR(500)
+    ,before_size BIGINT
+    ,before_hash NVARCHAR(500)
+    ,after_size BIGINT
+    ,after_hash NVARCHAR(500)
+
+    ,CONSTRAINT audit_log_audit_log_id_pkey PRIMARY KEY (audit_log_id)
+);
+
+CREATE INDEX audit_log_logged_at_idx ON audit_log (logged_at);
+
+CREATE INDEX audit_log_site_name_idx ON audit_log (site_name);
+
+ALTER TABLE users ADD CONSTRAINT users_username_fkey FOREIGN KEY (username) REFERENCES site (site_name);
+
+ALTER TABLE site_user ADD CONSTRAINT site_user_site_id_fkey FOREIGN KEY (site_id) REFERENCES site (site_id);
+
+ALTER TABLE site_user ADD CONSTRAINT site_user_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id);
+
+ALTER TABLE site_invite ADD CONSTRAINT site_invite_site_id_fkey FOREIGN KEY (site_id) REFERENCES site (site_id);
+
+ALTER TABLE site_invite ADD CONSTRAINT site_invite_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id);
+
+ALTER TABLE authentication ADD CONSTRAINT authentication_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id);
+
+ALTER TABLE recovery_code ADD CONSTRAINT recovery_code_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id);
+
+ALTER TABLE api_token ADD CONSTRAINT api_token_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id);
@@ -0,0 +1,3 @@
+DROP INDEX users_reset_token_hash_idx ON users;
+
+CREATE INDEX users_reset_token_hash_idx ON users (reset_token_hash);
@@ -0,0 +1,6 @@
+-- SQL Server unique constraints allow only one NULL, so reset tokens are
+-- kept unique by a filtered unique index instead. It keeps the name of the
+-- plain index it replaces, which is the index that automigrate looks for.
+DROP INDEX users_reset_token_hash_idx ON users;
+
+CREATE UNIQUE INDEX users_reset_token_hash_idx ON users (reset_token_hash) WHERE reset_token_hash IS NOT NULL;
@@ -15,7 +15,6 @@ import (
 	"net/netip"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,7 +29,26 @@ import (
 	"github.com/mholt/acmez"
 )
 
+// New opens the notebrew instance in fsys (see Open) and brings its database
+// schema up to date according to the migrations config key.
 func New(fsys FS) (*Notebrew, error) {
+	nbrew, err := Open(fsys)
+	if err != nil {
+		return nil, err
+	}
+	if nbrew.DB != nil {
+		err = nbrew.migrate(context.Background())
+		if err != nil {
+			nbrew.Close()
+			return nil, fmt.Errorf("%s: database: %w", nbrew.Config().source("database"), err)
+		}
+	}
+	return nbrew, nil
+}
+
+// Open opens the notebrew instance in fsys without touching its database
+// schema.
+func Open(fsys FS) (*Notebrew, error) {
 	_, err := fs.Stat(rootFS, "embed/top-10000-passwords.txt")
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
@@ -64,221 +82,76 @@ func New(fsys FS) (*Notebrew, error) {
 		return nil, err
 	}
 
-	// Read from config/address.txt.
-	b, err := fs.ReadFile(nbrew.FS, "config/address.txt")
+	config, err := ReadConfig(nbrew.FS)
 	if err != nil {
-		if !errors.Is(err, fs.ErrNotExist) {
-			return nil, fmt.Errorf("%s: %v", filepath.Join(localDir, "config/address.txt"), err)
-		}
-		nbrew.Scheme = "http://"
-		nbrew.AdminDomain = "localhost:6444"
-		nbrew.ContentDomain = "localhost:6444"
-	} else {
-		address := strings.TrimSpace(string(b))
-		if address == "" {
-			nbrew.Scheme = "http://"
-			nbrew.AdminDomain = "localhost:6444"
-			nbrew.ContentDomain = "localhost:6444"
-		} else {
-			lines := strings.Split(address, "\n")
-			if len(lines) == 1 {
-				nbrew.AdminDomain = strings.TrimSpace(lines[0])
-				nbrew.ContentDomain = strings.TrimSpace(lines[0])
-			} else if len(lines) == 2 {
-				nbrew.AdminDomain = strings.TrimSpace(lines[0])
-				nbrew.ContentDomain = strings.TrimSpace(lines[1])
-			} else {
-				return nil, fmt.Errorf("%s contains too many lines, maximum 2 lines."+
-					" The first line is the admin domain, the second line is the content domain."+
-					" Alternatively, if only one line is provided it will be used as as both the admin domain and content domain.",
-					filepath.Join(localDir, "config/address.txt"),
-				)
-			}
-			if strings.Contains(nbrew.AdminDomain, "127.0.0.1") {
-				return nil, fmt.Errorf(
-					"%s: %q: don't use 127.0.0.1, use localhost instead",
-					filepath.Join(localDir, "config/address.txt"),
-					nbrew.AdminDomain,
-				)
-			}
-			if strings.Contains(nbrew.ContentDomain, "127.0.0.1") {
-				return nil, fmt.Errorf(
-					"%s: %q: don't use 127.0.0.1, use localhost instead",
-					filepath.Join(localDir, "config/address.txt"),
-					nbrew.ContentDomain,
-				)
-			}
-			localhostAdmin := nbrew.AdminDomain == "localhost" || strings.HasPrefix(nbrew.AdminDomain, "localhost:")
-			localhostContent := nbrew.ContentDomain == "localhost" || strings.HasPrefix(nbrew.ContentDomain, "localhost:")
-			if localhostAdmin && localhostContent {
-				nbrew.Scheme = "http://"
-				if nbrew.AdminDomain != nbrew.ContentDomain {
-					return nil, fmt.Errorf(
-						"%s: %q, %q: if localhost, addresses must be the same",
-						filepath.Join(localDir, "config/address.txt"),
-						nbrew.AdminDomain,
-						nbrew.ContentDomain,
-					)
-				}
-				if strings.HasPrefix(nbrew.AdminDomain, "localhost:") {
-					_, err = strconv.Atoi(strings.TrimPrefix(nbrew.AdminDomain, "localhost:"))
-					if err != nil {
-						return nil, fmt.Errorf(
-							"%s: %q: localhost port invalid, must be a number e.g. localhost:6444",
-							filepath.Join(localDir, "config/address.txt"),
-							nbrew.AdminDomain,
-						)
-					}
-				}
-				if strings.HasPrefix(nbrew.ContentDomain, "localhost:") {
-					_, err = strconv.Atoi(strings.TrimPrefix(nbrew.ContentDomain, "localhost:"))
-					if err != nil {
-						return nil, fmt.Errorf(
-							"%s: %q: localhost port invalid, must be a number e.g. localhost:6444",
-							filepath.Join(localDir, "config/address.txt"),
-							nbrew.ContentDomain,
-						)
-					}
-				}
-			} else if !localhostAdmin && !localhostContent {
-				nbrew.Scheme = "https://"
-				if !strings.Contains(nbrew.AdminDomain, ".") {
-					return nil, fmt.Errorf("%s: %q is not a valid domain (e.g. example.com):"+
-						" missing a top level domain (.com, .org, .net, etc)",
-						filepath.Join(localDir, "config/address.txt"),
-						nbrew.AdminDomain,
-					)
-				}
-				for _, char := range nbrew.AdminDomain {
-					if (char >= '0' && char <= '9') || (char >= 'a' && char <= 'z') || char == '.' || char == '-' {
-						continue
-					}
-					return nil, fmt.Errorf("%s: %q is not a valid domain:"+
-						" only lowercase letters, numbers, dot and hyphen are allowed e.g. example.com",
-						filepath.Join(localDir, "config/address.txt"),
-						nbrew.AdminDomain,
-					)
-				}
-				if !strings.Contains(nbrew.ContentDomain, ".") {
-					return nil, fmt.Errorf("%s: %q is not a valid domain:"+
-						" missing a top level domain (.com, .org, .net, etc)",
-						filepath.Join(localDir, "config/address.txt"),
-						nbrew.ContentDomain,
-					)
-				}
-				for _, char := range nbrew.ContentDomain {
-					if (char >= '0' && char <= '9') || (char >= 'a' && char <= 'z') || char == '.' || char == '-' {
-						continue
-					}
-					return nil, fmt.Errorf("%s: %q is not a valid domain (e.g. example.com):"+
-						" only lowercase letters, numbers, dot and hyphen are allowed e.g. example.com",
-						filepath.Join(localDir, "config/address.txt"),
-						nbrew.ContentDomain,
-					)
-				}
-			} else {
-				return nil, fmt.Errorf(
-					"%s: %q, %q: localhost and non-localhost addresses cannot be mixed",
-					filepath.Join(localDir, "config/address.txt"),
-					nbrew.AdminDomain,
-					nbrew.ContentDomain,
-				)
-			}
-		}
+		return nil, err
 	}
-
-	// Read from config/multisite.txt.
-	b, err = fs.ReadFile(nbrew.FS, "config/multisite.txt")
+	err = config.Validate()
 	if err != nil {
-		if !errors.Is(err, fs.ErrNotExist) {
-			return nil, fmt.Errorf("%s: %v", filepath.Join(localDir, "config/multisite.txt"), err)
-		}
-	} else {
-		nbrew.MultisiteMode = strings.ToLower(string(b))
+		return nil, err
 	}
-	if nbrew.MultisiteMode != "" && nbrew.MultisiteMode != "subdomain" && nbrew.MultisiteMode != "subdirectory" {
-		return nil, fmt.Errorf(
-			`%s: %q is not a valid multisite value (accepted values: "", "subdomain", "subdirectory")`,
-			filepath.Join(localDir, "config/multisite.txt"),
-			nbrew.MultisiteMode,
-		)
+	nbrew.config.Store(config)
+	nbrew.AdminDomain = config.adminDomain()
+	nbrew.ContentDomain = config.contentDomain()
+	if nbrew.AdminDomain == "localhost" || strings.HasPrefix(nbrew.AdminDomain, "localhost:") {
+		nbrew.Scheme = "http://"
+	} else {
+		nbrew.Scheme = "https://"
 	}
 
-	// Read from config/database.txt.
-	var dsn string
-	b, err = fs.ReadFile(nbrew.FS, "config/database.txt")
-	if err != nil {
-		if !errors.Is(err, fs.ErrNotExist) {
-			return nil, err
-		}
+	dsn := config.Database
+	if dsn == "" {
 		if nbrew.Scheme == "https://" {
-			// If database.txt doesn't exist but we are serving a live site, we
-			// have to create a database. In this case, fall back to an SQLite
-			// database.
+			// If the database isn't configured but we are serving a live site,
+			// we have to create a database. In this case, fall back to an
+			// SQLite database.
 			dsn = "sqlite"
 		}
-	} else {
-		dsn = strings.TrimSpace(string(b))
-		if strings.HasPrefix(dsn, "file:") {
-			filename := strings.TrimPrefix(strings.TrimPrefix(dsn, "file:"), "//")
-			file, err := os.Open(filename)
+	} else if strings.HasPrefix(dsn, "file:") {
+		filename := strings.TrimPrefix(strings.TrimPrefix(dsn, "file:"), "//")
+		file, err := os.Open(filename)
+		if err != nil {
+			ext := filepath.Ext(filename)
+			if errors.Is(err, fs.ErrNotExist) && (ext == ".sqlite" || ext == ".sqlite3" || ext == ".db" || ext == ".db3") {
+				dsn = filename
+			} else {
+				return nil, fmt.Errorf("%s: database: opening %q: %v", config.source("database"), dsn, err)
+			}
+		} else {
+			defer file.Close()
+			r := bufio.NewReader(file)
+			// SQLite databases may also start with a 'file:' prefix. Treat
+			// the contents of the file as a dsn only if the file isn't
+			// already an SQLite database i.e. the first 16 bytes isn't the
+			// SQLite file header.
+			// https://www.sqlite.org/fileformat.html#the_database_header
+			header, err := r.Peek(16)
 			if err != nil {
-				ext := filepath.Ext(filename)
-				if errors.Is(err, fs.ErrNotExist) && (ext == ".sqlite" || ext == ".sqlite3" || ext == ".db" || ext == ".db3") {
-					dsn = filename
-				} else {
-					return nil, fmt.Errorf("%s: opening %q: %v", filepath.Join(localDir, "config/database.txt"), dsn, err)
-				}
+				return nil, fmt.Errorf("%s: database: reading %q: %v", config.source("database"), dsn, err)
+			}
+			if string(header) == "SQLite format 3\x00" {
+				dsn = "sqlite:" + filename
 			} else {
-				defer file.Close()
-				r := bufio.NewReader(file)
-				// SQLite databases may also start with a 'file:' prefix. Treat
-				// the contents of the file as a dsn only if the file isn't
-				// already an SQLite database i.e. the first 16 bytes isn't the
-				// SQLite file header.
-				// https://www.sqlite.org/fileformat.html#the_database_header
-				header, err := r.Peek(16)
+				var b strings.Builder
+				_, err = r.WriteTo(&b)
 				if err != nil {
-					return nil, fmt.Errorf("%s: reading %q: %v", filepath.Join(localDir, "config/database.txt"), dsn, err)
-				}
-				if string(header) == "SQLite format 3\x00" {
-					dsn = "sqlite:" + filename
-				} else {
-					var b strings.Builder
-					_, err = r.WriteTo(&b)
-					if err != nil {
-						return nil, fmt.Errorf("%s: reading %q: %v", filepath.Join(localDir, "config/database.txt"), dsn, err)
-					}
-					dsn = strings.TrimSpace(b.String())
+					return nil, fmt.Errorf("%s: database: reading %q: %v", config.source("database"), dsn, err)
 				}
+				dsn = strings.TrimSpace(b.String())
 			}
 		}
 	}
 	if dsn != "" {
 		// Determine the database dialect from the dsn.
+		nbrew.Dialect = databaseDialect(dsn)
+		if nbrew.Dialect == "" {
+			return nil, fmt.Errorf("%s: database: unknown or unsupported dataSourceName %q", config.source("database"), dsn)
+		}
 		if dsn == "sqlite" {
-			nbrew.Dialect = "sqlite"
 			if localDir == "" {
 				return nil, fmt.Errorf("unable to create sqlite database")
 			}
 			dsn = filepath.Join(localDir, "notebrew.db")
-		} else if strings.HasPrefix(dsn, "sqlite:") || strings.HasPrefix(dsn, "sqlite3:") {
-			nbrew.Dialect = "sqlite"
-		} else if strings.HasPrefix(dsn, "postgres://") {
-			nbrew.Dialect = "postgres"
-		} else if strings.HasPrefix(dsn, "mysql://") {
-			nbrew.Dialect = "mysql"
-		} else if strings.HasPrefix(dsn, "sqlserver://") {
-			nbrew.Dialect = "sqlserver"
-		} else if strings.Contains(dsn, "@tcp(") || strings.Contains(dsn, "@unix(") {
-			nbrew.Dialect = "mysql"
-		} else {
-			ext := filepath.Ext(dsn)
-			if ext == ".sqlite" || ext == ".sqlite3" || ext == ".db" || ext == ".db3" {
-				nbrew.Dialect = "sqlite"
-			} else {
-				return nil, fmt.Errorf("%s: unknown or unsupported dataSourceName %q", filepath.Join(localDir, "config/database.txt"), dsn)
-			}
 		}
 		// Set a default driverName depending on the dialect.
 		var driverName string
@@ -334,13 +207,20 @@ func New(fsys FS) (*Notebrew, error) {
 		nbrew.DB, err = sql.Open(driverName, dsn)
 		if err != nil {
 			return nil, fmt.Errorf(
-				"%s: opening database with driverName %q and dsn %q: %w",
-				filepath.Join(localDir, "config/database.txt"),
+				"%s: database: opening database with driverName %q and dsn %q: %w",
+				config.source("database"),
 				driverName,
 				dsn,
 				err,
 			)
 		}
+		if nbrew.Dialect == "sqlite" {
+			nbrew.DB, err = sqliteDB(nbrew.DB, dsn, config.SQLite)
+			if err != nil {
+				return nil, fmt.Errorf("%s: database: opening %q: %w", config.source("database"), dsn, err)
+			}
+		}
+		setPoolConfig(nbrew.DB, config.DatabasePool)
 		if nbrew.Dialect == "sqlite" {
 			rows, err := nbrew.DB.Query("PRAGMA quick_check")
 			if err != nil {
@@ -363,13 +243,25 @@ func New(fsys FS) (*Notebrew, error) {
 				}
 				return nil, fmt.Errorf("the sqlite database %q is corrupted, please remove the file or fix it: %s", dsn, string(b))
 			}
-		}
-		err = automigrate(nbrew.Dialect, nbrew.DB)
-		if err != nil {
-			return nil, fmt.Errorf("%s: automigrate failed: %w", filepath.Join(localDir, "config/database.txt"), err)
+		} else {
+			readyTimeout := 30 * time.Second
+			if config.DatabasePool.ReadyTimeout != "" {
+				// The duration has already been validated by Config.Validate.
+				readyTimeout, _ = time.ParseDuration(config.DatabasePool.ReadyTimeout)
+			}
+			err = waitForDB(context.Background(), nbrew.DB, readyTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("%s: database: %w", config.source("database"), err)
+			}
 		}
 	}
 
+	if config.RateLimits.Store == "database" && nbrew.DB != nil {
+		nbrew.RateLimitStore = &DatabaseRateLimitStore{Notebrew: nbrew}
+	} else {
+		nbrew.RateLimitStore = &MemoryRateLimitStore{}
+	}
+
 	dirs := []string{
 		"notes",
 		"output",
@@ -406,103 +298,60 @@ func (nbrew *Notebrew) NewServer() (*http.Server, error) {
 		return nil, fmt.Errorf("ContentDomain cannot be empty")
 	}
 	server.Addr = ":443"
-	localDir, err := filepath.Abs(fmt.Sprint(nbrew.FS))
-	if err == nil {
-		fileInfo, err := os.Stat(localDir)
-		if err != nil || !fileInfo.IsDir() {
-			localDir = ""
-		}
-	}
+	config := nbrew.Config()
 	var dns01Solver acmez.Solver
-	b, err := fs.ReadFile(nbrew.FS, "config/dns01.json")
-	if err != nil {
-		if !errors.Is(err, fs.ErrNotExist) {
-			return nil, err
+	// The dns01 credentials have already been validated by Config.Validate.
+	switch config.DNS01.Provider {
+	case "":
+		break
+	case "namecheap":
+		resp, err := http.Get("https://ipv4.icanhazip.com")
+		if err != nil {
+			return nil, fmt.Errorf("determining the IP address of this machine by calling https://ipv4.icanhazip.com: %w", err)
 		}
-	} else {
-		var config map[string]string
-		err = json.Unmarshal(b, &config)
+		defer resp.Body.Close()
+		var b strings.Builder
+		_, err = io.Copy(&b, resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("https://ipv4.icanhazip.com: reading response body: %w", err)
+		}
+		clientIP := strings.TrimSpace(b.String())
+		ip, err := netip.ParseAddr(clientIP)
 		if err != nil {
-			return nil, fmt.Errorf("%s: unmarshaling %q into map[string]string: %w", filepath.Join(localDir, "config/dns01.json"), string(b), err)
+			return nil, fmt.Errorf("could not determine IP address of the current machine: https://ipv4.icanhazip.com returned %q which is not an IP address", clientIP)
 		}
-		provider, ok := config["provider"]
-		if !ok {
-			return nil, fmt.Errorf("%s: no provider specified", filepath.Join(localDir, "config/dns01.json"))
+		if !ip.Is4() {
+			return nil, fmt.Errorf("the current machine's IP address (%s) is not IPv4: an IPv4 address is needed to integrate with namecheap's API, which is needed for free SSL certficates for your subdomains: if you are unable to obtain an IPv4 address, consider using the \"subdirectory\" multisite mode instead of \"subdomain\"", clientIP)
 		}
-		switch provider {
-		case "namecheap":
-			username := config["username"]
-			if username == "" {
-				return nil, fmt.Errorf("%s: namecheap: username missing", filepath.Join(localDir, "config/dns01.json"))
-			}
-			apiKey := config["apiKey"]
-			if apiKey == "" {
-				return nil, fmt.Errorf("%s: namecheap: apiKey missing", filepath.Join(localDir, "config/dns01.json"))
-			}
-			resp, err := http.Get("https://ipv4.icanhazip.com")
-			if err != nil {
-				return nil, fmt.Errorf("determining the IP address of this machine by calling https://ipv4.icanhazip.com: %w", err)
-			}
-			defer resp.Body.Close()
-			var b strings.Builder
-			_, err = io.Copy(&b, resp.Body)
-			if err != nil {
-				return nil, fmt.Errorf("https://ipv4.icanhazip.com: reading response body: %w", err)
-			}
-			clientIP := strings.TrimSpace(b.String())
-			ip, err := netip.ParseAddr(clientIP)
-			if err != nil {
-				return nil, fmt.Errorf("could not determine IP address of the current machine: https://ipv4.icanhazip.com returned %q which is not an IP address", clientIP)
-			}
-			if !ip.Is4() {
-				return nil, fmt.Errorf("the current machine's IP address (%s) is not IPv4: an IPv4 address is needed to integrate with namecheap's API, which is needed for free SSL certficates for your subdomains: if you are unable to obtain an IPv4 address, consider using the \"subdirectory\" multisite mode instead of \"subdomain\"", clientIP)
-			}
-			dns01Solver = &certmagic.DNS01Solver{
-				DNSProvider: &namecheap.Provider{
-					APIKey:      apiKey,
-					User:        username,
-					APIEndpoint: "https://api.namecheap.com/xml.response",
-					ClientIP:    clientIP,
-				},
-			}
-		case "cloudflare":
-			apiToken := config["apiToken"]
-			if apiToken == "" {
-				return nil, fmt.Errorf("%s: cloudflare: apiToken missing", filepath.Join(localDir, "config/dns01.json"))
-			}
-			dns01Solver = &certmagic.DNS01Solver{
-				DNSProvider: &cloudflare.Provider{
-					APIToken: apiToken,
-				},
-			}
-		case "porkbun":
-			apiKey := config["apiKey"]
-			if apiKey == "" {
-				return nil, fmt.Errorf("%s: porkbun: apiKey missing", filepath.Join(localDir, "config/dns01.json"))
-			}
-			secretKey := config["secretKey"]
-			if secretKey == "" {
-				return nil, fmt.Errorf("%s: porkbun: secretKey missing", filepath.Join(localDir, "config/dns01.json"))
-			}
-			dns01Solver = &certmagic.DNS01Solver{
-				DNSProvider: &porkbun.Provider{
-					APIKey:       apiKey,
-					APISecretKey: secretKey,
-				},
-			}
-		case "godaddy":
-			apiToken := config["apiToken"]
-			if apiToken == "" {
-				return nil, fmt.Errorf("%s: godaddy: apiToken missing", filepath.Join(localDir, "config/dns01.json"))
-			}
-			dns01Solver = &certmagic.DNS01Solver{
-				DNSProvider: &godaddy.Provider{
-					APIToken: apiToken,
-				},
-			}
-		default:
-			return nil, fmt.Errorf("%s: unsupported provider %q", filepath.Join(localDir, "config/dns01.json"), provider)
+		dns01Solver = &certmagic.DNS01Solver{
+			DNSProvider: &namecheap.Provider{
+				APIKey:      config.DNS01.APIKey,
+				User:        config.DNS01.Username,
+				APIEndpoint: "https://api.namecheap.com/xml.response",
+				ClientIP:    clientIP,
+			},
+		}
+	case "cloudflare":
+		dns01Solver = &certmagic.DNS01Solver{
+			DNSProvider: &cloudflare.Provider{
+				APIToken: config.DNS01.APIToken,
+			},
+		}
+	case "porkbun":
+		dns01Solver = &certmagic.DNS01Solver{
+			DNSProvider: &porkbun.Provider{
+				APIKey:       config.DNS01.APIKey,
+				APISecretKey: config.DNS01.SecretKey,
+			},
+		}
+	case "godaddy":
+		dns01Solver = &certmagic.DNS01Solver{
+			DNSProvider: &godaddy.Provider{
+				APIToken: config.DNS01.APIToken,
+			},
 		}
+	default:
+		return nil, fmt.Errorf("%s: dns01.provider: unsupported provider %q", config.source("dns01.provider"), config.DNS01.Provider)
 	}
 	domains := []string{nbrew.AdminDomain}
 	if nbrew.AdminDomain == nbrew.ContentDomain {
@@ -510,9 +359,9 @@ func (nbrew *Notebrew) NewServer() (*http.Server, error) {
 	} else {
 		domains = append(domains, nbrew.ContentDomain, "www."+nbrew.ContentDomain)
 	}
-	if nbrew.MultisiteMode == "subdomain" {
+	if nbrew.multisiteMode() == "subdomain" {
 		if certmagic.DefaultACME.CA == certmagic.LetsEncryptProductionCA && dns01Solver == nil {
-			return nil, fmt.Errorf(`%s: "subdomain" not supported because DNS-01 solver not configured, please use "subdirectory" instead (more info: https://notebrew.com/path/to/docs/)`, filepath.Join(localDir, "config/multisite.txt"))
+			return nil, fmt.Errorf(`%s: multisite: "subdomain" not supported because DNS-01 solver not configured, please configure dns01 or use "subdirectory" instead (more info: https://notebrew.com/path/to/docs/)`, config.source("multisite"))
 		}
 		domains = append(domains, "*."+nbrew.ContentDomain)
 	}
@@ -532,7 +381,7 @@ func (nbrew *Notebrew) NewServer() (*http.Server, error) {
 		}),
 	}
 	fmt.Printf("notebrew managing domains: %v\n", strings.Join(domains, ", "))
-	err = certConfig.ManageSync(context.Background(), domains)
+	err := certConfig.ManageSync(context.Background(), domains)
 	if err != nil {
 		return nil, err
 	}
@@ -616,6 +465,7 @@ func (nbrew *Notebrew) NewServer() (*http.Server, error) {
 }
 
 func (nbrew *Notebrew) Close() error {
+	nbrew.stopJobs()
 	if nbrew.DB == nil {
 		return nil
 	}
@@ -634,7 +484,7 @@ var (
 // particular dialect. It is not necessary to implement all fields.
 type Driver struct {
 	// (Required) Dialect is the database dialect. Possible values: "sqlite", "postgres",
-	// "mysql".
+	// "mysql", "sqlserver".
 	Dialect string
 
 	// (Required) DriverName is the driverName to be used with sql.Open().
@@ -27,8 +27,10 @@ import (
 	"path"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -56,8 +58,8 @@ type Notebrew struct {
 	// DB is the database associated with the notebrew instance.
 	DB *sql.DB
 
-	// Dialect is dialect of the database. Only sqlite, postgres and mysql
-	// databases are supported.
+	// Dialect is dialect of the database. Only sqlite, postgres, mysql and
+	// sqlserver databases are supported.
 	Dialect string
 
 	Scheme string // http:// | https://
@@ -66,7 +68,9 @@ type Notebrew struct {
 
 	ContentDomain string // localhost:6444, example.com
 
-	MultisiteMode string // subdomain | subdirectory
+	// MultisiteMode is subdomain, subdirectory or empty. If empty, the
+	// multisite config key is used.
+	MultisiteMode string
 
 	// ErrorCode translates a database error into an dialect-specific error
 	// code. If the error is not a database error or if no underlying
@@ -76,6 +80,70 @@ type Notebrew struct {
 	FTS *FTS
 
 	Logger *slog.Logger
+
+	// SessionIdleTimeout is how long an authentication session may go unused
+	// before it expires. If zero, the sessions.idleTimeout config key is
+	// used, which defaults to 30 days.
+	SessionIdleTimeout time.Duration
+
+	// SessionMaxAge is how long an authentication session lasts after
+	// logging in regardless of activity. If zero, the sessions.maxAge config
+	// key is used, which defaults to 365 days.
+	SessionMaxAge time.Duration
+
+	// TrashRetention is how long deleted items are kept in a site's trash
+	// before they are purged. If zero, the trash.retention config key is
+	// used, which defaults to 30 days.
+	TrashRetention time.Duration
+
+	// MaxRevisions is how many prior revisions are kept for each note,
+	// post, page and theme file. If zero, the revisions.maxRevisions config
+	// key is used, which defaults to 50. If negative, no revisions are kept.
+	MaxRevisions int
+
+	// WebmentionSender sends webmentions for the links in new, changed and
+	// deleted posts of sites that have webmentions turned on. If nil, no
+	// webmentions are sent.
+	WebmentionSender *WebmentionSender
+
+	// RateLimitStore holds the token buckets that login, signup, password
+	// reset and write requests are rate limited by. If nil, requests are
+	// not rate limited.
+	RateLimitStore RateLimitStore
+
+	// config is the current config snapshot, swapped out by ReloadConfig.
+	config atomic.Pointer[Config]
+
+	jobScheduler jobScheduler
+
+	proofOfWork proofOfWork
+}
+
+func (nbrew *Notebrew) multisiteMode() string {
+	if nbrew.MultisiteMode != "" {
+		return nbrew.MultisiteMode
+	}
+	return nbrew.Config().Multisite
+}
+
+func (nbrew *Notebrew) sessionIdleTimeout() time.Duration {
+	if nbrew.SessionIdleTimeout > 0 {
+		return nbrew.SessionIdleTimeout
+	}
+	if idleTimeout, _ := time.ParseDuration(nbrew.Config().Sessions.IdleTimeout); idleTimeout > 0 {
+		return idleTimeout
+	}
+	return 30 * 24 * time.Hour
+}
+
+func (nbrew *Notebrew) sessionMaxAge() time.Duration {
+	if nbrew.SessionMaxAge > 0 {
+		return nbrew.SessionMaxAge
+	}
+	if maxAge, _ := time.ParseDuration(nbrew.Config().Sessions.MaxAge); maxAge > 0 {
+		return maxAge
+	}
+	return 365 * 24 * time.Hour
 }
 
 func (nbrew *Notebrew) setSession(w http.ResponseWriter, r *http.Request, name string, value any) error {
@@ -234,6 +302,19 @@ func getAuthenticationTokenHash(r *http.Request) []byte {
 	return authenticationTokenHash[:]
 }
 
+// truncateUserAgent truncates a user agent so that it fits inside the
+// authentication table's user_agent column.
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) <= 500 {
+		return userAgent
+	}
+	n := 500
+	for n > 0 && !utf8.RuneStart(userAgent[n]) {
+		n--
+	}
+	return userAgent[:n]
+}
+
 func hashToken(token []byte) []byte {
 	var hashedToken [8 + blake2b.Size256]byte
 	checksum := blake2b.Sum256(token[8:])
@@ -255,7 +336,7 @@ func (nbrew *Notebrew) IsKeyViolation(err error) bool {
 	case "mysql":
 		return errcode == "1062" // ER_DUP_ENTRY
 	case "sqlserver":
-		return errcode == "2627"
+		return errcode == "2627" || errcode == "2601" // unique constraint violation, unique index violation
 	default:
 		return false
 	}
@@ -274,7 +355,7 @@ func (nbrew *Notebrew) IsForeignKeyViolation(err error) bool {
 	case "mysql":
 		return errcode == "1216" // ER_NO_REFERENCED_ROW
 	case "sqlserver":
-		return errcode == "547"
+		return errcode == "547" // constraint conflict (foreign key or check)
 	default:
 		return false
 	}
@@ -484,32 +565,93 @@ var bufPool = sync.Pool{
 	New: func() any { return &bytes.Buffer{} },
 }
 
-func getIP(r *http.Request) string {
-	// Get IP from the X-REAL-IP header
-	ip := r.Header.Get("X-REAL-IP")
-	_, err := netip.ParseAddr(ip)
-	if err == nil {
-		return ip
-	}
-	// Get IP from X-FORWARDED-FOR header
-	ips := r.Header.Get("X-FORWARDED-FOR")
-	splitIps := strings.Split(ips, ",")
-	for _, ip := range splitIps {
-		_, err = netip.ParseAddr(ip)
-		if err == nil {
-			return ip
-		}
+// getIP returns the IP address of the client that made the request. The
+// Forwarded, X-Forwarded-For and X-Real-IP headers are only consulted if the
+// request came from a trusted proxy (see ProxyConfig), otherwise anyone
+// could spoof their IP address by setting them. The forwarding headers are
+// walked from the right, skipping trusted proxies, because only the entries
+// appended by trusted proxies can be relied upon.
+func (nbrew *Notebrew) getIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
 	}
-	// Get IP from RemoteAddr
-	ip, _, err = net.SplitHostPort(r.RemoteAddr)
+	remoteAddr, err := netip.ParseAddr(host)
 	if err != nil {
 		return ""
 	}
-	_, err = netip.ParseAddr(ip)
-	if err == nil {
-		return ip
+	remoteAddr = remoteAddr.Unmap()
+	trustedProxies := nbrew.Config().trustedProxies()
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trustedProxies {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	if !isTrusted(remoteAddr) {
+		return remoteAddr.String()
+	}
+	var forwardedFor []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		forwardedFor = parseForwarded(values)
+	} else if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			forwardedFor = append(forwardedFor, strings.Split(value, ",")...)
+		}
+	} else if value := r.Header.Get("X-Real-IP"); value != "" {
+		forwardedFor = []string{value}
+	}
+	clientAddr := remoteAddr
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		addr, err := parseForwardedAddr(forwardedFor[i])
+		if err != nil {
+			// The hop before a malformed (or obfuscated) entry cannot be
+			// traced, so settle for the last proxy that could.
+			break
+		}
+		clientAddr = addr
+		if !isTrusted(addr) {
+			break
+		}
+	}
+	return clientAddr.String()
+}
+
+// parseForwarded returns the for= parameters of the Forwarded headers
+// (RFC 7239) in order.
+func parseForwarded(values []string) []string {
+	var forwardedFor []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if !strings.EqualFold(name, "for") {
+					continue
+				}
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+				forwardedFor = append(forwardedFor, value)
+			}
+		}
 	}
-	return ""
+	return forwardedFor
+}
+
+// parseForwardedAddr parses an IP address from a forwarding header, which
+// may have a port and IPv6 addresses may be in square brackets.
+func parseForwardedAddr(value string) (netip.Addr, error) {
+	value = strings.TrimSpace(value)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
 }
 
 func serveFile(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string, checkForGzipFallback bool) {
@@ -957,7 +1099,13 @@ func executeTemplate(w http.ResponseWriter, r *http.Request, modtime time.Time,
 	http.ServeContent(w, r, "", modtime, bytes.NewReader(buf.Bytes()))
 }
 
-func contentSecurityPolicy(w http.ResponseWriter, cdnBaseURL string, allowCaptcha bool) {
+// contentSecurityPolicy sets the Content-Security-Policy header. If captcha
+// is not nil, the origins of its captcha widget are allowed.
+func contentSecurityPolicy(w http.ResponseWriter, cdnBaseURL string, captcha CaptchaProvider) {
+	var captchaOrigins string
+	if captcha != nil {
+		captchaOrigins = strings.Join(captcha.Origins(), " ")
+	}
 	var b strings.Builder
 	// default-src
 	b.WriteString("default-src 'none';")
@@ -966,14 +1114,14 @@ func contentSecurityPolicy(w http.ResponseWriter, cdnBaseURL string, allowCaptch
 	if cdnBaseURL != "" {
 		b.WriteString(" " + cdnBaseURL)
 	}
-	if allowCaptcha {
-		b.WriteString(" https://hcaptcha.com https://*.hcaptcha.com")
+	if captchaOrigins != "" {
+		b.WriteString(" " + captchaOrigins)
 	}
 	b.WriteString(";")
 	// connect-src
 	b.WriteString(" connect-src 'self'")
-	if allowCaptcha {
-		b.WriteString(" https://hcaptcha.com https://*.hcaptcha.com")
+	if captchaOrigins != "" {
+		b.WriteString(" " + captchaOrigins)
 	}
 	b.WriteString(";")
 	// img-src
@@ -987,8 +1135,8 @@ func contentSecurityPolicy(w http.ResponseWriter, cdnBaseURL string, allowCaptch
 	if cdnBaseURL != "" {
 		b.WriteString(" " + cdnBaseURL)
 	}
-	if allowCaptcha {
-		b.WriteString(" https://hcaptcha.com https://*.hcaptcha.com")
+	if captchaOrigins != "" {
+		b.WriteString(" " + captchaOrigins)
 	}
 	b.WriteString(";")
 	// base-uri
@@ -998,8 +1146,8 @@ func contentSecurityPolicy(w http.ResponseWriter, cdnBaseURL string, allowCaptch
 	// manifest-src
 	b.WriteString(" manifest-src 'self';")
 	// frame-src
-	if allowCaptcha {
-		b.WriteString(" frame-src https://hcaptcha.com https://*.hcaptcha.com;")
+	if captchaOrigins != "" {
+		b.WriteString(" frame-src " + captchaOrigins + ";")
 	}
 	w.Header().Set("Content-Security-Policy", b.String())
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bokwoon95/nb7"
+	"github.com/bokwoon95/sq"
+)
+
+type APITokenCmd struct {
+	Notebrew  *nb7.Notebrew
+	Stdout    io.Writer
+	Action    string // "create" | "list" | "revoke"
+	Username  string
+	Name      string
+	Scopes    []string
+	ExpiresIn time.Duration
+}
+
+func APITokenCommand(nbrew *nb7.Notebrew, args ...string) (*APITokenCmd, error) {
+	var cmd APITokenCmd
+	cmd.Notebrew = nbrew
+	if len(args) == 0 {
+		return nil, fmt.Errorf("create, list or revoke required")
+	}
+	cmd.Action, args = args[0], args[1:]
+	var username, name sql.NullString
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("user", "", func(s string) error {
+		username = sql.NullString{String: strings.TrimPrefix(s, "@"), Valid: true}
+		return nil
+	})
+	if cmd.Action == "create" || cmd.Action == "revoke" {
+		flagset.Func("name", "Name of the API token.", func(s string) error {
+			name = sql.NullString{String: strings.TrimSpace(s), Valid: true}
+			return nil
+		})
+	}
+	if cmd.Action == "create" {
+		flagset.Func("scope", "Scope granted to the API token (read, write:<site> or write:<site>/<folder>). Can be repeated.", func(s string) error {
+			err := nb7.ValidateAPITokenScope(s)
+			if err != nil {
+				return err
+			}
+			cmd.Scopes = append(cmd.Scopes, s)
+			return nil
+		})
+		flagset.DurationVar(&cmd.ExpiresIn, "expires", 0, "How long until the API token expires e.g. 720h. Defaults to never.")
+	}
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew token create -user <username> -name <name> -scope <scope> [-scope <scope>...] [-expires <duration>]
+  notebrew token list -user <username>
+  notebrew token revoke -user <username> -name <name>
+Scopes:
+  read                    read-only access to every site the user belongs to
+  write:<site>            read and write access to a site e.g. write:@alice, write:/ for the main site
+  write:<site>/<folder>   write access to a folder within a site e.g. write:@alice/posts
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	switch cmd.Action {
+	case "create", "list", "revoke":
+		break
+	default:
+		flagset.Usage()
+		return nil, fmt.Errorf("unknown subcommand %q", cmd.Action)
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	if !username.Valid {
+		flagset.Usage()
+		return nil, fmt.Errorf("-user required")
+	}
+	cmd.Username = username.String
+	if cmd.Action == "create" || cmd.Action == "revoke" {
+		if !name.Valid || name.String == "" {
+			flagset.Usage()
+			return nil, fmt.Errorf("-name required")
+		}
+		cmd.Name = name.String
+	}
+	if cmd.Action == "create" {
+		if len(cmd.Scopes) == 0 {
+			flagset.Usage()
+			return nil, fmt.Errorf("at least one -scope required")
+		}
+		if cmd.ExpiresIn < 0 {
+			return nil, fmt.Errorf("-expires cannot be negative")
+		}
+	}
+	return &cmd, nil
+}
+
+func (cmd *APITokenCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	exists, err := sq.FetchExists(cmd.Notebrew.DB, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  "SELECT 1 FROM users WHERE username = {username}",
+		Values: []any{
+			sq.StringParam("username", cmd.Username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %q does not exist", cmd.Username)
+	}
+	switch cmd.Action {
+	case "create":
+		exists, err := sq.FetchExists(cmd.Notebrew.DB, sq.CustomQuery{
+			Dialect: cmd.Notebrew.Dialect,
+			Format: "SELECT 1" +
+				" FROM api_token" +
+				" JOIN users ON users.user_id = api_token.user_id" +
+				" WHERE users.username = {username} AND api_token.token_name = {name}",
+			Values: []any{
+				sq.StringParam("username", cmd.Username),
+				sq.StringParam("name", cmd.Name),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("API token %q already exists", cmd.Name)
+		}
+		token, tokenHash, err := nb7.NewAPIToken()
+		if err != nil {
+			return err
+		}
+		scopes, err := json.Marshal(cmd.Scopes)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		var expiresAt sql.NullInt64
+		if cmd.ExpiresIn > 0 {
+			expiresAt = sql.NullInt64{Int64: now.Add(cmd.ExpiresIn).Unix(), Valid: true}
+		}
+		_, err = sq.Exec(cmd.Notebrew.DB, sq.CustomQuery{
+			Dialect: cmd.Notebrew.Dialect,
+			Format: "INSERT INTO api_token (api_token_hash, user_id, token_name, scopes, created_at, expires_at)" +
+				" VALUES ({apiTokenHash}, (SELECT user_id FROM users WHERE username = {username}), {name}, {scopes}, {createdAt}, {expiresAt})",
+			Values: []any{
+				sq.BytesParam("apiTokenHash", tokenHash),
+				sq.StringParam("username", cmd.Username),
+				sq.StringParam("name", cmd.Name),
+				sq.StringParam("scopes", string(scopes)),
+				sq.Int64Param("createdAt", now.Unix()),
+				sq.Param("expiresAt", expiresAt),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+			IsAccount: true,
+			Action:    "createtoken",
+			Target:    cmd.Username + "/" + cmd.Name,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.Stdout, token)
+	case "list":
+		type APIToken struct {
+			Name       string
+			Scopes     []byte
+			CreatedAt  sql.NullInt64
+			ExpiresAt  sql.NullInt64
+			LastUsedAt sql.NullInt64
+		}
+		apiTokens, err := sq.FetchAll(cmd.Notebrew.DB, sq.CustomQuery{
+			Dialect: cmd.Notebrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM api_token" +
+				" JOIN users ON users.user_id = api_token.user_id" +
+				" WHERE users.username = {username}" +
+				" ORDER BY api_token.created_at DESC",
+			Values: []any{
+				sq.StringParam("username", cmd.Username),
+			},
+		}, func(row *sq.Row) APIToken {
+			return APIToken{
+				Name:       row.String("api_token.token_name"),
+				Scopes:     row.Bytes("api_token.scopes"),
+				CreatedAt:  row.NullInt64("api_token.created_at"),
+				ExpiresAt:  row.NullInt64("api_token.expires_at"),
+				LastUsedAt: row.NullInt64("api_token.last_used_at"),
+			}
+		})
+		if err != nil {
+			return err
+		}
+		formatTime := func(t sql.NullInt64, fallback string) string {
+			if !t.Valid {
+				return fallback
+			}
+			return time.Unix(t.Int64, 0).UTC().Format("2006-01-02 15:04:05Z")
+		}
+		tw := tabwriter.NewWriter(cmd.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+		for _, apiToken := range apiTokens {
+			var scopes []string
+			if len(apiToken.Scopes) > 0 {
+				err := json.Unmarshal(apiToken.Scopes, &scopes)
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				apiToken.Name,
+				strings.Join(scopes, " "),
+				formatTime(apiToken.CreatedAt, "-"),
+				formatTime(apiToken.ExpiresAt, "never"),
+				formatTime(apiToken.LastUsedAt, "never"),
+			)
+		}
+		return tw.Flush()
+	case "revoke":
+		result, err := sq.Exec(cmd.Notebrew.DB, sq.CustomQuery{
+			Dialect: cmd.Notebrew.Dialect,
+			Format: "DELETE FROM api_token" +
+				" WHERE user_id = (SELECT user_id FROM users WHERE username = {username})" +
+				" AND token_name = {name}",
+			Values: []any{
+				sq.StringParam("username", cmd.Username),
+				sq.StringParam("name", cmd.Name),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("API token not found")
+		}
+		err = writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+			IsAccount: true,
+			Action:    "revoketoken",
+			Target:    cmd.Username + "/" + cmd.Name,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "revoked API token %s\n", cmd.Name)
+	}
+	return nil
+}
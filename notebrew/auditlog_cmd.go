@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/nb7"
+)
+
+type AuditlogCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdout   io.Writer
+	Filter   nb7.AuditFilter
+}
+
+func AuditlogCommand(nbrew *nb7.Notebrew, args ...string) (*AuditlogCmd, error) {
+	var cmd AuditlogCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("site", "Only export entries for this site. Use -site \"\" for the main site.", func(s string) error {
+		cmd.Filter.SiteName = sql.NullString{String: strings.TrimPrefix(s, "@"), Valid: true}
+		return nil
+	})
+	flagset.Func("since", "Only export entries at or after this time, either a timestamp (2006-01-02 15:04:05) or a duration before now (72h).", func(s string) error {
+		since, err := parseSince(s)
+		if err != nil {
+			return err
+		}
+		cmd.Filter.Since = since
+		return nil
+	})
+	flagset.Func("until", "Only export entries before this time.", func(s string) error {
+		until, err := parseSince(s)
+		if err != nil {
+			return err
+		}
+		cmd.Filter.Until = until
+		return nil
+	})
+	flagset.StringVar(&cmd.Filter.Actor, "actor", "", "Only export entries by this user.")
+	flagset.StringVar(&cmd.Filter.Action, "action", "", "Only export entries with this action e.g. deletesite.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew auditlog [-site <site>] [-since <time>] [-until <time>] [-actor <username>] [-action <action>]
+Exports audit log entries as JSON lines, most recent first.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	cmd.Filter.Actor = strings.TrimPrefix(cmd.Filter.Actor, "@")
+	return &cmd, nil
+}
+
+func (cmd *AuditlogCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	encoder := json.NewEncoder(cmd.Stdout)
+	encoder.SetEscapeHTML(false)
+	return cmd.Notebrew.QueryAuditLog(context.Background(), cmd.Filter, func(entry nb7.AuditEntry) error {
+		return encoder.Encode(entry)
+	})
+}
+
+// parseSince parses either a time string accepted by parseTime or a duration
+// counting back from now.
+func parseSince(s string) (time.Time, error) {
+	if duration, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	t, err := parseTime(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Time, nil
+}
+
+// writeAuditLog records an action performed by a command in the audit log.
+func writeAuditLog(nbrew *nb7.Notebrew, entry nb7.AuditEntry) error {
+	entry.Source = nb7.AuditSourceCLI
+	return nbrew.WriteAuditLog(context.Background(), entry)
+}
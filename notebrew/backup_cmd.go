@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+)
+
+type BackupCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdout   io.Writer
+	SiteName string
+	Output   string
+}
+
+func BackupCommand(nbrew *nb7.Notebrew, args ...string) (*BackupCmd, error) {
+	var cmd BackupCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.StringVar(&cmd.SiteName, "site", "", "Site to back up. Defaults to the main site.")
+	flagset.StringVar(&cmd.Output, "o", "", "Output file. Use - for stdout.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew backup [-site <site>] -o <file>
+Backs up a site's notes, pages, posts, themes and images together with its
+storage settings and members into a tar.gz archive, which can be restored
+into any notebrew instance with notebrew restore.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	if cmd.Output == "" {
+		flagset.Usage()
+		return nil, fmt.Errorf("-o not provided")
+	}
+	cmd.SiteName = strings.TrimPrefix(cmd.SiteName, "@")
+	return &cmd, nil
+}
+
+func (cmd *BackupCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	var sitePrefix string
+	if strings.Contains(cmd.SiteName, ".") {
+		sitePrefix = cmd.SiteName
+	} else if cmd.SiteName != "" {
+		sitePrefix = "@" + cmd.SiteName
+	}
+	if cmd.Output == "-" {
+		return cmd.Notebrew.BackupSite(context.Background(), cmd.Stdout, sitePrefix)
+	}
+	file, err := os.Create(cmd.Output)
+	if err != nil {
+		return err
+	}
+	err = cmd.Notebrew.BackupSite(context.Background(), file, sitePrefix)
+	if err != nil {
+		file.Close()
+		os.Remove(cmd.Output)
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+)
+
+type ConfigCmd struct {
+	FS     nb7.FS
+	Stdout io.Writer
+	Action string // "get" | "set" | "validate"
+	Key    string
+	Value  string
+}
+
+func ConfigCommand(fsys nb7.FS, args ...string) (*ConfigCmd, error) {
+	var cmd ConfigCmd
+	cmd.FS = fsys
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew config get [<key>]
+  notebrew config set <key> <value>
+  notebrew config validate
+Reads and writes config/notebrew.json. get prints the value in effect, which
+may come from a legacy config file or an environment variable. Without a key,
+get prints the whole config.
+Keys:
+  `+strings.Join(nb7.ConfigKeys(), "\n  ")+`
+Environment variables:`)
+		for _, env := range nb7.ConfigEnv {
+			fmt.Fprintf(flagset.Output(), "  %-28s overrides %s\n", env.Name, env.Key)
+		}
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("get, set or validate required")
+	}
+	cmd.Action, flagArgs = flagArgs[0], flagArgs[1:]
+	switch cmd.Action {
+	case "get":
+		if len(flagArgs) > 1 {
+			flagset.Usage()
+			return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs[1:], " "))
+		}
+		if len(flagArgs) == 1 {
+			cmd.Key = flagArgs[0]
+		}
+	case "set":
+		if len(flagArgs) != 2 {
+			flagset.Usage()
+			return nil, fmt.Errorf("set requires a key and a value")
+		}
+		cmd.Key, cmd.Value = flagArgs[0], flagArgs[1]
+	case "validate":
+		if len(flagArgs) > 0 {
+			flagset.Usage()
+			return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+		}
+	default:
+		flagset.Usage()
+		return nil, fmt.Errorf("unknown subcommand %q", cmd.Action)
+	}
+	return &cmd, nil
+}
+
+func (cmd *ConfigCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	switch cmd.Action {
+	case "get":
+		config, err := nb7.ReadConfig(cmd.FS)
+		if err != nil {
+			return err
+		}
+		var value any = config
+		if cmd.Key != "" {
+			value, err = config.Get(cmd.Key)
+			if err != nil {
+				return err
+			}
+		}
+		if s, ok := value.(string); ok {
+			fmt.Fprintln(cmd.Stdout, s)
+			return nil
+		}
+		b, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.Stdout, string(b))
+	case "set":
+		err := nb7.SetConfig(cmd.FS, map[string]string{cmd.Key: cmd.Value})
+		if err != nil {
+			return err
+		}
+	case "validate":
+		config, err := nb7.ReadConfig(cmd.FS)
+		if err != nil {
+			return err
+		}
+		err = config.Validate()
+		if err != nil {
+			errs := []error{err}
+			if joinErr, ok := err.(interface{ Unwrap() []error }); ok {
+				errs = joinErr.Unwrap()
+			}
+			for _, err := range errs {
+				fmt.Fprintln(cmd.Stdout, err)
+			}
+			return fmt.Errorf("%d invalid config value(s)", len(errs))
+		}
+		fmt.Fprintln(cmd.Stdout, "config is valid")
+	}
+	return nil
+}
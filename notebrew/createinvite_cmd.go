@@ -79,5 +79,8 @@ func (cmd *CreateinviteCmd) Run() error {
 		}
 		fmt.Fprintln(cmd.Stdout, cmd.Notebrew.Scheme+cmd.Notebrew.AdminDomain+"/admin/signup/?token="+strings.TrimLeft(hex.EncodeToString(signupToken[:]), "0"))
 	}
-	return nil
+	return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		IsAccount: true,
+		Action:    "createinvite",
+	})
 }
@@ -108,7 +108,10 @@ func (cmd *CreatesiteCmd) Run() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		SiteName: cmd.SiteName,
+		Action:   "createsite",
+	})
 }
 
 func (cmd *CreatesiteCmd) validateSiteName(siteName string) (validationError string, err error) {
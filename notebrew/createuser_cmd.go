@@ -207,7 +207,7 @@ func (cmd *CreateuserCmd) Run() error {
 	}
 	_, err = sq.Exec(tx, sq.CustomQuery{
 		Dialect: cmd.Notebrew.Dialect,
-		Format:  "INSERT INTO site_user (site_id, user_id) VALUES ({siteID}, {userID})",
+		Format:  "INSERT INTO site_user (site_id, user_id, role) VALUES ({siteID}, {userID}, 'owner')",
 		Values: []any{
 			sq.UUIDParam("siteID", siteID),
 			sq.UUIDParam("userID", userID),
@@ -220,7 +220,11 @@ func (cmd *CreateuserCmd) Run() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		SiteName: cmd.Username,
+		Action:   "createuser",
+		Target:   cmd.Username,
+	})
 }
 
 func (cmd *CreateuserCmd) validateUsername(username string) (validationError string, err error) {
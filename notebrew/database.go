@@ -102,7 +102,7 @@ func init() {
 		ErrorCode: func(err error) (errcode string) {
 			var mssqlErr mssql.Error
 			if errors.As(err, &mssqlErr) {
-				strconv.FormatInt(int64(mssqlErr.Number), 10)
+				return strconv.FormatInt(int64(mssqlErr.Number), 10)
 			}
 			return ""
 		},
@@ -30,18 +30,8 @@ func init() {
 			if err != nil {
 				return dsn, nil
 			}
-			if !q.Has("_busy_timeout") && !q.Has("_timeout") {
-				q.Set("_busy_timeout", "10000") // milliseconds
-			}
-			if !q.Has("_foreign_keys") && !q.Has("_fk") {
-				q.Set("_foreign_keys", "ON")
-			}
-			if !q.Has("_journal_mode") && !q.Has("_journal") {
-				q.Set("_journal_mode", "WAL")
-			}
-			if !q.Has("_synchronous") && !q.Has("_sync") {
-				q.Set("_synchronous", "NORMAL")
-			}
+			// busy_timeout, foreign_keys, journal_mode and synchronous are
+			// set on every connection by notebrew (see the sqlite config).
 			if !q.Has("_txlock") {
 				q.Set("_txlock", "immediate")
 			}
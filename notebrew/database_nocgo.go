@@ -30,24 +30,8 @@ func init() {
 			if err != nil {
 				return dsn, nil
 			}
-			hasPragma := make(map[string]bool)
-			values := q["_pragma"]
-			for _, value := range values {
-				pragma, _, _ := strings.Cut(value, "(")
-				hasPragma[pragma] = true
-			}
-			if !hasPragma["busy_timeout"] {
-				q.Add("_pragma", "busy_timeout(10000)") // milliseconds
-			}
-			if !hasPragma["foreign_keys"] {
-				q.Add("_pragma", "foreign_keys(ON)")
-			}
-			if !hasPragma["journal_mode"] {
-				q.Add("_pragma", "journal_mode(WAL)")
-			}
-			if !hasPragma["synchronous"] {
-				q.Add("_pragma", "synchronous(NORMAL)")
-			}
+			// busy_timeout, foreign_keys, journal_mode and synchronous are
+			// set on every connection by notebrew (see the sqlite config).
 			if !q.Has("_txlock") {
 				q.Set("_txlock", "immediate")
 			}
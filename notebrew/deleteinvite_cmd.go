@@ -98,6 +98,13 @@ func (cmd *DeleteinviteCmd) Run() error {
 	if err != nil {
 		return err
 	}
+	err = writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		IsAccount: true,
+		Action:    "deleteinvite",
+	})
+	if err != nil {
+		return err
+	}
 	if result.RowsAffected == 1 {
 		fmt.Println("1 invite deleted")
 	} else {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -119,8 +120,8 @@ func (cmd *DeletesiteCmd) Run() error {
 		} else {
 			sitePrefix = "@" + cmd.SiteName
 		}
-		err = nb7.RemoveAll(cmd.Notebrew.FS, sitePrefix)
-		if err != nil {
+		_, err = cmd.Notebrew.MoveSiteToTrash(context.Background(), sitePrefix, "")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
 	}
@@ -144,6 +145,16 @@ func (cmd *DeletesiteCmd) Run() error {
 	if err != nil {
 		return err
 	}
+	_, err = sq.Exec(tx, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  "DELETE FROM site_invite WHERE site_id = (SELECT site_id FROM site WHERE site_name = {siteName})",
+		Values: []any{
+			sq.StringParam("siteName", cmd.SiteName),
+		},
+	})
+	if err != nil {
+		return err
+	}
 	_, err = sq.Exec(tx, sq.CustomQuery{
 		Dialect: cmd.Notebrew.Dialect,
 		Format:  "DELETE FROM site WHERE site_name = {siteName}",
@@ -158,7 +169,10 @@ func (cmd *DeletesiteCmd) Run() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		SiteName: cmd.SiteName,
+		Action:   "deletesite",
+	})
 }
 
 func (cmd DeletesiteCmd) validateSiteName(siteName string) (validationError string, err error) {
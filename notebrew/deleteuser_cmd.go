@@ -146,6 +146,39 @@ func (cmd *DeleteuserCmd) Run() error {
 			sq.StringParam("username", cmd.Username),
 		},
 	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(tx, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  "DELETE FROM recovery_code WHERE user_id = (SELECT user_id FROM users WHERE username = {username})",
+		Values: []any{
+			sq.StringParam("username", cmd.Username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(tx, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  "DELETE FROM api_token WHERE user_id = (SELECT user_id FROM users WHERE username = {username})",
+		Values: []any{
+			sq.StringParam("username", cmd.Username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(tx, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  "DELETE FROM site_invite WHERE user_id = (SELECT user_id FROM users WHERE username = {username})",
+		Values: []any{
+			sq.StringParam("username", cmd.Username),
+		},
+	})
+	if err != nil {
+		return err
+	}
 	_, err = sq.Exec(tx, sq.CustomQuery{
 		Dialect: cmd.Notebrew.Dialect,
 		Format:  "DELETE FROM users WHERE username = {username}",
@@ -170,7 +203,11 @@ func (cmd *DeleteuserCmd) Run() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		SiteName: cmd.Username,
+		Action:   "deleteuser",
+		Target:   cmd.Username,
+	})
 }
 
 func (cmd *DeleteuserCmd) validateUsername(username string) (validationError string, err error) {
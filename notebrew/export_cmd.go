@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+)
+
+type ExportCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdout   io.Writer
+	SiteName string
+	Output   string
+	Options  nb7.ExportOptions
+}
+
+func ExportCommand(nbrew *nb7.Notebrew, args ...string) (*ExportCmd, error) {
+	var cmd ExportCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.StringVar(&cmd.SiteName, "site", "", "Site to export. Defaults to the main site.")
+	flagset.StringVar(&cmd.Options.Format, "format", "", "Archive format, either tar.gz or zip. Defaults to the extension of the output file, or tar.gz.")
+	flagset.StringVar(&cmd.Output, "o", "", "Output file. Use - for stdout.")
+	flagset.StringVar(&cmd.Options.BaseURL, "base-url", "", "URL the site will be deployed to e.g. https://example.com. Defaults to root-relative links.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew export [-site <site>] [-format tar.gz|zip] [-base-url <url>] -o <file>
+Regenerates a site and packages its output folder into an archive that can be
+deployed to any static host.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	if cmd.Output == "" {
+		flagset.Usage()
+		return nil, fmt.Errorf("-o not provided")
+	}
+	if cmd.Options.Format == "" {
+		if strings.HasSuffix(cmd.Output, ".zip") {
+			cmd.Options.Format = "zip"
+		} else {
+			cmd.Options.Format = "tar.gz"
+		}
+	}
+	if cmd.Options.Format != "tar.gz" && cmd.Options.Format != "zip" {
+		return nil, fmt.Errorf("-format %q: must be tar.gz or zip", cmd.Options.Format)
+	}
+	cmd.SiteName = strings.TrimPrefix(cmd.SiteName, "@")
+	return &cmd, nil
+}
+
+func (cmd *ExportCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	var sitePrefix string
+	if strings.Contains(cmd.SiteName, ".") {
+		sitePrefix = cmd.SiteName
+	} else if cmd.SiteName != "" {
+		sitePrefix = "@" + cmd.SiteName
+	}
+	if cmd.Output == "-" {
+		return cmd.Notebrew.ExportSite(context.Background(), cmd.Stdout, sitePrefix, cmd.Options)
+	}
+	file, err := os.Create(cmd.Output)
+	if err != nil {
+		return err
+	}
+	err = cmd.Notebrew.ExportSite(context.Background(), file, sitePrefix, cmd.Options)
+	if err != nil {
+		file.Close()
+		os.Remove(cmd.Output)
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+)
+
+type ImportCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdout   io.Writer
+	SiteName string
+	From     string
+	Path     string
+}
+
+func ImportCommand(nbrew *nb7.Notebrew, args ...string) (*ImportCmd, error) {
+	var cmd ImportCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.StringVar(&cmd.SiteName, "site", "", "Site to import into. Defaults to the main site.")
+	flagset.StringVar(&cmd.From, "from", "", "Format to import from: markdown, jekyll, hugo or wxr.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew import [-site <site>] -from markdown|jekyll|hugo|wxr <path>
+Imports posts, pages and images from another blog. path is the blog's folder,
+or the WordPress export file for wxr. Post dates are kept, categories become
+post categories and referenced images are copied into output/images. Existing
+files are never overwritten, anything that couldn't be converted is reported.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	args = flagset.Args()
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			err := flagset.Parse(args[i:])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args[:i], flagset.Args()...)
+			break
+		}
+	}
+	if len(args) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("path not provided")
+	}
+	if len(args) > 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(args[1:], " "))
+	}
+	cmd.Path = args[0]
+	switch cmd.From {
+	case "":
+		flagset.Usage()
+		return nil, fmt.Errorf("-from not provided")
+	case nb7.ImportMarkdown, nb7.ImportJekyll, nb7.ImportHugo, nb7.ImportWXR:
+	default:
+		return nil, fmt.Errorf("-from %q: must be markdown, jekyll, hugo or wxr", cmd.From)
+	}
+	cmd.SiteName = strings.TrimPrefix(cmd.SiteName, "@")
+	return &cmd, nil
+}
+
+func (cmd *ImportCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	var sitePrefix string
+	if strings.Contains(cmd.SiteName, ".") {
+		sitePrefix = cmd.SiteName
+	} else if cmd.SiteName != "" {
+		sitePrefix = "@" + cmd.SiteName
+	}
+	_, err := fs.Stat(cmd.Notebrew.FS, path.Join(sitePrefix, "output"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("site %q does not exist", cmd.SiteName)
+		}
+		return err
+	}
+	srcPath, err := filepath.Abs(cmd.Path)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if cmd.From == nb7.ImportWXR && fileInfo.IsDir() {
+		return fmt.Errorf("%s is a directory, expected a WordPress export file", cmd.Path)
+	}
+	if cmd.From != nb7.ImportWXR && !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", cmd.Path)
+	}
+	result, err := cmd.Notebrew.ImportSite(context.Background(), sitePrefix, os.DirFS(filepath.Dir(srcPath)), filepath.Base(srcPath), cmd.From)
+	for _, problem := range result.Problems {
+		fmt.Fprintf(cmd.Stdout, "%s: %s\n", problem.Path, problem.Reason)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "imported %d posts, %d pages and %d images (%d problems)\n", result.Posts, result.Pages, result.Images, len(result.Problems))
+	return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		SiteName: cmd.SiteName,
+		Action:   "import",
+	})
+}
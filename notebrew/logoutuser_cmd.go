@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+	"github.com/bokwoon95/sq"
+)
+
+type LogoutuserCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdout   io.Writer
+	Username string
+}
+
+func LogoutuserCommand(nbrew *nb7.Notebrew, args ...string) (*LogoutuserCmd, error) {
+	var cmd LogoutuserCmd
+	cmd.Notebrew = nbrew
+	var username sql.NullString
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("user", "", func(s string) error {
+		username = sql.NullString{String: strings.TrimPrefix(s, "@"), Valid: true}
+		return nil
+	})
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew logout-user -user <username>
+Logs the user out of every session.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	if !username.Valid {
+		flagset.Usage()
+		return nil, fmt.Errorf("-user required")
+	}
+	cmd.Username = username.String
+	return &cmd, nil
+}
+
+func (cmd *LogoutuserCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	exists, err := sq.FetchExists(cmd.Notebrew.DB, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  "SELECT 1 FROM users WHERE username = {username}",
+		Values: []any{
+			sq.StringParam("username", cmd.Username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %q does not exist", cmd.Username)
+	}
+	result, err := sq.Exec(cmd.Notebrew.DB, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format: "DELETE FROM authentication" +
+			" WHERE user_id = (SELECT user_id FROM users WHERE username = {username})",
+		Values: []any{
+			sq.StringParam("username", cmd.Username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		IsAccount: true,
+		Action:    "logoutuser",
+		Target:    cmd.Username,
+	})
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 1 {
+		fmt.Fprintln(cmd.Stdout, "1 session revoked")
+	} else {
+		fmt.Fprintln(cmd.Stdout, strconv.FormatInt(result.RowsAffected, 10)+" sessions revoked")
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -17,7 +16,6 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -66,12 +64,29 @@ func main() {
 			return err
 		}
 
+		// The -address, -multisite and -database flags update the config.
+		// They are written to config/notebrew.json if it exists, otherwise to
+		// the legacy config files.
+		fsys := &nb7.LocalFS{RootDir: dir}
+		_, err = os.Stat(filepath.Join(dir, "config/notebrew.json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		useNotebrewJSON := err == nil
 		address = strings.TrimSpace(address)
 		if address != "" {
 			if strings.Count(address, ",") > 1 {
 				return fmt.Errorf("-addr %q: too many commas (max 1)", address)
 			}
-			err = os.WriteFile(filepath.Join(dir, "config/address.txt"), []byte(strings.ReplaceAll(address, ",", "\n")), 0644)
+			if useNotebrewJSON {
+				adminDomain, contentDomain, _ := strings.Cut(address, ",")
+				err = nb7.SetConfig(fsys, map[string]string{
+					"adminDomain":   strings.TrimSpace(adminDomain),
+					"contentDomain": strings.TrimSpace(contentDomain),
+				})
+			} else {
+				err = os.WriteFile(filepath.Join(dir, "config/address.txt"), []byte(strings.ReplaceAll(address, ",", "\n")), 0644)
+			}
 			if err != nil {
 				return err
 			}
@@ -79,7 +94,11 @@ func main() {
 
 		multisite = strings.TrimSpace(multisite)
 		if multisite != "" {
-			err = os.WriteFile(filepath.Join(dir, "config/multisite.txt"), []byte(multisite), 0644)
+			if useNotebrewJSON {
+				err = nb7.SetConfig(fsys, map[string]string{"multisite": multisite})
+			} else {
+				err = os.WriteFile(filepath.Join(dir, "config/multisite.txt"), []byte(multisite), 0644)
+			}
 			if err != nil {
 				return err
 			}
@@ -87,7 +106,11 @@ func main() {
 
 		database = strings.TrimSpace(database)
 		if database != "" {
-			err = os.WriteFile(filepath.Join(dir, "config/database.txt"), []byte(database), 0644)
+			if useNotebrewJSON {
+				err = nb7.SetConfig(fsys, map[string]string{"database": database})
+			} else {
+				err = os.WriteFile(filepath.Join(dir, "config/database.txt"), []byte(database), 0644)
+			}
 			if err != nil {
 				return err
 			}
@@ -96,22 +119,67 @@ func main() {
 		args := flagset.Args()
 		if len(args) > 0 {
 			command, args := args[0], args[1:]
+			var requiresDatabase bool
 			switch command {
 			case "createinvite", "deleteinvite", "createsite", "deletesite",
-				"createuser", "deleteuser", "permissions", "resetpassword":
+				"createuser", "deleteuser", "permissions", "resetpassword", "logout-user", "2fa",
+				"auditlog", "migrate":
+				requiresDatabase = true
+			case "token":
+				// The token subcommands manage API tokens, which are stored in
+				// the database. A bare token command does not need one.
+				requiresDatabase = len(args) > 0 && (args[0] == "create" || args[0] == "list" || args[0] == "revoke")
+			}
+			if requiresDatabase {
 				// For commands that require a database, configure the database to
 				// sqlite if it hasn't already been configured.
-				b, err := os.ReadFile(filepath.Join(dir, "config/database.txt"))
-				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				config, err := nb7.ReadConfig(fsys)
+				if err != nil {
 					return err
 				}
-				if len(bytes.TrimSpace(b)) == 0 {
-					err = os.WriteFile(filepath.Join(dir, "config/database.txt"), []byte("sqlite"), 0644)
+				if config.Database == "" {
+					if useNotebrewJSON {
+						err = nb7.SetConfig(fsys, map[string]string{"database": "sqlite"})
+					} else {
+						err = os.WriteFile(filepath.Join(dir, "config/database.txt"), []byte("sqlite"), 0644)
+					}
 					if err != nil {
 						return err
 					}
 				}
 			}
+			if command == "config" {
+				// The config command must work even if the config is invalid,
+				// so it doesn't go through NewNotebrew.
+				cmd, err := ConfigCommand(fsys, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				return nil
+			}
+			if command == "migrate" {
+				// The migrate command must work even if the database schema is
+				// out of date, so it doesn't go through NewNotebrew (which
+				// migrates the database).
+				nbrew, err := nb7.Open(fsys)
+				if err != nil {
+					return err
+				}
+				defer nbrew.Close()
+				cmd, err := MigrateCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				return nil
+			}
 			nbrew, err := NewNotebrew(dir)
 			if err != nil {
 				return err
@@ -190,6 +258,78 @@ func main() {
 				if err != nil {
 					return fmt.Errorf("%s: %w", command, err)
 				}
+			case "logout-user":
+				cmd, err := LogoutuserCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+			case "2fa":
+				cmd, err := TwofaCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+			case "auditlog":
+				cmd, err := AuditlogCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+			case "backup":
+				cmd, err := BackupCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+			case "restore":
+				cmd, err := RestoreCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+			case "import":
+				cmd, err := ImportCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+			case "export":
+				cmd, err := ExportCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+			case "output":
+				cmd, err := OutputCommand(nbrew, args...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", command, err)
+				}
 			case "sendmail":
 				cmd, err := SendmailCommand(nbrew, args...)
 				if err != nil {
@@ -218,6 +358,17 @@ func main() {
 					return fmt.Errorf("%s: %w", command, err)
 				}
 			case "token":
+				if len(args) > 0 && (args[0] == "create" || args[0] == "list" || args[0] == "revoke") {
+					cmd, err := APITokenCommand(nbrew, args...)
+					if err != nil {
+						return fmt.Errorf("%s: %w", command, err)
+					}
+					err = cmd.Run()
+					if err != nil {
+						return fmt.Errorf("%s: %w", command, err)
+					}
+					break
+				}
 				cmd, err := TokenCommand(args...)
 				if err != nil {
 					return fmt.Errorf("%s: %w", command, err)
@@ -242,7 +393,15 @@ func main() {
 			return err
 		}
 		wait := make(chan os.Signal, 1)
-		signal.Notify(wait, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		signal.Notify(wait, syscall.SIGINT, syscall.SIGTERM)
+		// SIGHUP reloads the config instead of shutting down the server.
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		backgroundCtx, stopBackground := context.WithCancel(context.Background())
+		defer stopBackground()
+		go nbrew.WatchConfig(backgroundCtx, 5*time.Second)
+		nbrew.WebmentionSender = &nb7.WebmentionSender{Logger: nbrew.Logger}
+		go nbrew.WebmentionSender.Run(backgroundCtx)
 		// Don't use ListenAndServe, manually acquire a listener. That way we
 		// can report back to the user if the port is already in user.
 		listener, err := net.Listen("tcp", server.Addr)
@@ -267,6 +426,11 @@ func main() {
 				return err
 			}
 		}
+		if nbrew.Config().Proxy.ProxyProtocol {
+			listener = nbrew.ProxyProtocolListener(listener)
+		}
+		// The jobs are stopped by nbrew.Close.
+		nbrew.StartJobs()
 		if nbrew.Scheme == "https://" {
 			go http.ListenAndServe(":80", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if r.Method != "GET" && r.Method != "HEAD" {
@@ -297,7 +461,22 @@ func main() {
 			go server.Serve(listener)
 			open("http://" + server.Addr + "/admin/")
 		}
-		<-wait
+		for shutdown := false; !shutdown; {
+			select {
+			case <-wait:
+				shutdown = true
+			case <-hangup:
+				restartKeys, err := nbrew.ReloadConfig()
+				if err != nil {
+					fmt.Printf("config not reloaded: %v\n", err)
+					break
+				}
+				fmt.Println("config reloaded")
+				if len(restartKeys) > 0 {
+					fmt.Printf("restart notebrew for changes to %s to take effect\n", strings.Join(restartKeys, ", "))
+				}
+			}
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 		defer cancel()
 		server.Shutdown(ctx)
@@ -372,19 +551,8 @@ func NewNotebrew(dir string) (*nb7.Notebrew, error) {
 			return
 		}
 
-		// Otherwise, log the query depending on the contents inside config/debug.txt.
-		file, err := nbrew.FS.Open("config/show-queries.txt")
-		if err != nil {
-			return
-		}
-		defer file.Close()
-		reader := bufio.NewReader(file)
-		b, _ := reader.Peek(6)
-		if len(b) == 0 {
-			return
-		}
-		debug, _ := strconv.ParseBool(string(bytes.TrimSpace(b)))
-		if debug {
+		// Otherwise, log the query depending on the showQueries config key.
+		if nbrew.Config().ShowQueries {
 			query, err := sq.Sprintf(queryStats.Dialect, queryStats.Query, queryStats.Args)
 			if err != nil {
 				output.Args = make([]string, len(queryStats.Args))
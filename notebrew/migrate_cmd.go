@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+)
+
+type MigrateCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdout   io.Writer
+	Action   string // "status" | "up" | "down" | "dry-run"
+	Confirm  bool
+	Steps    int
+}
+
+func MigrateCommand(nbrew *nb7.Notebrew, args ...string) (*MigrateCmd, error) {
+	var cmd MigrateCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.BoolVar(&cmd.Confirm, "confirm", false, "(up) Allow automigrate to drop tables, columns and constraints.")
+	flagset.IntVar(&cmd.Steps, "steps", 1, "(down) Number of migrations to revert.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew migrate status
+  notebrew migrate up [-confirm]
+  notebrew migrate down [-steps <n>]
+  notebrew migrate dry-run
+Manages the database schema. With "migrations": "versioned" in
+config/notebrew.json, up applies the pending numbered migrations, down
+reverts the last applied ones and dry-run prints the SQL that up would run.
+Otherwise up automigrates the database to match the current schema, which
+requires -confirm if it would drop anything, and dry-run prints the SQL
+that automigrate would run.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("status, up, down or dry-run required")
+	}
+	cmd.Action, flagArgs = flagArgs[0], flagArgs[1:]
+	// Allow flags after the subcommand e.g. notebrew migrate up -confirm.
+	err = flagset.Parse(flagArgs)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs = flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	switch cmd.Action {
+	case "status", "up", "dry-run":
+		break
+	case "down":
+		if cmd.Steps < 1 {
+			return nil, fmt.Errorf("-steps must be at least 1")
+		}
+	default:
+		flagset.Usage()
+		return nil, fmt.Errorf("unknown subcommand %q", cmd.Action)
+	}
+	return &cmd, nil
+}
+
+func (cmd *MigrateCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	ctx := context.Background()
+	versioned := cmd.Notebrew.Config().Migrations == "versioned"
+	switch cmd.Action {
+	case "status":
+		statuses, err := cmd.Notebrew.MigrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		if versioned {
+			fmt.Fprintln(cmd.Stdout, "migrations: versioned")
+		} else {
+			fmt.Fprintln(cmd.Stdout, "migrations: auto")
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if !status.AppliedAt.IsZero() {
+				appliedAt = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(cmd.Stdout, "%04d_%-30s %s\n", status.Version, status.Name, appliedAt)
+		}
+		if !versioned {
+			statements, _, err := cmd.Notebrew.AutomigrateDryRun()
+			if err != nil {
+				return err
+			}
+			if statements == "" {
+				fmt.Fprintln(cmd.Stdout, "the database matches the schema")
+			} else {
+				fmt.Fprintln(cmd.Stdout, "the database does not match the schema, run notebrew migrate dry-run to see the changes")
+			}
+		}
+	case "up":
+		if versioned {
+			n, err := cmd.Notebrew.MigrateUp(ctx, cmd.Stdout, false)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				fmt.Fprintln(cmd.Stdout, "no pending migrations")
+			}
+			return nil
+		}
+		err := cmd.Notebrew.Automigrate(ctx, cmd.Confirm)
+		if err != nil {
+			var destructiveErr *nb7.DestructiveMigrationError
+			if errors.As(err, &destructiveErr) {
+				return fmt.Errorf("automigrate would drop tables, columns or constraints or lose data, run notebrew migrate dry-run to review the changes and notebrew migrate up -confirm to apply them")
+			}
+			return err
+		}
+		fmt.Fprintln(cmd.Stdout, "the database matches the schema")
+	case "down":
+		if !versioned {
+			return fmt.Errorf("down requires \"migrations\": \"versioned\" in config/notebrew.json")
+		}
+		n, err := cmd.Notebrew.MigrateDown(ctx, cmd.Stdout, cmd.Steps, false)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Fprintln(cmd.Stdout, "no applied migrations")
+		}
+	case "dry-run":
+		if versioned {
+			n, err := cmd.Notebrew.MigrateUp(ctx, cmd.Stdout, true)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				fmt.Fprintln(cmd.Stdout, "-- no pending migrations")
+			}
+			return nil
+		}
+		statements, warnings, err := cmd.Notebrew.AutomigrateDryRun()
+		if err != nil {
+			return err
+		}
+		for _, warning := range warnings {
+			fmt.Fprintln(cmd.Stdout, "-- "+warning)
+		}
+		if statements == "" {
+			fmt.Fprintln(cmd.Stdout, "-- the database matches the schema")
+			return nil
+		}
+		fmt.Fprintln(cmd.Stdout, statements)
+	}
+	return nil
+}
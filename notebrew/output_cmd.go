@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/nb7"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+type OutputCmd struct {
+	Notebrew    *nb7.Notebrew
+	Stdout      io.Writer
+	SiteName    string
+	Dir         string
+	Commit      bool
+	Push        bool
+	Message     string
+	AuthorName  string
+	AuthorEmail string
+}
+
+func OutputCommand(nbrew *nb7.Notebrew, args ...string) (*OutputCmd, error) {
+	var cmd OutputCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.StringVar(&cmd.SiteName, "site", "", "Site whose output to export. Defaults to the main site.")
+	flagset.BoolVar(&cmd.Commit, "commit", false, "Commit the changes if the directory is a git repository.")
+	flagset.BoolVar(&cmd.Push, "push", false, "Push the commit to the repository's origin remote. Implies -commit.")
+	flagset.StringVar(&cmd.Message, "m", "", "Commit message. Defaults to a generated message.")
+	flagset.StringVar(&cmd.AuthorName, "author-name", "notebrew", "Commit author name.")
+	flagset.StringVar(&cmd.AuthorEmail, "author-email", "notebrew@localhost", "Commit author email.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew output [-site <site>] [-commit] [-push] [-m <message>] <dir>
+Regenerates a site and mirrors its output folder into dir, deleting files in
+dir that are no longer in the output (a top-level .git is left alone). Use
+this to publish a site to static hosts like GitHub Pages or Netlify.
+So that a mistyped dir isn't wiped, dir must be empty, a git repository or a
+directory that was output to before (it has a .notebrew-output file).
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	args = flagset.Args()
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			err := flagset.Parse(args[i:])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args[:i], flagset.Args()...)
+			break
+		}
+	}
+	if len(args) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("directory not provided")
+	}
+	if len(args) > 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(args[1:], " "))
+	}
+	cmd.Dir = args[0]
+	cmd.SiteName = strings.TrimPrefix(cmd.SiteName, "@")
+	if cmd.Push {
+		cmd.Commit = true
+	}
+	return &cmd, nil
+}
+
+func (cmd *OutputCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	var sitePrefix string
+	if strings.Contains(cmd.SiteName, ".") {
+		sitePrefix = cmd.SiteName
+	} else if cmd.SiteName != "" {
+		sitePrefix = "@" + cmd.SiteName
+	}
+	fileInfo, err := fs.Stat(cmd.Notebrew.FS, path.Join(sitePrefix, "output"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("site %q does not exist", cmd.SiteName)
+		}
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", path.Join(sitePrefix, "output"))
+	}
+	err = cmd.Notebrew.RegenerateSite(context.Background(), sitePrefix)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(cmd.Dir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	written, removed, err := mirrorOutput(cmd.Notebrew.FS, path.Join(sitePrefix, "output"), dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "%d files written, %d files removed\n", written, removed)
+	if !cmd.Commit {
+		return nil
+	}
+
+	repository, err := git.PlainOpen(dir)
+	if err != nil {
+		if errors.Is(err, git.ErrRepositoryNotExists) {
+			return fmt.Errorf("%s is not a git repository", dir)
+		}
+		return err
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+	err = worktree.AddWithOptions(&git.AddOptions{All: true})
+	if err != nil {
+		return err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	if status.IsClean() {
+		fmt.Fprintln(cmd.Stdout, "nothing to commit")
+	} else {
+		message := cmd.Message
+		if message == "" {
+			siteName := cmd.SiteName
+			if siteName == "" {
+				siteName = "main site"
+			}
+			message = fmt.Sprintf("Update %s (%d files written, %d files removed)", siteName, written, removed)
+		}
+		hash, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  cmd.AuthorName,
+				Email: cmd.AuthorEmail,
+				When:  time.Now(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.Stdout, "committed "+hash.String())
+	}
+	if !cmd.Push {
+		return nil
+	}
+	err = repository.Push(&git.PushOptions{RemoteName: "origin"})
+	if err != nil {
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			fmt.Fprintln(cmd.Stdout, "already up to date")
+			return nil
+		}
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, "pushed to origin")
+	return nil
+}
+
+// outputMarker is the file that mirrorOutput leaves at the top of destDir,
+// marking the directory as one whose contents it may delete.
+const outputMarker = ".notebrew-output"
+
+// mirrorOutput makes destDir an exact copy of the outputDir in fsys, writing
+// only files whose contents differ and removing anything that isn't in
+// outputDir. A .git entry and the outputMarker file at the top of destDir are
+// never touched.
+//
+// Since everything else in destDir is deleted, mirrorOutput refuses a
+// non-empty destDir unless it has an outputMarker file or a .git entry.
+func mirrorOutput(fsys nb7.FS, outputDir, destDir string) (written, removed int, err error) {
+	dirEntries, err := os.ReadDir(destDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(dirEntries) > 0 {
+		var marked bool
+		for _, dirEntry := range dirEntries {
+			if dirEntry.Name() == outputMarker || dirEntry.Name() == ".git" {
+				marked = true
+				break
+			}
+		}
+		if !marked {
+			return 0, 0, fmt.Errorf("%s is not empty and is neither a git repository nor a directory that was output to before (it has no %s file), refusing to delete its contents", destDir, outputMarker)
+		}
+	}
+	err = os.WriteFile(filepath.Join(destDir, outputMarker), []byte("This directory mirrors the output of a notebrew site (see notebrew output -h).\nFiles that are not in the output are deleted.\n"), 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	wanted := make(map[string]bool)
+	err = fs.WalkDir(fsys, outputDir, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(filePath, outputDir), "/")
+		if name == "" {
+			return nil
+		}
+		if name == ".git" || name == outputMarker {
+			if dirEntry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		wanted[name] = true
+		destPath := filepath.Join(destDir, filepath.FromSlash(name))
+		if dirEntry.IsDir() {
+			fileInfo, err := os.Lstat(destPath)
+			if err == nil && !fileInfo.IsDir() {
+				err = os.Remove(destPath)
+				if err != nil {
+					return err
+				}
+				removed++
+			}
+			return os.MkdirAll(destPath, 0755)
+		}
+		b, err := fs.ReadFile(fsys, filePath)
+		if err != nil {
+			return err
+		}
+		fileInfo, err := os.Lstat(destPath)
+		if err == nil {
+			if fileInfo.IsDir() {
+				err = os.RemoveAll(destPath)
+				if err != nil {
+					return err
+				}
+				removed++
+			} else if fileInfo.Size() == int64(len(b)) {
+				existing, err := os.ReadFile(destPath)
+				if err != nil {
+					return err
+				}
+				if bytes.Equal(existing, b) {
+					return nil
+				}
+			}
+		}
+		err = os.WriteFile(destPath, b, 0644)
+		if err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return written, removed, err
+	}
+	// Walk destDir and remove anything that isn't in the output. Removed
+	// directories are skipped since their contents are already gone.
+	err = filepath.WalkDir(destDir, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(destDir, filePath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if name == ".git" || name == outputMarker {
+			if dirEntry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if wanted[name] {
+			return nil
+		}
+		err = os.RemoveAll(filePath)
+		if err != nil {
+			return err
+		}
+		removed++
+		if dirEntry.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return written, removed, err
+	}
+	return written, removed, nil
+}
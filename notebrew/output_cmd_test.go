@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bokwoon95/nb7"
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+func Test_mirrorOutput(t *testing.T) {
+	fsys := testutil.NewFS(fstest.MapFS{
+		"output/index.html":       &fstest.MapFile{Data: []byte("<h1>home</h1>")},
+		"output/about/index.html": &fstest.MapFile{Data: []byte("<h1>about</h1>")},
+	})
+	writeFile := func(name, data string) {
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		err = os.WriteFile(name, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(testutil.Callers(), err)
+		}
+		return err == nil
+	}
+
+	t.Run("unmarked", func(t *testing.T) {
+		// A directory that notebrew has not output to, such as a mistyped
+		// home directory, is left untouched.
+		dir := t.TempDir()
+		writeFile(filepath.Join(dir, "notes.txt"), "important")
+		_, _, err := mirrorOutput(fsys, "output", dir)
+		if err == nil {
+			t.Fatalf("%s: got nil error, want an error", testutil.Callers())
+		}
+		if !exists(filepath.Join(dir, "notes.txt")) {
+			t.Errorf("%s: notes.txt was deleted", testutil.Callers())
+		}
+		if exists(filepath.Join(dir, "index.html")) || exists(filepath.Join(dir, outputMarker)) {
+			t.Errorf("%s: files were written into an unmarked directory", testutil.Callers())
+		}
+	})
+
+	t.Run("marked", func(t *testing.T) {
+		dir := t.TempDir()
+		written, removed, err := mirrorOutput(fsys, "output", dir)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if written != 2 || removed != 0 {
+			t.Errorf("%s: got %d written, %d removed, want 2 written, 0 removed", testutil.Callers(), written, removed)
+		}
+		if !exists(filepath.Join(dir, outputMarker)) {
+			t.Fatalf("%s: %s was not written", testutil.Callers(), outputMarker)
+		}
+		// Now that the directory is marked, files that aren't in the output
+		// are removed on the next run, and unchanged files aren't rewritten.
+		writeFile(filepath.Join(dir, "stale.html"), "stale")
+		writeFile(filepath.Join(dir, "old", "index.html"), "old")
+		written, removed, err = mirrorOutput(fsys, "output", dir)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if written != 0 || removed != 2 {
+			t.Errorf("%s: got %d written, %d removed, want 0 written, 2 removed", testutil.Callers(), written, removed)
+		}
+		for _, name := range []string{"stale.html", "old"} {
+			if exists(filepath.Join(dir, name)) {
+				t.Errorf("%s: %s was not removed", testutil.Callers(), name)
+			}
+		}
+		for _, name := range []string{outputMarker, "index.html", filepath.Join("about", "index.html")} {
+			if !exists(filepath.Join(dir, name)) {
+				t.Errorf("%s: %s does not exist", testutil.Callers(), name)
+			}
+		}
+	})
+
+	t.Run("git repository", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/main\n")
+		writeFile(filepath.Join(dir, "stale.html"), "stale")
+		_, removed, err := mirrorOutput(fsys, "output", dir)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		if removed != 1 || exists(filepath.Join(dir, "stale.html")) {
+			t.Errorf("%s: got %d removed, want stale.html removed", testutil.Callers(), removed)
+		}
+		if !exists(filepath.Join(dir, ".git", "HEAD")) {
+			t.Errorf("%s: .git was touched", testutil.Callers())
+		}
+	})
+}
+
+func Test_OutputCmd_push(t *testing.T) {
+	nbrew := &nb7.Notebrew{
+		FS: testutil.NewFS(fstest.MapFS{
+			"output":           &fstest.MapFile{Mode: fs.ModeDir},
+			"posts":            &fstest.MapFile{Mode: fs.ModeDir},
+			"pages":            &fstest.MapFile{Mode: fs.ModeDir},
+			"pages/about.html": &fstest.MapFile{Data: []byte("<title>About me</title><p>I write Go.</p>")},
+		}),
+		Scheme:        "https://",
+		ContentDomain: "example.com",
+	}
+	remoteDir := filepath.Join(t.TempDir(), "remote.git")
+	remote, err := git.PlainInit(remoteDir, true)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	dir := filepath.Join(t.TempDir(), "site")
+	repository, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	_, err = repository.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{remoteDir},
+	})
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	cmd := &OutputCmd{
+		Notebrew:    nbrew,
+		Stdout:      io.Discard,
+		Dir:         dir,
+		Push:        true,
+		Commit:      true,
+		AuthorName:  "notebrew",
+		AuthorEmail: "notebrew@localhost",
+	}
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	head, err := remote.Head()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	commit, err := remote.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	for _, name := range []string{outputMarker, "about/index.html"} {
+		_, err := commit.File(name)
+		if err != nil {
+			t.Errorf("%s: %s: %v", testutil.Callers(), name, err)
+		}
+	}
+	// Running it again with nothing changed pushes nothing.
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+}
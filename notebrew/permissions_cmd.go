@@ -19,13 +19,14 @@ type PermissionsCmd struct {
 	Stdout   io.Writer
 	Username sql.NullString
 	SiteName sql.NullString
+	Role     sql.NullString
 	Action   string // grant | revoke | setowner
 }
 
 func PermissionsCommand(nbrew *nb7.Notebrew, args ...string) (*PermissionsCmd, error) {
 	var cmd PermissionsCmd
 	cmd.Notebrew = nbrew
-	var grant, revoke bool
+	var grant, revoke, setowner bool
 	flagset := flag.NewFlagSet("", flag.ContinueOnError)
 	flagset.Func("user", "", func(s string) error {
 		cmd.Username = sql.NullString{String: s, Valid: true}
@@ -35,8 +36,34 @@ func PermissionsCommand(nbrew *nb7.Notebrew, args ...string) (*PermissionsCmd, e
 		cmd.SiteName = sql.NullString{String: s, Valid: true}
 		return nil
 	})
+	flagset.Func("role", "", func(s string) error {
+		if !nb7.IsValidRole(s) {
+			return fmt.Errorf("invalid role %q (possible values: owner, editor, author, viewer)", s)
+		}
+		cmd.Role = sql.NullString{String: s, Valid: true}
+		return nil
+	})
 	flagset.BoolVar(&grant, "grant", false, "")
 	flagset.BoolVar(&revoke, "revoke", false, "")
+	flagset.BoolVar(&setowner, "setowner", false, "")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew permissions                                        # list every user's sites and roles
+  notebrew permissions -user <username>                       # list the sites a user belongs to
+  notebrew permissions -site <sitename>                       # list the users of a site
+  notebrew permissions -user <username> -site <sitename>      # show a user's role on a site
+  notebrew permissions -user <username> -site <sitename> -grant [-role <role>]
+  notebrew permissions -user <username> -site <sitename> -role <role>
+  notebrew permissions -user <username> -site <sitename> -revoke
+  notebrew permissions -user <username> -site <sitename> -setowner
+Roles:
+  owner    can do everything, including deleting the site
+  editor   can edit everything but cannot delete the site
+  author   can create and edit notes and posts
+  viewer   has read-only access
+Flags:`)
+		flagset.PrintDefaults()
+	}
 	err := flagset.Parse(args)
 	if err != nil {
 		return nil, err
@@ -46,14 +73,32 @@ func PermissionsCommand(nbrew *nb7.Notebrew, args ...string) (*PermissionsCmd, e
 		flagset.Usage()
 		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
 	}
-	if grant && revoke {
+	var n int
+	for _, b := range []bool{grant, revoke, setowner} {
+		if b {
+			n++
+		}
+	}
+	if n > 1 {
 		flagset.Usage()
-		return nil, fmt.Errorf("-grant and -revoke cannot be provided at the same time")
+		return nil, fmt.Errorf("only one of -grant, -revoke or -setowner can be provided at a time")
 	}
 	if grant {
 		cmd.Action = "grant"
 	} else if revoke {
 		cmd.Action = "revoke"
+	} else if setowner {
+		cmd.Action = "setowner"
+	} else if cmd.Role.Valid {
+		cmd.Action = "setrole"
+	}
+	if cmd.Action != "" && (!cmd.Username.Valid || !cmd.SiteName.Valid) {
+		flagset.Usage()
+		return nil, fmt.Errorf("-user and -site required")
+	}
+	if (revoke || setowner) && cmd.Role.Valid {
+		flagset.Usage()
+		return nil, fmt.Errorf("-role cannot be used with -revoke or -setowner")
 	}
 	return &cmd, nil
 }
@@ -75,11 +120,13 @@ func (cmd *PermissionsCmd) Run() error {
 			Username string
 			SiteID   [16]byte
 			SiteName string
+			Role     string
 		}) {
 			row.UUID(&result.UserID, "users.user_id")
 			result.Username = row.String("users.username")
 			row.UUID(&result.SiteID, "site.site_id")
 			result.SiteName = row.String("site.site_name")
+			result.Role = row.String("COALESCE(site_user.role, 'owner')")
 			return result
 		})
 		if err != nil {
@@ -91,7 +138,7 @@ func (cmd *PermissionsCmd) Run() error {
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(cmd.Stdout, "userid=%s user=%s siteid=%s site=%s\n", hex.EncodeToString(result.UserID[:]), result.Username, hex.EncodeToString(result.SiteID[:]), result.SiteName)
+			fmt.Fprintf(cmd.Stdout, "userid=%s user=%s siteid=%s site=%s role=%s\n", hex.EncodeToString(result.UserID[:]), result.Username, hex.EncodeToString(result.SiteID[:]), result.SiteName, result.Role)
 		}
 		return cursor.Close()
 	}
@@ -124,9 +171,11 @@ func (cmd *PermissionsCmd) Run() error {
 			}, func(row *sq.Row) (result struct {
 				SiteID   [16]byte
 				SiteName string
+				Role     string
 			}) {
 				row.UUID(&result.SiteID, "site.site_id")
 				result.SiteName = row.String("site.site_name")
+				result.Role = row.String("COALESCE(site_user.role, 'owner')")
 				return result
 			})
 			if err != nil {
@@ -138,7 +187,7 @@ func (cmd *PermissionsCmd) Run() error {
 				if err != nil {
 					return err
 				}
-				fmt.Fprintf(cmd.Stdout, "siteid=%s site=%s\n", hex.EncodeToString(result.SiteID[:]), result.SiteName)
+				fmt.Fprintf(cmd.Stdout, "siteid=%s site=%s role=%s\n", hex.EncodeToString(result.SiteID[:]), result.SiteName, result.Role)
 			}
 			return cursor.Close()
 		}
@@ -172,9 +221,11 @@ func (cmd *PermissionsCmd) Run() error {
 			}, func(row *sq.Row) (result struct {
 				UserID   [16]byte
 				Username string
+				Role     string
 			}) {
 				row.UUID(&result.UserID, "users.user_id")
 				result.Username = row.String("users.username")
+				result.Role = row.String("COALESCE(site_user.role, 'owner')")
 				return result
 			})
 			if err != nil {
@@ -186,28 +237,104 @@ func (cmd *PermissionsCmd) Run() error {
 				if err != nil {
 					return err
 				}
-				fmt.Fprintf(cmd.Stdout, "userid=%s user=%s\n", hex.EncodeToString(result.UserID[:]), result.Username)
+				fmt.Fprintf(cmd.Stdout, "userid=%s user=%s role=%s\n", hex.EncodeToString(result.UserID[:]), result.Username, result.Role)
 			}
 			return cursor.Close()
 		}
 	}
 	switch cmd.Action {
 	case "grant":
+		role := nb7.RoleEditor
+		if cmd.Role.Valid {
+			role = cmd.Role.String
+		}
 		_, err := sq.Exec(cmd.Notebrew.DB, sq.CustomQuery{
 			Dialect: cmd.Notebrew.Dialect,
-			Format: "INSERT INTO site_user (site_id, user_id)" +
-				" VALUES ((SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username}))",
+			Format: "INSERT INTO site_user (site_id, user_id, role)" +
+				" VALUES ((SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username}), {role})",
 			Values: []any{
 				sq.StringParam("username", cmd.Username.String),
 				sq.StringParam("siteName", cmd.SiteName.String),
+				sq.StringParam("role", role),
 			},
 		})
 		if err != nil {
-			if cmd.Notebrew.IsKeyViolation(err) {
+			if !cmd.Notebrew.IsKeyViolation(err) {
+				return err
+			}
+			if !cmd.Role.Valid {
 				return nil
 			}
+			err = cmd.setRole(cmd.Notebrew.DB, cmd.Role.String)
+			if err != nil {
+				return err
+			}
+		}
+		return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+			SiteName: cmd.SiteName.String,
+			Action:   "grant",
+			Target:   cmd.Username.String,
+		})
+	case "setrole":
+		err := cmd.setRole(cmd.Notebrew.DB, cmd.Role.String)
+		if err != nil {
+			return err
+		}
+		return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+			SiteName: cmd.SiteName.String,
+			Action:   "setrole",
+			Target:   cmd.Username.String,
+		})
+	case "setowner":
+		// A site has only one owner, so the current owner(s) are demoted to
+		// editors.
+		tx, err := cmd.Notebrew.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		_, err = sq.Exec(tx, sq.CustomQuery{
+			Dialect: cmd.Notebrew.Dialect,
+			Format: "UPDATE site_user SET role = 'editor'" +
+				" WHERE site_id = (SELECT site_id FROM site WHERE site_name = {siteName})" +
+				" AND (role = 'owner' OR role IS NULL)",
+			Values: []any{
+				sq.StringParam("siteName", cmd.SiteName.String),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = sq.Exec(tx, sq.CustomQuery{
+			Dialect: cmd.Notebrew.Dialect,
+			Format: "INSERT INTO site_user (site_id, user_id, role)" +
+				" SELECT site.site_id, users.user_id, 'owner'" +
+				" FROM site, users" +
+				" WHERE site.site_name = {siteName} AND users.username = {username}" +
+				" AND NOT EXISTS (" +
+				"SELECT 1 FROM site_user WHERE site_user.site_id = site.site_id AND site_user.user_id = users.user_id" +
+				")",
+			Values: []any{
+				sq.StringParam("username", cmd.Username.String),
+				sq.StringParam("siteName", cmd.SiteName.String),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = cmd.setRole(tx, nb7.RoleOwner)
+		if err != nil {
 			return err
 		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+			SiteName: cmd.SiteName.String,
+			Action:   "setowner",
+			Target:   cmd.Username.String,
+		})
 	case "revoke":
 		_, err := sq.Exec(cmd.Notebrew.DB, sq.CustomQuery{
 			Dialect: cmd.Notebrew.Dialect,
@@ -222,6 +349,11 @@ func (cmd *PermissionsCmd) Run() error {
 		if err != nil {
 			return err
 		}
+		return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+			SiteName: cmd.SiteName.String,
+			Action:   "revoke",
+			Target:   cmd.Username.String,
+		})
 	default:
 		result, err := sq.FetchOne(cmd.Notebrew.DB, sq.CustomQuery{
 			Dialect: cmd.Notebrew.Dialect,
@@ -241,11 +373,13 @@ func (cmd *PermissionsCmd) Run() error {
 			Username string
 			SiteID   [16]byte
 			SiteName string
+			Role     string
 		}) {
 			row.UUID(&result.UserID, "users.user_id")
 			result.Username = row.String("users.username")
 			row.UUID(&result.SiteID, "site.site_id")
 			result.SiteName = row.String("site.site_name")
+			result.Role = row.String("COALESCE(site_user.role, 'owner')")
 			return result
 		})
 		if err != nil {
@@ -254,7 +388,28 @@ func (cmd *PermissionsCmd) Run() error {
 			}
 			return err
 		}
-		fmt.Fprintf(cmd.Stdout, "userid=%s user=%s siteid=%s site=%s\n", hex.EncodeToString(result.UserID[:]), result.Username, hex.EncodeToString(result.SiteID[:]), result.SiteName)
+		fmt.Fprintf(cmd.Stdout, "userid=%s user=%s siteid=%s site=%s role=%s\n", hex.EncodeToString(result.UserID[:]), result.Username, hex.EncodeToString(result.SiteID[:]), result.SiteName, result.Role)
+	}
+	return nil
+}
+
+func (cmd *PermissionsCmd) setRole(db sq.DB, role string) error {
+	result, err := sq.Exec(db, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format: "UPDATE site_user SET role = {role}" +
+			" WHERE site_id = (SELECT site_id FROM site WHERE site_name = {siteName})" +
+			" AND user_id = (SELECT user_id FROM users WHERE username = {username})",
+		Values: []any{
+			sq.StringParam("role", role),
+			sq.StringParam("username", cmd.Username.String),
+			sq.StringParam("siteName", cmd.SiteName.String),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("user %q is not a member of site %q, use -grant instead", cmd.Username.String, cmd.SiteName.String)
 	}
 	return nil
 }
@@ -191,6 +191,14 @@ func (cmd *ResetpasswordCmd) Run() error {
 				return err
 			}
 		}
+		err = writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+			IsAccount: true,
+			Action:    "resetpasswordlink",
+			Target:    cmd.Username,
+		})
+		if err != nil {
+			return err
+		}
 		values := make(url.Values)
 		values.Set("token", strings.TrimLeft(hex.EncodeToString(resetToken[:]), "0"))
 		fmt.Fprintf(os.Stderr, "Password reset link generated for %s:\n", name)
@@ -263,6 +271,14 @@ func (cmd *ResetpasswordCmd) Run() error {
 	if err != nil {
 		return err
 	}
+	err = writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		IsAccount: true,
+		Action:    "resetpassword",
+		Target:    cmd.Username,
+	})
+	if err != nil {
+		return err
+	}
 	fmt.Fprintf(os.Stderr, "password reset for %s\n", name)
 	return nil
 }
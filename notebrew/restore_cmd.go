@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+)
+
+type RestoreCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdin    io.Reader
+	Stdout   io.Writer
+	Input    string
+	Options  nb7.RestoreOptions
+}
+
+func RestoreCommand(nbrew *nb7.Notebrew, args ...string) (*RestoreCmd, error) {
+	var cmd RestoreCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("site", "Site to restore into. Defaults to the site in the backup.", func(s string) error {
+		cmd.Options.SiteName = sql.NullString{String: strings.TrimPrefix(s, "@"), Valid: true}
+		return nil
+	})
+	flagset.BoolVar(&cmd.Options.Overwrite, "overwrite", false, "Restore into a site that already exists, replacing its files with those in the backup.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew restore [-site <site>] [-overwrite] <file>
+Restores a site from an archive made by notebrew backup. Use - to read the
+archive from stdin. Members whose users do not exist in this instance are
+skipped.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	args = flagset.Args()
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			err := flagset.Parse(args[i:])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args[:i], flagset.Args()...)
+			break
+		}
+	}
+	if len(args) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("file not provided")
+	}
+	if len(args) > 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(args[1:], " "))
+	}
+	cmd.Input = args[0]
+	return &cmd, nil
+}
+
+func (cmd *RestoreCmd) Run() error {
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	reader := cmd.Stdin
+	if cmd.Input != "-" {
+		file, err := os.Open(cmd.Input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	result, err := cmd.Notebrew.RestoreSite(context.Background(), reader, cmd.Options)
+	if err != nil {
+		return err
+	}
+	siteName := result.SiteName
+	if siteName == "" {
+		siteName = "main site"
+	}
+	fmt.Fprintf(cmd.Stdout, "restored %d files into %s\n", len(result.Manifest.Files), siteName)
+	for _, username := range result.SkippedMembers {
+		fmt.Fprintf(cmd.Stdout, "skipped member %s: user does not exist\n", username)
+	}
+	return writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		SiteName: result.SiteName,
+		Action:   "restoresite",
+	})
+}
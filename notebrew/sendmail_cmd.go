@@ -10,7 +10,6 @@ import (
 	"net/smtp"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/bokwoon95/nb7"
@@ -59,54 +58,44 @@ func SendmailCommand(nbrew *nb7.Notebrew, args ...string) (*SendmailCmd, error)
 }
 
 func (cmd *SendmailCmd) Run() error {
-	localDir, err := filepath.Abs(fmt.Sprint(cmd.Notebrew.FS))
-	if err == nil {
-		fileInfo, err := os.Stat(localDir)
-		if err != nil || !fileInfo.IsDir() {
-			localDir = ""
-		}
-	}
-	b, err := fs.ReadFile(cmd.Notebrew.FS, "config/mailer.txt")
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return fmt.Errorf("mailer not configured: %s does not exist", filepath.Join(localDir, "config/mailer.txt"))
-		}
-		return err
+	rawURL := cmd.Notebrew.Config().Mailer
+	if rawURL == "" {
+		return fmt.Errorf("mailer not configured: set the mailer key with notebrew config set mailer <smtp-url>")
 	}
-	rawURL := string(bytes.TrimSpace(b))
+	source := cmd.Notebrew.Config().Source("mailer")
 	if strings.HasPrefix(rawURL, "file:") {
 		filename := strings.TrimPrefix(strings.TrimPrefix(rawURL, "file:"), "//")
 		b, err := os.ReadFile(filename)
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
-				return fmt.Errorf("%s: %s does not exist", filepath.Join(localDir, "config/mailer.txt"), filename)
+				return fmt.Errorf("%s: mailer: %s does not exist", source, filename)
 			}
-			return nil
+			return err
 		}
 		rawURL = string(bytes.TrimSpace(b))
 	}
 	const expectedFormat = "smtp://user@mail.com:password@smtp.server.com:587"
 	if rawURL == "" {
-		return fmt.Errorf("%s is empty (expected format: %s)", filepath.Join(localDir, "config/mailer.txt"), expectedFormat)
+		return fmt.Errorf("%s: mailer: SMTP URL is empty (expected format: %s)", source, expectedFormat)
 	}
 	uri, err := url.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("%s: %q is not a valid URL (expected format: %s)", filepath.Join(localDir, "config/mailer.txt"), rawURL, expectedFormat)
+		return fmt.Errorf("%s: mailer: %q is not a valid URL (expected format: %s)", source, rawURL, expectedFormat)
 	}
 	if uri.Scheme != "smtp" {
-		return fmt.Errorf("%s: %q is not an SMTP URL (expected format: %s)", filepath.Join(localDir, "config/mailer.txt"), rawURL, expectedFormat)
+		return fmt.Errorf("%s: mailer: %q is not an SMTP URL (expected format: %s)", source, rawURL, expectedFormat)
 	}
 	if uri.User == nil {
-		return fmt.Errorf("%s: %q is missing the username (expected format: %s)", filepath.Join(localDir, "config/mailer.txt"), rawURL, expectedFormat)
+		return fmt.Errorf("%s: mailer: %q is missing the username (expected format: %s)", source, rawURL, expectedFormat)
 	}
 	username := uri.User.Username()
 	password, ok := uri.User.Password()
 	if !ok {
-		return fmt.Errorf("%s: %q is missing the password (expected format: %s)", filepath.Join(localDir, "config/mailer.txt"), rawURL, expectedFormat)
+		return fmt.Errorf("%s: mailer: %q is missing the password (expected format: %s)", source, rawURL, expectedFormat)
 	}
 	port := uri.Port()
 	if port == "" {
-		return fmt.Errorf("%s: %q is missing the port number (expected format: %s)", filepath.Join(localDir, "config/mailer.txt"), rawURL, expectedFormat)
+		return fmt.Errorf("%s: mailer: %q is missing the port number (expected format: %s)", source, rawURL, expectedFormat)
 	}
 	if len(cmd.To) == 0 {
 		return fmt.Errorf("no recipient(s) specified")
@@ -25,8 +25,10 @@ func TokenCommand(args ...string) (*TokenCmd, error) {
 	flagset := flag.NewFlagSet("", flag.ContinueOnError)
 	flagset.Usage = func() {
 		fmt.Fprintln(flagset.Output(), `Usage:
-  lorem ipsum dolor sit amet
-  consectetur adipiscing elit`)
+  notebrew token                   # generate a new token and its hash
+  notebrew token <timestamp>       # generate a token with the given timestamp
+  notebrew token <token or hash>   # print the timestamp of a token (and its hash)
+  notebrew token create|list|revoke  # manage API tokens, see notebrew token create -h`)
 	}
 	err := flagset.Parse(args)
 	if err != nil {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bokwoon95/nb7"
+	"github.com/bokwoon95/sq"
+)
+
+type TwofaCmd struct {
+	Notebrew *nb7.Notebrew
+	Stdout   io.Writer
+	Username string
+	Disable  bool
+}
+
+func TwofaCommand(nbrew *nb7.Notebrew, args ...string) (*TwofaCmd, error) {
+	var cmd TwofaCmd
+	cmd.Notebrew = nbrew
+	var username sql.NullString
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("user", "", func(s string) error {
+		username = sql.NullString{String: strings.TrimPrefix(s, "@"), Valid: true}
+		return nil
+	})
+	flagset.BoolVar(&cmd.Disable, "disable", false, "Disable two-factor authentication for the user.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew 2fa -user <username>          # show whether two-factor authentication is enabled
+  notebrew 2fa -user <username> -disable # disable two-factor authentication
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	if !username.Valid {
+		flagset.Usage()
+		return nil, fmt.Errorf("-user required")
+	}
+	cmd.Username = username.String
+	return &cmd, nil
+}
+
+func (cmd *TwofaCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	result, err := sq.FetchOne(cmd.Notebrew.DB, sq.CustomQuery{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  "SELECT {*} FROM users WHERE username = {username}",
+		Values: []any{
+			sq.StringParam("username", cmd.Username),
+		},
+	}, func(row *sq.Row) (result struct {
+		Enabled                bool
+		RecoveryCodesRemaining int
+	}) {
+		result.Enabled = row.Bool("CASE WHEN totp_secret IS NOT NULL THEN 1 ELSE 0 END")
+		result.RecoveryCodesRemaining = row.Int("(SELECT COUNT(*) FROM recovery_code WHERE recovery_code.user_id = users.user_id)")
+		return result
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %q does not exist", cmd.Username)
+		}
+		return err
+	}
+	if !cmd.Disable {
+		if result.Enabled {
+			fmt.Fprintf(cmd.Stdout, "two-factor authentication is enabled for %s (%d recovery codes remaining)\n", cmd.Username, result.RecoveryCodesRemaining)
+		} else {
+			fmt.Fprintf(cmd.Stdout, "two-factor authentication is not enabled for %s\n", cmd.Username)
+		}
+		return nil
+	}
+	if !result.Enabled {
+		fmt.Fprintf(cmd.Stdout, "two-factor authentication is not enabled for %s\n", cmd.Username)
+		return nil
+	}
+	err = cmd.Notebrew.DisableTwoFactor(context.Background(), cmd.Username)
+	if err != nil {
+		return err
+	}
+	err = writeAuditLog(cmd.Notebrew, nb7.AuditEntry{
+		IsAccount: true,
+		Action:    "disabletwofactor",
+		Target:    cmd.Username,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "two-factor authentication disabled for %s\n", cmd.Username)
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build cgo
+
+package nb7
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sqlite3ErrorCode = func(err error) (errcode string) {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) {
+			return strconv.Itoa(int(sqliteErr.ExtendedCode))
+		}
+		return ""
+	}
+}
@@ -0,0 +1,204 @@
+package nb7
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolSignature is the signature that every PROXY protocol v2
+// header starts with.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolListener wraps a listener so that connections from trusted
+// proxies (see ProxyConfig) must start with a PROXY protocol v1 or v2
+// header, and reports the client address in the header as the remote
+// address of the connection. Connections from anywhere else are passed
+// through untouched.
+//
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+func (nbrew *Notebrew) ProxyProtocolListener(listener net.Listener) net.Listener {
+	return &proxyProtocolListener{
+		Listener: listener,
+		isTrusted: func(addr netip.Addr) bool {
+			for _, prefix := range nbrew.Config().trustedProxies() {
+				if prefix.Contains(addr) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	isTrusted func(netip.Addr) bool
+}
+
+func (listener *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, isTrusted: listener.isTrusted}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header on the first call to
+// Read or RemoteAddr rather than in Accept, so that a slow or misbehaving
+// proxy does not hold up accepting other connections.
+type proxyProtocolConn struct {
+	net.Conn
+	isTrusted  func(netip.Addr) bool
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (conn *proxyProtocolConn) init() {
+	conn.once.Do(func() {
+		conn.remoteAddr = conn.Conn.RemoteAddr()
+		addrPort, err := netip.ParseAddrPort(conn.remoteAddr.String())
+		if err != nil || !conn.isTrusted(addrPort.Addr().Unmap()) {
+			return
+		}
+		conn.reader = bufio.NewReader(conn.Conn)
+		conn.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		remoteAddr, err := readProxyProtocolHeader(conn.reader)
+		conn.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			conn.err = fmt.Errorf("PROXY protocol: %s: %w", conn.remoteAddr, err)
+			conn.Conn.Close()
+			return
+		}
+		if remoteAddr != nil {
+			conn.remoteAddr = remoteAddr
+		}
+	})
+}
+
+func (conn *proxyProtocolConn) Read(b []byte) (int, error) {
+	conn.init()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	if conn.reader != nil {
+		return conn.reader.Read(b)
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	conn.init()
+	return conn.remoteAddr
+}
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header and returns
+// the source address in it. It returns a nil address for headers that do
+// not carry one (UNKNOWN in v1, LOCAL or non-IP families in v2).
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyProtocolSignature))
+	if err == nil && bytes.Equal(signature, proxyProtocolSignature) {
+		return readProxyProtocolV2(reader)
+	}
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) != "PROXY " {
+		return nil, fmt.Errorf("missing header")
+	}
+	return readProxyProtocolV1(reader)
+}
+
+// readProxyProtocolV1 reads a human-readable header e.g.
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", header)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 header %q: %w", header, err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 header %q: %w", header, err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), uint16(port))), nil
+}
+
+// readProxyProtocolV2 reads a binary header.
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return nil, err
+	}
+	version, command := header[12]>>4, header[12]&0x0F
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+	switch command {
+	case 0x0: // LOCAL: the proxy's own connection e.g. a health check.
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+	// The payload starts with the source and destination addresses followed
+	// by the source and destination ports. Any TLVs after them are ignored.
+	switch family {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("v2 header too short for IPv4 addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("v2 header too short for IPv6 addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34]))), nil
+	default:
+		return nil, nil
+	}
+}
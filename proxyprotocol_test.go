@@ -0,0 +1,107 @@
+package nb7
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_readProxyProtocolHeader(t *testing.T) {
+	type TestTable struct {
+		description    string
+		header         string
+		wantRemoteAddr string
+		wantErr        bool
+	}
+	tests := []TestTable{{
+		description:    "v1 TCP4",
+		header:         "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		wantRemoteAddr: "192.0.2.1:56324",
+	}, {
+		description:    "v1 TCP6",
+		header:         "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		wantRemoteAddr: "[2001:db8::1]:56324",
+	}, {
+		description: "v1 UNKNOWN",
+		header:      "PROXY UNKNOWN\r\n",
+	}, {
+		description: "v1 not terminated",
+		header:      "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		wantErr:     true,
+	}, {
+		description:    "v2 PROXY IPv4",
+		header:         string(proxyProtocolSignature) + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04" + "\x01\xbb",
+		wantRemoteAddr: "192.0.2.1:56324",
+	}, {
+		description: "v2 LOCAL",
+		header:      string(proxyProtocolSignature) + "\x20\x00\x00\x00",
+	}, {
+		description: "no header",
+		header:      "GET / HTTP/1.1\r\n",
+		wantErr:     true,
+	}}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n"))
+			remoteAddr, err := readProxyProtocolHeader(reader)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("%s: expected error, got nil", testutil.Callers())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			var gotRemoteAddr string
+			if remoteAddr != nil {
+				gotRemoteAddr = remoteAddr.String()
+			}
+			if gotRemoteAddr != tt.wantRemoteAddr {
+				t.Errorf("%s: got %q, want %q", testutil.Callers(), gotRemoteAddr, tt.wantRemoteAddr)
+			}
+			// The rest of the connection must be left intact.
+			line, _ := reader.ReadString('\n')
+			if line != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%s: got %q after the header, want the request line", testutil.Callers(), line)
+			}
+		})
+	}
+}
+
+func Test_ProxyProtocolListener(t *testing.T) {
+	nbrew := &Notebrew{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	listener = nbrew.ProxyProtocolListener(listener)
+	defer listener.Close()
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello\n"))
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	defer conn.Close()
+	if remoteAddr := conn.RemoteAddr().String(); remoteAddr != "192.0.2.1:56324" {
+		t.Errorf("%s: got %q, want %q", testutil.Callers(), remoteAddr, "192.0.2.1:56324")
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if line != "hello\n" {
+		t.Errorf("%s: got %q, want %q", testutil.Callers(), line, "hello\n")
+	}
+}
@@ -0,0 +1,293 @@
+package nb7
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// RateLimitPolicy is the size and refill rate of a token bucket: it holds
+// up to Requests tokens and refills at Requests tokens per Period, so
+// Requests requests may be made at once but no more than Requests per
+// Period on average.
+type RateLimitPolicy struct {
+	Requests int
+	Period   time.Duration
+}
+
+// RateLimitStore holds the token buckets of the rate limiter.
+//
+// A bucket is stored as the time at which it will be full again, which is
+// enough to work out how many tokens it holds: a bucket that is full at or
+// before now holds all of its tokens, and every token taken pushes the time
+// back by Period/Requests.
+type RateLimitStore interface {
+	// Take takes a token from the bucket identified by key. If the bucket is
+	// empty, no token is taken and Take returns how long until the next
+	// token is available.
+	Take(ctx context.Context, key string, policy RateLimitPolicy) (retryAfter time.Duration, err error)
+
+	// Peek reports how long until a token is available from the bucket
+	// identified by key (0 if there is one now) without taking it.
+	Peek(ctx context.Context, key string, policy RateLimitPolicy) (retryAfter time.Duration, err error)
+}
+
+// takeToken takes a token from a bucket that is full at fullAt. It returns
+// when the bucket will be full again afterwards, or if the bucket is empty
+// how long until the next token is available.
+func takeToken(fullAt, now time.Time, policy RateLimitPolicy) (newFullAt time.Time, retryAfter time.Duration) {
+	if fullAt.Before(now) {
+		fullAt = now
+	}
+	newFullAt = fullAt.Add(policy.Period / time.Duration(policy.Requests))
+	// The bucket is empty when it is more than a whole period away from
+	// being full.
+	if excess := newFullAt.Sub(now) - policy.Period; excess > 0 {
+		return fullAt, excess
+	}
+	return newFullAt, 0
+}
+
+// MemoryRateLimitStore keeps token buckets in memory. The zero value is
+// ready to use.
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	buckets  map[string]time.Time
+	prunedAt time.Time
+}
+
+func (store *MemoryRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy) (retryAfter time.Duration, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	if store.buckets == nil {
+		store.buckets = make(map[string]time.Time)
+	}
+	// Full buckets are indistinguishable from buckets that don't exist, so
+	// drop them every now and then to keep memory bounded.
+	if now.Sub(store.prunedAt) > time.Minute {
+		for bucketKey, fullAt := range store.buckets {
+			if !fullAt.After(now) {
+				delete(store.buckets, bucketKey)
+			}
+		}
+		store.prunedAt = now
+	}
+	newFullAt, retryAfter := takeToken(store.buckets[key], now, policy)
+	if retryAfter > 0 {
+		return retryAfter, nil
+	}
+	store.buckets[key] = newFullAt
+	return 0, nil
+}
+
+func (store *MemoryRateLimitStore) Peek(ctx context.Context, key string, policy RateLimitPolicy) (retryAfter time.Duration, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, retryAfter = takeToken(store.buckets[key], time.Now(), policy)
+	return retryAfter, nil
+}
+
+// DatabaseRateLimitStore keeps token buckets in the rate_limit table, so
+// that notebrew instances that use the same database share their rate
+// limits.
+type DatabaseRateLimitStore struct {
+	// Notebrew provides the database.
+	Notebrew *Notebrew
+}
+
+func (store *DatabaseRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy) (retryAfter time.Duration, err error) {
+	nbrew := store.Notebrew
+	// Concurrent requests for the same bucket are resolved with
+	// compare-and-swap rather than row locks, which differ by dialect: if
+	// the bucket changed since it was read, read it again.
+	for attempt := 0; attempt < 5; attempt++ {
+		now := time.Now()
+		fullAt, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM rate_limit WHERE rate_limit_key = {key}",
+			Values: []any{
+				sq.StringParam("key", key),
+			},
+		}, func(row *sq.Row) int64 {
+			return row.Int64("full_at")
+		})
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return 0, err
+			}
+			newFullAt, retryAfter := takeToken(now, now, policy)
+			if retryAfter > 0 {
+				return retryAfter, nil
+			}
+			_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "INSERT INTO rate_limit (rate_limit_key, full_at) VALUES ({key}, {fullAt})",
+				Values: []any{
+					sq.StringParam("key", key),
+					sq.Int64Param("fullAt", newFullAt.UnixMilli()),
+				},
+			})
+			if err != nil {
+				if nbrew.IsKeyViolation(err) {
+					continue
+				}
+				return 0, err
+			}
+			return 0, nil
+		}
+		newFullAt, retryAfter := takeToken(time.UnixMilli(fullAt), now, policy)
+		if retryAfter > 0 {
+			return retryAfter, nil
+		}
+		result, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE rate_limit SET full_at = {newFullAt} WHERE rate_limit_key = {key} AND full_at = {fullAt}",
+			Values: []any{
+				sq.Int64Param("newFullAt", newFullAt.UnixMilli()),
+				sq.StringParam("key", key),
+				sq.Int64Param("fullAt", fullAt),
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+		if result.RowsAffected > 0 {
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("rate limit %s: too many concurrent requests", key)
+}
+
+func (store *DatabaseRateLimitStore) Peek(ctx context.Context, key string, policy RateLimitPolicy) (retryAfter time.Duration, err error) {
+	nbrew := store.Notebrew
+	fullAt, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM rate_limit WHERE rate_limit_key = {key}",
+		Values: []any{
+			sq.StringParam("key", key),
+		},
+	}, func(row *sq.Row) int64 {
+		return row.Int64("full_at")
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	_, retryAfter = takeToken(time.UnixMilli(fullAt), time.Now(), policy)
+	return retryAfter, nil
+}
+
+// rateLimitPolicies are the rate limit policies that apply to each route
+// and their defaults.
+var rateLimitPolicies = map[string]struct {
+	config        func(*Config) RateLimitConfig
+	defaultPolicy RateLimitPolicy
+}{
+	"login": {
+		config:        func(config *Config) RateLimitConfig { return config.RateLimits.Login },
+		defaultPolicy: RateLimitPolicy{Requests: 10, Period: time.Minute},
+	},
+	"signup": {
+		config:        func(config *Config) RateLimitConfig { return config.RateLimits.Signup },
+		defaultPolicy: RateLimitPolicy{Requests: 5, Period: time.Hour},
+	},
+	"resetpassword": {
+		config:        func(config *Config) RateLimitConfig { return config.RateLimits.ResetPassword },
+		defaultPolicy: RateLimitPolicy{Requests: 5, Period: time.Hour},
+	},
+	"write": {
+		config:        func(config *Config) RateLimitConfig { return config.RateLimits.Write },
+		defaultPolicy: RateLimitPolicy{Requests: 120, Period: time.Minute},
+	},
+}
+
+// rateLimitPolicy returns the named rate limit policy as configured, or
+// false if it is disabled.
+func (nbrew *Notebrew) rateLimitPolicy(policyName string) (RateLimitPolicy, bool) {
+	config := rateLimitPolicies[policyName].config(nbrew.Config())
+	if config.Disabled {
+		return RateLimitPolicy{}, false
+	}
+	policy := rateLimitPolicies[policyName].defaultPolicy
+	if config.Requests > 0 {
+		policy.Requests = config.Requests
+	}
+	if config.Period != "" {
+		// The period has already been validated by Config.Validate.
+		policy.Period, _ = time.ParseDuration(config.Period)
+	}
+	return policy, true
+}
+
+// rateLimit takes a token from the bucket of key (an IP address or user)
+// under the named policy. If there are none left, it responds with 429 Too
+// Many Requests and returns false.
+func (nbrew *Notebrew) rateLimit(w http.ResponseWriter, r *http.Request, policyName, key string) bool {
+	if nbrew.RateLimitStore == nil {
+		return true
+	}
+	policy, ok := nbrew.rateLimitPolicy(policyName)
+	if !ok {
+		return true
+	}
+	retryAfter, err := nbrew.RateLimitStore.Take(r.Context(), policyName+":"+key, policy)
+	if err != nil {
+		// Let the request through rather than lock everyone out because the
+		// store is unavailable.
+		getLogger(r.Context()).Error(err.Error())
+		return true
+	}
+	if retryAfter > 0 {
+		tooManyRequests(w, r, retryAfter)
+		return false
+	}
+	return true
+}
+
+// checkRateLimit is like rateLimit but only checks that the bucket of key
+// has a token left without taking it, for requests that only count against
+// the limit once their outcome is known (see spendRateLimit).
+func (nbrew *Notebrew) checkRateLimit(w http.ResponseWriter, r *http.Request, policyName, key string) bool {
+	if nbrew.RateLimitStore == nil {
+		return true
+	}
+	policy, ok := nbrew.rateLimitPolicy(policyName)
+	if !ok {
+		return true
+	}
+	retryAfter, err := nbrew.RateLimitStore.Peek(r.Context(), policyName+":"+key, policy)
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+		return true
+	}
+	if retryAfter > 0 {
+		tooManyRequests(w, r, retryAfter)
+		return false
+	}
+	return true
+}
+
+// spendRateLimit takes a token from the bucket of key checked earlier by
+// checkRateLimit.
+func (nbrew *Notebrew) spendRateLimit(r *http.Request, policyName, key string) {
+	if nbrew.RateLimitStore == nil {
+		return
+	}
+	policy, ok := nbrew.rateLimitPolicy(policyName)
+	if !ok {
+		return
+	}
+	_, err := nbrew.RateLimitStore.Take(r.Context(), policyName+":"+key, policy)
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+	}
+}
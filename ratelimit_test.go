@@ -0,0 +1,176 @@
+package nb7
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_RateLimitStore(t *testing.T) {
+	stores := map[string]RateLimitStore{
+		"memory": &MemoryRateLimitStore{},
+	}
+	for _, testDB := range testDatabases {
+		stores[testDB.Name] = &DatabaseRateLimitStore{
+			Notebrew: &Notebrew{
+				Dialect:   testDB.Dialect,
+				DB:        testDB.DB,
+				ErrorCode: testDB.ErrorCode,
+			},
+		}
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			policy := RateLimitPolicy{Requests: 3, Period: time.Hour}
+			key := "test:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			for i := 0; i < policy.Requests; i++ {
+				retryAfter, err := store.Peek(context.Background(), key, policy)
+				if err != nil {
+					t.Fatal(testutil.Callers(), err)
+				}
+				if retryAfter != 0 {
+					t.Fatalf("%s peek %d: got retryAfter %s, want 0", testutil.Callers(), i+1, retryAfter)
+				}
+				retryAfter, err = store.Take(context.Background(), key, policy)
+				if err != nil {
+					t.Fatal(testutil.Callers(), err)
+				}
+				if retryAfter != 0 {
+					t.Fatalf("%s request %d: got retryAfter %s, want 0", testutil.Callers(), i+1, retryAfter)
+				}
+			}
+			retryAfter, err := store.Take(context.Background(), key, policy)
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			// One token refills every 20 minutes.
+			if retryAfter <= 19*time.Minute || retryAfter > 20*time.Minute {
+				t.Errorf("%s: got retryAfter %s, want about 20m", testutil.Callers(), retryAfter)
+			}
+			retryAfter, err = store.Peek(context.Background(), key, policy)
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			if retryAfter <= 19*time.Minute || retryAfter > 20*time.Minute {
+				t.Errorf("%s: got peek retryAfter %s, want about 20m", testutil.Callers(), retryAfter)
+			}
+		})
+	}
+}
+
+func Test_rateLimit(t *testing.T) {
+	nbrew := &Notebrew{
+		FS:             testutil.NewFS(nil),
+		Scheme:         "http://",
+		AdminDomain:    "localhost:6444",
+		ContentDomain:  "localhost:6444",
+		RateLimitStore: &MemoryRateLimitStore{},
+	}
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 6; i++ {
+		w = httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost:6444/admin/resetpassword/", strings.NewReader(url.Values{"email": {"dijkstra@email.com"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", "application/json")
+		r.RemoteAddr = "192.0.2.1:1234"
+		nbrew.ServeHTTP(w, r)
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("%s: got status %d, want %d", testutil.Callers(), w.Code, http.StatusTooManyRequests)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "720" {
+		t.Errorf("%s: got Retry-After %q, want %q", testutil.Callers(), retryAfter, "720")
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("%s: got Content-Type %q, want application/json", testutil.Callers(), contentType)
+	}
+}
+
+func Test_rateLimit_account(t *testing.T) {
+	for _, testDB := range testDatabases {
+		t.Run(testDB.Name, func(t *testing.T) {
+			nbrew := &Notebrew{
+				Dialect:        testDB.Dialect,
+				DB:             testDB.DB,
+				FS:             testutil.NewFS(nil),
+				ErrorCode:      testDB.ErrorCode,
+				Scheme:         "http://",
+				AdminDomain:    "localhost:6444",
+				ContentDomain:  "localhost:6444",
+				RateLimitStore: &MemoryRateLimitStore{},
+			}
+			createUser(t, nbrew, "pike", "pike@email.com", "password123")
+			createUser(t, nbrew, "plauger", "plauger@email.com", "password123")
+			// Every request comes from a different IP address, so only the
+			// per-account buckets can run out.
+			var requests int
+			post := func(path string, values url.Values) *httptest.ResponseRecorder {
+				requests++
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("POST", "http://localhost:6444"+path, strings.NewReader(values.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				r.Header.Set("Accept", "application/json")
+				r.RemoteAddr = "192.0.2." + strconv.Itoa(requests) + ":1234"
+				nbrew.ServeHTTP(w, r)
+				return w
+			}
+
+			// Failed logins run out the account's bucket, and the response
+			// once they do doesn't depend on whether the account exists.
+			var bodies []string
+			for _, username := range []string{"pike", "@nosuchuser"} {
+				values := url.Values{"username": {username}, "password": {"wrongpassword"}}
+				for i := 0; i < 10; i++ {
+					w := post("/admin/login/", values)
+					if w.Code == http.StatusTooManyRequests {
+						t.Fatalf("%s %s: request %d was rate limited", testutil.Callers(), username, i+1)
+					}
+				}
+				w := post("/admin/login/", values)
+				if w.Code != http.StatusTooManyRequests {
+					t.Fatalf("%s %s: got status %d, want %d", testutil.Callers(), username, w.Code, http.StatusTooManyRequests)
+				}
+				bodies = append(bodies, w.Header().Get("Retry-After")+" "+w.Body.String())
+			}
+			if diff := testutil.Diff(bodies[0], bodies[1]); diff != "" {
+				t.Errorf("%s: responses differ for an existing and a missing account: %s", testutil.Callers(), diff)
+			}
+
+			// Successful logins and requests turned away before the password
+			// is checked don't count.
+			for i := 0; i < 15; i++ {
+				for _, values := range []url.Values{
+					{"username": {"plauger"}, "password": {"password123"}},
+					{"username": {"plauger"}, "password": {""}},
+				} {
+					w := post("/admin/login/", values)
+					if w.Code == http.StatusTooManyRequests {
+						t.Fatalf("%s %v: request %d was rate limited", testutil.Callers(), values, i+1)
+					}
+				}
+			}
+
+			// Reset requests only count once an email is sent, which needs a
+			// mailer, so take the tokens directly.
+			r, _ := http.NewRequest("POST", "http://localhost:6444/admin/resetpassword/", nil)
+			for i := 0; i < 5; i++ {
+				nbrew.spendRateLimit(r, "resetpassword", "account:pike@email.com")
+			}
+			for _, email := range []string{"Pike@email.com", "nosuchuser@email.com"} {
+				for i := 0; i < 6; i++ {
+					w := post("/admin/resetpassword/", url.Values{"email": {email}})
+					if limited := w.Code == http.StatusTooManyRequests; limited != (email == "Pike@email.com") {
+						t.Fatalf("%s %s: request %d got status %d", testutil.Callers(), email, i+1, w.Code)
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,8 @@
 package nb7
 
 import (
-	"bytes"
 	"crypto/rand"
+	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -10,13 +10,11 @@ import (
 	"fmt"
 	"html"
 	"html/template"
-	"io/fs"
 	"mime"
 	"net/http"
 	"net/mail"
 	"net/smtp"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -26,6 +24,9 @@ import (
 	"golang.org/x/crypto/blake2b"
 )
 
+// resetTokenMaxAge is how long a password reset link stays valid.
+const resetTokenMaxAge = 20 * time.Minute
+
 func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip string) {
 	type Request struct {
 		Email           string `json:"email,omitempty"`
@@ -40,12 +41,6 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 		Errors           map[string][]Error `json:"errors,omitempty"`
 		MailSendingError string             `json:"mailSendingError,omitempty"`
 	}
-	type SmtpSettings struct {
-		Username string
-		Password string
-		Host     string
-		Port     string
-	}
 
 	if nbrew.DB == nil {
 		notFound(w, r)
@@ -96,57 +91,12 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 			return nil, false, nil
 		}
 		issuedAt := time.Unix(int64(binary.BigEndian.Uint64(resetTokenHash[:8])), 0)
-		if time.Now().Sub(issuedAt) > 20*time.Minute {
+		if time.Now().Sub(issuedAt) > resetTokenMaxAge {
 			return resetTokenHash, true, nil
 		}
 		return resetTokenHash, false, nil
 	}
 
-	getSmtpSettings := func() (smtpSettings *SmtpSettings, isDisabled, isMisconfigured bool, err error) {
-		b, err := fs.ReadFile(nbrew.FS, "config/mailer.txt")
-		if err != nil {
-			if errors.Is(err, fs.ErrNotExist) {
-				return nil, true, false, nil
-			}
-			return nil, false, false, err
-		}
-		smtpURL := string(bytes.TrimSpace(b))
-		if strings.HasPrefix(smtpURL, "file:") {
-			filename := strings.TrimPrefix(strings.TrimPrefix(smtpURL, "file:"), "//")
-			b, err := os.ReadFile(filename)
-			if err != nil {
-				if errors.Is(err, fs.ErrNotExist) {
-					return nil, false, true, nil
-				}
-				return nil, false, true, err
-			}
-			smtpURL = string(bytes.TrimSpace(b))
-		}
-		smtpSettings = &SmtpSettings{}
-		uri, err := url.Parse(smtpURL)
-		if err != nil {
-			return nil, false, true, nil
-		}
-		if uri.Scheme != "smtp" {
-			return nil, false, true, nil
-		}
-		if uri.User == nil {
-			return nil, false, true, nil
-		}
-		var ok bool
-		smtpSettings.Username = uri.User.Username()
-		smtpSettings.Password, ok = uri.User.Password()
-		if !ok {
-			return nil, false, true, nil
-		}
-		smtpSettings.Port = uri.Port()
-		if smtpSettings.Port == "" {
-			return nil, false, true, nil
-		}
-		smtpSettings.Host = strings.TrimSuffix(uri.Host, ":"+smtpSettings.Port)
-		return smtpSettings, false, false, nil
-	}
-
 	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
 	switch r.Method {
 	case "GET":
@@ -173,7 +123,7 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", false)
+			contentSecurityPolicy(w, "", nil)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -218,7 +168,7 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 			}
 			response.ResetToken = r.Form.Get("token")
 		} else {
-			_, isDisabled, isMisconfigured, err := getSmtpSettings()
+			_, isDisabled, isMisconfigured, err := nbrew.getSmtpSettings()
 			if err != nil {
 				getLogger(r.Context()).Error(err.Error())
 				internalServerError(w, r, err)
@@ -323,6 +273,19 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 			writeResponse(w, r, response)
 			return
 		}
+		// Besides the per-IP limit applied by the router, the reset emails
+		// sent to an address are limited so that it can't be flooded from
+		// many addresses. Only emails that are actually sent count, each with
+		// a reset link that replaces the last, so filling up the limit never
+		// leaves the owner without a working link. The check happens before
+		// the address is looked up so that it responds the same whether or
+		// not an account uses it.
+		emailKey := "account:" + strings.ToLower(request.Email)
+		if response.ResetToken == "" && request.Email != "" {
+			if !nbrew.checkRateLimit(w, r, "resetpassword", emailKey) {
+				return
+			}
+		}
 		var resetTokenHash []byte
 		if response.ResetToken != "" {
 			var err error
@@ -399,7 +362,7 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 		}
 
 		if resetTokenHash == nil {
-			smtpSettings, isDisabled, isMisconfigured, err := getSmtpSettings()
+			smtpSettings, isDisabled, isMisconfigured, err := nbrew.getSmtpSettings()
 			if err != nil {
 				getLogger(r.Context()).Error(err.Error())
 				internalServerError(w, r, err)
@@ -440,6 +403,7 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 				internalServerError(w, r, err)
 				return
 			}
+			nbrew.spendRateLimit(r, "resetpassword", emailKey)
 			auth := smtp.PlainAuth("", smtpSettings.Username, smtpSettings.Password, smtpSettings.Host)
 			from := "Notebrew mailer"
 			to := strings.ReplaceAll(strings.ReplaceAll(response.Email, "\r", ""), "\n", "")
@@ -479,6 +443,25 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 			return
 		}
 		defer tx.Rollback()
+		username, err := sq.FetchOneContext(r.Context(), tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM users WHERE reset_token_hash = {resetTokenHash}",
+			Values: []any{
+				sq.BytesParam("resetTokenHash", resetTokenHash),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("username")
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				response.Status = ErrInvalidToken
+				writeResponse(w, r, response)
+				return
+			}
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
 		_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
 			Dialect: nbrew.Dialect,
 			Format: "DELETE FROM authentication WHERE EXISTS (" +
@@ -518,6 +501,11 @@ func (nbrew *Notebrew) resetpassword(w http.ResponseWriter, r *http.Request, ip
 			internalServerError(w, r, err)
 			return
 		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:     username,
+			IsAccount: true,
+			Action:    "resetpassword",
+		})
 		response.Status = ResetPasswordSuccess
 		writeResponse(w, r, response)
 	default:
@@ -0,0 +1,631 @@
+package nb7
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// revisionsDir is where prior revisions of a site's files are kept. The
+// revisions of a file are stored in revisionsDir/<filePath>/<revisionID>
+// alongside a revisionsDir/<filePath>/<revisionID>.json file describing each
+// revision. Since they live inside the site folder they count towards the
+// site's storage usage.
+const revisionsDir = "system/revisions"
+
+// Revision describes a prior revision of a file.
+type Revision struct {
+	RevisionID string    `json:"revisionID"`
+	SavedAt    time.Time `json:"savedAt"` // when the revision was replaced
+	SavedBy    string    `json:"savedBy,omitempty"`
+	Size       int64     `json:"size"`
+}
+
+// DiffLine is a line in a line diff. Op is one of '=', '-' or '+'.
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+func (nbrew *Notebrew) maxRevisions() int {
+	if nbrew.MaxRevisions != 0 {
+		return nbrew.MaxRevisions
+	}
+	if maxRevisions := nbrew.Config().Revisions.MaxRevisions; maxRevisions != 0 {
+		return maxRevisions
+	}
+	return 50
+}
+
+// hasRevisions reports whether revisions are kept for filePath. Only notes,
+// posts, pages and theme files have revisions.
+func hasRevisions(filePath string) bool {
+	segments := strings.Split(filePath, "/")
+	switch segments[0] {
+	case "notes", "pages", "posts":
+		return len(segments) > 1
+	case "output":
+		return len(segments) > 2 && segments[1] == "themes"
+	}
+	return false
+}
+
+func (nbrew *Notebrew) revisions(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Request struct {
+		Path       string `json:"path,omitempty"`
+		RevisionID string `json:"revisionID,omitempty"`
+	}
+	type Response struct {
+		Status     Error              `json:"status"`
+		Errors     map[string][]Error `json:"errors,omitempty"`
+		SitePrefix string             `json:"sitePrefix,omitempty"`
+		Path       string             `json:"path,omitempty"`
+		Revisions  []Revision         `json:"revisions"`
+		From       string             `json:"from,omitempty"`
+		To         string             `json:"to,omitempty"`
+		Diff       []DiffLine         `json:"diff,omitempty"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"join":             path.Join,
+				"fileSizeToString": fileSizeToString,
+				"stylesCSS":        func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":       func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase":      func() bool { return nbrew.DB != nil },
+				"referer":          func() string { return r.Referer() },
+				"username":         func() string { return username },
+				"safeHTML":         func(s string) template.HTML { return template.HTML(s) },
+				"canRestore":       func() bool { return canWriteTo(r, sitePrefix, response.Path) },
+			}
+			tmpl, err := template.New("revisions.html").Funcs(funcMap).ParseFS(rootFS, "embed/revisions.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status == "" {
+			response.Status = Success
+		}
+		query := r.URL.Query()
+		response.SitePrefix = sitePrefix
+		response.Path = path.Clean(strings.Trim(query.Get("path"), "/"))
+		response.From = query.Get("from")
+		response.To = query.Get("to")
+		if !hasRevisions(response.Path) {
+			notFound(w, r)
+			return
+		}
+		response.Revisions, err = nbrew.getRevisions(sitePrefix, response.Path)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if response.Revisions == nil {
+			response.Revisions = []Revision{}
+		}
+		if response.From == "" && response.To == "" {
+			writeResponse(w, r, response)
+			return
+		}
+		// An empty revision ID refers to the current contents of the file.
+		var contents [2]string
+		for i, revisionID := range []string{response.From, response.To} {
+			name := path.Join(sitePrefix, response.Path)
+			if revisionID != "" {
+				if !isValidRevisionID(revisionID) {
+					response.Status = ErrRevisionNotFound
+					writeResponse(w, r, response)
+					return
+				}
+				name = path.Join(sitePrefix, revisionsDir, response.Path, revisionID)
+			}
+			b, err := fs.ReadFile(nbrew.FS, name)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					if revisionID == "" {
+						continue
+					}
+					response.Status = ErrRevisionNotFound
+					writeResponse(w, r, response)
+					return
+				}
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contents[i] = string(b)
+		}
+		response.Diff = diffLines(contents[0], contents[1])
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"status": response.Status,
+				"errors": response.Errors,
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if response.Status.Success() {
+				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, response.Path), http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "revisions")+"/?path="+url.QueryEscape(response.Path), http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.Path = r.Form.Get("path")
+			request.RevisionID = r.Form.Get("revisionID")
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		response := Response{
+			SitePrefix: sitePrefix,
+			Path:       path.Clean(strings.Trim(request.Path, "/")),
+			Revisions:  []Revision{},
+			Errors:     make(map[string][]Error),
+		}
+		if !hasRevisions(response.Path) {
+			notFound(w, r)
+			return
+		}
+		if !canWriteTo(r, sitePrefix, response.Path) {
+			notAuthorized(w, r)
+			return
+		}
+		if !isValidRevisionID(request.RevisionID) {
+			response.Status = ErrRevisionNotFound
+			writeResponse(w, r, response)
+			return
+		}
+		content, err := fs.ReadFile(nbrew.FS, path.Join(sitePrefix, revisionsDir, response.Path, request.RevisionID))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				response.Status = ErrRevisionNotFound
+				writeResponse(w, r, response)
+				return
+			}
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+
+		if nbrew.DB != nil {
+			result, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM site WHERE site_name = {siteName}",
+				Values: []any{
+					sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+				},
+			}, func(row *sq.Row) (result struct {
+				StorageLimit sql.NullInt64
+				StorageUsed  int64
+			}) {
+				result.StorageLimit = row.NullInt64("storage_limit")
+				result.StorageUsed = row.Int64("storage_used")
+				return result
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			// The current contents are kept as a revision, so restoring
+			// takes up as much space as the restored contents.
+			if result.StorageLimit.Valid && result.StorageUsed+int64(len(content)) > result.StorageLimit.Int64 {
+				response.Status = ErrStorageLimitExceeded
+				writeResponse(w, r, response)
+				return
+			}
+			logger := getLogger(r.Context())
+			defer func() {
+				storageUsed, err := getFileSize(nbrew.FS, sitePrefix)
+				if err != nil {
+					logger.Error(err.Error())
+					return
+				}
+				_, err = sq.Exec(nbrew.DB, sq.CustomQuery{
+					Dialect: nbrew.Dialect,
+					Format:  "UPDATE site SET storage_used = {storageUsed} WHERE site_name = {siteName}",
+					Values: []any{
+						sq.Int64Param("storageUsed", storageUsed),
+						sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+					},
+				})
+				if err != nil {
+					logger.Error(err.Error())
+					return
+				}
+			}()
+		}
+
+		var before *AuditSnapshot
+		if nbrew.DB != nil {
+			before = NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, response.Path))
+		}
+		// Keep the current contents as a revision so that restoring can be
+		// undone as well.
+		err = nbrew.saveRevision(sitePrefix, response.Path, username, string(content))
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = MkdirAll(nbrew.FS, path.Dir(path.Join(sitePrefix, response.Path)), 0755)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, response.Path), 0644)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		_, err = readerFrom.ReadFrom(strings.NewReader(string(content)))
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if nbrew.DB != nil {
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   "restorerevision",
+				FilePath: response.Path,
+				Target:   request.RevisionID,
+				Before:   before,
+				After:    NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, response.Path)),
+			})
+		}
+
+		head, _, _ := strings.Cut(response.Path, "/")
+		if head == "posts" || head == "pages" || head == "output" {
+			err = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(3 * time.Minute))
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			err = nbrew.RegenerateSite(r.Context(), sitePrefix)
+			if err != nil {
+				var templateError TemplateError
+				if errors.As(err, &templateError) {
+					response.Errors["content"] = templateError.Errors()
+					response.Status = ErrFileGenerationFailed
+					writeResponse(w, r, response)
+					return
+				}
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		response.Status = RestoreRevisionSuccess
+		writeResponse(w, r, response)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+func isValidRevisionID(revisionID string) bool {
+	if len(revisionID) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(revisionID)
+	return err == nil
+}
+
+// saveRevision keeps the current contents of filePath as a revision before
+// it is overwritten with newContent, then prunes the oldest revisions beyond
+// the cap. Nothing is saved if the file does not exist yet, if its contents
+// are unchanged or if revisions are disabled.
+func (nbrew *Notebrew) saveRevision(sitePrefix, filePath, username, newContent string) error {
+	if !hasRevisions(filePath) || nbrew.maxRevisions() < 0 {
+		return nil
+	}
+	content, err := fs.ReadFile(nbrew.FS, path.Join(sitePrefix, filePath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if string(content) == newContent {
+		return nil
+	}
+	id := NewID()
+	revision := Revision{
+		RevisionID: hex.EncodeToString(id[:]),
+		SavedAt:    time.Now().UTC(),
+		SavedBy:    username,
+		Size:       int64(len(content)),
+	}
+	dir := path.Join(sitePrefix, revisionsDir, filePath)
+	err = MkdirAll(nbrew.FS, dir, 0755)
+	if err != nil {
+		return err
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(dir, revision.RevisionID), 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(strings.NewReader(string(content)))
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&revision)
+	if err != nil {
+		return err
+	}
+	readerFrom, err = nbrew.FS.OpenReaderFrom(path.Join(dir, revision.RevisionID+".json"), 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(strings.NewReader(string(b)))
+	if err != nil {
+		return err
+	}
+	revisions, err := nbrew.getRevisions(sitePrefix, filePath)
+	if err != nil {
+		return err
+	}
+	for i := nbrew.maxRevisions(); i < len(revisions); i++ {
+		err = nbrew.FS.Remove(path.Join(dir, revisions[i].RevisionID))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = nbrew.FS.Remove(path.Join(dir, revisions[i].RevisionID+".json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRevisions returns the revisions of filePath, most recent first.
+func (nbrew *Notebrew) getRevisions(sitePrefix, filePath string) ([]Revision, error) {
+	dir := path.Join(sitePrefix, revisionsDir, filePath)
+	dirEntries, err := nbrew.FS.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var revisions []Revision
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || path.Ext(name) != ".json" || !isValidRevisionID(strings.TrimSuffix(name, ".json")) {
+			continue
+		}
+		b, err := fs.ReadFile(nbrew.FS, path.Join(dir, name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		var revision Revision
+		err = json.Unmarshal(b, &revision)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path.Join(dir, name), err)
+		}
+		revision.RevisionID = strings.TrimSuffix(name, ".json")
+		revisions = append(revisions, revision)
+	}
+	slices.SortFunc(revisions, func(a, b Revision) int {
+		if c := b.SavedAt.Compare(a.SavedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.RevisionID, a.RevisionID)
+	})
+	return revisions, nil
+}
+
+// diffLines returns a line diff that turns a into b, using the linear
+// space variant of Myers' diff algorithm: rather than keeping every step of
+// the search in order to walk it back, it looks for the middle of the edit
+// path from both ends at once and diffs either side of it recursively.
+func diffLines(a, b string) []DiffLine {
+	splitLines := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	}
+	return appendDiff(nil, splitLines(a), splitLines(b))
+}
+
+func appendDiff(diff []DiffLine, x, y []string) []DiffLine {
+	// Lines in common at the start and end are not part of the edit path.
+	var prefix, suffix int
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+	for _, line := range x[:prefix] {
+		diff = append(diff, DiffLine{Op: "=", Text: line})
+	}
+	common := x[len(x)-suffix:]
+	x, y = x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+	if len(x) == 0 || len(y) == 0 {
+		for _, line := range x {
+			diff = append(diff, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range y {
+			diff = append(diff, DiffLine{Op: "+", Text: line})
+		}
+	} else if i, j, ok := middleSnake(x, y); ok {
+		diff = appendDiff(diff, x[:i], y[:j])
+		diff = appendDiff(diff, x[i:], y[j:])
+	} else {
+		for _, line := range x {
+			diff = append(diff, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range y {
+			diff = append(diff, DiffLine{Op: "+", Text: line})
+		}
+	}
+	for _, line := range common {
+		diff = append(diff, DiffLine{Op: "=", Text: line})
+	}
+	return diff
+}
+
+// middleSnake searches for the shortest edit path from x to y forwards from
+// the start and backwards from the end until the two searches meet, and
+// returns the point at which they do. x and y must be non-empty and must not
+// share a first or last line. If the searches never meet, x and y have
+// nothing in common and ok is false.
+func middleSnake(x, y []string) (i, j int, ok bool) {
+	n, m := len(x), len(y)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// forward[offset+k] is the furthest i reached on diagonal k = i-j from
+	// the start, and backward[offset+k] the furthest reached from the end.
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for k := range forward {
+		forward[k], backward[k] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// When delta is odd the searches can only meet on a forward step, and
+	// when it is even only on a backward step.
+	odd := delta%2 != 0
+	// Diagonals that run off the edge of the grid are not searched again.
+	var forwardStart, forwardEnd, backwardStart, backwardEnd int
+	for d := 0; d < maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			var fi int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				fi = forward[offset+k+1]
+			} else {
+				fi = forward[offset+k-1] + 1
+			}
+			fj := fi - k
+			for fi < n && fj < m && x[fi] == y[fj] {
+				fi++
+				fj++
+			}
+			forward[offset+k] = fi
+			if fi > n {
+				forwardEnd += 2
+			} else if fj > m {
+				forwardStart += 2
+			} else if odd {
+				bk := offset + delta - k
+				if bk >= 0 && bk < len(backward) && backward[bk] != -1 && fi >= n-backward[bk] {
+					return fi, fj, true
+				}
+			}
+		}
+		for k := -d + backwardStart; k <= d-backwardEnd; k += 2 {
+			var bi int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				bi = backward[offset+k+1]
+			} else {
+				bi = backward[offset+k-1] + 1
+			}
+			bj := bi - k
+			for bi < n && bj < m && x[n-1-bi] == y[m-1-bj] {
+				bi++
+				bj++
+			}
+			backward[offset+k] = bi
+			if bi > n {
+				backwardEnd += 2
+			} else if bj > m {
+				backwardStart += 2
+			} else if !odd {
+				fk := offset + delta - k
+				if fk >= 0 && fk < len(forward) && forward[fk] != -1 && forward[fk] >= n-bi {
+					fi := forward[fk]
+					return fi, fi - (fk - offset), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,263 @@
+package nb7
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_admin_revisions(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "knuth", "knuth@email.com", "password123")
+			authenticationToken := generateAuthenticationToken(t, nbrew, "knuth")
+			for _, dir := range []string{"@knuth", "@knuth/notes"} {
+				err := nbrew.FS.Mkdir(dir, 0755)
+				if err != nil && !errors.Is(err, fs.ErrExist) {
+					return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+				}
+			}
+			readerFrom, err := nbrew.FS.OpenReaderFrom("@knuth/notes/tex.md", 0644)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			_, err = readerFrom.ReadFrom(strings.NewReader("first\nsecond\n"))
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			for _, content := range []string{"first\nsecond\nthird\n", "first\nthird\n"} {
+				var body bytes.Buffer
+				multipartWriter := multipart.NewWriter(&body)
+				fileInfo, err := fs.Stat(nbrew.FS, "@knuth/notes/tex.md")
+				if err != nil {
+					return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+				}
+				multipartWriter.WriteField("content", content)
+				multipartWriter.WriteField("modTime", fileInfo.ModTime().Format(time.RFC3339Nano))
+				multipartWriter.Close()
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("POST", "/admin/@knuth/notes/tex.md", &body)
+				r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+				r.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+				r.Header.Set("Accept", "application/json")
+				nbrew.admin(w, r.WithContext(ctx), "")
+				if ctx.Err() != nil {
+					return nil
+				}
+				if w.Code != http.StatusOK {
+					return fmt.Errorf("[%s] %s save: got status %d: %s", nbrew.Dialect, testutil.Callers(), w.Code, w.Body.String())
+				}
+			}
+
+			type Response struct {
+				Status    Error      `json:"status"`
+				Revisions []Revision `json:"revisions"`
+				Diff      []DiffLine `json:"diff"`
+			}
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/admin/@knuth/revisions/?path=notes/tex.md", nil)
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			var response Response
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if len(response.Revisions) != 2 {
+				return fmt.Errorf("[%s] %s got %d revisions, want 2", nbrew.Dialect, testutil.Callers(), len(response.Revisions))
+			}
+			oldest := response.Revisions[1]
+			if oldest.SavedBy != "knuth" || oldest.Size != int64(len("first\nsecond\n")) {
+				return fmt.Errorf("[%s] %s unexpected revision %+v", nbrew.Dialect, testutil.Callers(), oldest)
+			}
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("GET", "/admin/@knuth/revisions/?path=notes/tex.md&from="+oldest.RevisionID, nil)
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			response = Response{}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			wantDiff := []DiffLine{{Op: "=", Text: "first"}, {Op: "-", Text: "second"}, {Op: "+", Text: "third"}}
+			if len(response.Diff) != len(wantDiff) {
+				return fmt.Errorf("[%s] %s got diff %+v, want %+v", nbrew.Dialect, testutil.Callers(), response.Diff, wantDiff)
+			}
+			for i := range wantDiff {
+				if response.Diff[i] != wantDiff[i] {
+					return fmt.Errorf("[%s] %s got diff %+v, want %+v", nbrew.Dialect, testutil.Callers(), response.Diff, wantDiff)
+				}
+			}
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("POST", "/admin/@knuth/revisions/", strings.NewReader(`{"path":"notes/tex.md","revisionID":"`+oldest.RevisionID+`"}`))
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			response = Response{}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if response.Status != RestoreRevisionSuccess {
+				return fmt.Errorf("[%s] %s restore: got status %q", nbrew.Dialect, testutil.Callers(), response.Status)
+			}
+			b, err := fs.ReadFile(nbrew.FS, "@knuth/notes/tex.md")
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if string(b) != "first\nsecond\n" {
+				return fmt.Errorf("[%s] %s restored file has contents %q", nbrew.Dialect, testutil.Callers(), string(b))
+			}
+			revisions, err := nbrew.getRevisions("@knuth", "notes/tex.md")
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if len(revisions) != 3 {
+				return fmt.Errorf("[%s] %s got %d revisions after restoring, want 3", nbrew.Dialect, testutil.Callers(), len(revisions))
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_diffLines(t *testing.T) {
+	// check verifies that diff turns a into b and makes no more changes than
+	// the length of the longest common subsequence allows.
+	check := func(t *testing.T, a, b []string, diff []DiffLine) {
+		var gotA, gotB []string
+		var changes int
+		for _, line := range diff {
+			switch line.Op {
+			case "=":
+				gotA = append(gotA, line.Text)
+				gotB = append(gotB, line.Text)
+			case "-":
+				gotA = append(gotA, line.Text)
+				changes++
+			case "+":
+				gotB = append(gotB, line.Text)
+				changes++
+			}
+		}
+		if strings.Join(gotA, "\n") != strings.Join(a, "\n") || strings.Join(gotB, "\n") != strings.Join(b, "\n") {
+			t.Fatalf("%s: diff %+v does not turn %q into %q", testutil.Callers(), diff, a, b)
+		}
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		if want := len(a) + len(b) - 2*lcs[0][0]; changes != want {
+			t.Errorf("%s: %q to %q: got %d changes, want %d", testutil.Callers(), a, b, changes, want)
+		}
+	}
+	t.Run("small", func(t *testing.T) {
+		t.Parallel()
+		// Every pair of up to 5 lines drawn from 3 distinct lines.
+		var inputs [][]string
+		var generate func(lines []string)
+		generate = func(lines []string) {
+			inputs = append(inputs, lines)
+			if len(lines) == 5 {
+				return
+			}
+			for _, line := range []string{"a", "b", "c"} {
+				generate(append(lines[:len(lines):len(lines)], line))
+			}
+		}
+		generate(nil)
+		for _, a := range inputs {
+			for _, b := range inputs {
+				diff := diffLines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+				check(t, a, b, diff)
+			}
+		}
+	})
+	t.Run("large and completely different", func(t *testing.T) {
+		t.Parallel()
+		a := make([]string, 5000)
+		b := make([]string, 5000)
+		for i := range a {
+			a[i] = fmt.Sprintf("a%d", i)
+			b[i] = fmt.Sprintf("b%d", i)
+		}
+		diff := diffLines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+		if len(diff) != len(a)+len(b) {
+			t.Fatalf("%s: got %d lines, want %d", testutil.Callers(), len(diff), len(a)+len(b))
+		}
+		for i, line := range diff {
+			if line.Op == "=" {
+				t.Fatalf("%s: line %d: got %+v, want no lines in common", testutil.Callers(), i, line)
+			}
+		}
+	})
+	t.Run("large with changes", func(t *testing.T) {
+		t.Parallel()
+		a := make([]string, 2000)
+		for i := range a {
+			a[i] = fmt.Sprintf("line %d", i%50)
+		}
+		b := slices.Clone(a)
+		for i := 0; i < len(b); i += 7 {
+			b[i] = fmt.Sprintf("changed %d", i)
+		}
+		b = append(b[:300], b[900:]...)
+		check(t, a[:200], b[:200], diffLines(strings.Join(a[:200], "\n"), strings.Join(b[:200], "\n")))
+		diff := diffLines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+		var gotB []string
+		for _, line := range diff {
+			if line.Op != "-" {
+				gotB = append(gotB, line.Text)
+			}
+		}
+		if !slices.Equal(gotB, b) {
+			t.Errorf("%s: diff does not turn a into b", testutil.Callers())
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package nb7
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Roles a user can have on a site, stored in site_user.role. Rows without a
+// role predate roles and are treated as owners.
+const (
+	// RoleOwner can do everything, including deleting the site.
+	RoleOwner = "owner"
+	// RoleEditor can edit everything in the site but cannot delete it.
+	RoleEditor = "editor"
+	// RoleAuthor can create and edit notes and posts, but not pages or
+	// themes.
+	RoleAuthor = "author"
+	// RoleViewer has read-only access to the site.
+	RoleViewer = "viewer"
+)
+
+// IsValidRole reports whether role is one of the site roles.
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleOwner, RoleEditor, RoleAuthor, RoleViewer:
+		return true
+	}
+	return false
+}
+
+// roleCanWrite reports whether the role may write to filePath inside a site.
+func roleCanWrite(role, filePath string) bool {
+	switch role {
+	case RoleOwner, RoleEditor:
+		return true
+	case RoleAuthor:
+		head, _, _ := strings.Cut(filePath, "/")
+		return head == "notes" || head == "posts"
+	default:
+		return false
+	}
+}
+
+// accountRoutes are the admin routes that act on the user's own account
+// rather than on a site, which every user may use whatever their role.
+var accountRoutes = map[string]bool{
+	"createsite": true,
+	"deletesite": true,
+	"sessions":   true,
+	"twofactor":  true,
+	"tokens":     true,
+	"invite":     true,
+}
+
+// roleAllows reports whether the role allows a request to the site-scoped
+// admin route identified by head and urlPath.
+func roleAllows(role, method, head, urlPath string) bool {
+	if !IsValidRole(role) {
+		return false
+	}
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+	switch head {
+	case "", "notes", "pages", "posts", "output":
+		return roleCanWrite(role, urlPath)
+	case "createnote":
+		return roleCanWrite(role, "notes")
+	case "createpost", "createcategory":
+		return roleCanWrite(role, "posts")
+	case "createpage":
+		return roleCanWrite(role, "pages")
+	case "createfile", "createfolder", "delete", "trash", "revisions":
+		// The folder being written to is only known once the request body
+		// has been parsed, so the handler checks it with canWriteTo.
+		return role != RoleViewer
+	case "collaborators":
+		return role == RoleOwner
+	default:
+		return role == RoleOwner || role == RoleEditor
+	}
+}
+
+var roleKey = &contextKey{}
+
+// canWriteTo reports whether the request may write to filePath inside the
+// site, taking into account both the user's role and the scopes of the API
+// token used (if any).
+func canWriteTo(r *http.Request, sitePrefix, filePath string) bool {
+	if role, ok := r.Context().Value(roleKey).(string); ok && !roleCanWrite(role, filePath) {
+		return false
+	}
+	if scopes, ok := r.Context().Value(apiTokenScopesKey).([]apiTokenScope); ok && !canWrite(scopes, sitePrefix, filePath) {
+		return false
+	}
+	return true
+}
+
+func withRole(r *http.Request, role string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), roleKey, role))
+}
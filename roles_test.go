@@ -0,0 +1,153 @@
+package nb7
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"github.com/bokwoon95/sq"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_admin_roles(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "lovelace", "lovelace@email.com", "password123")
+			authenticationToken := generateAuthenticationToken(t, nbrew, "lovelace")
+			tests := []struct {
+				role   string
+				method string
+				url    string
+				denied bool
+			}{
+				{"author", "POST", "/admin/@lovelace/createpost/", false},
+				{"author", "POST", "/admin/@lovelace/createpage/", true},
+				{"author", "POST", "/admin/@lovelace/output/themes/post.html", true},
+				{"author", "GET", "/admin/@lovelace/output/themes/", false},
+				{"viewer", "GET", "/admin/@lovelace/notes/", false},
+				{"viewer", "POST", "/admin/@lovelace/createnote/", true},
+				{"editor", "POST", "/admin/@lovelace/output/themes/post.html", false},
+			}
+			for _, tt := range tests {
+				_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+					Dialect: nbrew.Dialect,
+					Format:  "UPDATE site_user SET role = {role} WHERE user_id = (SELECT user_id FROM users WHERE username = 'lovelace')",
+					Values: []any{
+						sq.StringParam("role", tt.role),
+					},
+				})
+				if err != nil {
+					return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+				}
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest(tt.method, tt.url, strings.NewReader("{}"))
+				r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Accept", "application/json")
+				nbrew.admin(w, r.WithContext(ctx), "")
+				if ctx.Err() != nil {
+					return nil
+				}
+				if denied := w.Code == http.StatusForbidden; denied != tt.denied {
+					return fmt.Errorf("[%s] %s %s %s %s: got status %d, want denied=%v", nbrew.Dialect, testutil.Callers(), tt.role, tt.method, tt.url, w.Code, tt.denied)
+				}
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_admin_accountRoutes(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			// A viewer of the main site can still manage their own account.
+			createUser(t, nbrew, "wirth", "wirth@email.com", "password123")
+			addSiteUser(t, nbrew, "", "wirth", RoleViewer)
+			authenticationToken := generateAuthenticationToken(t, nbrew, "wirth")
+			// A second session for the user to revoke.
+			generateAuthenticationToken(t, nbrew, "wirth")
+			do := func(method, url string, body any, v any) error {
+				b, err := json.Marshal(body)
+				if err != nil {
+					return err
+				}
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest(method, url, bytes.NewReader(b))
+				r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Accept", "application/json")
+				nbrew.admin(w, r.WithContext(ctx), "")
+				if w.Code != http.StatusOK {
+					return fmt.Errorf("%s %s: got status %d: %s", method, url, w.Code, w.Body.String())
+				}
+				return json.Unmarshal(w.Body.Bytes(), v)
+			}
+			var response struct {
+				Status   Error `json:"status"`
+				Sessions []struct {
+					SessionID string `json:"sessionID"`
+					IsCurrent bool   `json:"isCurrent"`
+				} `json:"sessions"`
+			}
+			err := do("GET", "/admin/sessions/", nil, &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			var sessionID string
+			for _, session := range response.Sessions {
+				if !session.IsCurrent {
+					sessionID = session.SessionID
+				}
+			}
+			if sessionID == "" {
+				return fmt.Errorf("[%s] %s: got sessions %+v, want another session", nbrew.Dialect, testutil.Callers(), response.Sessions)
+			}
+			err = do("POST", "/admin/sessions/", map[string]any{"sessionID": sessionID}, &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if !response.Status.Equal(RevokeSessionSuccess) {
+				return fmt.Errorf("[%s] %s: got status %q, want %q", nbrew.Dialect, testutil.Callers(), response.Status, RevokeSessionSuccess)
+			}
+			var tokenResponse struct {
+				Status Error `json:"status"`
+			}
+			err = do("POST", "/admin/tokens/", map[string]any{"action": "create", "name": "ci", "scopes": []string{"read"}}, &tokenResponse)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if !tokenResponse.Status.Equal(CreateAPITokenSuccess) {
+				return fmt.Errorf("[%s] %s: got status %q, want %q", nbrew.Dialect, testutil.Callers(), tokenResponse.Status, CreateAPITokenSuccess)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/bokwoon95/sq"
 	"github.com/bokwoon95/sqddl/ddl"
@@ -14,10 +15,33 @@ import (
 //go:embed schema.go
 var schemaFS embed.FS
 
-func automigrate(dialect string, db *sql.DB) error {
+// automigrate brings the database in line with the tables in this file.
+// Unless confirmDestructive is true, it refuses to drop tables, columns or
+// constraints or to make changes that may lose data, returning a
+// *DestructiveMigrationError instead.
+func automigrate(dialect string, db *sql.DB, confirmDestructive bool) error {
 	if db == nil {
 		return nil
 	}
+	if !confirmDestructive {
+		statements, warnings, err := automigrateDryRun(dialect, db, false)
+		if err != nil {
+			return err
+		}
+		allStatements, _, err := automigrateDryRun(dialect, db, true)
+		if err != nil {
+			return err
+		}
+		if len(warnings) > 0 || allStatements != statements {
+			return &DestructiveMigrationError{
+				SQL:      allStatements,
+				Warnings: warnings,
+			}
+		}
+		if statements == "" {
+			return nil
+		}
+	}
 	automigrateCmd := &ddl.AutomigrateCmd{
 		DB:             db,
 		Dialect:        dialect,
@@ -40,6 +64,62 @@ func automigrate(dialect string, db *sql.DB) error {
 	return nil
 }
 
+// automigrateDryRun returns the SQL that automigrate would run and the
+// warnings about it. If dropObjects is false, statements that drop tables,
+// columns and constraints are left out.
+func automigrateDryRun(dialect string, db *sql.DB, dropObjects bool) (statements string, warnings []string, err error) {
+	var stdout, stderr strings.Builder
+	automigrateCmd := &ddl.AutomigrateCmd{
+		DB:          db,
+		Dialect:     dialect,
+		DirFS:       schemaFS,
+		Filenames:   []string{"schema.go"},
+		DropObjects: dropObjects,
+		DryRun:      true,
+		Stdout:      &stdout,
+		Stderr:      &stderr,
+	}
+	err = automigrateCmd.Run()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			warnings = append(warnings, line)
+		}
+	}
+	return strings.TrimSpace(stdout.String()), warnings, nil
+}
+
+// DestructiveMigrationError is returned when automigrate would drop tables,
+// columns or constraints or make changes that may lose data.
+type DestructiveMigrationError struct {
+	// SQL is the full automigration, including the destructive statements.
+	SQL string
+
+	Warnings []string
+}
+
+func (e *DestructiveMigrationError) Error() string {
+	var b strings.Builder
+	b.WriteString("automigrate refused to make destructive changes to the database." +
+		" Review them with \"notebrew migrate dry-run\" and apply them with \"notebrew migrate up -confirm\"")
+	for _, warning := range e.Warnings {
+		b.WriteString("\n" + warning)
+	}
+	b.WriteString("\n" + e.SQL)
+	return b.String()
+}
+
+// SCHEMA_MIGRATIONS records the versioned migrations (see migrate.go) that
+// have been applied to the database.
+type SCHEMA_MIGRATIONS struct {
+	sq.TableStruct
+	VERSION    sq.NumberField `ddl:"type=BIGINT primarykey"`
+	NAME       sq.StringField `ddl:"notnull len=500"`
+	APPLIED_AT sq.NumberField `ddl:"type=BIGINT notnull"` // unix timestamp
+}
+
 type SITE struct {
 	sq.TableStruct
 	SITE_ID       sq.UUIDField   `ddl:"primarykey"`
@@ -48,14 +128,19 @@ type SITE struct {
 	STORAGE_USED  sq.NumberField
 }
 
+// USERS are the user accounts. RESET_TOKEN_HASH, like every token hash in
+// the schema, is BINARY on MySQL and SQL Server because neither can index
+// variable-length blobs.
 type USERS struct {
 	sq.TableStruct
 	USER_ID          sq.UUIDField   `ddl:"primarykey"`
-	USERNAME         sq.StringField `ddl:"notnull len=500 unique references={site.site_name onupdate=cascade}"`
+	USERNAME         sq.StringField `ddl:"notnull len=500 unique references={site.site_name sqlite,postgres,mysql:onupdate=cascade}"`
 	EMAIL            sq.StringField `ddl:"notnull len=500 unique"`
 	PASSWORD_HASH    sq.StringField `ddl:"len=500"`
-	RESET_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) unique"`
+	RESET_TOKEN_HASH sq.BinaryField `ddl:"mysql,sqlserver:type=BINARY(40) sqlite,postgres,mysql:unique sqlserver:index"` // SQL Server unique constraints allow only one NULL, migration 0003 makes the index unique where not NULL
 	FAILED_LOGINS    sq.NumberField
+	TOTP_SECRET      sq.StringField `ddl:"len=500"`
+	TOTP_LAST_USED   sq.NumberField `ddl:"type=BIGINT"` // last accepted TOTP time step, to prevent replays
 }
 
 type IP_LOGIN struct {
@@ -64,25 +149,85 @@ type IP_LOGIN struct {
 	FAILED_LOGINS sq.NumberField
 }
 
+// SITE_USER records which users belong to which sites. Its foreign keys
+// (like every other foreign key in the schema) do not cascade updates on SQL
+// Server, which rejects the multiple cascade paths from site to site_user
+// (directly and through users); nothing updates the keys they reference
+// anyway.
 type SITE_USER struct {
 	sq.TableStruct `ddl:"primarykey=site_id,user_id"`
-	SITE_ID        sq.UUIDField `ddl:"references={site onupdate=cascade}"`
-	USER_ID        sq.UUIDField `ddl:"references={users onupdate=cascade index}"`
+	SITE_ID        sq.UUIDField   `ddl:"references={site sqlite,postgres,mysql:onupdate=cascade}"`
+	USER_ID        sq.UUIDField   `ddl:"references={users sqlite,postgres,mysql:onupdate=cascade index}"`
+	ROLE           sq.StringField `ddl:"len=500"` // owner | editor | author | viewer, NULL means owner
 }
 
 type SESSION struct {
 	sq.TableStruct
-	SESSION_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) primarykey"`
+	SESSION_TOKEN_HASH sq.BinaryField `ddl:"mysql,sqlserver:type=BINARY(40) primarykey"`
 	DATA               sq.JSONField
 }
 
 type SIGNUP struct {
 	sq.TableStruct
-	SIGNUP_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) primarykey"`
+	SIGNUP_TOKEN_HASH sq.BinaryField `ddl:"mysql,sqlserver:type=BINARY(40) primarykey"`
+}
+
+type SITE_INVITE struct {
+	sq.TableStruct
+	SITE_INVITE_TOKEN_HASH sq.BinaryField `ddl:"mysql,sqlserver:type=BINARY(40) primarykey"`
+	SITE_ID                sq.UUIDField   `ddl:"notnull references={site sqlite,postgres,mysql:onupdate=cascade index}"`
+	USER_ID                sq.UUIDField   `ddl:"notnull references={users sqlite,postgres,mysql:onupdate=cascade index}"`
+	ROLE                   sq.StringField `ddl:"len=500"`
 }
 
 type AUTHENTICATION struct {
 	sq.TableStruct
-	AUTHENTICATION_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) primarykey"`
-	USER_ID                   sq.UUIDField   `ddl:"notnull references={users onupdate=cascade index}"`
+	AUTHENTICATION_TOKEN_HASH sq.BinaryField `ddl:"mysql,sqlserver:type=BINARY(40) primarykey"`
+	USER_ID                   sq.UUIDField   `ddl:"notnull references={users sqlite,postgres,mysql:onupdate=cascade index}"`
+	CREATED_AT                sq.NumberField `ddl:"type=BIGINT"` // unix timestamp
+	LAST_SEEN_AT              sq.NumberField `ddl:"type=BIGINT"` // unix timestamp
+	USER_AGENT                sq.StringField `ddl:"len=500"`
+	IP                        sq.StringField `ddl:"len=500"`
+}
+
+type RECOVERY_CODE struct {
+	sq.TableStruct
+	RECOVERY_CODE_HASH sq.BinaryField `ddl:"mysql,sqlserver:type=BINARY(32) primarykey"`
+	USER_ID            sq.UUIDField   `ddl:"notnull references={users sqlite,postgres,mysql:onupdate=cascade index}"`
+}
+
+type API_TOKEN struct {
+	sq.TableStruct `ddl:"unique=user_id,token_name"`
+	API_TOKEN_HASH sq.BinaryField `ddl:"mysql,sqlserver:type=BINARY(40) primarykey"`
+	USER_ID        sq.UUIDField   `ddl:"notnull references={users sqlite,postgres,mysql:onupdate=cascade}"`
+	TOKEN_NAME     sq.StringField `ddl:"notnull len=500"`
+	SCOPES         sq.JSONField
+	CREATED_AT     sq.NumberField `ddl:"type=BIGINT"` // unix timestamp
+	EXPIRES_AT     sq.NumberField `ddl:"type=BIGINT"` // unix timestamp, NULL means never
+	LAST_USED_AT   sq.NumberField `ddl:"type=BIGINT"` // unix timestamp
+}
+
+type AUDIT_LOG struct {
+	sq.TableStruct
+	AUDIT_LOG_ID sq.UUIDField   `ddl:"primarykey"`
+	LOGGED_AT    sq.NumberField `ddl:"type=BIGINT notnull index"` // unix timestamp
+	ACTOR        sq.StringField `ddl:"len=500"`                   // username, empty for CLI commands
+	SOURCE       sq.StringField `ddl:"len=500"`                   // admin | api | cli
+	SITE_NAME    sq.StringField `ddl:"len=500 index"`             // NULL for actions on the actor's account
+	ACTION       sq.StringField `ddl:"notnull len=500"`
+	FILE_PATH    sq.StringField `ddl:"len=500"`
+	TARGET       sq.StringField `ddl:"len=500"` // user or API token acted on
+	IP           sq.StringField `ddl:"len=500"`
+	BEFORE_SIZE  sq.NumberField `ddl:"type=BIGINT"`
+	BEFORE_HASH  sq.StringField `ddl:"len=500"` // hex-encoded SHA-256
+	AFTER_SIZE   sq.NumberField `ddl:"type=BIGINT"`
+	AFTER_HASH   sq.StringField `ddl:"len=500"` // hex-encoded SHA-256
+}
+
+// RATE_LIMIT holds the token buckets of the database rate limit store (see
+// ratelimit.go).
+type RATE_LIMIT struct {
+	sq.TableStruct
+	RATE_LIMIT_KEY sq.StringField `ddl:"primarykey len=500"`
+	FULL_AT        sq.NumberField `ddl:"type=BIGINT notnull"` // unix milliseconds at which the bucket is full again
 }
@@ -0,0 +1,152 @@
+package nb7
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/net/html"
+)
+
+// SearchIndexEntry is a single entry in a site's output/search-index.json.
+// The search index lets a generated site offer client-side search to its
+// readers without exposing the admin full text search.
+type SearchIndexEntry struct {
+	URL     string   `json:"url"`
+	Title   string   `json:"title"`
+	Summary string   `json:"summary,omitempty"`
+	Tokens  []string `json:"tokens"`
+}
+
+// searchIndexEnabled reports whether the site has opted into emitting a
+// search index, which is done by putting "true" inside the site's
+// system/search.txt.
+func searchIndexEnabled(fsys FS, sitePrefix string) (bool, error) {
+	b, err := fs.ReadFile(fsys, path.Join(sitePrefix, "system/search.txt"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	ok, _ := strconv.ParseBool(string(bytes.TrimSpace(b)))
+	return ok, nil
+}
+
+// markdownText returns the plain text of a markdown document, with each text
+// node separated by a space.
+func markdownText(src []byte) string {
+	var b strings.Builder
+	var node ast.Node
+	nodes := []ast.Node{goldmarkMarkdown.Parser().Parse(text.NewReader(src))}
+	for len(nodes) > 0 {
+		node, nodes = nodes[len(nodes)-1], nodes[:len(nodes)-1]
+		if node == nil {
+			continue
+		}
+		switch node := node.(type) {
+		case *ast.Text:
+			b.Write(node.Text(src))
+			if node.SoftLineBreak() || node.HardLineBreak() || node.NextSibling() == nil {
+				b.WriteByte(' ')
+			}
+		case *ast.CodeBlock, *ast.FencedCodeBlock:
+			lines := node.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				segment := lines.At(i)
+				b.Write(segment.Value(src))
+			}
+			b.WriteByte(' ')
+		}
+		nodes = append(nodes, node.NextSibling(), node.FirstChild())
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// htmlText returns the contents of the <title> element and the visible text
+// of an HTML document.
+func htmlText(r io.Reader) (title, content string) {
+	var b strings.Builder
+	var inTitle bool
+	skipDepth := 0
+	tokenizer := html.NewTokenizer(r)
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(title), " "), strings.Join(strings.Fields(b.String()), " ")
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "script", "style", "noscript", "template":
+				skipDepth++
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "script", "style", "noscript", "template":
+				if skipDepth > 0 {
+					skipDepth--
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			b.Write(tokenizer.Text())
+			b.WriteByte(' ')
+		}
+	}
+}
+
+// searchSummary truncates text to at most 160 bytes, cutting at a word
+// boundary where possible.
+func searchSummary(text string) string {
+	const maxLen = 160
+	if len(text) <= maxLen {
+		return text
+	}
+	i := maxLen
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	if j := strings.LastIndexByte(text[:i], ' '); j > 0 {
+		i = j
+	}
+	return strings.TrimSpace(text[:i]) + "…"
+}
+
+// searchTokens returns the sorted, deduplicated lowercase words found in texts.
+// Words that are only one character long are dropped.
+func searchTokens(texts ...string) []string {
+	var tokens []string
+	for _, text := range texts {
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(char rune) bool {
+			return !unicode.IsLetter(char) && !unicode.IsNumber(char)
+		}) {
+			if utf8.RuneCountInString(word) < 2 {
+				continue
+			}
+			tokens = append(tokens, word)
+		}
+	}
+	slices.Sort(tokens)
+	return slices.Compact(tokens)
+}
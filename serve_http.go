@@ -1,11 +1,11 @@
 package nb7
 
 import (
-	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -14,9 +14,9 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 
@@ -31,7 +31,9 @@ func (nbrew *Notebrew) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Clean the path and redirect if necessary.
 	if r.Method == "GET" {
 		cleanedPath := path.Clean(r.URL.Path)
-		if cleanedPath != "/" && path.Ext(cleanedPath) == "" {
+		// /admin/health is polled by load balancers and uptime monitors, which
+		// may not follow redirects.
+		if cleanedPath != "/" && path.Ext(cleanedPath) == "" && cleanedPath != "/admin/health" {
 			cleanedPath += "/"
 		}
 		if cleanedPath != r.URL.Path {
@@ -51,7 +53,7 @@ func (nbrew *Notebrew) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.TLS == nil {
 		scheme = "http://"
 	}
-	ip := getIP(r)
+	ip := nbrew.getIP(r)
 	logger = logger.With(
 		slog.String("method", r.Method),
 		slog.String("url", scheme+r.Host+r.URL.RequestURI()),
@@ -84,23 +86,12 @@ func (nbrew *Notebrew) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(segments) < 2 || segments[0] != "admin" || segments[1] != "static" {
-		file, err := nbrew.FS.Open("config/show-latency.txt")
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			logger.Error(err.Error())
-		} else {
-			defer file.Close()
-			reader := bufio.NewReader(file)
-			b, _ := reader.Peek(6)
-			if len(b) > 0 {
-				ok, _ := strconv.ParseBool(string(bytes.TrimSpace(b)))
-				if ok {
-					startedAt := time.Now()
-					defer func() {
-						timeTaken := time.Since(startedAt)
-						fmt.Printf("%s %s %s\n", r.Method, r.URL.RequestURI(), timeTaken.String())
-					}()
-				}
-			}
+		if nbrew.Config().ShowLatency {
+			startedAt := time.Now()
+			defer func() {
+				timeTaken := time.Since(startedAt)
+				fmt.Printf("%s %s %s\n", r.Method, r.URL.RequestURI(), timeTaken.String())
+			}()
 		}
 	}
 
@@ -137,7 +128,7 @@ func (nbrew *Notebrew) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "404 Not Found", http.StatusNotFound)
 			return
 		}
-		if siteName == "www" || nbrew.MultisiteMode == "subdomain" {
+		if siteName == "www" || nbrew.multisiteMode() == "subdomain" {
 			http.Redirect(w, r, nbrew.Scheme+siteName+"."+nbrew.ContentDomain+"/"+urlPath, http.StatusFound)
 			return
 		}
@@ -152,7 +143,7 @@ func (nbrew *Notebrew) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		if subdomainPrefix == "www" {
 			sitePrefix = ""
-		} else if nbrew.MultisiteMode == "subdirectory" {
+		} else if nbrew.multisiteMode() == "subdirectory" {
 			http.Redirect(w, r, nbrew.Scheme+nbrew.ContentDomain+"/"+path.Join(sitePrefix, urlPath), http.StatusFound)
 			return
 		}
@@ -173,7 +164,7 @@ func (nbrew *Notebrew) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	if nbrew.MultisiteMode == "" && sitePrefix != "" {
+	if nbrew.multisiteMode() == "" && sitePrefix != "" {
 		http.Error(w, "404 Not Found", http.StatusNotFound)
 		return
 	}
@@ -274,6 +265,15 @@ func (nbrew *Notebrew) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ext == ".html" {
+		enabled, err := webmentionEnabled(nbrew.FS, sitePrefix)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		} else if enabled {
+			w.Header().Set("Link", "<"+nbrew.webmentionEndpoint(sitePrefix)+`>; rel="webmention"`)
+		}
+	}
+
 	if !extInfo.isGzippable {
 		fileSeeker, ok := file.(io.ReadSeeker)
 		if ok {
@@ -386,11 +386,22 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request, ip string)
 		serveFile(w, r, rootFS, urlPath, true)
 		return
 	}
+	if head == "health" {
+		if tail != "" {
+			notFound(w, r)
+			return
+		}
+		nbrew.health(w, r)
+		return
+	}
 	if head == "signup" || head == "login" || head == "logout" || head == "resetpassword" {
 		if tail != "" {
 			notFound(w, r)
 			return
 		}
+		if r.Method == "POST" && head != "logout" && !nbrew.rateLimit(w, r, head, "ip:"+ip) {
+			return
+		}
 		switch head {
 		case "signup":
 			nbrew.signup(w, r, ip)
@@ -415,14 +426,36 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request, ip string)
 		return
 	}
 
+	if head == "webmention" {
+		if tail != "" {
+			notFound(w, r)
+			return
+		}
+		if r.Method == "POST" && !nbrew.rateLimit(w, r, "write", "ip:"+ip) {
+			return
+		}
+		nbrew.webmention(w, r, sitePrefix)
+		return
+	}
+
 	var username string
-	if nbrew.DB != nil {
+	if nbrew.DB != nil && strings.HasPrefix(r.Header.Get("Authorization"), "Notebrew "+APITokenPrefix) {
+		var ok bool
+		username, r, ok = nbrew.authenticateAPIToken(w, r, ip, sitePrefix, head, urlPath)
+		if !ok {
+			return
+		}
+	} else if nbrew.DB != nil {
 		authenticationTokenHash := getAuthenticationTokenHash(r)
 		if authenticationTokenHash == nil {
 			if head == "" {
 				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/login/?401", http.StatusFound)
 				return
 			}
+			if head == "invite" && r.Method == "GET" {
+				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/login/?401&redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
 			notAuthenticated(w, r)
 			return
 		}
@@ -432,13 +465,12 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request, ip string)
 				" FROM authentication" +
 				" JOIN users ON users.user_id = authentication.user_id" +
 				" LEFT JOIN (" +
-				"SELECT site_user.user_id" +
+				"SELECT site_user.user_id, site_user.role" +
 				" FROM site_user" +
 				" JOIN site ON site.site_id = site_user.site_id" +
 				" WHERE site.site_name = {siteName}" +
 				") AS authorized_users ON authorized_users.user_id = users.user_id" +
-				" WHERE authentication.authentication_token_hash = {authenticationTokenHash}" +
-				" LIMIT 1",
+				" WHERE authentication.authentication_token_hash = {authenticationTokenHash}",
 			Values: []any{
 				sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
 				sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
@@ -446,9 +478,15 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request, ip string)
 		}, func(row *sq.Row) (result struct {
 			Username     string
 			IsAuthorized bool
+			Role         string
+			CreatedAt    sql.NullInt64
+			LastSeenAt   sql.NullInt64
 		}) {
 			result.Username = row.String("users.username")
-			result.IsAuthorized = row.Bool("authorized_users.user_id IS NOT NULL")
+			result.IsAuthorized = row.Bool("CASE WHEN authorized_users.user_id IS NOT NULL THEN 1 ELSE 0 END")
+			result.Role = row.String("COALESCE(authorized_users.role, 'owner')")
+			result.CreatedAt = row.NullInt64("authentication.created_at")
+			result.LastSeenAt = row.NullInt64("authentication.last_seen_at")
 			return result
 		})
 		if err != nil {
@@ -470,14 +508,87 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request, ip string)
 			internalServerError(w, r, err)
 			return
 		}
+		// Sessions created before created_at and last_seen_at were tracked
+		// fall back to the timestamp embedded in the token and the current
+		// time respectively.
+		now := time.Now()
+		createdAt := time.Unix(int64(binary.BigEndian.Uint64(authenticationTokenHash[:8])), 0)
+		if result.CreatedAt.Valid {
+			createdAt = time.Unix(result.CreatedAt.Int64, 0)
+		}
+		lastSeenAt := now
+		if result.LastSeenAt.Valid {
+			lastSeenAt = time.Unix(result.LastSeenAt.Int64, 0)
+		}
+		if now.Sub(createdAt) > nbrew.sessionMaxAge() || now.Sub(lastSeenAt) > nbrew.sessionIdleTimeout() {
+			_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM authentication WHERE authentication_token_hash = {authenticationTokenHash}",
+				Values: []any{
+					sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+			}
+			http.SetCookie(w, &http.Cookie{
+				Path:   "/",
+				Name:   "authentication",
+				Value:  "0",
+				MaxAge: -1,
+			})
+			if head == "" {
+				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/login/?401", http.StatusFound)
+				return
+			}
+			notAuthenticated(w, r)
+			return
+		}
+		// Only bump last_seen_at once a minute so that we don't write to the
+		// database on every request.
+		if !result.CreatedAt.Valid || !result.LastSeenAt.Valid || now.Sub(lastSeenAt) > time.Minute {
+			_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "UPDATE authentication" +
+					" SET created_at = {createdAt}, last_seen_at = {lastSeenAt}, ip = {ip}" +
+					" WHERE authentication_token_hash = {authenticationTokenHash}",
+				Values: []any{
+					sq.Int64Param("createdAt", createdAt.Unix()),
+					sq.Int64Param("lastSeenAt", now.Unix()),
+					sq.StringParam("ip", ip),
+					sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+			}
+		}
 		username = result.Username
 		logger := getLogger(r.Context()).With(slog.String("username", username))
 		r = r.WithContext(context.WithValue(r.Context(), loggerKey, logger))
 		if !result.IsAuthorized {
-			if (sitePrefix != "" || head != "") && head != "createsite" && head != "deletesite" {
+			// The main site's trash is where deleted sites go, which their
+			// owners may restore (see canAccessTrashItem).
+			if (sitePrefix != "" || head != "") && !accountRoutes[head] && (sitePrefix != "" || head != "trash") {
 				notAuthorized(w, r)
 				return
 			}
+		} else {
+			if !accountRoutes[head] && !roleAllows(result.Role, r.Method, head, urlPath) {
+				notAuthorized(w, r)
+				return
+			}
+			r = withRole(r, result.Role)
+		}
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		key := "user:" + username
+		if username == "" {
+			key = "ip:" + ip
+		}
+		if !nbrew.rateLimit(w, r, "write", key) {
+			return
 		}
 	}
 
@@ -511,6 +622,12 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request, ip string)
 		nbrew.deletesite(w, r, username)
 	case "delete":
 		nbrew.delet(w, r, username, sitePrefix)
+	case "trash":
+		nbrew.trash(w, r, username, sitePrefix)
+	case "revisions":
+		nbrew.revisions(w, r, username, sitePrefix)
+	case "webmentions":
+		nbrew.webmentions(w, r, username, sitePrefix)
 	case "createnote":
 		nbrew.createnote(w, r, username, sitePrefix)
 	case "createpost":
@@ -523,6 +640,18 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request, ip string)
 		nbrew.createpage(w, r, username, sitePrefix)
 	case "createfile":
 		nbrew.createfile(w, r, username, sitePrefix)
+	case "sessions":
+		nbrew.sessions(w, r, username)
+	case "twofactor":
+		nbrew.twofactor(w, r, username)
+	case "tokens":
+		nbrew.tokens(w, r, username)
+	case "collaborators":
+		nbrew.collaborators(w, r, username, sitePrefix)
+	case "auditlog":
+		nbrew.auditlog(w, r, username, sitePrefix)
+	case "invite":
+		nbrew.invite(w, r, username)
 	case "cut":
 	case "copy":
 	case "paste":
@@ -0,0 +1,88 @@
+package nb7
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_ServeHTTP_nilDatabase(t *testing.T) {
+	nbrew := &Notebrew{
+		FS:            testutil.NewFS(nil),
+		Scheme:        "http://",
+		AdminDomain:   "localhost:6444",
+		ContentDomain: "localhost:6444",
+	}
+	for _, urlPath := range []string{
+		"/admin/signup/",
+		"/admin/login/",
+		"/admin/logout/",
+		"/admin/resetpassword/",
+	} {
+		for _, accept := range []string{"text/html", "application/json"} {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "http://localhost:6444"+urlPath, nil)
+			r.Header.Set("Accept", accept)
+			nbrew.ServeHTTP(w, r)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s %s (%s): got status %d, want %d", testutil.Callers(), urlPath, accept, w.Code, http.StatusNotFound)
+			}
+		}
+	}
+}
+
+// Test_ServeHTTP_jsonContentType checks that every admin page responds with
+// a JSON Content-Type when JSON is requested, including error responses.
+func Test_ServeHTTP_jsonContentType(t *testing.T) {
+	for _, testDB := range testDatabases {
+		t.Run(testDB.Name, func(t *testing.T) {
+			nbrew := &Notebrew{
+				Dialect:       testDB.Dialect,
+				DB:            testDB.DB,
+				FS:            testutil.NewFS(nil),
+				ErrorCode:     testDB.ErrorCode,
+				Scheme:        "http://",
+				AdminDomain:   "localhost:6444",
+				ContentDomain: "localhost:6444",
+			}
+			createUser(t, nbrew, "hoare", "hoare@email.com", "password123")
+			authenticationToken := generateAuthenticationToken(t, nbrew, "hoare")
+			for _, tt := range []struct {
+				urlPath       string
+				authenticated bool
+			}{
+				{"/admin/login/", false},
+				{"/admin/signup/", false},
+				{"/admin/resetpassword/", false},
+				{"/admin/health", false},
+				{"/admin/@hoare/notes/", false}, // not authenticated
+				{"/admin/@hoare/", true},
+				{"/admin/@hoare/notes/", true},
+				{"/admin/@hoare/notes/missing.md", true}, // not found
+				{"/admin/@hoare/trash/", true},
+				{"/admin/@hoare/collaborators/", true},
+				{"/admin/@hoare/auditlog/", true},
+				{"/admin/@hoare/createnote/", true},
+				{"/admin/@nobody/notes/", true}, // not authorized
+				{"/admin/sessions/", true},
+				{"/admin/tokens/", true},
+				{"/admin/twofactor/", true},
+				{"/admin/createsite/", true},
+				{"/admin/nonexistent/", true},
+			} {
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("GET", "http://localhost:6444"+tt.urlPath, nil)
+				r.Header.Set("Accept", "application/json")
+				if tt.authenticated {
+					r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+				}
+				nbrew.ServeHTTP(w, r)
+				if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+					t.Errorf("%s %s: got status %d with Content-Type %q, want application/json", testutil.Callers(), tt.urlPath, w.Code, contentType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package nb7
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+func (nbrew *Notebrew) sessions(w http.ResponseWriter, r *http.Request, username string) {
+	type Session struct {
+		SessionID  string    `json:"sessionID"`
+		IsCurrent  bool      `json:"isCurrent,omitempty"`
+		CreatedAt  time.Time `json:"createdAt"`
+		LastSeenAt time.Time `json:"lastSeenAt"`
+		UserAgent  string    `json:"userAgent,omitempty"`
+		IP         string    `json:"ip,omitempty"`
+	}
+	type Request struct {
+		SessionID string `json:"sessionID,omitempty"`
+		RevokeAll bool   `json:"revokeAll,omitempty"`
+	}
+	type Response struct {
+		Status   Error     `json:"status"`
+		Sessions []Session `json:"sessions,omitempty"`
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+	currentTokenHash := getAuthenticationTokenHash(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"stylesCSS":   func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":  func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase": func() bool { return nbrew.DB != nil },
+				"referer":     func() string { return r.Referer() },
+				"username":    func() string { return username },
+				"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+			}
+			tmpl, err := template.New("sessions.html").Funcs(funcMap).ParseFS(rootFS, "embed/sessions.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status == "" {
+			response.Status = Success
+		}
+		response.Sessions, err = sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM authentication" +
+				" JOIN users ON users.user_id = authentication.user_id" +
+				" WHERE users.username = {username}" +
+				" ORDER BY authentication.last_seen_at DESC",
+			Values: []any{
+				sq.StringParam("username", username),
+			},
+		}, func(row *sq.Row) Session {
+			authenticationTokenHash := row.Bytes("authentication.authentication_token_hash")
+			createdAt := row.NullInt64("authentication.created_at")
+			lastSeenAt := row.NullInt64("authentication.last_seen_at")
+			session := Session{
+				SessionID: hex.EncodeToString(authenticationTokenHash),
+				IsCurrent: bytes.Equal(authenticationTokenHash, currentTokenHash),
+				UserAgent: row.String("COALESCE(authentication.user_agent, '')"),
+				IP:        row.String("COALESCE(authentication.ip, '')"),
+			}
+			if createdAt.Valid {
+				session.CreatedAt = time.Unix(createdAt.Int64, 0).UTC()
+			}
+			if lastSeenAt.Valid {
+				session.LastSeenAt = time.Unix(lastSeenAt.Int64, 0).UTC()
+			}
+			return session
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			if response.Status.Equal(RevokeSessionSuccess) && len(response.Sessions) > 0 && response.Sessions[0].IsCurrent {
+				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/login/", http.StatusFound)
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", &response)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/sessions/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.SessionID = r.Form.Get("sessionID")
+			request.RevokeAll = r.Form.Get("revokeAll") == "true"
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		var response Response
+		if request.RevokeAll {
+			_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "DELETE FROM authentication" +
+					" WHERE user_id = (SELECT user_id FROM users WHERE username = {username})" +
+					" AND authentication_token_hash <> {currentTokenHash}",
+				Values: []any{
+					sq.StringParam("username", username),
+					sq.BytesParam("currentTokenHash", currentTokenHash),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			nbrew.auditLog(r, AuditEntry{
+				Actor:     username,
+				IsAccount: true,
+				Action:    "revokeallsessions",
+			})
+			response.Status = RevokeAllSessionsSuccess
+			writeResponse(w, r, response)
+			return
+		}
+
+		authenticationTokenHash, err := hex.DecodeString(request.SessionID)
+		if err != nil || len(authenticationTokenHash) == 0 {
+			response.Status = ErrSessionNotFound
+			writeResponse(w, r, response)
+			return
+		}
+		result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "DELETE FROM authentication" +
+				" WHERE user_id = (SELECT user_id FROM users WHERE username = {username})" +
+				" AND authentication_token_hash = {authenticationTokenHash}",
+			Values: []any{
+				sq.StringParam("username", username),
+				sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
+			},
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if result.RowsAffected == 0 {
+			response.Status = ErrSessionNotFound
+			writeResponse(w, r, response)
+			return
+		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:     username,
+			IsAccount: true,
+			Action:    "revokesession",
+		})
+		response.Status = RevokeSessionSuccess
+		response.Sessions = []Session{{
+			SessionID: request.SessionID,
+			IsCurrent: bytes.Equal(authenticationTokenHash, currentTokenHash),
+		}}
+		if response.Sessions[0].IsCurrent {
+			http.SetCookie(w, &http.Cookie{
+				Path:   "/",
+				Name:   "authentication",
+				Value:  "0",
+				MaxAge: -1,
+			})
+		}
+		writeResponse(w, r, response)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
@@ -1,7 +1,7 @@
 package nb7
 
 import (
-	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -14,7 +14,6 @@ import (
 	"net/url"
 	"path"
 	"strconv"
-	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -23,6 +22,9 @@ import (
 	"golang.org/x/crypto/blake2b"
 )
 
+// signupTokenMaxAge is how long a signup invite link stays valid.
+const signupTokenMaxAge = 7 * 24 * time.Hour
+
 func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string) {
 	type Request struct {
 		SignupToken     string `json:"signupToken,omitempty"`
@@ -34,13 +36,15 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 		DryRun          bool   `json:"dryRun,omitempty"`
 	}
 	type Response struct {
-		Status         Error              `json:"status"`
-		SignupToken    string             `json:"signupToken,omitempty"`
-		Username       string             `json:"username,omitempty"`
-		Email          string             `json:"email,omitempty"`
-		RequireCaptcha bool               `json:"requireCaptcha,omitempty"`
-		CaptchaSiteKey string             `json:"captchaSiteKey,omitempty"`
-		Errors         map[string][]Error `json:"errors,omitempty"`
+		Status           Error              `json:"status"`
+		SignupToken      string             `json:"signupToken,omitempty"`
+		Username         string             `json:"username,omitempty"`
+		Email            string             `json:"email,omitempty"`
+		RequireCaptcha   bool               `json:"requireCaptcha,omitempty"`
+		CaptchaProvider  string             `json:"captchaProvider,omitempty"`
+		CaptchaSiteKey   string             `json:"captchaSiteKey,omitempty"`
+		CaptchaChallenge string             `json:"captchaChallenge,omitempty"`
+		Errors           map[string][]Error `json:"errors,omitempty"`
 	}
 
 	if nbrew.DB == nil {
@@ -66,30 +70,8 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 		return exists
 	}
 
-	type CaptchaCredentials struct {
-		SecretKey string `json:"secretKey,omitempty"`
-		SiteKey   string `json:"siteKey,omitempty"`
-	}
-	getCaptchaCredentials := func() (CaptchaCredentials, error) {
-		var captchaCredentials CaptchaCredentials
-		b, err := fs.ReadFile(nbrew.FS, "config/captcha.json")
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return captchaCredentials, err
-		}
-		err = json.Unmarshal(b, &captchaCredentials)
-		return captchaCredentials, err
-	}
-
 	signupsAreOpen := func() bool {
-		b, err := fs.ReadFile(nbrew.FS, "config/signups.txt")
-		if err != nil {
-			if !errors.Is(err, fs.ErrNotExist) {
-				getLogger(r.Context()).Error(err.Error())
-			}
-			return false
-		}
-		isOpen, _ := strconv.ParseBool(string(bytes.TrimSpace(b)))
-		return isOpen
+		return nbrew.Config().Signups
 	}
 
 	hashAndValidateSignupToken := func(signupToken string) (signupTokenHash []byte, err error) {
@@ -100,6 +82,10 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 		if err != nil {
 			return nil, nil
 		}
+		issuedAt := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+		if time.Since(issuedAt) > signupTokenMaxAge {
+			return nil, nil
+		}
 		checksum := blake2b.Sum256(b[8:])
 		signupTokenHash = make([]byte, 8+blake2b.Size256)
 		copy(signupTokenHash[:8], b[:8])
@@ -124,14 +110,21 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 	switch r.Method {
 	case "GET":
 		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
-			captchaCredentials, err := getCaptchaCredentials()
-			if err != nil {
-				getLogger(r.Context()).Error(err.Error())
-				internalServerError(w, r, err)
-				return
+			captcha := nbrew.captchaProvider()
+			if captcha != nil {
+				response.CaptchaProvider = captcha.Name()
+				response.CaptchaSiteKey = captcha.SiteKey()
+			}
+			response.RequireCaptcha = captcha != nil && response.SignupToken == ""
+			if response.RequireCaptcha {
+				var err error
+				response.CaptchaChallenge, err = captcha.Challenge()
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
 			}
-			response.CaptchaSiteKey = captchaCredentials.SiteKey
-			response.RequireCaptcha = captchaCredentials.SecretKey != "" && captchaCredentials.SiteKey != "" && response.SignupToken == ""
 			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
 			if accept == "application/json" {
 				w.Header().Set("Content-Type", "application/json")
@@ -154,7 +147,7 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 				internalServerError(w, r, err)
 				return
 			}
-			contentSecurityPolicy(w, "", true)
+			contentSecurityPolicy(w, "", captcha)
 			executeTemplate(w, r, time.Time{}, tmpl, &response)
 		}
 
@@ -242,6 +235,7 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/login/", http.StatusFound)
 		}
 
+		captcha := nbrew.captchaProvider()
 		var request Request
 		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
 		switch contentType {
@@ -270,7 +264,9 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 			request.Email = r.Form.Get("email")
 			request.Password = r.Form.Get("password")
 			request.ConfirmPassword = r.Form.Get("confirmPassword")
-			request.CaptchaResponse = r.Form.Get("h-captcha-response")
+			if captcha != nil {
+				request.CaptchaResponse = r.Form.Get(captcha.ResponseField())
+			}
 			request.DryRun, _ = strconv.ParseBool(r.Form.Get("dryRun"))
 		default:
 			unsupportedContentType(w, r)
@@ -288,15 +284,11 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 			writeResponse(w, r, response)
 			return
 		}
-		captchaCredentials, err := getCaptchaCredentials()
-		if err != nil {
-			getLogger(r.Context()).Error(err.Error())
-			internalServerError(w, r, err)
-			return
-		}
-		response.CaptchaSiteKey = captchaCredentials.SiteKey
+		var err error
 		var signupTokenHash []byte
-		if captchaCredentials.SecretKey != "" && captchaCredentials.SiteKey != "" {
+		if captcha != nil {
+			response.CaptchaProvider = captcha.Name()
+			response.CaptchaSiteKey = captcha.SiteKey()
 			signupTokenHash, err = hashAndValidateSignupToken(request.SignupToken)
 			if err != nil {
 				getLogger(r.Context()).Error(err.Error())
@@ -317,8 +309,16 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 			}
 		}
 
-		response.RequireCaptcha = captchaCredentials.SecretKey != "" && captchaCredentials.SiteKey != "" && signupTokenHash == nil && !request.DryRun
+		response.RequireCaptcha = captcha != nil && signupTokenHash == nil && !request.DryRun
 		if response.RequireCaptcha {
+			// Every attempt needs a new challenge, whether or not this one
+			// succeeds.
+			response.CaptchaChallenge, err = captcha.Challenge()
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
 			if request.CaptchaResponse == "" {
 				response.Status = ErrRetryWithCaptcha
 				writeResponse(w, r, response)
@@ -332,42 +332,13 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 					return
 				}
 			}
-			client := &http.Client{
-				Timeout: 60 * time.Second,
-			}
-			values := url.Values{
-				"secret":   []string{captchaCredentials.SecretKey},
-				"response": []string{request.CaptchaResponse},
-				"remoteip": []string{getIP(r)},
-				"sitekey":  []string{captchaCredentials.SiteKey},
-			}
-			resp, err := client.Post("https://api.hcaptcha.com/siteverify", "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
-			if err != nil {
-				getLogger(r.Context()).Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			defer resp.Body.Close()
-			result := make(map[string]any)
-			err = json.NewDecoder(resp.Body).Decode(&result)
+			ok, err := captcha.Verify(r.Context(), request.CaptchaResponse, ip)
 			if err != nil {
 				getLogger(r.Context()).Error(err.Error())
 				internalServerError(w, r, err)
 				return
 			}
-			success, _ := result["success"].(bool)
-			if !success {
-				buf := bufPool.Get().(*bytes.Buffer)
-				buf.Reset()
-				defer bufPool.Put(buf)
-				encoder := json.NewEncoder(buf)
-				encoder.SetEscapeHTML(false)
-				err := encoder.Encode(result)
-				if err != nil {
-					getLogger(r.Context()).Warn(err.Error())
-				} else {
-					getLogger(r.Context()).Warn(strings.TrimSpace(buf.String()))
-				}
+			if !ok {
 				response.Status = ErrCaptchaChallengeFailed
 				writeResponse(w, r, response)
 				return
@@ -549,7 +520,7 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 		}
 		_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
 			Dialect: nbrew.Dialect,
-			Format:  "INSERT INTO site_user (site_id, user_id) VALUES ({siteID}, {userID})",
+			Format:  "INSERT INTO site_user (site_id, user_id, role) VALUES ({siteID}, {userID}, 'owner')",
 			Values: []any{
 				sq.UUIDParam("siteID", siteID),
 				sq.UUIDParam("userID", userID),
@@ -589,6 +560,11 @@ func (nbrew *Notebrew) signup(w http.ResponseWriter, r *http.Request, ip string)
 			internalServerError(w, r, err)
 			return
 		}
+		nbrew.auditLog(r, AuditEntry{
+			Actor:    request.Username,
+			SiteName: request.Username,
+			Action:   "signup",
+		})
 		response.Status = SignupSuccess
 		writeResponse(w, r, response)
 	default:
@@ -3,8 +3,8 @@ if (form) {
     form.addEventListener("submit", function(event) {
         event.preventDefault();
         const formData = new FormData(form);
-        if (formData.has("h-captcha-response")) {
-            if (formData.get("h-captcha-response") == "") {
+        for (const name of ["h-captcha-response", "cf-turnstile-response", "captcha-response"]) {
+            if (formData.has(name) && formData.get(name) == "") {
                 const insertionNode = document.querySelector("[data-validation-status]");
                 if (insertionNode) {
                     insertionNode.innerHTML = "NOTE: Solve the captcha";
@@ -32,8 +32,8 @@ if (form) {
             && result.status.charAt(8) == " "
             && result.status.charAt(3) == "0"
             && result.status.charAt(4) == "0") {
-            if (formData.has("h-captcha-response")) {
-                if (formData.get("h-captcha-response") == "") {
+            for (const name of ["h-captcha-response", "cf-turnstile-response", "captcha-response"]) {
+                if (formData.has(name) && formData.get(name) == "") {
                     const insertionNode = document.querySelector("[data-validation-status]");
                     if (insertionNode) {
                         insertionNode.innerHTML = "NOTE: Solve the captcha";
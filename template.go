@@ -3,7 +3,9 @@ package nb7
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -47,7 +49,7 @@ func NewTemplateParser(ctx context.Context, nbrew *Notebrew, sitePrefix string)
 	if strings.Contains(siteName, ".") {
 		siteURL = "https://" + siteName
 	} else if siteName != "" {
-		switch nbrew.MultisiteMode {
+		switch nbrew.multisiteMode() {
 		case "subdomain":
 			siteURL = nbrew.Scheme + siteName + "." + nbrew.ContentDomain
 		case "subdirectory":
@@ -315,12 +317,39 @@ func (templateErrors TemplateError) Errors() []Error {
 }
 
 func (nbrew *Notebrew) RegenerateSite(ctx context.Context, sitePrefix string) error {
+	parentCtx := ctx
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(runtime.NumCPU())
 	templateParser, err := NewTemplateParser(ctx, nbrew, sitePrefix)
 	if err != nil {
 		return err
 	}
+	searchEnabled, err := searchIndexEnabled(nbrew.FS, sitePrefix)
+	if err != nil {
+		return err
+	}
+	webmentionsEnabled, err := webmentionEnabled(nbrew.FS, sitePrefix)
+	if err != nil {
+		return err
+	}
+	var webmentionMu sync.Mutex
+	webmentionPosts := make(map[string]webmentionPost)
+	var searchMu sync.Mutex
+	var searchIndex []SearchIndexEntry
+	addToSearchIndex := func(url, title, content string) {
+		if !searchEnabled {
+			return
+		}
+		entry := SearchIndexEntry{
+			URL:     url,
+			Title:   title,
+			Summary: searchSummary(strings.TrimSpace(strings.TrimPrefix(content, title))),
+			Tokens:  searchTokens(title, content),
+		}
+		searchMu.Lock()
+		searchIndex = append(searchIndex, entry)
+		searchMu.Unlock()
+	}
 
 	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "output"))
 	if err != nil {
@@ -438,7 +467,12 @@ func (nbrew *Notebrew) RegenerateSite(ctx context.Context, sitePrefix string) er
 		ch <- err
 	}()
 	defer pipeReader.Close()
-	err = indexTmpl.Execute(&ctxWriter{ctx: ctx, dest: pipeWriter}, nil)
+	var indexBuf bytes.Buffer
+	var indexDest io.Writer = pipeWriter
+	if searchEnabled {
+		indexDest = io.MultiWriter(pipeWriter, &indexBuf)
+	}
+	err = indexTmpl.Execute(&ctxWriter{ctx: ctx, dest: indexDest}, nil)
 	pipeWriter.CloseWithError(err)
 	if err != nil {
 		return err
@@ -447,6 +481,10 @@ func (nbrew *Notebrew) RegenerateSite(ctx context.Context, sitePrefix string) er
 	if err != nil {
 		return err
 	}
+	if searchEnabled {
+		title, content := htmlText(&indexBuf)
+		addToSearchIndex(templateParser.siteURL+"/", title, content)
+	}
 
 	// Render posts.
 	err = fs.WalkDir(nbrew.FS, path.Join(sitePrefix, "posts"), func(filePath string, dirEntry fs.DirEntry, err error) error {
@@ -567,8 +605,23 @@ func (nbrew *Notebrew) RegenerateSite(ctx context.Context, sitePrefix string) er
 				ch <- err
 			}()
 			defer pipeReader.Close()
+			postURL := templateParser.siteURL + "/" + path.Join("posts", category, strings.TrimSuffix(name, path.Ext(name))) + "/"
+			if searchEnabled {
+				addToSearchIndex(postURL, title, markdownText(buf.Bytes()))
+			}
+			if webmentionsEnabled {
+				sum := sha256.Sum256(buf.Bytes())
+				post := webmentionPost{
+					Source: postURL,
+					Hash:   hex.EncodeToString(sum[:]),
+					Links:  markdownLinks(buf.Bytes()),
+				}
+				webmentionMu.Lock()
+				webmentionPosts[path.Join("posts", category, name)] = post
+				webmentionMu.Unlock()
+			}
 			err = postTmpl.Execute(&ctxWriter{ctx: ctx, dest: pipeWriter}, Post{
-				URL:       templateParser.siteURL + "/" + path.Join("posts", category, strings.TrimSuffix(name, path.Ext(name))) + "/",
+				URL:       postURL,
 				Category:  category,
 				Name:      name,
 				Title:     title,
@@ -635,12 +688,25 @@ func (nbrew *Notebrew) RegenerateSite(ctx context.Context, sitePrefix string) er
 				ch <- err
 			}()
 			defer pipeReader.Close()
-			err = tmpl.Execute(&ctxWriter{ctx: ctx, dest: pipeWriter}, nil)
+			var pageBuf bytes.Buffer
+			var dest io.Writer = pipeWriter
+			if searchEnabled {
+				dest = io.MultiWriter(pipeWriter, &pageBuf)
+			}
+			err = tmpl.Execute(&ctxWriter{ctx: ctx, dest: dest}, nil)
 			pipeWriter.CloseWithError(err)
 			if err != nil {
 				return err
 			}
-			return <-ch
+			err = <-ch
+			if err != nil {
+				return err
+			}
+			if searchEnabled {
+				title, content := htmlText(&pageBuf)
+				addToSearchIndex(templateParser.siteURL+"/"+strings.TrimSuffix(relativePath, ext)+"/", title, content)
+			}
+			return nil
 		})
 		return nil
 	})
@@ -651,7 +717,103 @@ func (nbrew *Notebrew) RegenerateSite(ctx context.Context, sitePrefix string) er
 	if err != nil {
 		return err
 	}
-	return nil
+	if webmentionsEnabled {
+		err = nbrew.queueWebmentions(sitePrefix, templateParser.siteURL, webmentionPosts)
+		if err != nil {
+			return err
+		}
+	}
+	if !searchEnabled {
+		return nil
+	}
+
+	// The errgroup context is canceled once g.Wait() returns, so switch back
+	// to the parent context for the remaining work.
+	ctx = parentCtx
+
+	// Render search-index.json.
+	slices.SortFunc(searchIndex, func(a, b SearchIndexEntry) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+	if searchIndex == nil {
+		searchIndex = []SearchIndexEntry{}
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(searchIndex)
+	if err != nil {
+		return err
+	}
+	readerFrom, err = nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, "output/search-index.json"), 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+
+	// Render search/index.html, unless the user has their own search page.
+	_, err = fs.Stat(nbrew.FS, path.Join(sitePrefix, "pages/search.html"))
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	file, err = nbrew.FS.Open(path.Join(sitePrefix, "output/themes/search.html"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		file, err = rootFS.Open("static/search.html")
+		if err != nil {
+			return err
+		}
+	}
+	fileInfo, err = file.Stat()
+	if err != nil {
+		return err
+	}
+	b.Reset()
+	b.Grow(int(fileInfo.Size()))
+	_, err = io.Copy(&b, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	templateParser, err = NewTemplateParser(ctx, nbrew, sitePrefix)
+	if err != nil {
+		return err
+	}
+	searchTmpl, err := templateParser.Parse(b.String())
+	if err != nil {
+		return err
+	}
+	err = MkdirAll(nbrew.FS, path.Join(sitePrefix, "output/search"), 0755)
+	if err != nil {
+		return err
+	}
+	readerFrom, err = nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, "output/search/index.html"), 0644)
+	if err != nil {
+		return err
+	}
+	pipeReader, pipeWriter = io.Pipe()
+	ch = make(chan error, 1)
+	go func() {
+		_, err := readerFrom.ReadFrom(pipeReader)
+		ch <- err
+	}()
+	defer pipeReader.Close()
+	err = searchTmpl.Execute(&ctxWriter{ctx: ctx, dest: pipeWriter}, nil)
+	pipeWriter.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	return <-ch
 }
 
 type ctxWriter struct {
@@ -0,0 +1,85 @@
+package nb7
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_RegenerateSite_searchIndex(t *testing.T) {
+	nbrew := &Notebrew{
+		FS: testutil.NewFS(fstest.MapFS{
+			"output":               &fstest.MapFile{Mode: fs.ModeDir},
+			"posts":                &fstest.MapFile{Mode: fs.ModeDir},
+			"pages":                &fstest.MapFile{Mode: fs.ModeDir},
+			"system/search.txt":    &fstest.MapFile{Data: []byte("true")},
+			"posts/hello-world.md": &fstest.MapFile{Data: []byte("# Hello World\n\nThis is my *first* post about Golang.\n")},
+			"pages/about.html":     &fstest.MapFile{Data: []byte("<title>About me</title><script>var x;</script><p>I write Go.</p>")},
+		}),
+		Scheme:        "https://",
+		ContentDomain: "example.com",
+	}
+	err := nbrew.RegenerateSite(context.Background(), "")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	b, err := fs.ReadFile(nbrew.FS, "output/search-index.json")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	var entries []SearchIndexEntry
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	gotEntries := make(map[string]SearchIndexEntry)
+	for _, entry := range entries {
+		gotEntries[entry.URL] = entry
+	}
+	wantEntries := map[string]SearchIndexEntry{
+		"https://example.com/about/": {
+			URL:     "https://example.com/about/",
+			Title:   "About me",
+			Summary: "I write Go.",
+			Tokens:  []string{"about", "go", "me", "write"},
+		},
+		"https://example.com/posts/hello-world/": {
+			URL:     "https://example.com/posts/hello-world/",
+			Title:   "Hello World",
+			Summary: "This is my first post about Golang.",
+			Tokens:  []string{"about", "first", "golang", "hello", "is", "my", "post", "this", "world"},
+		},
+	}
+	for url, wantEntry := range wantEntries {
+		if diff := testutil.Diff(gotEntries[url], wantEntry); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+	}
+	_, err = fs.Stat(nbrew.FS, "output/search/index.html")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+}
+
+// newTestSite returns a Notebrew without a database whose FS holds files
+// along with the output, posts and pages folders of the site at sitePrefix
+// that RegenerateSite expects.
+func newTestSite(sitePrefix string, files fstest.MapFS) *Notebrew {
+	mapFS := fstest.MapFS{}
+	for _, dir := range []string{"output", "posts", "pages"} {
+		mapFS[path.Join(sitePrefix, dir)] = &fstest.MapFile{Mode: fs.ModeDir}
+	}
+	for name, file := range files {
+		mapFS[name] = file
+	}
+	return &Notebrew{
+		FS:            testutil.NewFS(mapFS),
+		Scheme:        "https://",
+		ContentDomain: "example.com",
+	}
+}
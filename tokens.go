@@ -0,0 +1,315 @@
+package nb7
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+func (nbrew *Notebrew) tokens(w http.ResponseWriter, r *http.Request, username string) {
+	type APIToken struct {
+		Name       string    `json:"name"`
+		Scopes     []string  `json:"scopes"`
+		CreatedAt  time.Time `json:"createdAt"`
+		ExpiresAt  time.Time `json:"expiresAt,omitempty"`
+		LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+	}
+	type Request struct {
+		Action        string   `json:"action,omitempty"` // "create" | "revoke"
+		Name          string   `json:"name,omitempty"`
+		Scopes        []string `json:"scopes,omitempty"`
+		ExpiresInDays int      `json:"expiresInDays,omitempty"` // 0 means the token never expires
+	}
+	type Response struct {
+		Status    Error              `json:"status"`
+		Errors    map[string][]Error `json:"errors,omitempty"`
+		Name      string             `json:"name,omitempty"`
+		Token     string             `json:"token,omitempty"`
+		APITokens []APIToken         `json:"apiTokens,omitempty"`
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"stylesCSS":   func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":  func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase": func() bool { return nbrew.DB != nil },
+				"referer":     func() string { return r.Referer() },
+				"username":    func() string { return username },
+				"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+				"join":        strings.Join,
+			}
+			tmpl, err := template.New("tokens.html").Funcs(funcMap).ParseFS(rootFS, "embed/tokens.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status == "" {
+			response.Status = Success
+		}
+		response.APITokens, err = sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM api_token" +
+				" JOIN users ON users.user_id = api_token.user_id" +
+				" WHERE users.username = {username}" +
+				" ORDER BY api_token.created_at DESC",
+			Values: []any{
+				sq.StringParam("username", username),
+			},
+		}, func(row *sq.Row) APIToken {
+			apiToken := APIToken{
+				Name: row.String("api_token.token_name"),
+			}
+			b := row.Bytes("api_token.scopes")
+			createdAt := row.NullInt64("api_token.created_at")
+			expiresAt := row.NullInt64("api_token.expires_at")
+			lastUsedAt := row.NullInt64("api_token.last_used_at")
+			if len(b) > 0 {
+				_ = json.Unmarshal(b, &apiToken.Scopes)
+			}
+			if createdAt.Valid {
+				apiToken.CreatedAt = time.Unix(createdAt.Int64, 0).UTC()
+			}
+			if expiresAt.Valid {
+				apiToken.ExpiresAt = time.Unix(expiresAt.Int64, 0).UTC()
+			}
+			if lastUsedAt.Valid {
+				apiToken.LastUsedAt = time.Unix(lastUsedAt.Int64, 0).UTC()
+			}
+			return apiToken
+		})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", &response)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/tokens/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.Action = r.Form.Get("action")
+			request.Name = r.Form.Get("name")
+			request.Scopes = strings.Fields(r.Form.Get("scopes"))
+			if s := r.Form.Get("expiresInDays"); s != "" {
+				expiresInDays, err := strconv.Atoi(s)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+				request.ExpiresInDays = expiresInDays
+			}
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		response := Response{
+			Name:   strings.TrimSpace(request.Name),
+			Errors: make(map[string][]Error),
+		}
+		switch request.Action {
+		case "create":
+			if response.Name == "" {
+				response.Errors["name"] = append(response.Errors["name"], ErrRequired)
+			} else if len(response.Name) > 100 {
+				response.Errors["name"] = append(response.Errors["name"], ErrTooLong)
+			}
+			if len(request.Scopes) == 0 {
+				response.Errors["scopes"] = append(response.Errors["scopes"], ErrRequired)
+			}
+			for _, scope := range request.Scopes {
+				err := ValidateAPITokenScope(scope)
+				if err != nil {
+					response.Errors["scopes"] = append(response.Errors["scopes"], ErrInvalidScope)
+					break
+				}
+			}
+			if request.ExpiresInDays < 0 {
+				response.Errors["expiresInDays"] = append(response.Errors["expiresInDays"], ErrInvalidValue)
+			}
+			if len(response.Errors) == 0 {
+				exists, err := sq.FetchExistsContext(r.Context(), nbrew.DB, sq.CustomQuery{
+					Dialect: nbrew.Dialect,
+					Format: "SELECT 1" +
+						" FROM api_token" +
+						" JOIN users ON users.user_id = api_token.user_id" +
+						" WHERE users.username = {username} AND api_token.token_name = {name}",
+					Values: []any{
+						sq.StringParam("username", username),
+						sq.StringParam("name", response.Name),
+					},
+				})
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				if exists {
+					response.Errors["name"] = append(response.Errors["name"], ErrUnavailable)
+				}
+			}
+			if len(response.Errors) > 0 {
+				response.Status = ErrValidationFailed
+				writeResponse(w, r, response)
+				return
+			}
+			token, tokenHash, err := NewAPIToken()
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			scopes, err := json.Marshal(request.Scopes)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			now := time.Now()
+			expiresAt := sql.NullInt64{}
+			if request.ExpiresInDays > 0 {
+				expiresAt = sql.NullInt64{Int64: now.AddDate(0, 0, request.ExpiresInDays).Unix(), Valid: true}
+			}
+			_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "INSERT INTO api_token (api_token_hash, user_id, token_name, scopes, created_at, expires_at)" +
+					" VALUES ({apiTokenHash}, (SELECT user_id FROM users WHERE username = {username}), {name}, {scopes}, {createdAt}, {expiresAt})",
+				Values: []any{
+					sq.BytesParam("apiTokenHash", tokenHash),
+					sq.StringParam("username", username),
+					sq.StringParam("name", response.Name),
+					sq.StringParam("scopes", string(scopes)),
+					sq.Int64Param("createdAt", now.Unix()),
+					sq.Param("expiresAt", expiresAt),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			nbrew.auditLog(r, AuditEntry{
+				Actor:     username,
+				IsAccount: true,
+				Action:    "createtoken",
+				Target:    response.Name,
+			})
+			response.Token = token
+			response.Status = CreateAPITokenSuccess
+			writeResponse(w, r, response)
+		case "revoke":
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "DELETE FROM api_token" +
+					" WHERE user_id = (SELECT user_id FROM users WHERE username = {username})" +
+					" AND token_name = {name}",
+				Values: []any{
+					sq.StringParam("username", username),
+					sq.StringParam("name", response.Name),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Status = ErrAPITokenNotFound
+				writeResponse(w, r, response)
+				return
+			}
+			nbrew.auditLog(r, AuditEntry{
+				Actor:     username,
+				IsAccount: true,
+				Action:    "revoketoken",
+				Target:    response.Name,
+			})
+			response.Status = RevokeAPITokenSuccess
+			writeResponse(w, r, response)
+		default:
+			response.Status = ErrInvalidValue
+			writeResponse(w, r, response)
+		}
+	default:
+		methodNotAllowed(w, r)
+	}
+}
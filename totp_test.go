@@ -0,0 +1,33 @@
+package nb7
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_totpCode(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got := totpCode(secret, uint64(tt.unix)/totpPeriod)
+		if got != tt.code {
+			t.Errorf("totpCode at %d: got %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+	encodedSecret := totpEncoding.EncodeToString(secret)
+	if _, ok := verifyTOTP(encodedSecret, "287082", time.Unix(59+totpPeriod, 0)); !ok {
+		t.Errorf("verifyTOTP: code from the previous time step was rejected")
+	}
+	if _, ok := verifyTOTP(encodedSecret, "287082", time.Unix(59+3*totpPeriod, 0)); ok {
+		t.Errorf("verifyTOTP: stale code was accepted")
+	}
+}
@@ -0,0 +1,640 @@
+package nb7
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// trashDir is where deleted items of a site are kept until they are restored
+// or purged. Each item is moved to trashDir/<trashID> alongside a
+// trashDir/<trashID>.json file describing it.
+const trashDir = "system/trash"
+
+// TrashItem describes an item in a site's trash.
+type TrashItem struct {
+	TrashID      string    `json:"trashID"`
+	OriginalPath string    `json:"originalPath"` // relative to the site
+	IsDir        bool      `json:"isDir"`
+	Size         int64     `json:"size"`
+	DeletedAt    time.Time `json:"deletedAt"`
+	DeletedBy    string    `json:"deletedBy,omitempty"`
+
+	// SiteMembers are the users of a deleted site and their roles at the
+	// time it was deleted, so that they can be added back when the site is
+	// restored. It is only set for sites in the main site's trash.
+	SiteMembers []TrashSiteMember `json:"siteMembers,omitempty"`
+}
+
+// TrashSiteMember is a user of a deleted site.
+type TrashSiteMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// isSite reports whether the item is a deleted site in the main site's
+// trash.
+func (item TrashItem) isSite(sitePrefix string) bool {
+	return sitePrefix == "" && !strings.Contains(item.OriginalPath, "/") && (strings.HasPrefix(item.OriginalPath, "@") || strings.Contains(item.OriginalPath, "."))
+}
+
+// siteOwners returns the owners of a deleted site. Sites deleted before
+// their members were recorded fall back to whoever deleted them.
+func (item TrashItem) siteOwners() []string {
+	var owners []string
+	for _, member := range item.SiteMembers {
+		if member.Role == RoleOwner {
+			owners = append(owners, member.Username)
+		}
+	}
+	if item.SiteMembers == nil && item.DeletedBy != "" {
+		owners = append(owners, item.DeletedBy)
+	}
+	return owners
+}
+
+// canAccessTrashItem reports whether the user may see, restore or purge an
+// item in a site's trash.
+//
+// Deleted sites are kept in the main site's trash, but they may only be
+// accessed by the owners of the main site and by whoever owned the site when
+// it was deleted. The owners of a deleted site may access the main site's
+// trash for this even if they are not members of the main site, in which
+// case they see nothing else in it.
+func (nbrew *Notebrew) canAccessTrashItem(r *http.Request, username, sitePrefix string, item TrashItem) bool {
+	if nbrew.DB == nil {
+		return true
+	}
+	role, isMember := r.Context().Value(roleKey).(string)
+	if !item.isSite(sitePrefix) {
+		return isMember || sitePrefix != ""
+	}
+	if isMember && role == RoleOwner {
+		return true
+	}
+	return slices.Contains(item.siteOwners(), username)
+}
+
+func (nbrew *Notebrew) trashRetention() time.Duration {
+	if nbrew.TrashRetention > 0 {
+		return nbrew.TrashRetention
+	}
+	if retention, _ := time.ParseDuration(nbrew.Config().Trash.Retention); retention > 0 {
+		return retention
+	}
+	return 30 * 24 * time.Hour
+}
+
+func (nbrew *Notebrew) trash(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Request struct {
+		Action   string   `json:"action,omitempty"` // "restore" | "purge"
+		TrashIDs []string `json:"trashIDs,omitempty"`
+	}
+	type Response struct {
+		Status     Error       `json:"status"`
+		Errors     []Error     `json:"errors,omitempty"`
+		SitePrefix string      `json:"sitePrefix,omitempty"`
+		Retention  string      `json:"retention,omitempty"`
+		Items      []TrashItem `json:"items"`
+	}
+
+	role, _ := r.Context().Value(roleKey).(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"join":             path.Join,
+				"stylesCSS":        func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":       func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase":      func() bool { return nbrew.DB != nil },
+				"referer":          func() string { return r.Referer() },
+				"username":         func() string { return username },
+				"safeHTML":         func(s string) template.HTML { return template.HTML(s) },
+				"canPurge":         func() bool { return role == "" || role == RoleOwner || role == RoleEditor },
+				"fileSizeToString": fileSizeToString,
+			}
+			tmpl, err := template.New("trash.html").Funcs(funcMap).ParseFS(rootFS, "embed/trash.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status == "" {
+			response.Status = Success
+		}
+		response.SitePrefix = sitePrefix
+		response.Retention = nbrew.trashRetention().String()
+		items, err := nbrew.getTrashItems(sitePrefix)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		for _, item := range items {
+			if nbrew.canAccessTrashItem(r, username, sitePrefix, item) {
+				response.Items = append(response.Items, item)
+			}
+		}
+		if response.Items == nil {
+			response.Items = []TrashItem{}
+		}
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"status": response.Status,
+				"errors": response.Errors,
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "trash")+"/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.Action = r.Form.Get("action")
+			request.TrashIDs = r.Form["trashID"]
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		response := Response{
+			SitePrefix: sitePrefix,
+			Items:      []TrashItem{},
+		}
+		switch request.Action {
+		case "restore":
+			break
+		case "purge":
+			// Purging cannot be undone, so it is limited to those who can
+			// manage the whole site (or in the case of a deleted site, its
+			// owners, which canAccessTrashItem checks).
+			if role != "" && role != RoleOwner && role != RoleEditor {
+				notAuthorized(w, r)
+				return
+			}
+		default:
+			response.Status = ErrInvalidValue
+			writeResponse(w, r, response)
+			return
+		}
+		shouldRegenerate := false
+		seen := make(map[string]bool)
+		for _, trashID := range request.TrashIDs {
+			if seen[trashID] {
+				continue
+			}
+			seen[trashID] = true
+			item, err := nbrew.getTrashItem(sitePrefix, trashID)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					response.Errors = append(response.Errors, Error(trashID+": "+ErrTrashItemNotFound.Message()))
+					continue
+				}
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			// Items the user may not access are reported the same way as
+			// items that don't exist.
+			if !nbrew.canAccessTrashItem(r, username, sitePrefix, item) {
+				response.Errors = append(response.Errors, Error(trashID+": "+ErrTrashItemNotFound.Message()))
+				continue
+			}
+			if !canWriteTo(r, sitePrefix, item.OriginalPath) {
+				notAuthorized(w, r)
+				return
+			}
+			if request.Action == "purge" {
+				err = nbrew.purgeFromTrash(sitePrefix, item)
+				if err != nil {
+					response.Errors = append(response.Errors, Error(fmt.Sprintf("%s: %v", item.OriginalPath, err)))
+					continue
+				}
+				response.Items = append(response.Items, item)
+				nbrew.auditLog(r, AuditEntry{
+					Actor:    username,
+					SiteName: strings.TrimPrefix(sitePrefix, "@"),
+					Action:   "purge",
+					FilePath: path.Join(trashDir, item.TrashID),
+					Target:   item.OriginalPath,
+					Before:   &AuditSnapshot{Size: item.Size},
+				})
+				continue
+			}
+			err = nbrew.restoreFromTrash(sitePrefix, item)
+			if err != nil {
+				if errors.Is(err, fs.ErrExist) {
+					response.Errors = append(response.Errors, Error(item.OriginalPath+": "+ErrItemAlreadyExists.Message()))
+					continue
+				}
+				response.Errors = append(response.Errors, Error(fmt.Sprintf("%s: %v", item.OriginalPath, err)))
+				continue
+			}
+			if item.isSite(sitePrefix) {
+				// A restored site needs its database rows back, otherwise
+				// nobody would be able to access it.
+				err = nbrew.restoreSite(r.Context(), item)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+			}
+			head, tail, _ := strings.Cut(item.OriginalPath, "/")
+			if head == "pages" || head == "posts" || (head == "output" && strings.HasPrefix(tail, "themes")) {
+				shouldRegenerate = true
+			}
+			response.Items = append(response.Items, item)
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   "restore",
+				FilePath: item.OriginalPath,
+				After:    NewAuditSnapshot(nbrew.FS, path.Join(sitePrefix, item.OriginalPath)),
+			})
+		}
+
+		var b strings.Builder
+		verb := " restored"
+		if request.Action == "purge" {
+			verb = " purged"
+		}
+		if len(response.Errors) == 0 {
+			if request.Action == "purge" {
+				b.WriteString(PurgeSuccess.Code() + " ")
+			} else {
+				b.WriteString(RestoreSuccess.Code() + " ")
+			}
+		} else {
+			if request.Action == "purge" {
+				b.WriteString(ErrPurgeFailed.Code() + " ")
+			} else {
+				b.WriteString(ErrRestoreFailed.Code() + " ")
+			}
+		}
+		if len(response.Items) == 1 {
+			b.WriteString("1 item" + verb)
+		} else {
+			b.WriteString(strconv.Itoa(len(response.Items)) + " items" + verb)
+		}
+		if len(response.Errors) == 1 {
+			b.WriteString(" (1 item failed)")
+		} else if len(response.Errors) > 1 {
+			b.WriteString(" (" + strconv.Itoa(len(response.Errors)) + " items failed)")
+		}
+
+		if shouldRegenerate {
+			err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(3 * time.Minute))
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			err = nbrew.RegenerateSite(r.Context(), sitePrefix)
+			if err != nil {
+				var templateError TemplateError
+				if errors.As(err, &templateError) {
+					response.Errors = templateError.Errors()
+					response.Status = ErrFileGenerationFailed
+					writeResponse(w, r, response)
+					return
+				}
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		response.Status = Error(b.String())
+		writeResponse(w, r, response)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// MoveToTrash moves the file or folder at filePath into the site's trash.
+func (nbrew *Notebrew) MoveToTrash(sitePrefix, filePath, username string) (TrashItem, error) {
+	return nbrew.moveToTrash(sitePrefix, filePath, TrashItem{DeletedBy: username})
+}
+
+// MoveSiteToTrash moves a site's folder into the main site's trash, recording
+// the site's members and their roles so that restoring the site restores
+// them too. The caller is expected to delete the site's database rows
+// afterwards.
+func (nbrew *Notebrew) MoveSiteToTrash(ctx context.Context, sitePrefix, username string) (TrashItem, error) {
+	item := TrashItem{DeletedBy: username}
+	if nbrew.DB != nil {
+		var err error
+		item.SiteMembers, err = sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM site_user" +
+				" JOIN site ON site.site_id = site_user.site_id" +
+				" JOIN users ON users.user_id = site_user.user_id" +
+				" WHERE site.site_name = {siteName}" +
+				" ORDER BY users.username",
+			Values: []any{
+				sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+			},
+		}, func(row *sq.Row) TrashSiteMember {
+			return TrashSiteMember{
+				Username: row.String("users.username"),
+				Role:     row.String("COALESCE(site_user.role, 'owner')"),
+			}
+		})
+		if err != nil {
+			return TrashItem{}, err
+		}
+	}
+	return nbrew.moveToTrash("", sitePrefix, item)
+}
+
+// moveToTrash moves the file or folder at filePath into the site's trash,
+// filling in the rest of item.
+func (nbrew *Notebrew) moveToTrash(sitePrefix, filePath string, item TrashItem) (TrashItem, error) {
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, filePath))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	size, err := getFileSize(nbrew.FS, path.Join(sitePrefix, filePath))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	id := NewID()
+	item.TrashID = hex.EncodeToString(id[:])
+	item.OriginalPath = filePath
+	item.IsDir = fileInfo.IsDir()
+	item.Size = size
+	item.DeletedAt = time.Now().UTC().Truncate(time.Second)
+	err = MkdirAll(nbrew.FS, path.Join(sitePrefix, trashDir), 0755)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	b, err := json.Marshal(&item)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, trashDir, item.TrashID+".json"), 0644)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	_, err = readerFrom.ReadFrom(strings.NewReader(string(b)))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	err = nbrew.FS.Rename(path.Join(sitePrefix, filePath), path.Join(sitePrefix, trashDir, item.TrashID))
+	if err != nil {
+		_ = nbrew.FS.Remove(path.Join(sitePrefix, trashDir, item.TrashID+".json"))
+		return TrashItem{}, err
+	}
+	return item, nil
+}
+
+// getTrashItems returns the items in a site's trash, most recently deleted
+// first.
+func (nbrew *Notebrew) getTrashItems(sitePrefix string) ([]TrashItem, error) {
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, trashDir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var items []TrashItem
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || path.Ext(name) != ".json" {
+			continue
+		}
+		item, err := nbrew.getTrashItem(sitePrefix, strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b TrashItem) int {
+		return b.DeletedAt.Compare(a.DeletedAt)
+	})
+	return items, nil
+}
+
+func (nbrew *Notebrew) getTrashItem(sitePrefix, trashID string) (TrashItem, error) {
+	if len(trashID) != 32 {
+		return TrashItem{}, fs.ErrNotExist
+	}
+	if _, err := hex.DecodeString(trashID); err != nil {
+		return TrashItem{}, fs.ErrNotExist
+	}
+	b, err := fs.ReadFile(nbrew.FS, path.Join(sitePrefix, trashDir, trashID+".json"))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	var item TrashItem
+	err = json.Unmarshal(b, &item)
+	if err != nil {
+		return TrashItem{}, fmt.Errorf("%s: %w", path.Join(sitePrefix, trashDir, trashID+".json"), err)
+	}
+	item.TrashID = trashID
+	return item, nil
+}
+
+// restoreFromTrash moves an item in the trash back to its original path. It
+// returns fs.ErrExist if something already occupies the original path.
+func (nbrew *Notebrew) restoreFromTrash(sitePrefix string, item TrashItem) error {
+	_, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, item.OriginalPath))
+	if err == nil {
+		return fs.ErrExist
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = MkdirAll(nbrew.FS, path.Dir(path.Join(sitePrefix, item.OriginalPath)), 0755)
+	if err != nil {
+		return err
+	}
+	err = nbrew.FS.Rename(path.Join(sitePrefix, trashDir, item.TrashID), path.Join(sitePrefix, item.OriginalPath))
+	if err != nil {
+		return err
+	}
+	return nbrew.FS.Remove(path.Join(sitePrefix, trashDir, item.TrashID+".json"))
+}
+
+// restoreSite recreates the database rows of a site restored from the main
+// site's trash, adding back the members it had when it was deleted. Sites
+// deleted before their members were recorded get whoever deleted them as
+// the owner. Members whose accounts no longer exist are skipped.
+func (nbrew *Notebrew) restoreSite(ctx context.Context, item TrashItem) error {
+	if nbrew.DB == nil {
+		return nil
+	}
+	members := item.SiteMembers
+	if members == nil && item.DeletedBy != "" {
+		members = []TrashSiteMember{{Username: item.DeletedBy, Role: RoleOwner}}
+	}
+	siteName := strings.TrimPrefix(item.OriginalPath, "@")
+	tx, err := nbrew.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "INSERT INTO site (site_id, site_name) VALUES ({siteID}, {siteName})",
+		Values: []any{
+			sq.UUIDParam("siteID", NewID()),
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil && !nbrew.IsKeyViolation(err) {
+		return err
+	}
+	for _, member := range members {
+		role := member.Role
+		if !IsValidRole(role) {
+			role = RoleOwner
+		}
+		_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "INSERT INTO site_user (site_id, user_id, role)" +
+				" SELECT site.site_id, users.user_id, {role} FROM site, users" +
+				" WHERE site.site_name = {siteName} AND users.username = {username}" +
+				" AND NOT EXISTS (SELECT 1 FROM site_user WHERE site_user.site_id = site.site_id AND site_user.user_id = users.user_id)",
+			Values: []any{
+				sq.StringParam("role", role),
+				sq.StringParam("siteName", siteName),
+				sq.StringParam("username", member.Username),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// purgeFromTrash permanently deletes an item in the trash.
+func (nbrew *Notebrew) purgeFromTrash(sitePrefix string, item TrashItem) error {
+	err := RemoveAll(nbrew.FS, path.Join(sitePrefix, trashDir, item.TrashID))
+	if err != nil {
+		return err
+	}
+	err = nbrew.FS.Remove(path.Join(sitePrefix, trashDir, item.TrashID+".json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes items that have been in the trash of any
+// site for longer than the trash retention period. It returns the number of
+// items purged.
+func (nbrew *Notebrew) PurgeTrash(ctx context.Context) (int, error) {
+	sitePrefixes := []string{""}
+	dirEntries, err := nbrew.FS.ReadDir(".")
+	if err != nil {
+		return 0, err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() && (strings.HasPrefix(name, "@") || strings.Contains(name, ".")) {
+			sitePrefixes = append(sitePrefixes, name)
+		}
+	}
+	cutoff := time.Now().Add(-nbrew.trashRetention())
+	var count int
+	for _, sitePrefix := range sitePrefixes {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		items, err := nbrew.getTrashItems(sitePrefix)
+		if err != nil {
+			return count, err
+		}
+		for _, item := range items {
+			if item.DeletedAt.After(cutoff) {
+				continue
+			}
+			err = nbrew.purgeFromTrash(sitePrefix, item)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,283 @@
+package nb7
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+	"github.com/bokwoon95/sq"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_admin_trashDeletedSite(t *testing.T) {
+	for _, testDB := range testDatabases {
+		t.Run(testDB.Name, func(t *testing.T) {
+			nbrew := &Notebrew{
+				Dialect:   testDB.Dialect,
+				DB:        testDB.DB,
+				FS:        testutil.NewFS(nil),
+				ErrorCode: testDB.ErrorCode,
+			}
+			createUser(t, nbrew, "babbage", "babbage@email.com", "password123")
+			createUser(t, nbrew, "menabrea", "menabrea@email.com", "password123")
+			createUser(t, nbrew, "hollerith", "hollerith@email.com", "password123")
+			addSiteUser(t, nbrew, "", "hollerith", RoleEditor)
+			addSiteUser(t, nbrew, "engine", "babbage", RoleOwner)
+			addSiteUser(t, nbrew, "engine", "menabrea", RoleEditor)
+			err := nbrew.FS.Mkdir("@engine", 0755)
+			if err != nil && !errors.Is(err, fs.ErrExist) {
+				t.Fatal(testutil.Callers(), err)
+			}
+			authenticationTokens := map[string]string{
+				"babbage":   generateAuthenticationToken(t, nbrew, "babbage"),
+				"hollerith": generateAuthenticationToken(t, nbrew, "hollerith"),
+			}
+			serve := func(username, method, urlPath, body string) *deadlineRecorder {
+				w := &deadlineRecorder{httptest.NewRecorder()}
+				r, _ := http.NewRequest(method, urlPath, strings.NewReader(body))
+				r.Header.Set("Authorization", "Notebrew "+authenticationTokens[username])
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Accept", "application/json")
+				nbrew.admin(w, r, "")
+				return w
+			}
+			getTrash := func(username string) []TrashItem {
+				w := serve(username, "GET", "/admin/trash/", "")
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s %s: got status %d: %s", testutil.Callers(), username, w.Code, w.Body.String())
+				}
+				var response struct {
+					Items []TrashItem `json:"items"`
+				}
+				err := json.Unmarshal(w.Body.Bytes(), &response)
+				if err != nil {
+					t.Fatal(testutil.Callers(), err, w.Body.String())
+				}
+				return response.Items
+			}
+			restore := func(username, trashID string) Error {
+				w := serve(username, "POST", "/admin/trash/", `{"action":"restore","trashIDs":["`+trashID+`"]}`)
+				var response struct {
+					Status Error `json:"status"`
+				}
+				err := json.Unmarshal(w.Body.Bytes(), &response)
+				if err != nil {
+					t.Fatal(testutil.Callers(), err, w.Body.String())
+				}
+				return response.Status
+			}
+
+			w := serve("babbage", "POST", "/admin/deletesite/", `{"siteName":"engine"}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s deletesite: got status %d: %s", testutil.Callers(), w.Code, w.Body.String())
+			}
+			if _, err := fs.Stat(nbrew.FS, "@engine"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("%s deleted site still exists (err=%v)", testutil.Callers(), err)
+			}
+
+			// A main site editor who was not an owner of the deleted site can
+			// neither see nor restore it.
+			for _, item := range getTrash("hollerith") {
+				if item.OriginalPath == "@engine" {
+					t.Fatalf("%s hollerith: got deleted site %+v in the trash, want it hidden", testutil.Callers(), item)
+				}
+			}
+			var item TrashItem
+			for _, trashItem := range getTrash("babbage") {
+				if trashItem.OriginalPath == "@engine" {
+					item = trashItem
+				}
+			}
+			if item.TrashID == "" {
+				t.Fatalf("%s babbage: deleted site not in the trash", testutil.Callers())
+			}
+			wantMembers := []TrashSiteMember{{Username: "babbage", Role: RoleOwner}, {Username: "menabrea", Role: RoleEditor}}
+			if !slices.Equal(item.SiteMembers, wantMembers) {
+				t.Fatalf("%s: got site members %+v, want %+v", testutil.Callers(), item.SiteMembers, wantMembers)
+			}
+			if status := restore("hollerith", item.TrashID); status.Code() != ErrRestoreFailed.Code() {
+				t.Fatalf("%s hollerith restore: got status %q, want %q", testutil.Callers(), status, ErrRestoreFailed)
+			}
+			if status := restore("babbage", item.TrashID); status.Code() != RestoreSuccess.Code() {
+				t.Fatalf("%s babbage restore: got status %q, want %q", testutil.Callers(), status, RestoreSuccess)
+			}
+			if _, err := fs.Stat(nbrew.FS, "@engine"); err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			members, err := sq.FetchAll(nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "SELECT {*}" +
+					" FROM site_user" +
+					" JOIN site ON site.site_id = site_user.site_id" +
+					" JOIN users ON users.user_id = site_user.user_id" +
+					" WHERE site.site_name = 'engine'" +
+					" ORDER BY users.username",
+			}, func(row *sq.Row) TrashSiteMember {
+				return TrashSiteMember{
+					Username: row.String("users.username"),
+					Role:     row.String("COALESCE(site_user.role, 'owner')"),
+				}
+			})
+			if err != nil {
+				t.Fatal(testutil.Callers(), err)
+			}
+			if !slices.Equal(members, wantMembers) {
+				t.Errorf("%s: got restored members %+v, want %+v", testutil.Callers(), members, wantMembers)
+			}
+		})
+	}
+}
+
+func Test_admin_trash(t *testing.T) {
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, testDB := range testDatabases {
+		nbrew := &Notebrew{
+			Dialect:   testDB.Dialect,
+			DB:        testDB.DB,
+			FS:        testutil.NewFS(nil),
+			ErrorCode: testDB.ErrorCode,
+		}
+		g.Go(func() error {
+			createUser(t, nbrew, "turing", "turing@email.com", "password123")
+			authenticationToken := generateAuthenticationToken(t, nbrew, "turing")
+			for _, dir := range []string{"@turing", "@turing/notes"} {
+				err := nbrew.FS.Mkdir(dir, 0755)
+				if err != nil && !errors.Is(err, fs.ErrExist) {
+					return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+				}
+			}
+			readerFrom, err := nbrew.FS.OpenReaderFrom("@turing/notes/machine.md", 0644)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			_, err = readerFrom.ReadFrom(strings.NewReader("# on computable numbers"))
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+
+			// delete sets a write deadline before regenerating the site,
+			// which httptest.ResponseRecorder does not support.
+			w := deadlineRecorder{httptest.NewRecorder()}
+			r, _ := http.NewRequest("POST", "/admin/@turing/delete/", strings.NewReader(`{"parentFolder":"notes","names":["machine.md"]}`))
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			if w.Code != http.StatusOK {
+				return fmt.Errorf("[%s] %s delete: got status %d: %s", nbrew.Dialect, testutil.Callers(), w.Code, w.Body.String())
+			}
+			_, err = fs.Stat(nbrew.FS, "@turing/notes/machine.md")
+			if !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("[%s] %s deleted file still exists (err=%v)", nbrew.Dialect, testutil.Callers(), err)
+			}
+
+			w = deadlineRecorder{httptest.NewRecorder()}
+			r, _ = http.NewRequest("GET", "/admin/@turing/trash/", nil)
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			var response struct {
+				Items []TrashItem `json:"items"`
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if len(response.Items) != 1 {
+				return fmt.Errorf("[%s] %s got %d items, want 1", nbrew.Dialect, testutil.Callers(), len(response.Items))
+			}
+			item := response.Items[0]
+			if item.OriginalPath != "notes/machine.md" || item.DeletedBy != "turing" || item.Size != int64(len("# on computable numbers")) {
+				return fmt.Errorf("[%s] %s unexpected item %+v", nbrew.Dialect, testutil.Callers(), item)
+			}
+
+			w = deadlineRecorder{httptest.NewRecorder()}
+			r, _ = http.NewRequest("POST", "/admin/@turing/trash/", strings.NewReader(`{"action":"restore","trashIDs":["`+item.TrashID+`"]}`))
+			r.Header.Set("Authorization", "Notebrew "+authenticationToken)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/json")
+			nbrew.admin(w, r.WithContext(ctx), "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			var restoreResponse struct {
+				Status Error `json:"status"`
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &restoreResponse)
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v: %s", nbrew.Dialect, testutil.Callers(), err, w.Body.String())
+			}
+			if restoreResponse.Status.Code() != RestoreSuccess.Code() {
+				return fmt.Errorf("[%s] %s restore: got status %q", nbrew.Dialect, testutil.Callers(), restoreResponse.Status)
+			}
+			b, err := fs.ReadFile(nbrew.FS, "@turing/notes/machine.md")
+			if err != nil {
+				return fmt.Errorf("[%s] %s %v", nbrew.Dialect, testutil.Callers(), err)
+			}
+			if string(b) != "# on computable numbers" {
+				return fmt.Errorf("[%s] %s restored file has contents %q", nbrew.Dialect, testutil.Callers(), string(b))
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// addSiteUser adds a user to a site with the given role, creating the site
+// row if it does not exist.
+func addSiteUser(t *testing.T, nbrew *Notebrew, siteName, username, role string) {
+	exists, err := sq.FetchExists(nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT 1 FROM site WHERE site_name = {siteName}",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if !exists {
+		_, err = sq.Exec(nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "INSERT INTO site (site_id, site_name) VALUES ({siteID}, {siteName})",
+			Values: []any{
+				sq.UUIDParam("siteID", NewID()),
+				sq.StringParam("siteName", siteName),
+			},
+		})
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+	}
+	_, err = sq.Exec(nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO site_user (site_id, user_id, role)" +
+			" SELECT site.site_id, users.user_id, {role} FROM site, users" +
+			" WHERE site.site_name = {siteName} AND users.username = {username}",
+		Values: []any{
+			sq.StringParam("role", role),
+			sq.StringParam("siteName", siteName),
+			sq.StringParam("username", username),
+		},
+	})
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+}
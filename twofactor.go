@@ -0,0 +1,552 @@
+package nb7
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/skip2/go-qrcode"
+)
+
+// twoFactorLogin is the data held in the session table between the password
+// step and the two-factor step of a login.
+type twoFactorLogin struct {
+	Username string `json:"twoFactorUsername"`
+	Redirect string `json:"redirect,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+// maxTwoFactorAttempts is the number of incorrect codes allowed before the
+// user has to start over from the password step.
+const maxTwoFactorAttempts = 5
+
+// createTwoFactorLogin stores a pending two-factor login in the session table
+// and returns the token that identifies it.
+func (nbrew *Notebrew) createTwoFactorLogin(ctx context.Context, login twoFactorLogin) (string, error) {
+	data, err := json.Marshal(&login)
+	if err != nil {
+		return "", fmt.Errorf("marshaling JSON: %w", err)
+	}
+	var twoFactorToken [8 + 16]byte
+	binary.BigEndian.PutUint64(twoFactorToken[:8], uint64(time.Now().Unix()))
+	_, err = rand.Read(twoFactorToken[8:])
+	if err != nil {
+		return "", fmt.Errorf("reading rand: %w", err)
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "INSERT INTO session (session_token_hash, data) VALUES ({sessionTokenHash}, {data})",
+		Values: []any{
+			sq.BytesParam("sessionTokenHash", hashToken(twoFactorToken[:])),
+			sq.StringParam("data", string(data)),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("saving session: %w", err)
+	}
+	return strings.TrimLeft(hex.EncodeToString(twoFactorToken[:]), "0"), nil
+}
+
+// takeTwoFactorAttempt fetches the pending two-factor login identified by
+// twoFactorToken and counts an attempt against it before the code is
+// checked, so that concurrent requests can't make more than
+// maxTwoFactorAttempts attempts between them. Like any other session, it is
+// only valid for 5 minutes. ok is false if the login has expired or has no
+// attempts left.
+func (nbrew *Notebrew) takeTwoFactorAttempt(ctx context.Context, twoFactorToken string) (login twoFactorLogin, sessionTokenHash []byte, ok bool, err error) {
+	token, err := hex.DecodeString(fmt.Sprintf("%048s", twoFactorToken))
+	if err != nil || len(token) != 8+16 {
+		return login, nil, false, nil
+	}
+	sessionTokenHash = hashToken(token)
+	createdAt := time.Unix(int64(binary.BigEndian.Uint64(sessionTokenHash[:8])), 0)
+	if time.Now().Sub(createdAt) > 5*time.Minute {
+		return login, nil, false, nil
+	}
+	// The attempt is counted with compare-and-swap on the session data: if
+	// another request counted one since the data was read, read it again.
+	// Every lost race means another attempt was counted, so the attempts run
+	// out before the loop does.
+	dataEquals := "data = {data}"
+	if nbrew.Dialect == "mysql" {
+		dataEquals = "data = CAST({data} AS JSON)"
+	}
+	for i := 0; i <= maxTwoFactorAttempts; i++ {
+		data, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM session WHERE session_token_hash = {sessionTokenHash}",
+			Values: []any{
+				sq.BytesParam("sessionTokenHash", sessionTokenHash),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("data")
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return login, nil, false, nil
+			}
+			return login, nil, false, err
+		}
+		login = twoFactorLogin{}
+		err = json.Unmarshal([]byte(data), &login)
+		if err != nil {
+			return login, nil, false, err
+		}
+		if login.Attempts >= maxTwoFactorAttempts {
+			return login, nil, false, nil
+		}
+		login.Attempts++
+		newData, err := json.Marshal(&login)
+		if err != nil {
+			return login, nil, false, err
+		}
+		result, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE session SET data = {newData} WHERE session_token_hash = {sessionTokenHash} AND " + dataEquals,
+			Values: []any{
+				sq.StringParam("newData", string(newData)),
+				sq.BytesParam("sessionTokenHash", sessionTokenHash),
+				sq.StringParam("data", data),
+			},
+		})
+		if err != nil {
+			return login, nil, false, err
+		}
+		if result.RowsAffected > 0 {
+			return login, sessionTokenHash, true, nil
+		}
+	}
+	return login, nil, false, fmt.Errorf("two-factor login: too many concurrent attempts")
+}
+
+// verifyTwoFactorCode checks code against the user's TOTP secret, falling
+// back to the user's recovery codes. A recovery code is consumed once used.
+func (nbrew *Notebrew) verifyTwoFactorCode(ctx context.Context, username, code string) (ok bool, err error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	totpSecret, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM users WHERE username = {username}",
+		Values: []any{
+			sq.StringParam("username", username),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("COALESCE(totp_secret, '')")
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if totpSecret == "" {
+		return false, nil
+	}
+	counter, ok := verifyTOTP(totpSecret, code, time.Now())
+	if ok {
+		// A code is only accepted if no code from the same or a later time
+		// step has been, which the update checks so that concurrent requests
+		// can't both use the same code.
+		updateResult, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "UPDATE users SET totp_last_used = {counter}" +
+				" WHERE username = {username} AND (totp_last_used IS NULL OR totp_last_used < {counter})",
+			Values: []any{
+				sq.Int64Param("counter", int64(counter)),
+				sq.StringParam("username", username),
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+		return updateResult.RowsAffected > 0, nil
+	}
+	deleteResult, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "DELETE FROM recovery_code" +
+			" WHERE user_id = (SELECT user_id FROM users WHERE username = {username})" +
+			" AND recovery_code_hash = {recoveryCodeHash}",
+		Values: []any{
+			sq.StringParam("username", username),
+			sq.BytesParam("recoveryCodeHash", hashRecoveryCode(code)),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleteResult.RowsAffected > 0, nil
+}
+
+func (nbrew *Notebrew) twofactor(w http.ResponseWriter, r *http.Request, username string) {
+	type Request struct {
+		Action string `json:"action,omitempty"` // enable | disable
+		Code   string `json:"code,omitempty"`
+	}
+	type Response struct {
+		Status                 Error    `json:"status"`
+		Enabled                bool     `json:"enabled"`
+		Secret                 string   `json:"secret,omitempty"`
+		OTPAuthURI             string   `json:"otpauthURI,omitempty"`
+		QRCode                 string   `json:"qrCode,omitempty"` // data URI
+		RecoveryCodes          []string `json:"recoveryCodes,omitempty"`
+		RecoveryCodesRemaining int      `json:"recoveryCodesRemaining,omitempty"`
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+
+	isEnabled := func() (enabled bool, recoveryCodesRemaining int, err error) {
+		result, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM users" +
+				" WHERE username = {username}",
+			Values: []any{
+				sq.StringParam("username", username),
+			},
+		}, func(row *sq.Row) (result struct {
+			Enabled                bool
+			RecoveryCodesRemaining int
+		}) {
+			result.Enabled = row.Bool("CASE WHEN totp_secret IS NOT NULL THEN 1 ELSE 0 END")
+			result.RecoveryCodesRemaining = row.Int("(SELECT COUNT(*) FROM recovery_code WHERE recovery_code.user_id = users.user_id)")
+			return result
+		})
+		if err != nil {
+			return false, 0, err
+		}
+		return result.Enabled, result.RecoveryCodesRemaining, nil
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"stylesCSS":   func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":  func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase": func() bool { return nbrew.DB != nil },
+				"referer":     func() string { return r.Referer() },
+				"username":    func() string { return username },
+				"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+				"safeURL":     func(s string) template.URL { return template.URL(s) },
+			}
+			tmpl, err := template.New("twofactor.html").Funcs(funcMap).ParseFS(rootFS, "embed/twofactor.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status == "" {
+			response.Status = Success
+		}
+		response.Enabled, response.RecoveryCodesRemaining, err = isEnabled()
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if response.Enabled {
+			writeResponse(w, r, response)
+			return
+		}
+		// Generate a fresh secret for the user to enrol with. It is held in a
+		// short-lived session until the user confirms it with a valid code.
+		response.Secret, err = newTOTPSecret()
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		accountName := username
+		if accountName == "" {
+			accountName = "admin"
+		}
+		response.OTPAuthURI = totpURI("notebrew ("+nbrew.AdminDomain+")", accountName, response.Secret)
+		png, err := qrcode.Encode(response.OTPAuthURI, qrcode.Medium, 256)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		response.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+		err = nbrew.setSession(w, r, "twofactor", map[string]string{"secret": response.Secret})
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			// Don't put the secret back into the flash session, a fresh one
+			// will be generated when the page is reloaded.
+			response.Secret = ""
+			err := nbrew.setSession(w, r, "flash", &response)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/twofactor/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.Action = r.Form.Get("action")
+			request.Code = r.Form.Get("code")
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		var response Response
+		enabled, _, err := isEnabled()
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		switch request.Action {
+		case "enable":
+			if enabled {
+				response.Status = ErrTwoFactorAlreadyEnabled
+				response.Enabled = true
+				writeResponse(w, r, response)
+				return
+			}
+			// The secret is the one generated for the user when they loaded
+			// the page, never one supplied by the client.
+			var session struct {
+				Secret string `json:"secret"`
+			}
+			_, err := nbrew.getSession(r, "twofactor", &session)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+			}
+			secret := session.Secret
+			if secret == "" {
+				response.Status = ErrTokenExpired
+				writeResponse(w, r, response)
+				return
+			}
+			counter, ok := verifyTOTP(secret, request.Code, time.Now())
+			if !ok {
+				response.Status = ErrIncorrectTwoFactorCode
+				writeResponse(w, r, response)
+				return
+			}
+			recoveryCodes := make([]string, 10)
+			for i := range recoveryCodes {
+				recoveryCodes[i], err = newRecoveryCode()
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+			}
+			tx, err := nbrew.DB.BeginTx(r.Context(), nil)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			defer tx.Rollback()
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "UPDATE users SET totp_secret = {secret}, totp_last_used = {counter} WHERE username = {username}",
+				Values: []any{
+					sq.StringParam("secret", secret),
+					sq.Int64Param("counter", int64(counter)),
+					sq.StringParam("username", username),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM recovery_code WHERE user_id = (SELECT user_id FROM users WHERE username = {username})",
+				Values: []any{
+					sq.StringParam("username", username),
+				},
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			for _, recoveryCode := range recoveryCodes {
+				_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+					Dialect: nbrew.Dialect,
+					Format: "INSERT INTO recovery_code (recovery_code_hash, user_id)" +
+						" VALUES ({recoveryCodeHash}, (SELECT user_id FROM users WHERE username = {username}))",
+					Values: []any{
+						sq.BytesParam("recoveryCodeHash", hashRecoveryCode(recoveryCode)),
+						sq.StringParam("username", username),
+					},
+				})
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+			}
+			err = tx.Commit()
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			nbrew.clearSession(w, r, "twofactor")
+			nbrew.auditLog(r, AuditEntry{
+				Actor:     username,
+				IsAccount: true,
+				Action:    "enabletwofactor",
+			})
+			response.Status = EnableTwoFactorSuccess
+			response.Enabled = true
+			response.RecoveryCodes = recoveryCodes
+			writeResponse(w, r, response)
+		case "disable":
+			if !enabled {
+				response.Status = ErrTwoFactorNotEnabled
+				writeResponse(w, r, response)
+				return
+			}
+			ok, err := nbrew.verifyTwoFactorCode(r.Context(), username, request.Code)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if !ok {
+				response.Status = ErrIncorrectTwoFactorCode
+				response.Enabled = true
+				writeResponse(w, r, response)
+				return
+			}
+			err = nbrew.DisableTwoFactor(r.Context(), username)
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			nbrew.auditLog(r, AuditEntry{
+				Actor:     username,
+				IsAccount: true,
+				Action:    "disabletwofactor",
+			})
+			response.Status = DisableTwoFactorSuccess
+			writeResponse(w, r, response)
+		default:
+			response.Status = ErrInvalidValue
+			response.Enabled = enabled
+			writeResponse(w, r, response)
+		}
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and deletes
+// their recovery codes.
+func (nbrew *Notebrew) DisableTwoFactor(ctx context.Context, username string) error {
+	tx, err := nbrew.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE users SET totp_secret = NULL, totp_last_used = NULL WHERE username = {username}",
+		Values: []any{
+			sq.StringParam("username", username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM recovery_code WHERE user_id = (SELECT user_id FROM users WHERE username = {username})",
+		Values: []any{
+			sq.StringParam("username", username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
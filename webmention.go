@@ -0,0 +1,878 @@
+package nb7
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/net/html"
+)
+
+// webmentionDir holds a site's webmention state: sent.json records the links
+// of each post as of the last time webmentions were sent for it, and
+// received/ holds the moderation queue of incoming webmentions, one file per
+// source and target pair.
+const webmentionDir = "system/webmentions"
+
+// webmentionEnabled reports whether a site sends and receives webmentions,
+// which is turned on by putting "true" in system/webmention.txt.
+func webmentionEnabled(fsys FS, sitePrefix string) (bool, error) {
+	b, err := fs.ReadFile(fsys, path.Join(sitePrefix, "system/webmention.txt"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	ok, _ := strconv.ParseBool(string(bytes.TrimSpace(b)))
+	return ok, nil
+}
+
+// Webmention is a notification that Source links to Target.
+// https://www.w3.org/TR/webmention/
+type Webmention struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// WebmentionSender sends webmentions in the background, retrying those that
+// fail because of network errors or server errors.
+type WebmentionSender struct {
+	// Client is used for endpoint discovery and sending. If nil, a client
+	// that refuses to connect to loopback and private addresses is used.
+	Client *http.Client
+
+	Logger *slog.Logger
+
+	// MaxAttempts is how many times a webmention is attempted before it is
+	// given up on. If zero, it defaults to 5.
+	MaxAttempts int
+
+	// RetryDelay is how long to wait before the first retry, doubling after
+	// every attempt. If zero, it defaults to 1 minute.
+	RetryDelay time.Duration
+
+	initOnce sync.Once
+	queue    chan webmentionJob
+}
+
+type webmentionJob struct {
+	Webmention
+	attempt int
+}
+
+func (sender *WebmentionSender) init() {
+	sender.initOnce.Do(func() {
+		sender.queue = make(chan webmentionJob, 1000)
+	})
+}
+
+func (sender *WebmentionSender) logger() *slog.Logger {
+	if sender.Logger != nil {
+		return sender.Logger
+	}
+	return defaultLogger
+}
+
+// Enqueue queues a webmention to be sent by Run. If the queue is full the
+// webmention is dropped and logged.
+func (sender *WebmentionSender) Enqueue(mention Webmention) {
+	sender.enqueue(webmentionJob{Webmention: mention})
+}
+
+func (sender *WebmentionSender) enqueue(job webmentionJob) {
+	sender.init()
+	select {
+	case sender.queue <- job:
+	default:
+		sender.logger().Error("webmention queue full, dropping webmention", slog.String("source", job.Source), slog.String("target", job.Target))
+	}
+}
+
+// Run sends queued webmentions until ctx is canceled.
+func (sender *WebmentionSender) Run(ctx context.Context) {
+	sender.init()
+	maxAttempts := sender.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	retryDelay := sender.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = time.Minute
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	semaphore := make(chan struct{}, 4)
+	for {
+		var job webmentionJob
+		select {
+		case <-ctx.Done():
+			return
+		case job = <-sender.queue:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case semaphore <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			logger := sender.logger().With(slog.String("source", job.Source), slog.String("target", job.Target))
+			err := sender.Send(ctx, job.Webmention)
+			if err == nil {
+				logger.Info("webmention sent")
+				return
+			}
+			if errors.Is(err, errNoWebmentionEndpoint) {
+				logger.Debug(err.Error())
+				return
+			}
+			var sendErr *webmentionError
+			if errors.As(err, &sendErr) && sendErr.retryable && job.attempt+1 < maxAttempts {
+				delay := retryDelay << job.attempt
+				logger.Warn("webmention failed, retrying", slog.String("error", err.Error()), slog.Duration("delay", delay))
+				job.attempt++
+				time.AfterFunc(delay, func() { sender.enqueue(job) })
+				return
+			}
+			logger.Error("webmention failed", slog.String("error", err.Error()))
+		}()
+	}
+}
+
+var errNoWebmentionEndpoint = errors.New("no webmention endpoint")
+
+// webmentionError is an error sending a webmention. Network errors, rate
+// limiting and server errors are retryable, anything else is not.
+type webmentionError struct {
+	err       error
+	retryable bool
+}
+
+func (e *webmentionError) Error() string { return e.err.Error() }
+
+func (e *webmentionError) Unwrap() error { return e.err }
+
+// Send discovers the webmention endpoint of the target and sends the
+// webmention to it.
+func (sender *WebmentionSender) Send(ctx context.Context, mention Webmention) error {
+	client := sender.Client
+	if client == nil {
+		client = webmentionClient
+	}
+	endpoint, err := discoverWebmentionEndpoint(ctx, client, mention.Target)
+	if err != nil {
+		return err
+	}
+	form := url.Values{"source": {mention.Source}, "target": {mention.Target}}
+	request, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return &webmentionError{err: err}
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := client.Do(request)
+	if err != nil {
+		return &webmentionError{err: err, retryable: true}
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<20))
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return nil
+	}
+	return &webmentionError{
+		err:       fmt.Errorf("%s: %s", endpoint, response.Status),
+		retryable: response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500,
+	}
+}
+
+// discoverWebmentionEndpoint returns the webmention endpoint of target,
+// advertised either in a Link header or a <link> or <a> element with
+// rel="webmention".
+func discoverWebmentionEndpoint(ctx context.Context, client *http.Client, target string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return "", &webmentionError{err: err}
+	}
+	request.Header.Set("Accept", "text/html")
+	response, err := client.Do(request)
+	if err != nil {
+		return "", &webmentionError{err: err, retryable: true}
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return "", &webmentionError{err: fmt.Errorf("%s: %s", target, response.Status), retryable: true}
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", &webmentionError{err: fmt.Errorf("%s: %s", target, response.Status)}
+	}
+	resolve := func(href string) (string, error) {
+		endpointURL, err := response.Request.URL.Parse(strings.TrimSpace(href))
+		if err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") {
+			return "", &webmentionError{err: fmt.Errorf("%s: invalid webmention endpoint %q", target, href)}
+		}
+		return endpointURL.String(), nil
+	}
+	for _, header := range response.Header.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			href, params, ok := strings.Cut(link, ";")
+			href = strings.TrimSpace(href)
+			if !ok || !strings.HasPrefix(href, "<") || !strings.HasSuffix(href, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(param, "=")
+				if strings.TrimSpace(key) == "rel" && hasRel(strings.Trim(strings.TrimSpace(value), `"`), "webmention") {
+					return resolve(href[1 : len(href)-1])
+				}
+			}
+		}
+	}
+	contentType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if contentType != "text/html" {
+		return "", errNoWebmentionEndpoint
+	}
+	tokenizer := html.NewTokenizer(io.LimitReader(response.Body, 1<<20))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return "", errNoWebmentionEndpoint
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			if (string(name) != "link" && string(name) != "a") || !hasAttr {
+				continue
+			}
+			var rel, href string
+			var hasHref bool
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = tokenizer.TagAttr()
+				switch string(key) {
+				case "rel":
+					rel = string(value)
+				case "href":
+					href, hasHref = string(value), true
+				}
+			}
+			if hasHref && hasRel(rel, "webmention") {
+				return resolve(href)
+			}
+		}
+	}
+}
+
+func hasRel(rel, value string) bool {
+	for _, field := range strings.Fields(rel) {
+		if strings.EqualFold(field, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// webmentionClient is the default client for sending and verifying
+// webmentions. Since the URLs come from post content and from strangers, it
+// refuses to connect to anything that isn't a public address.
+var webmentionClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, conn syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+					return fmt.Errorf("%s is not a public address", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+}
+
+// markdownLinks returns the absolute http(s) links in a markdown document.
+func markdownLinks(src []byte) []string {
+	var links []string
+	seen := make(map[string]bool)
+	ast.Walk(goldmarkMarkdown.Parser().Parse(text.NewReader(src)), func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		var link string
+		switch node := node.(type) {
+		case *ast.Link:
+			link = string(node.Destination)
+		case *ast.AutoLink:
+			if node.AutoLinkType == ast.AutoLinkURL {
+				link = string(node.URL(src))
+			}
+		}
+		if (strings.HasPrefix(link, "https://") || strings.HasPrefix(link, "http://")) && !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+		return ast.WalkContinue, nil
+	})
+	return links
+}
+
+// webmentionPost is a post as far as sending webmentions is concerned.
+type webmentionPost struct {
+	Source string   `json:"source"`
+	Hash   string   `json:"hash"`
+	Links  []string `json:"links,omitempty"`
+}
+
+// queueWebmentions compares the posts of a site against the ones recorded
+// the last time it was regenerated and queues webmentions for the links of
+// every post that is new, changed or deleted. The first time it is called
+// for a site it only records the posts, so that turning on webmentions for
+// an existing site doesn't notify every link it has ever made.
+func (nbrew *Notebrew) queueWebmentions(sitePrefix, siteURL string, posts map[string]webmentionPost) error {
+	if nbrew.WebmentionSender == nil {
+		return nil
+	}
+	statePath := path.Join(sitePrefix, webmentionDir, "sent.json")
+	var previous map[string]webmentionPost
+	b, err := fs.ReadFile(nbrew.FS, statePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &previous)
+		if err != nil {
+			return fmt.Errorf("%s: %w", statePath, err)
+		}
+		queue := func(source string, links ...[]string) {
+			seen := make(map[string]bool)
+			for _, targets := range links {
+				for _, target := range targets {
+					// Don't send webmentions to ourselves.
+					if seen[target] || strings.HasPrefix(target, siteURL+"/") {
+						continue
+					}
+					seen[target] = true
+					nbrew.WebmentionSender.Enqueue(Webmention{Source: source, Target: target})
+				}
+			}
+		}
+		for name, post := range posts {
+			previousPost, ok := previous[name]
+			if ok && previousPost.Hash == post.Hash && previousPost.Source == post.Source {
+				continue
+			}
+			queue(post.Source, previousPost.Links, post.Links)
+		}
+		for name, previousPost := range previous {
+			if _, ok := posts[name]; !ok {
+				// The post was deleted, the targets will find out when they
+				// try to verify it.
+				queue(previousPost.Source, previousPost.Links)
+			}
+		}
+	}
+	b, err = json.Marshal(posts)
+	if err != nil {
+		return err
+	}
+	err = MkdirAll(nbrew.FS, path.Dir(statePath), 0755)
+	if err != nil {
+		return err
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(statePath, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+	return err
+}
+
+// ReceivedWebmention is an incoming webmention in a site's moderation queue.
+type ReceivedWebmention struct {
+	ID         string    `json:"id"`
+	Source     string    `json:"source"`
+	Target     string    `json:"target"`
+	Title      string    `json:"title,omitempty"` // title of the source page
+	Status     string    `json:"status"`          // "pending" | "approved" | "rejected"
+	ReceivedAt time.Time `json:"receivedAt"`
+	UpdatedAt  time.Time `json:"updatedAt,omitempty"`
+}
+
+func webmentionID(source, target string) string {
+	sum := sha256.Sum256([]byte(source + " " + target))
+	return hex.EncodeToString(sum[:16])
+}
+
+func isValidWebmentionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (nbrew *Notebrew) getReceivedWebmentions(sitePrefix string) ([]ReceivedWebmention, error) {
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, webmentionDir, "received"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var mentions []ReceivedWebmention
+	for _, dirEntry := range dirEntries {
+		id, ok := strings.CutSuffix(dirEntry.Name(), ".json")
+		if !ok || !isValidWebmentionID(id) {
+			continue
+		}
+		mention, err := nbrew.getReceivedWebmention(sitePrefix, id)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	slices.SortFunc(mentions, func(a, b ReceivedWebmention) int {
+		return b.ReceivedAt.Compare(a.ReceivedAt)
+	})
+	return mentions, nil
+}
+
+func (nbrew *Notebrew) getReceivedWebmention(sitePrefix, id string) (ReceivedWebmention, error) {
+	var mention ReceivedWebmention
+	if !isValidWebmentionID(id) {
+		return mention, fs.ErrNotExist
+	}
+	b, err := fs.ReadFile(nbrew.FS, path.Join(sitePrefix, webmentionDir, "received", id+".json"))
+	if err != nil {
+		return mention, err
+	}
+	err = json.Unmarshal(b, &mention)
+	if err != nil {
+		return mention, fmt.Errorf("%s.json: %w", id, err)
+	}
+	return mention, nil
+}
+
+func (nbrew *Notebrew) saveReceivedWebmention(sitePrefix string, mention ReceivedWebmention) error {
+	b, err := json.Marshal(&mention)
+	if err != nil {
+		return err
+	}
+	err = MkdirAll(nbrew.FS, path.Join(sitePrefix, webmentionDir, "received"), 0755)
+	if err != nil {
+		return err
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, webmentionDir, "received", mention.ID+".json"), 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+	return err
+}
+
+// webmentionEndpoint is where a site receives webmentions.
+func (nbrew *Notebrew) webmentionEndpoint(sitePrefix string) string {
+	return nbrew.Scheme + nbrew.AdminDomain + "/" + path.Join("admin", sitePrefix, "webmention") + "/"
+}
+
+// webmention is a site's public webmention endpoint. The webmention is
+// verified synchronously and, if the source really links to the target,
+// added to the site's moderation queue.
+func (nbrew *Notebrew) webmention(w http.ResponseWriter, r *http.Request, sitePrefix string) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	enabled, err := webmentionEnabled(nbrew.FS, sitePrefix)
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10 /* 64KB */)
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := url.Parse(r.PostForm.Get("source"))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		http.Error(w, "400 Bad Request: invalid source", http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(r.PostForm.Get("target"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "400 Bad Request: invalid target", http.StatusBadRequest)
+		return
+	}
+	source.Fragment, target.Fragment = "", ""
+	if source.String() == target.String() {
+		http.Error(w, "400 Bad Request: source and target are the same", http.StatusBadRequest)
+		return
+	}
+	// The target must be a page on this site.
+	siteURL := contentSiteURL(nbrew, sitePrefix)
+	urlPath, ok := strings.CutPrefix(target.String(), siteURL)
+	if siteURL == "" || !ok {
+		http.Error(w, "400 Bad Request: target is not on this site", http.StatusBadRequest)
+		return
+	}
+	urlPath, _, _ = strings.Cut(urlPath, "?")
+	name := path.Join(sitePrefix, "output", urlPath)
+	if path.Ext(name) == "" {
+		name += "/index.html"
+	}
+	if !strings.HasPrefix(name, path.Join(sitePrefix, "output")+"/") {
+		http.Error(w, "400 Bad Request: target not found", http.StatusBadRequest)
+		return
+	}
+	_, err = fs.Stat(nbrew.FS, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "400 Bad Request: target not found", http.StatusBadRequest)
+			return
+		}
+		getLogger(r.Context()).Error(err.Error())
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	id := webmentionID(source.String(), target.String())
+	existing, err := nbrew.getReceivedWebmention(sitePrefix, id)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		getLogger(r.Context()).Error(err.Error())
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	client := webmentionClient
+	if nbrew.WebmentionSender != nil && nbrew.WebmentionSender.Client != nil {
+		client = nbrew.WebmentionSender.Client
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	title, err := verifyWebmention(ctx, client, source.String(), target.String())
+	if err != nil {
+		// A webmention for a source that no longer links to the target
+		// removes it.
+		if exists {
+			err := nbrew.FS.Remove(path.Join(sitePrefix, webmentionDir, "received", id+".json"))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				getLogger(r.Context()).Error(err.Error())
+			}
+		}
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	mention := ReceivedWebmention{
+		ID:         id,
+		Source:     source.String(),
+		Target:     target.String(),
+		Title:      title,
+		Status:     "pending",
+		ReceivedAt: now,
+	}
+	if exists {
+		mention.Status = existing.Status
+		mention.ReceivedAt = existing.ReceivedAt
+		mention.UpdatedAt = now
+	}
+	err = nbrew.saveReceivedWebmention(sitePrefix, mention)
+	if err != nil {
+		getLogger(r.Context()).Error(err.Error())
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// verifyWebmention fetches source and checks that it links to target,
+// returning the title of the source page.
+func verifyWebmention(ctx context.Context, client *http.Client, source, target string) (title string, err error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Accept", "text/html")
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("fetching source: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("fetching source: %s", response.Status)
+	}
+	var inTitle, found bool
+	tokenizer := html.NewTokenizer(io.LimitReader(response.Body, 1<<20))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if !found {
+				return "", fmt.Errorf("source does not link to target")
+			}
+			return strings.Join(strings.Fields(title), " "), nil
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "title" {
+				inTitle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			if string(name) == "title" {
+				inTitle = true
+			}
+			for hasAttr && !found {
+				var key, value []byte
+				key, value, hasAttr = tokenizer.TagAttr()
+				if string(key) != "href" && string(key) != "src" {
+					continue
+				}
+				link, err := response.Request.URL.Parse(string(value))
+				if err != nil {
+					continue
+				}
+				link.Fragment = ""
+				found = link.String() == target
+			}
+		}
+	}
+}
+
+// webmentions is a site's moderation queue for received webmentions.
+func (nbrew *Notebrew) webmentions(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Request struct {
+		Action        string   `json:"action,omitempty"` // "approve" | "reject" | "delete"
+		WebmentionIDs []string `json:"webmentionIDs,omitempty"`
+	}
+	type Response struct {
+		Status      Error                `json:"status"`
+		Errors      []Error              `json:"errors,omitempty"`
+		SitePrefix  string               `json:"sitePrefix,omitempty"`
+		Enabled     bool                 `json:"enabled"`
+		Endpoint    string               `json:"endpoint,omitempty"`
+		Webmentions []ReceivedWebmention `json:"webmentions"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20 /* 2MB */)
+	switch r.Method {
+	case "GET":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"join":        path.Join,
+				"stylesCSS":   func() template.CSS { return template.CSS(stylesCSS) },
+				"baselineJS":  func() template.JS { return template.JS(baselineJS) },
+				"hasDatabase": func() bool { return nbrew.DB != nil },
+				"referer":     func() string { return r.Referer() },
+				"username":    func() string { return username },
+				"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+			}
+			tmpl, err := template.New("webmentions.html").Funcs(funcMap).ParseFS(rootFS, "embed/webmentions.html")
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy(w, "", nil)
+			executeTemplate(w, r, time.Time{}, tmpl, &response)
+		}
+
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.Status == "" {
+			response.Status = Success
+		}
+		response.SitePrefix = sitePrefix
+		response.Enabled, err = webmentionEnabled(nbrew.FS, sitePrefix)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if response.Enabled {
+			response.Endpoint = nbrew.webmentionEndpoint(sitePrefix)
+		}
+		webmentions, err := nbrew.getReceivedWebmentions(sitePrefix)
+		if err != nil {
+			getLogger(r.Context()).Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		response.Webmentions = []ReceivedWebmention{}
+		for _, webmention := range webmentions {
+			if status == "" || webmention.Status == status {
+				response.Webmentions = append(response.Webmentions, webmention)
+			}
+		}
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					getLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"status": response.Status,
+				"errors": response.Errors,
+			})
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "webmentions")+"/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				badRequest(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			if contentType == "multipart/form-data" {
+				err := r.ParseMultipartForm(2 << 20 /* 2MB */)
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			} else {
+				err := r.ParseForm()
+				if err != nil {
+					badRequest(w, r, err)
+					return
+				}
+			}
+			request.Action = r.Form.Get("action")
+			request.WebmentionIDs = r.Form["webmentionID"]
+		default:
+			unsupportedContentType(w, r)
+			return
+		}
+
+		response := Response{
+			SitePrefix:  sitePrefix,
+			Webmentions: []ReceivedWebmention{},
+		}
+		var status string
+		switch request.Action {
+		case "approve":
+			status = "approved"
+		case "reject":
+			status = "rejected"
+		case "delete":
+			break
+		default:
+			response.Status = ErrInvalidValue
+			writeResponse(w, r, response)
+			return
+		}
+		for _, id := range request.WebmentionIDs {
+			webmention, err := nbrew.getReceivedWebmention(sitePrefix, id)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					response.Errors = append(response.Errors, Error(id+": "+ErrWebmentionNotFound.Message()))
+					continue
+				}
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if request.Action == "delete" {
+				err = nbrew.FS.Remove(path.Join(sitePrefix, webmentionDir, "received", id+".json"))
+			} else {
+				webmention.Status = status
+				webmention.UpdatedAt = time.Now().UTC()
+				err = nbrew.saveReceivedWebmention(sitePrefix, webmention)
+			}
+			if err != nil {
+				getLogger(r.Context()).Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			response.Webmentions = append(response.Webmentions, webmention)
+			nbrew.auditLog(r, AuditEntry{
+				Actor:    username,
+				SiteName: strings.TrimPrefix(sitePrefix, "@"),
+				Action:   request.Action + "webmention",
+				Target:   webmention.Source,
+			})
+		}
+		if len(response.Errors) == 0 {
+			response.Status = Error(ModerateWebmentionsSuccess.Code() + " " + strconv.Itoa(len(response.Webmentions)) + " webmention(s) " + request.Action + "d")
+		} else {
+			response.Status = Error(ErrUpdateFailed.Code() + " " + strconv.Itoa(len(response.Webmentions)) + " webmention(s) " + request.Action + "d (" + strconv.Itoa(len(response.Errors)) + " failed)")
+		}
+		writeResponse(w, r, response)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,154 @@
+package nb7
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bokwoon95/nb7/internal/testutil"
+)
+
+func Test_webmention(t *testing.T) {
+	// The stand-in for other sites on the web.
+	var attempts atomic.Int32
+	received := make(chan url.Values, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</endpoint?token=abc>; rel="webmention"`)
+		io.WriteString(w, "<title>Article</title>")
+	})
+	mux.HandleFunc("/no-endpoint", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<a href="/elsewhere" rel="nofollow">elsewhere</a>`)
+	})
+	mux.HandleFunc("/endpoint", func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt so that the webmention is retried.
+		if attempts.Add(1) == 1 {
+			http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		r.ParseForm()
+		received <- r.PostForm
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/reply", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<title>A reply</title><p>Nice post: <a href="https://example.com/posts/hello/#comments">hello</a></p>`)
+	})
+	mux.HandleFunc("/unrelated", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<title>Spam</title>`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	nbrew := &Notebrew{
+		FS: testutil.NewFS(fstest.MapFS{
+			"output":                  &fstest.MapFile{Mode: fs.ModeDir},
+			"posts":                   &fstest.MapFile{Mode: fs.ModeDir},
+			"pages":                   &fstest.MapFile{Mode: fs.ModeDir},
+			"system/webmention.txt":   &fstest.MapFile{Data: []byte("true")},
+			"posts/old-post.md":       &fstest.MapFile{Data: []byte("# Old\n\n[article](" + server.URL + "/article)\n")},
+			"posts/unrelated-post.md": &fstest.MapFile{Data: []byte("# Unrelated\n")},
+		}),
+		Scheme:        "https://",
+		AdminDomain:   "admin.example.com",
+		ContentDomain: "example.com",
+		WebmentionSender: &WebmentionSender{
+			Client:     server.Client(),
+			Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+			RetryDelay: time.Millisecond,
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go nbrew.WebmentionSender.Run(ctx)
+
+	// The first regeneration only records the existing posts.
+	err := nbrew.RegenerateSite(ctx, "")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if _, err := fs.Stat(nbrew.FS, "system/webmentions/sent.json"); err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	writeFile := func(name, content string) {
+		readerFrom, err := nbrew.FS.OpenReaderFrom(name, 0644)
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+		_, err = readerFrom.ReadFrom(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(testutil.Callers(), err)
+		}
+	}
+	writeFile("posts/hello.md", "# Hello\n\nI liked [this article]("+server.URL+"/article), <"+server.URL+"/no-endpoint> and [my own post](https://example.com/posts/old-post/).\n")
+	err = nbrew.RegenerateSite(ctx, "")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	select {
+	case form := <-received:
+		if got, want := form.Get("source"), "https://example.com/posts/hello/"; got != want {
+			t.Errorf("%s source: got %q, want %q", testutil.Callers(), got, want)
+		}
+		if got, want := form.Get("target"), server.URL+"/article"; got != want {
+			t.Errorf("%s target: got %q, want %q", testutil.Callers(), got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s webmention was not sent", testutil.Callers())
+	}
+	// old-post.md's link to /article was recorded by the first regeneration
+	// and not sent again, so only the retried webmention for hello.md arrives.
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("%s got %d attempts, want 2", testutil.Callers(), n)
+	}
+
+	// Receiving.
+	postWebmention := func(source, target string) *httptest.ResponseRecorder {
+		form := url.Values{"source": {source}, "target": {target}}
+		r := httptest.NewRequest("POST", "/admin/webmention/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		nbrew.admin(w, r, "")
+		return w
+	}
+	if w := postWebmention(server.URL+"/reply", "https://example.com/posts/hello/"); w.Code != http.StatusCreated {
+		t.Fatalf("%s got %d %s, want 201", testutil.Callers(), w.Code, w.Body.String())
+	}
+	if w := postWebmention(server.URL+"/unrelated", "https://example.com/posts/hello/"); w.Code != http.StatusBadRequest {
+		t.Errorf("%s source without a link: got %d, want 400", testutil.Callers(), w.Code)
+	}
+	if w := postWebmention(server.URL+"/reply", "https://example.com/posts/missing/"); w.Code != http.StatusBadRequest {
+		t.Errorf("%s missing target: got %d, want 400", testutil.Callers(), w.Code)
+	}
+	webmentions, err := nbrew.getReceivedWebmentions("")
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if len(webmentions) != 1 || webmentions[0].Status != "pending" || webmentions[0].Title != "A reply" {
+		t.Fatalf("%s got %+v, want one pending webmention titled A reply", testutil.Callers(), webmentions)
+	}
+	r := httptest.NewRequest("POST", "/admin/webmentions/", strings.NewReader(`{"action":"approve","webmentionIDs":["`+webmentions[0].ID+`"]}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	nbrew.admin(w, r, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s got %d %s", testutil.Callers(), w.Code, w.Body.String())
+	}
+	webmention, err := nbrew.getReceivedWebmention("", webmentions[0].ID)
+	if err != nil {
+		t.Fatal(testutil.Callers(), err)
+	}
+	if webmention.Status != "approved" {
+		t.Errorf("%s got status %q, want approved", testutil.Callers(), webmention.Status)
+	}
+}